@@ -0,0 +1,526 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Account billing. Motor clubs, insurers and other accounts have negotiated
+// rate cards per job type (a flat rate covering the first few towed km, then
+// a per-km rate), may require a PO or claim number on every job, and get an
+// invoice addressed to the account rather than the vehicle owner. At the start
+// of each month a statement is generated per account summarising the
+// previous month's invoices and payments.
+
+type accountRate struct {
+	JobType    string  `json:"job_type"`
+	FlatRate   float64 `json:"flat_rate"`
+	IncludedKm float64 `json:"included_km"`
+	PerKmRate  float64 `json:"per_km_rate"`
+}
+
+// The billing side of a customer: whether it is an account, and whether it needs a PO number
+type billingCustomer struct {
+	ID         int64
+	Name       string
+	Phone      string
+	IsAccount  bool
+	PORequired bool
+	TermsDays  int
+}
+
+func loadBillingCustomer(customerID int64) (*billingCustomer, error) {
+	customer := &billingCustomer{ID: customerID}
+	var customerType string
+	var phone sql.NullString
+	err := db.QueryRow(`SELECT name, phone, customer_type, po_required, billing_terms_days FROM customers WHERE id = ?`, customerID).
+		Scan(&customer.Name, &phone, &customerType, &customer.PORequired, &customer.TermsDays)
+	if err != nil {
+		return nil, err
+	}
+	customer.Phone = phone.String
+	customer.IsAccount = customerType != "individual"
+	return customer, nil
+}
+
+// Distance the vehicle was towed on a job, from the driving log of its return leg
+func jobTowedKm(jobID interface{}) (float64, error) {
+	var km float64
+	err := db.QueryRow(`SELECT COALESCE(SUM(distance_km), 0) FROM driver_driving_log WHERE job_id = ? AND leg = 'return'`, jobID).Scan(&km)
+	return km, err
+}
+
+// Price a job on an account's rate card. Returns nil when the account has no
+// rate for the job type.
+func priceAccountJob(customerID int64, jobType string, towedKm float64) ([]quoteLineItem, float64, error) {
+	var rate accountRate
+	err := db.QueryRow(`SELECT job_type, flat_rate, included_km, per_km_rate FROM account_rates WHERE customer_id = ? AND job_type = ?`,
+		customerID, jobType).Scan(&rate.JobType, &rate.FlatRate, &rate.IncludedKm, &rate.PerKmRate)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	items := []quoteLineItem{{
+		Code:        "account_flat_rate",
+		Description: fmt.Sprintf("%s tow, first %.0f km", jobType, rate.IncludedKm),
+		Quantity:    1,
+		UnitAmount:  rate.FlatRate,
+		Amount:      rate.FlatRate,
+	}}
+	total := rate.FlatRate
+
+	// Extra distance is billed per started km
+	if extraKm := math.Ceil(towedKm - rate.IncludedKm); extraKm > 0 && rate.PerKmRate > 0 {
+		amount := roundCents(extraKm * rate.PerKmRate)
+		items = append(items, quoteLineItem{
+			Code:        "account_per_km",
+			Description: fmt.Sprintf("Towing beyond %.0f km", rate.IncludedKm),
+			Quantity:    int(extraKm),
+			UnitAmount:  rate.PerKmRate,
+			Amount:      amount,
+		})
+		total += amount
+	}
+	return items, roundCents(total), nil
+}
+
+func getAccountRates(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	exists, err := customerExists(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Query(`SELECT job_type, flat_rate, included_km, per_km_rate FROM account_rates WHERE customer_id = ? ORDER BY job_type`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rates := []accountRate{}
+	for rows.Next() {
+		var rate accountRate
+		if err := rows.Scan(&rate.JobType, &rate.FlatRate, &rate.IncludedKm, &rate.PerKmRate); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rates = append(rates, rate)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rates)
+}
+
+// Create or replace an account's rate for a job type:
+// {"flat_rate": 95, "included_km": 8, "per_km_rate": 3.25}
+func updateAccountRate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var rate map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&rate); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	customerID, err := parseAccountID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	values := map[string]float64{}
+	for _, field := range []string{"flat_rate", "included_km", "per_km_rate"} {
+		value, ok := rate[field]
+		if !ok {
+			if field == "flat_rate" {
+				http.Error(w, "flat_rate is required", http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		number, isNumber := value.(float64)
+		if !isNumber || number < 0 {
+			http.Error(w, field+" must be a number of at least 0", http.StatusBadRequest)
+			return
+		}
+		values[field] = number
+	}
+
+	_, err = db.Exec(`INSERT INTO account_rates (customer_id, job_type, flat_rate, included_km, per_km_rate) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(customer_id, job_type) DO UPDATE SET flat_rate = excluded.flat_rate, included_km = excluded.included_km,
+		per_km_rate = excluded.per_km_rate`,
+		customerID, vars["jobType"], roundCents(values["flat_rate"]), values["included_km"], roundCents(values["per_km_rate"]))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accountRate{
+		JobType:    vars["jobType"],
+		FlatRate:   roundCents(values["flat_rate"]),
+		IncludedKm: values["included_km"],
+		PerKmRate:  roundCents(values["per_km_rate"]),
+	})
+}
+
+func deleteAccountRate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	result, err := db.Exec(`DELETE FROM account_rates WHERE customer_id = ? AND job_type = ?`, vars["id"], vars["jobType"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Rate not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Look up an account customer by URL id, writing 404 (unknown) or 400
+// (individual) itself
+func parseAccountID(w http.ResponseWriter, id string) (int64, error) {
+	var customerID int64
+	var customerType string
+	err := db.QueryRow(`SELECT id, customer_type FROM customers WHERE id = ? AND deleted_at IS NULL`, id).Scan(&customerID, &customerType)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return 0, err
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, err
+	}
+	if customerType == "individual" {
+		http.Error(w, "Customer is not an account", http.StatusBadRequest)
+		return 0, fmt.Errorf("customer %d is not an account", customerID)
+	}
+	return customerID, nil
+}
+
+// Statements
+
+type statementInvoice struct {
+	ID        int64   `json:"id"`
+	JobID     int64   `json:"job_id"`
+	PONumber  string  `json:"po_number"`
+	CreatedAt string  `json:"created_at"`
+	DueDate   string  `json:"due_date"`
+	Amount    float64 `json:"amount"`
+}
+
+type statementPayment struct {
+	ID              int64   `json:"id"`
+	InvoiceID       int64   `json:"invoice_id"`
+	PaidAt          string  `json:"paid_at"`
+	Amount          float64 `json:"amount"`
+	PaymentMethod   string  `json:"payment_method"`
+	ReferenceNumber string  `json:"reference_number"`
+}
+
+type accountStatement struct {
+	ID             int64              `json:"id,omitempty"`
+	CustomerID     int64              `json:"customer_id"`
+	CustomerName   string             `json:"customer_name"`
+	Period         string             `json:"period"`
+	PeriodStart    string             `json:"period_start"`
+	PeriodEnd      string             `json:"period_end"`
+	OpeningBalance float64            `json:"opening_balance"`
+	Invoiced       float64            `json:"invoiced"`
+	Paid           float64            `json:"paid"`
+	ClosingBalance float64            `json:"closing_balance"`
+	GeneratedAt    string             `json:"generated_at,omitempty"`
+	Invoices       []statementInvoice `json:"invoices,omitempty"`
+	Payments       []statementPayment `json:"payments,omitempty"`
+}
+
+// Build an account's statement for the calendar month starting at monthStart
+func buildAccountStatement(customerID int64, monthStart time.Time) (*accountStatement, error) {
+	monthEnd := monthStart.AddDate(0, 1, 0)
+	startStr, endStr := monthStart.Format(sqliteTimeLayout), monthEnd.Format(sqliteTimeLayout)
+
+	statement := &accountStatement{
+		CustomerID:  customerID,
+		Period:      monthStart.Format("2006-01"),
+		PeriodStart: monthStart.Format("2006-01-02"),
+		PeriodEnd:   monthEnd.AddDate(0, 0, -1).Format("2006-01-02"),
+		Invoices:    []statementInvoice{},
+		Payments:    []statementPayment{},
+	}
+	if err := db.QueryRow(`SELECT name FROM customers WHERE id = ?`, customerID).Scan(&statement.CustomerName); err != nil {
+		return nil, err
+	}
+
+	// Opening balance: everything invoiced before the month less everything paid before it
+	err := db.QueryRow(`SELECT
+		COALESCE((SELECT SUM(amount) FROM invoices WHERE customer_id = ? AND created_at < ?), 0) -
+		COALESCE((SELECT SUM(p.amount) FROM payments p JOIN invoices i ON i.id = p.invoice_id WHERE i.customer_id = ? AND p.paid_at < ?), 0)`,
+		customerID, startStr, customerID, startStr).Scan(&statement.OpeningBalance)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT id, job_id, po_number, created_at, due_date, amount FROM invoices
+		WHERE customer_id = ? AND created_at >= ? AND created_at < ? ORDER BY created_at, id`, customerID, startStr, endStr)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var invoice statementInvoice
+		var jobID sql.NullInt64
+		var poNumber, createdAt, dueDate sql.NullString
+		if err := rows.Scan(&invoice.ID, &jobID, &poNumber, &createdAt, &dueDate, &invoice.Amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		invoice.JobID = jobID.Int64
+		invoice.PONumber = poNumber.String
+		invoice.CreatedAt = formatDBDate(createdAt.String)
+		invoice.DueDate = formatDBDate(dueDate.String)
+		statement.Invoices = append(statement.Invoices, invoice)
+		statement.Invoiced += invoice.Amount
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT p.id, p.invoice_id, p.paid_at, p.amount, p.payment_method, p.reference_number
+		FROM payments p JOIN invoices i ON i.id = p.invoice_id
+		WHERE i.customer_id = ? AND p.paid_at >= ? AND p.paid_at < ? ORDER BY p.paid_at, p.id`, customerID, startStr, endStr)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var payment statementPayment
+		var paidAt, method, reference sql.NullString
+		if err := rows.Scan(&payment.ID, &payment.InvoiceID, &paidAt, &payment.Amount, &method, &reference); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		payment.PaidAt = formatDBDate(paidAt.String)
+		payment.PaymentMethod = method.String
+		payment.ReferenceNumber = reference.String
+		statement.Payments = append(statement.Payments, payment)
+		statement.Paid += payment.Amount
+	}
+	rows.Close()
+
+	statement.OpeningBalance = roundCents(statement.OpeningBalance)
+	statement.Invoiced = roundCents(statement.Invoiced)
+	statement.Paid = roundCents(statement.Paid)
+	statement.ClosingBalance = roundCents(statement.OpeningBalance + statement.Invoiced - statement.Paid)
+	return statement, nil
+}
+
+// Store the statement for a month. Returns 0 when one already exists.
+func generateAccountStatement(customerID int64, monthStart time.Time) (int64, *accountStatement, error) {
+	statement, err := buildAccountStatement(customerID, monthStart)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	result, err := db.Exec(`INSERT OR IGNORE INTO account_statements (customer_id, period_start, period_end,
+		opening_balance, invoiced, paid, closing_balance, generated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		customerID, statement.PeriodStart, statement.PeriodEnd, statement.OpeningBalance, statement.Invoiced,
+		statement.Paid, statement.ClosingBalance, simNow().Format(sqliteTimeLayout))
+	if err != nil {
+		return 0, nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, statement, nil
+	}
+	statement.ID, _ = result.LastInsertId()
+	statement.GeneratedAt = simNow().Format(time.RFC3339)
+	return statement.ID, statement, nil
+}
+
+func statementWorker() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Account statement generation started")
+
+	generateMonthlyStatements()
+	for range ticker.C {
+		generateMonthlyStatements()
+	}
+}
+
+// Generate last month's statement for every account that does not have one yet
+func generateMonthlyStatements() {
+	now := simNow()
+	lastMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+
+	rows, err := db.Query(`SELECT id FROM customers c WHERE customer_type != 'individual' AND deleted_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM account_statements s WHERE s.customer_id = c.id AND s.period_start = ?)`,
+		lastMonth.Format("2006-01-02"))
+	if err != nil {
+		log.Printf("Error loading accounts for statements: %v", err)
+		return
+	}
+	var customerIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			log.Printf("Error loading accounts for statements: %v", err)
+			return
+		}
+		customerIDs = append(customerIDs, id)
+	}
+	rows.Close()
+
+	for _, customerID := range customerIDs {
+		id, statement, err := generateAccountStatement(customerID, lastMonth)
+		if err != nil {
+			log.Printf("Error generating statement for customer %d: %v", customerID, err)
+			continue
+		}
+		if id != 0 {
+			log.Printf("Generated %s statement %d for %s: closing balance %.2f", statement.Period, id, statement.CustomerName, statement.ClosingBalance)
+		}
+	}
+}
+
+func getAccountStatements(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	customerID, err := parseAccountID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(`SELECT s.id, s.customer_id, c.name, s.period_start, s.period_end, s.opening_balance, s.invoiced, s.paid,
+		s.closing_balance, s.generated_at FROM account_statements s JOIN customers c ON c.id = s.customer_id
+		WHERE s.customer_id = ? ORDER BY s.period_start DESC`, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	statements := []accountStatement{}
+	for rows.Next() {
+		statement, err := scanAccountStatement(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statements = append(statements, *statement)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statements)
+}
+
+func scanAccountStatement(row interface{ Scan(...interface{}) error }) (*accountStatement, error) {
+	var statement accountStatement
+	var periodStart, periodEnd, generatedAt sql.NullString
+	err := row.Scan(&statement.ID, &statement.CustomerID, &statement.CustomerName, &periodStart, &periodEnd,
+		&statement.OpeningBalance, &statement.Invoiced, &statement.Paid, &statement.ClosingBalance, &generatedAt)
+	if err != nil {
+		return nil, err
+	}
+	statement.PeriodStart = formatDBDate(periodStart.String)
+	statement.PeriodEnd = formatDBDate(periodEnd.String)
+	statement.Period = statement.PeriodStart
+	if len(statement.Period) >= 7 {
+		statement.Period = statement.Period[:7]
+	}
+	statement.GeneratedAt = generatedAt.String
+	return &statement, nil
+}
+
+// Generate a statement on demand: {"month": "2025-09"}. A month that is not
+// over yet is previewed without being stored.
+func createAccountStatement(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var body struct {
+		Month string `json:"month"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	customerID, err := parseAccountID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	monthStart, err := time.Parse("2006-01", body.Month)
+	if err != nil {
+		http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+		return
+	}
+
+	if monthStart.AddDate(0, 1, 0).After(simNow()) {
+		statement, err := buildAccountStatement(customerID, monthStart)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statement)
+		return
+	}
+
+	id, statement, err := generateAccountStatement(customerID, monthStart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if id == 0 {
+		http.Error(w, fmt.Sprintf("Statement for %s already exists", body.Month), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(statement)
+}
+
+// A stored statement with its invoice and payment lines
+func getAccountStatement(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	stored, err := scanAccountStatement(db.QueryRow(`SELECT s.id, s.customer_id, c.name, s.period_start, s.period_end,
+		s.opening_balance, s.invoiced, s.paid, s.closing_balance, s.generated_at
+		FROM account_statements s JOIN customers c ON c.id = s.customer_id WHERE s.id = ?`, vars["id"]))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Statement not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	monthStart, _ := time.Parse("2006-01-02", stored.PeriodStart)
+	lines, err := buildAccountStatement(stored.CustomerID, monthStart)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Totals stay as generated; the lines show what they were made of
+	stored.Invoices = lines.Invoices
+	stored.Payments = lines.Payments
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stored)
+}
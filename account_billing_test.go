@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestPriceAccountJob(t *testing.T) {
+	openTestDB(t,
+		`CREATE TABLE account_rates (customer_id INTEGER, job_type TEXT, flat_rate REAL, included_km REAL, per_km_rate REAL)`,
+		`INSERT INTO account_rates VALUES (1, 'breakdown', 95, 8, 3.25), (1, 'repo', 120, 0, 0)`,
+	)
+
+	tests := []struct {
+		name       string
+		customerID int64
+		jobType    string
+		towedKm    float64
+		wantItems  int
+		wantExtra  int // km billed beyond included_km
+		wantTotal  float64
+	}{
+		{"no rate for the job type", 1, "police", 20, 0, 0, 0},
+		{"no rate for the customer", 2, "breakdown", 20, 0, 0, 0},
+		{"within the included km", 1, "breakdown", 5, 1, 0, 95},
+		{"exactly the included km", 1, "breakdown", 8, 1, 0, 95},
+		{"a started km is billed", 1, "breakdown", 8.2, 2, 1, 98.25},
+		{"several extra km", 1, "breakdown", 12.5, 2, 5, 111.25},
+		{"flat rate only", 1, "repo", 50, 1, 0, 120},
+	}
+	for _, tt := range tests {
+		items, total, err := priceAccountJob(tt.customerID, tt.jobType, tt.towedKm)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(items) != tt.wantItems || total != tt.wantTotal {
+			t.Errorf("%s: got %d items totalling %.2f, want %d totalling %.2f", tt.name, len(items), total, tt.wantItems, tt.wantTotal)
+			continue
+		}
+		if tt.wantExtra > 0 && (items[1].Code != "account_per_km" || items[1].Quantity != tt.wantExtra) {
+			t.Errorf("%s: got %s x %d, want account_per_km x %d", tt.name, items[1].Code, items[1].Quantity, tt.wantExtra)
+		}
+	}
+}
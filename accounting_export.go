@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Accounting export. Invoices, late fees, payments and refunds (negative
+// payments) are turned into balanced double-entry journal entries straight
+// from the invoices, line items and payments tables, so export totals always
+// match the API. Late fees are their own entries, dated when the aging sweep
+// added them, so a period that has been exported does not change later.
+
+type journalLine struct {
+	Account string  `json:"account"`
+	Debit   float64 `json:"debit"`
+	Credit  float64 `json:"credit"`
+}
+
+type journalEntry struct {
+	Date     string        `json:"date"`
+	Source   string        `json:"source"`
+	SourceID int64         `json:"source_id"`
+	Name     string        `json:"name"`
+	Memo     string        `json:"memo"`
+	Lines    []journalLine `json:"lines"`
+}
+
+// Account mappings keyed by mapping type then key
+type accountMap map[string]map[string]string
+
+func (m accountMap) lookup(mappingType, key, fallback string) string {
+	if account, ok := m[mappingType][key]; ok && key != "" {
+		return account
+	}
+	return m["default"][fallback]
+}
+
+func loadAccountMappings() (accountMap, error) {
+	rows, err := db.Query(`SELECT mapping_type, mapping_key, account FROM account_mappings`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mappings := accountMap{"default": {}, "job_type": {}, "payment_method": {}}
+	for rows.Next() {
+		var mappingType, key, account string
+		if err := rows.Scan(&mappingType, &key, &account); err != nil {
+			return nil, err
+		}
+		if mappings[mappingType] == nil {
+			mappings[mappingType] = map[string]string{}
+		}
+		mappings[mappingType][key] = account
+	}
+	return mappings, rows.Err()
+}
+
+// Build journal entries for invoices, late fees and payments dated within [from, to]
+func buildJournalEntries(from, to string) ([]journalEntry, error) {
+	mappings, err := loadAccountMappings()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []journalEntry
+
+	rows, err := db.Query(`SELECT i.id, date(i.created_at), i.amount, i.customer_name, j.job_type,
+		(SELECT COALESCE(SUM(li.amount), 0) FROM invoice_line_items li WHERE li.invoice_id = i.id AND li.item_type = 'late_fee')
+		FROM invoices i LEFT JOIN jobs j ON j.id = i.job_id
+		WHERE date(i.created_at) BETWEEN ? AND ? ORDER BY i.created_at, i.id`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		var date, customerName, jobType sql.NullString
+		var amount, lateFees float64
+		if err := rows.Scan(&id, &date, &amount, &customerName, &jobType, &lateFees); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		// The invoice as billed; late fees added since are entries of their own
+		amount = roundCents(amount - lateFees)
+		entries = append(entries, journalEntry{
+			Date:     date.String,
+			Source:   "invoice",
+			SourceID: id,
+			Name:     customerName.String,
+			Memo:     fmt.Sprintf("Invoice #%d - %s tow", id, jobType.String),
+			Lines: []journalLine{
+				{Account: mappings.lookup("default", "accounts_receivable", "accounts_receivable"), Debit: amount},
+				{Account: mappings.lookup("job_type", jobType.String, "revenue"), Credit: amount},
+			},
+		})
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT li.id, li.invoice_id, date(li.created_at), li.amount, li.description, i.customer_name
+		FROM invoice_line_items li JOIN invoices i ON i.id = li.invoice_id
+		WHERE li.item_type = 'late_fee' AND date(li.created_at) BETWEEN ? AND ? ORDER BY li.created_at, li.id`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, invoiceID int64
+		var date, description, customerName sql.NullString
+		var amount float64
+		if err := rows.Scan(&id, &invoiceID, &date, &amount, &description, &customerName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		amount = roundCents(amount)
+		entries = append(entries, journalEntry{
+			Date:     date.String,
+			Source:   "late_fee",
+			SourceID: id,
+			Name:     customerName.String,
+			Memo:     fmt.Sprintf("%s on invoice #%d", description.String, invoiceID),
+			Lines: []journalLine{
+				{Account: mappings.lookup("default", "accounts_receivable", "accounts_receivable"), Debit: amount},
+				{Account: mappings.lookup("default", "late_fees", "late_fees"), Credit: amount},
+			},
+		})
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT p.id, p.invoice_id, date(p.paid_at), p.amount, p.payment_method, p.reference_number, i.customer_name
+		FROM payments p LEFT JOIN invoices i ON i.id = p.invoice_id
+		WHERE date(p.paid_at) BETWEEN ? AND ? ORDER BY p.paid_at, p.id`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, invoiceID int64
+		var date, method, reference, customerName sql.NullString
+		var amount float64
+		if err := rows.Scan(&id, &invoiceID, &date, &amount, &method, &reference, &customerName); err != nil {
+			return nil, err
+		}
+
+		receivable := mappings.lookup("default", "accounts_receivable", "accounts_receivable")
+		deposit := mappings.lookup("payment_method", method.String, "deposit")
+		entry := journalEntry{
+			Date:     date.String,
+			SourceID: id,
+			Name:     customerName.String,
+		}
+		if amount >= 0 {
+			entry.Source = "payment"
+			entry.Memo = fmt.Sprintf("Payment %s on invoice #%d", reference.String, invoiceID)
+			entry.Lines = []journalLine{
+				{Account: deposit, Debit: roundCents(amount)},
+				{Account: receivable, Credit: roundCents(amount)},
+			}
+		} else {
+			entry.Source = "refund"
+			entry.Memo = fmt.Sprintf("Refund %s on invoice #%d", reference.String, invoiceID)
+			entry.Lines = []journalLine{
+				{Account: receivable, Debit: roundCents(-amount)},
+				{Account: deposit, Credit: roundCents(-amount)},
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Export journal entries as json, csv or QuickBooks iif
+func getAccountingExport(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" {
+		from = "0001-01-01"
+	}
+	if to == "" {
+		to = "9999-12-31"
+	}
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			http.Error(w, "from and to must be YYYY-MM-DD dates", http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" && format != "iif" {
+		http.Error(w, "format must be one of csv, iif, json", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := buildJournalEntries(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", "attachment; filename=accounting-export.csv")
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"date", "entry", "source", "source_id", "name", "account", "debit", "credit", "memo"})
+		for i, entry := range entries {
+			for _, line := range entry.Lines {
+				writer.Write([]string{
+					entry.Date, fmt.Sprint(i + 1), entry.Source, fmt.Sprint(entry.SourceID), entry.Name,
+					line.Account, formatAmount(line.Debit), formatAmount(line.Credit), entry.Memo,
+				})
+			}
+		}
+		writer.Flush()
+	case "iif":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Disposition", "attachment; filename=accounting-export.iif")
+		fmt.Fprint(w, "!TRNS\tTRNSID\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tDOCNUM\tMEMO\r\n")
+		fmt.Fprint(w, "!SPL\tSPLID\tTRNSTYPE\tDATE\tACCNT\tNAME\tAMOUNT\tDOCNUM\tMEMO\r\n")
+		fmt.Fprint(w, "!ENDTRNS\r\n")
+		for i, entry := range entries {
+			date := entry.Date
+			if t, err := time.Parse("2006-01-02", entry.Date); err == nil {
+				date = t.Format("01/02/2006")
+			}
+			docNum := fmt.Sprintf("%s-%d", strings.ToUpper(entry.Source[:3]), entry.SourceID)
+			for j, line := range entry.Lines {
+				kind := "SPL"
+				if j == 0 {
+					kind = "TRNS"
+				}
+				// IIF amounts are signed: debits positive, credits negative
+				amount := formatAmount(roundCents(line.Debit - line.Credit))
+				fmt.Fprintf(w, "%s\t%d\tGENERAL JOURNAL\t%s\t%s\t%s\t%s\t%s\t%s\r\n",
+					kind, i+1, date, iifField(line.Account), iifField(entry.Name), amount, docNum, iifField(entry.Memo))
+			}
+			fmt.Fprint(w, "ENDTRNS\r\n")
+		}
+	default:
+		var debits, credits, invoiced, lateFees, received, refunded float64
+		for _, entry := range entries {
+			for _, line := range entry.Lines {
+				debits += line.Debit
+				credits += line.Credit
+			}
+			switch entry.Source {
+			case "invoice":
+				invoiced += entry.Lines[0].Debit
+			case "late_fee":
+				lateFees += entry.Lines[0].Debit
+			case "payment":
+				received += entry.Lines[0].Debit
+			case "refund":
+				refunded += entry.Lines[0].Debit
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"from":    from,
+			"to":      to,
+			"entries": entries,
+			"totals": map[string]float64{
+				"debit":     roundCents(debits),
+				"credit":    roundCents(credits),
+				"invoiced":  roundCents(invoiced),
+				"late_fees": roundCents(lateFees),
+				"payments":  roundCents(received),
+				"refunds":   roundCents(refunded),
+			},
+		})
+	}
+}
+
+func formatAmount(amount float64) string {
+	if amount == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.2f", amount)
+}
+
+// IIF is tab separated; strip anything that would break a row
+func iifField(value string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(value)
+}
+
+func getAccountMappings(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT mapping_type, mapping_key, account FROM account_mappings ORDER BY mapping_type, mapping_key`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var mappings []map[string]interface{}
+	for rows.Next() {
+		var mappingType, key, account sql.NullString
+		if err := rows.Scan(&mappingType, &key, &account); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		mappings = append(mappings, map[string]interface{}{
+			"mapping_type": mappingType.String,
+			"mapping_key":  key.String,
+			"account":      account.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(mappings)
+}
+
+// Create or replace the account used for a job_type, payment_method or default
+func updateAccountMapping(w http.ResponseWriter, r *http.Request) {
+	var mapping map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&mapping); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mappingType, _ := mapping["mapping_type"].(string)
+	key, _ := mapping["mapping_key"].(string)
+	account, _ := mapping["account"].(string)
+	if mappingType != "default" && mappingType != "job_type" && mappingType != "payment_method" {
+		http.Error(w, "mapping_type must be one of default, job_type, payment_method", http.StatusBadRequest)
+		return
+	}
+	if key == "" || account == "" {
+		http.Error(w, "mapping_key and account are required", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`INSERT OR REPLACE INTO account_mappings (mapping_type, mapping_key, account) VALUES (?, ?, ?)`,
+		mappingType, key, account)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"mapping_type": mappingType, "mapping_key": key, "account": account})
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Photo and document attachments on impound records and jobs. Files are
+// kept in an attachmentStore under a key derived from the owner and the
+// file's checksum; metadata lives in the attachments table.
+
+const (
+	maxAttachmentSize  = 10 << 20
+	thumbnailMaxPixels = 200
+	maxImagePixels     = 40_000_000 // decoded size guard: a small file can declare huge dimensions
+)
+
+var errImageTooLarge = fmt.Errorf("image too large (max %d megapixels)", maxImagePixels/1_000_000)
+
+// Content types we accept, keyed by the sniffed type, with the file extension to store under
+var allowedAttachmentTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"application/pdf": ".pdf",
+}
+
+var attachmentCategories = []string{"damage_photo", "police_authorization", "release_form", "credential", "inspection_photo", "other"}
+
+// Storage backend for attachment bytes. The local disk store is used today;
+// an S3-compatible store only needs to implement these three calls.
+type attachmentStore interface {
+	Put(key string, data []byte) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+type localDiskStore struct {
+	root string
+}
+
+func (s *localDiskStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *localDiskStore) Put(key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (s *localDiskStore) Get(key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s *localDiskStore) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+var attachments attachmentStore = newAttachmentStore()
+
+func newAttachmentStore() attachmentStore {
+	root := os.Getenv("ATTACHMENT_DIR")
+	if root == "" {
+		root = "./attachments"
+	}
+	return &localDiskStore{root: root}
+}
+
+// Read an image's declared dimensions from its header and refuse ones that
+// would take too much memory to decode
+func checkImageSize(data []byte) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return errImageTooLarge
+	}
+	return nil
+}
+
+// Scale an image down to fit thumbnailMaxPixels and encode it as JPEG
+func makeThumbnail(data []byte) ([]byte, error) {
+	if err := checkImageSize(data); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	scale := 1.0
+	if width > height && width > thumbnailMaxPixels {
+		scale = float64(thumbnailMaxPixels) / float64(width)
+	} else if height >= width && height > thumbnailMaxPixels {
+		scale = float64(thumbnailMaxPixels) / float64(height)
+	}
+	thumbWidth, thumbHeight := int(float64(width)*scale), int(float64(height)*scale)
+	if thumbWidth < 1 {
+		thumbWidth = 1
+	}
+	if thumbHeight < 1 {
+		thumbHeight = 1
+	}
+
+	// Nearest neighbour is plenty for a preview
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		for x := 0; x < thumbWidth; x++ {
+			srcX := bounds.Min.X + x*width/thumbWidth
+			srcY := bounds.Min.Y + y*height/thumbHeight
+			thumb.Set(x, y, src.At(srcX, srcY))
+		}
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, thumb, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func uploadImpoundAttachment(w http.ResponseWriter, r *http.Request) {
+	uploadAttachment(w, r, "impound")
+}
+
+func uploadJobAttachment(w http.ResponseWriter, r *http.Request) {
+	uploadAttachment(w, r, "job")
+}
+
+func uploadCredentialAttachment(w http.ResponseWriter, r *http.Request) {
+	uploadAttachment(w, r, "credential")
+}
+
+func uploadInspectionAttachment(w http.ResponseWriter, r *http.Request) {
+	uploadAttachment(w, r, "inspection")
+}
+
+func getImpoundAttachments(w http.ResponseWriter, r *http.Request) {
+	listAttachments(w, r, "impound")
+}
+
+func getJobAttachments(w http.ResponseWriter, r *http.Request) {
+	listAttachments(w, r, "job")
+}
+
+func getCredentialAttachments(w http.ResponseWriter, r *http.Request) {
+	listAttachments(w, r, "credential")
+}
+
+func getInspectionAttachments(w http.ResponseWriter, r *http.Request) {
+	listAttachments(w, r, "inspection")
+}
+
+var attachmentOwnerTables = map[string]string{
+	"impound":    "impounded_vehicles",
+	"job":        "jobs",
+	"credential": "driver_credentials",
+	"inspection": "vehicle_inspections",
+}
+
+// Check the impound record, job, credential or inspection an attachment belongs to exists
+func attachmentOwnerExists(ownerType string, ownerID int64) (bool, error) {
+	table := attachmentOwnerTables[ownerType]
+
+	var count int
+	err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ?", table), ownerID).Scan(&count)
+	return count > 0, err
+}
+
+// Accept a multipart "file" upload with optional category, description,
+// uploaded_by and sha256 (verified against the received bytes)
+func uploadAttachment(w http.ResponseWriter, r *http.Request, ownerType string) {
+	ownerID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := attachmentOwnerExists(ownerType, ownerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		switch ownerType {
+		case "impound":
+			http.Error(w, "Impound record not found", http.StatusNotFound)
+		case "credential":
+			http.Error(w, "Credential not found", http.StatusNotFound)
+		case "inspection":
+			http.Error(w, "Inspection not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Job not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	if err := r.ParseMultipartForm(maxAttachmentSize); err != nil {
+		http.Error(w, "Invalid multipart upload or file too large (max 10MB)", http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "file is empty", http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAttachmentSize {
+		http.Error(w, "file too large (max 10MB)", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Trust the bytes, not the client's declared type
+	contentType := http.DetectContentType(data)
+	extension, ok := allowedAttachmentTypes[contentType]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported content type %s (allowed: JPEG, PNG, GIF, PDF)", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	if strings.HasPrefix(contentType, "image/") {
+		if err := checkImageSize(data); errors.Is(err, errImageTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	if expected := r.FormValue("sha256"); expected != "" && !strings.EqualFold(expected, checksum) {
+		http.Error(w, "sha256 does not match the uploaded file", http.StatusBadRequest)
+		return
+	}
+
+	category := r.FormValue("category")
+	if category == "" {
+		category = "other"
+	}
+	validCategory := false
+	for _, c := range attachmentCategories {
+		if c == category {
+			validCategory = true
+		}
+	}
+	if !validCategory {
+		http.Error(w, "category must be one of damage_photo, police_authorization, release_form, credential, inspection_photo, other", http.StatusBadRequest)
+		return
+	}
+
+	storageKey := fmt.Sprintf("%s/%d/%s%s", ownerType, ownerID, checksum, extension)
+	if err := attachments.Put(storageKey, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var thumbnailKey interface{}
+	if strings.HasPrefix(contentType, "image/") {
+		if thumb, err := makeThumbnail(data); err == nil {
+			key := fmt.Sprintf("%s/%d/%s_thumb.jpg", ownerType, ownerID, checksum)
+			if err := attachments.Put(key, thumb); err == nil {
+				thumbnailKey = key
+			}
+		}
+	}
+
+	result, err := db.Exec(`INSERT INTO attachments (owner_type, owner_id, category, filename, content_type, size_bytes,
+		sha256, storage_key, thumbnail_key, description, uploaded_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		ownerType, ownerID, category, filepath.Base(header.Filename), contentType, len(data),
+		checksum, storageKey, thumbnailKey, r.FormValue("description"), r.FormValue("uploaded_by"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":            id,
+		"content_type":  contentType,
+		"size_bytes":    len(data),
+		"sha256":        checksum,
+		"has_thumbnail": thumbnailKey != nil,
+	})
+}
+
+func listAttachments(w http.ResponseWriter, r *http.Request, ownerType string) {
+	vars := mux.Vars(r)
+
+	query := `SELECT id, category, filename, content_type, size_bytes, sha256, thumbnail_key, description, uploaded_by, created_at
+		FROM attachments WHERE owner_type = ? AND owner_id = ?`
+	args := []interface{}{ownerType, vars["id"]}
+	if category := r.URL.Query().Get("category"); category != "" {
+		query += ` AND category = ?`
+		args = append(args, category)
+	}
+
+	rows, err := db.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var files []map[string]interface{}
+	for rows.Next() {
+		var id, size sql.NullInt64
+		var category, filename, contentType, checksum, thumbnailKey, description, uploadedBy, createdAt sql.NullString
+
+		err := rows.Scan(&id, &category, &filename, &contentType, &size, &checksum, &thumbnailKey, &description, &uploadedBy, &createdAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		file := map[string]interface{}{
+			"id":           id.Int64,
+			"category":     category.String,
+			"filename":     filename.String,
+			"content_type": contentType.String,
+			"size_bytes":   size.Int64,
+			"sha256":       checksum.String,
+			"description":  description.String,
+			"uploaded_by":  uploadedBy.String,
+			"created_at":   createdAt.String,
+			"download_url": fmt.Sprintf("/attachments/%d", id.Int64),
+		}
+		if thumbnailKey.Valid {
+			file["thumbnail_url"] = fmt.Sprintf("/attachments/%d/thumbnail", id.Int64)
+		}
+		files = append(files, file)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(files)
+}
+
+func downloadAttachment(w http.ResponseWriter, r *http.Request) {
+	serveAttachment(w, r, false)
+}
+
+func downloadAttachmentThumbnail(w http.ResponseWriter, r *http.Request) {
+	serveAttachment(w, r, true)
+}
+
+func serveAttachment(w http.ResponseWriter, r *http.Request, thumbnail bool) {
+	vars := mux.Vars(r)
+
+	var filename, contentType, checksum, storageKey string
+	var thumbnailKey sql.NullString
+	err := db.QueryRow(`SELECT filename, content_type, sha256, storage_key, thumbnail_key FROM attachments WHERE id = ?`, vars["id"]).
+		Scan(&filename, &contentType, &checksum, &storageKey, &thumbnailKey)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	key := storageKey
+	if thumbnail {
+		if !thumbnailKey.Valid {
+			http.Error(w, "Attachment has no thumbnail", http.StatusNotFound)
+			return
+		}
+		key, contentType = thumbnailKey.String, "image/jpeg"
+	}
+
+	file, err := attachments.Get(key)
+	if err != nil {
+		http.Error(w, "Attachment file is missing from storage", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	if !thumbnail {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		w.Header().Set("ETag", fmt.Sprintf("%q", checksum))
+	}
+	io.Copy(w, file)
+}
+
+func deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var storageKey string
+	var thumbnailKey sql.NullString
+	err := db.QueryRow(`SELECT storage_key, thumbnail_key FROM attachments WHERE id = ?`, vars["id"]).Scan(&storageKey, &thumbnailKey)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM attachments WHERE id = ?`, vars["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The same file uploaded twice to one owner shares a key; keep it while referenced
+	var remaining int
+	db.QueryRow(`SELECT COUNT(*) FROM attachments WHERE storage_key = ?`, storageKey).Scan(&remaining)
+	if remaining == 0 {
+		attachments.Delete(storageKey)
+		if thumbnailKey.Valid {
+			attachments.Delete(thumbnailKey.String)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Simulation clock. Background sweeps (invoice aging and friends) read the
+// time from simNow so a demo can jump days ahead without waiting.
+
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+var (
+	simClockOffset time.Duration
+	simClockMutex  = sync.RWMutex{}
+)
+
+func simNow() time.Time {
+	simClockMutex.RLock()
+	defer simClockMutex.RUnlock()
+	return time.Now().UTC().Add(simClockOffset)
+}
+
+// Parse the timestamp formats SQLite hands back (driver RFC3339, CURRENT_TIMESTAMP, plain dates)
+func parseDBTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, sqliteTimeLayout, "2006-01-02"} {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// DATE columns scan back as timestamps; show them as plain dates
+func formatDBDate(value string) string {
+	if t, ok := parseDBTime(value); ok {
+		return t.Format("2006-01-02")
+	}
+	return value
+}
+
+func getSimulationClock(w http.ResponseWriter, r *http.Request) {
+	writeSimulationClock(w)
+}
+
+// Move the simulation clock: {"advance_hours": 24}, {"now": "2025-10-01T08:00:00Z"} or {"reset": true}
+func updateSimulationClock(w http.ResponseWriter, r *http.Request) {
+	var clock map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&clock); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	simClockMutex.Lock()
+	if reset, _ := clock["reset"].(bool); reset {
+		simClockOffset = 0
+	}
+	if hours, ok := clock["advance_hours"].(float64); ok {
+		simClockOffset += time.Duration(hours * float64(time.Hour))
+	}
+	if now, ok := clock["now"].(string); ok {
+		target, err := time.Parse(time.RFC3339, now)
+		if err != nil {
+			simClockMutex.Unlock()
+			http.Error(w, "now must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		simClockOffset = target.Sub(time.Now().UTC())
+	}
+	simClockMutex.Unlock()
+
+	// Jobs booked ahead are created as soon as the clock reaches them
+	materializeScheduledJobs()
+
+	writeSimulationClock(w)
+}
+
+func writeSimulationClock(w http.ResponseWriter) {
+	simClockMutex.RLock()
+	offset := simClockOffset
+	simClockMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"now":            simNow().Format(time.RFC3339),
+		"offset_seconds": int64(offset.Seconds()),
+	})
+}
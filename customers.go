@@ -0,0 +1,927 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Customers and accounts. Jobs, invoices and impound records point at a
+// customer; the free-text name and phone columns are kept alongside for
+// display. Free text without a customer is matched to an existing customer by
+// phone number (or by name when one side has no phone) and a new individual
+// customer is created otherwise. Deleted customers keep their row so history
+// still resolves.
+
+var customerTypes = []string{"individual", "motor_club", "insurance", "police", "property_manager", "business"}
+
+var emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+const (
+	defaultAccountTermsDays = 30
+	maxBillingTermsDays     = 180
+)
+
+func validCustomerType(customerType string) bool {
+	for _, t := range customerTypes {
+		if t == customerType {
+			return true
+		}
+	}
+	return false
+}
+
+// Digits of a phone number, used to match customers. Too short to identify
+// anyone returns "".
+func phoneDigits(phone string) string {
+	var digits strings.Builder
+	for _, c := range phone {
+		if c >= '0' && c <= '9' {
+			digits.WriteRune(c)
+		}
+	}
+	if digits.Len() < 7 {
+		return ""
+	}
+	return digits.String()
+}
+
+func customerExists(customerID interface{}) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM customers WHERE id = ? AND deleted_at IS NULL`, customerID).Scan(&count)
+	return count > 0, err
+}
+
+// Read an optional customer_id from a request body. Returns the id (0 when
+// absent) or a problem message.
+func customerIDFromBody(body map[string]interface{}) (int64, string, int, error) {
+	value, ok := body["customer_id"]
+	if !ok || value == nil {
+		return 0, "", 0, nil
+	}
+	id, isNumber := value.(float64)
+	if !isNumber || id != math.Trunc(id) {
+		return 0, "customer_id must be a number", http.StatusBadRequest, nil
+	}
+	exists, err := customerExists(int64(id))
+	if err != nil {
+		return 0, "", 0, err
+	}
+	if !exists {
+		return 0, "Customer not found", http.StatusNotFound, nil
+	}
+	return int64(id), "", 0, nil
+}
+
+// Find the customer a free-text name and phone refer to, creating an
+// individual customer when none matches. Returns 0 when both are empty.
+func findOrCreateCustomer(name, phone string) (int64, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	phone = strings.TrimSpace(phone)
+	digits := phoneDigits(phone)
+	if name == "" && digits == "" {
+		return 0, nil
+	}
+
+	if digits != "" {
+		if id, err := customerByPhone(digits); id != 0 || err != nil {
+			return id, err
+		}
+	}
+
+	if name != "" {
+		// Same name where one side has no phone
+		var id int64
+		err := db.QueryRow(`SELECT id FROM customers WHERE LOWER(name) = LOWER(?) AND (phone_digits = '' OR ? = '')
+			AND deleted_at IS NULL ORDER BY id LIMIT 1`, name, digits).Scan(&id)
+		if err == nil {
+			if digits == "" {
+				return id, nil
+			}
+			// Only fill in a phone the customer does not have yet. Once it has
+			// one (or the number went to someone else) this is a different
+			// customer.
+			result, err := db.Exec(`UPDATE customers SET phone = ?, phone_digits = ? WHERE id = ? AND phone_digits = ''`, phone, digits, id)
+			if err == nil {
+				if filled, _ := result.RowsAffected(); filled > 0 {
+					return id, nil
+				}
+			} else if !strings.Contains(err.Error(), "UNIQUE") {
+				return 0, err
+			}
+		} else if err != sql.ErrNoRows {
+			return 0, err
+		}
+	} else {
+		name = phone
+	}
+
+	result, err := db.Exec(`INSERT INTO customers (customer_type, name, phone, phone_digits, created_at) VALUES ('individual', ?, ?, ?, ?)`,
+		name, phone, digits, simNow().Format(sqliteTimeLayout))
+	if err != nil && digits != "" && strings.Contains(err.Error(), "UNIQUE") {
+		// Created by another request since the lookup above
+		return customerByPhone(digits)
+	} else if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// The live customer with this phone number, or 0 when there is none
+func customerByPhone(digits string) (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT id FROM customers WHERE phone_digits = ? AND deleted_at IS NULL`, digits).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// Link jobs, impound records and invoices that only carry free-text customer
+// details to customer records, merging duplicates. Safe to run repeatedly.
+func migrateFreeTextCustomers() error {
+	sources := []struct{ table, nameColumn, phoneColumn string }{
+		{"invoices", "customer_name", "customer_phone"},
+		{"impounded_vehicles", "owner_name", "owner_phone"},
+		{"jobs", "owner_name", "owner_phone"},
+	}
+
+	var before, after int
+	db.QueryRow(`SELECT COUNT(*) FROM customers`).Scan(&before)
+
+	linked := 0
+	for _, source := range sources {
+		rows, err := db.Query(fmt.Sprintf(`SELECT id, COALESCE(%s, ''), COALESCE(%s, '') FROM %s WHERE customer_id IS NULL ORDER BY id`,
+			source.nameColumn, source.phoneColumn, source.table))
+		if err != nil {
+			return err
+		}
+		type freeText struct {
+			id          int64
+			name, phone string
+		}
+		var records []freeText
+		for rows.Next() {
+			var record freeText
+			if err := rows.Scan(&record.id, &record.name, &record.phone); err != nil {
+				rows.Close()
+				return err
+			}
+			records = append(records, record)
+		}
+		rows.Close()
+
+		for _, record := range records {
+			customerID, err := findOrCreateCustomer(record.name, record.phone)
+			if err != nil {
+				return err
+			}
+			if customerID == 0 {
+				continue
+			}
+			if _, err := db.Exec(fmt.Sprintf(`UPDATE %s SET customer_id = ? WHERE id = ?`, source.table), customerID, record.id); err != nil {
+				return err
+			}
+			linked++
+		}
+	}
+
+	db.QueryRow(`SELECT COUNT(*) FROM customers`).Scan(&after)
+	log.Printf("Linked %d records to customers (%d customers created)", linked, after-before)
+	return nil
+}
+
+// Validate one customer field from a request body. Returns the value to store
+// or a problem message with its HTTP status.
+func customerFieldValue(field string, value interface{}) (interface{}, string, int) {
+	if field == "billing_terms_days" {
+		days, isNumber := value.(float64)
+		if !isNumber || days != math.Trunc(days) || days < 0 || days > maxBillingTermsDays {
+			return nil, fmt.Sprintf("billing_terms_days must be a whole number between 0 and %d", maxBillingTermsDays), http.StatusBadRequest
+		}
+		return int(days), "", 0
+	}
+	if field == "pickup_radius_m" {
+		if value == nil {
+			return nil, "", 0
+		}
+		radius, isNumber := value.(float64)
+		if !isNumber || radius < 25 || radius > 5000 {
+			return nil, "pickup_radius_m must be a number between 25 and 5000", http.StatusBadRequest
+		}
+		return radius, "", 0
+	}
+	if field == "po_required" {
+		required, isBool := value.(bool)
+		if value == nil {
+			required, isBool = false, true
+		}
+		if !isBool {
+			return nil, "po_required must be a boolean", http.StatusBadRequest
+		}
+		return required, "", 0
+	}
+
+	text, isString := value.(string)
+	if value == nil {
+		text, isString = "", true
+	}
+	if !isString {
+		return nil, field + " must be a string", http.StatusBadRequest
+	}
+	text = strings.TrimSpace(text)
+
+	switch field {
+	case "name":
+		if text == "" {
+			return nil, "name cannot be empty", http.StatusBadRequest
+		}
+	case "customer_type":
+		if !validCustomerType(text) {
+			return nil, "customer_type must be one of " + strings.Join(customerTypes, ", "), http.StatusBadRequest
+		}
+	case "phone":
+		if text != "" && !phonePattern.MatchString(text) {
+			return nil, "phone must be 7-20 digits, spaces or + ( ) - .", http.StatusBadRequest
+		}
+	case "email":
+		if text != "" && !emailPattern.MatchString(text) {
+			return nil, "email is not a valid address", http.StatusBadRequest
+		}
+	case "account_number":
+		if text == "" {
+			return nil, "", 0
+		}
+		text = strings.ToUpper(text)
+	}
+	return text, "", 0
+}
+
+var customerFields = []string{"customer_type", "name", "account_number", "contact_name", "phone", "email",
+	"address_line1", "address_line2", "city", "region", "postal_code", "billing_terms_days", "po_required", "pickup_radius_m", "notes"}
+
+func isCustomerField(field string) bool {
+	for _, f := range customerFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+const customerColumns = `c.id, c.customer_type, c.name, c.account_number, c.contact_name, c.phone, c.email,
+	c.address_line1, c.address_line2, c.city, c.region, c.postal_code, c.billing_terms_days, c.po_required, c.pickup_radius_m, c.notes, c.created_at,
+	(SELECT COUNT(*) FROM jobs WHERE customer_id = c.id),
+	(SELECT COALESCE(SUM(i.amount - (SELECT COALESCE(SUM(p.amount), 0) FROM payments p WHERE p.invoice_id = i.id)), 0)
+		FROM invoices i WHERE i.customer_id = c.id AND i.status IN ('pending', 'overdue'))`
+
+func scanCustomer(row interface{ Scan(...interface{}) error }) (map[string]interface{}, error) {
+	var id sql.NullInt64
+	var customerType, name, accountNumber, contactName, phone, email sql.NullString
+	var address1, address2, city, region, postalCode, notes, createdAt sql.NullString
+	var termsDays sql.NullInt64
+	var poRequired bool
+	var pickupRadius sql.NullFloat64
+	var jobCount int
+	var openBalance float64
+
+	err := row.Scan(&id, &customerType, &name, &accountNumber, &contactName, &phone, &email,
+		&address1, &address2, &city, &region, &postalCode, &termsDays, &poRequired, &pickupRadius, &notes, &createdAt, &jobCount, &openBalance)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"id":                 id.Int64,
+		"customer_type":      customerType.String,
+		"name":               name.String,
+		"account_number":     accountNumber.String,
+		"contact_name":       contactName.String,
+		"phone":              phone.String,
+		"email":              email.String,
+		"address_line1":      address1.String,
+		"address_line2":      address2.String,
+		"city":               city.String,
+		"region":             region.String,
+		"postal_code":        postalCode.String,
+		"billing_terms_days": termsDays.Int64,
+		"po_required":        poRequired,
+		"pickup_radius_m":    pickupRadius.Float64,
+		"notes":              notes.String,
+		"created_at":         createdAt.String,
+		"jobs":               jobCount,
+		"open_balance":       roundCents(openBalance),
+	}, nil
+}
+
+// Search customers by name, phone, email, account number or contact name
+// (?q=), optionally of one type (?type=)
+func getCustomers(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT ` + customerColumns + ` FROM customers c WHERE c.deleted_at IS NULL`
+	var args []interface{}
+
+	if customerType := r.URL.Query().Get("type"); customerType != "" {
+		query += ` AND c.customer_type = ?`
+		args = append(args, customerType)
+	}
+	if q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q"))); q != "" {
+		like := "%" + q + "%"
+		conditions := []string{"LOWER(c.name) LIKE ?", "LOWER(c.email) LIKE ?", "LOWER(c.account_number) LIKE ?",
+			"EXISTS (SELECT 1 FROM customer_contacts cc WHERE cc.customer_id = c.id AND LOWER(cc.name) LIKE ?)"}
+		args = append(args, like, like, like, like)
+		if digits := strings.Map(func(c rune) rune {
+			if c >= '0' && c <= '9' {
+				return c
+			}
+			return -1
+		}, q); len(digits) >= 3 {
+			conditions = append(conditions, "c.phone_digits LIKE ?")
+			args = append(args, "%"+digits+"%")
+		}
+		query += ` AND (` + strings.Join(conditions, " OR ") + `)`
+	}
+	query += ` ORDER BY c.name, c.id LIMIT 100`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	customers := []map[string]interface{}{}
+	for rows.Next() {
+		customer, err := scanCustomer(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		customers = append(customers, customer)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customers)
+}
+
+func getCustomer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	customer, err := scanCustomer(db.QueryRow(`SELECT `+customerColumns+` FROM customers c WHERE c.id = ? AND c.deleted_at IS NULL`, vars["id"]))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contacts, err := loadCustomerContacts(customer["id"].(int64))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	customer["contacts"] = contacts
+
+	var invoiceCount, impoundCount int
+	db.QueryRow(`SELECT COUNT(*) FROM invoices WHERE customer_id = ?`, customer["id"]).Scan(&invoiceCount)
+	db.QueryRow(`SELECT COUNT(*) FROM impounded_vehicles WHERE customer_id = ?`, customer["id"]).Scan(&impoundCount)
+	customer["invoices"] = invoiceCount
+	customer["impounds"] = impoundCount
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(customer)
+}
+
+func loadCustomerContacts(customerID int64) ([]map[string]interface{}, error) {
+	rows, err := db.Query(`SELECT id, name, role, phone, email, is_primary FROM customer_contacts
+		WHERE customer_id = ? ORDER BY is_primary DESC, id`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := []map[string]interface{}{}
+	for rows.Next() {
+		var id int64
+		var name, role, phone, email sql.NullString
+		var isPrimary bool
+		if err := rows.Scan(&id, &name, &role, &phone, &email, &isPrimary); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, map[string]interface{}{
+			"id":         id,
+			"name":       name.String,
+			"role":       role.String,
+			"phone":      phone.String,
+			"email":      email.String,
+			"is_primary": isPrimary,
+		})
+	}
+	return contacts, rows.Err()
+}
+
+// Validate and insert one contact: {"name": "...", "role": "...", "phone": "...", "email": "...", "is_primary": true}
+func insertCustomerContact(tx *sql.Tx, customerID int64, contact map[string]interface{}) (int64, string, error) {
+	values := map[string]interface{}{}
+	for _, field := range []string{"name", "role", "phone", "email"} {
+		value, problem, _ := customerFieldValue(field, contact[field])
+		if problem != "" {
+			return 0, "contact " + problem, nil
+		}
+		values[field] = value
+	}
+	isPrimary, _ := contact["is_primary"].(bool)
+
+	if isPrimary {
+		if _, err := tx.Exec(`UPDATE customer_contacts SET is_primary = 0 WHERE customer_id = ?`, customerID); err != nil {
+			return 0, "", err
+		}
+	}
+	result, err := tx.Exec(`INSERT INTO customer_contacts (customer_id, name, role, phone, email, is_primary) VALUES (?, ?, ?, ?, ?, ?)`,
+		customerID, values["name"], values["role"], values["phone"], values["email"], isPrimary)
+	if err != nil {
+		return 0, "", err
+	}
+	id, _ := result.LastInsertId()
+	return id, "", nil
+}
+
+// The same phone number is the same customer and account numbers are one per
+// customer, so no other customer may take either. Checked inside the write
+// transaction, with the unique indexes on customers as the backstop. Writes the
+// 409, or a 500 on a failed lookup, and reports whether it did.
+func rejectDuplicateCustomer(w http.ResponseWriter, tx *sql.Tx, values map[string]interface{}, customerID int64) bool {
+	phone, _ := values["phone"].(string)
+	if digits := phoneDigits(phone); digits != "" {
+		var existingID int64
+		err := tx.QueryRow(`SELECT id FROM customers WHERE phone_digits = ? AND id != ? AND deleted_at IS NULL`,
+			digits, customerID).Scan(&existingID)
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":       "A customer with this phone number already exists",
+				"customer_id": existingID,
+			})
+			return true
+		} else if err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+	}
+
+	if accountNumber, _ := values["account_number"].(string); accountNumber != "" {
+		var taken int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM customers WHERE account_number = ? AND id != ? AND deleted_at IS NULL`,
+			accountNumber, customerID).Scan(&taken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		if taken > 0 {
+			http.Error(w, "account_number is already used by another customer", http.StatusConflict)
+			return true
+		}
+	}
+	return false
+}
+
+// The 409 message for a write refused by a unique index on customers, or ""
+func customerUniqueProblem(err error) string {
+	switch {
+	case strings.Contains(err.Error(), "customers.phone_digits"):
+		return "A customer with this phone number already exists"
+	case strings.Contains(err.Error(), "customers.account_number"):
+		return "account_number is already used by another customer"
+	}
+	return ""
+}
+
+func createCustomer(w http.ResponseWriter, r *http.Request) {
+	var customer map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&customer); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for field := range customer {
+		if field != "contacts" && !isCustomerField(field) {
+			http.Error(w, fmt.Sprintf("Unknown field %s", field), http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := customer["name"]; !ok {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := customer["customer_type"]; !ok {
+		customer["customer_type"] = "individual"
+	}
+	// Accounts are invoiced on terms; individuals pay on the day
+	if _, ok := customer["billing_terms_days"]; !ok {
+		customer["billing_terms_days"] = 0.0
+		if customer["customer_type"] != "individual" {
+			customer["billing_terms_days"] = float64(defaultAccountTermsDays)
+		}
+	}
+
+	values := map[string]interface{}{}
+	for _, field := range customerFields {
+		value, ok := customer[field]
+		if !ok {
+			continue
+		}
+		value, problem, status := customerFieldValue(field, value)
+		if problem != "" {
+			http.Error(w, problem, status)
+			return
+		}
+		values[field] = value
+	}
+
+	phone, _ := values["phone"].(string)
+	digits := phoneDigits(phone)
+
+	contacts, isList := customer["contacts"].([]interface{})
+	if _, ok := customer["contacts"]; ok && !isList {
+		http.Error(w, "contacts must be a list", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if rejectDuplicateCustomer(w, tx, values, 0) {
+		return
+	}
+
+	columns := []string{"phone_digits", "created_at"}
+	args := []interface{}{digits, simNow().Format(sqliteTimeLayout)}
+	for _, field := range customerFields {
+		if value, ok := values[field]; ok {
+			columns = append(columns, field)
+			args = append(args, value)
+		}
+	}
+	result, err := tx.Exec(fmt.Sprintf(`INSERT INTO customers (%s) VALUES (?%s)`,
+		strings.Join(columns, ", "), strings.Repeat(", ?", len(columns)-1)), args...)
+	if err != nil {
+		if problem := customerUniqueProblem(err); problem != "" {
+			http.Error(w, problem, http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	customerID, _ := result.LastInsertId()
+
+	for _, item := range contacts {
+		contact, isObject := item.(map[string]interface{})
+		if !isObject {
+			http.Error(w, "each contact must be an object", http.StatusBadRequest)
+			return
+		}
+		if _, problem, err := insertCustomerContact(tx, customerID, contact); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int64{"id": customerID})
+}
+
+// PUT replaces the customer's details (name and customer_type required, other
+// fields left out are cleared); PATCH changes only the fields given.
+func updateCustomer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for field := range update {
+		if !isCustomerField(field) {
+			http.Error(w, fmt.Sprintf("Unknown field %s", field), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var customerID int64
+	err := db.QueryRow(`SELECT id FROM customers WHERE id = ? AND deleted_at IS NULL`, vars["id"]).Scan(&customerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		for _, field := range []string{"name", "customer_type"} {
+			if _, ok := update[field]; !ok {
+				http.Error(w, field+" is required", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, field := range customerFields {
+			if _, ok := update[field]; !ok {
+				update[field] = nil
+				if field == "billing_terms_days" {
+					update[field] = 0.0
+				}
+			}
+		}
+	}
+
+	changes := map[string]interface{}{}
+	for _, field := range customerFields {
+		value, ok := update[field]
+		if !ok {
+			continue
+		}
+		value, problem, status := customerFieldValue(field, value)
+		if problem != "" {
+			http.Error(w, problem, status)
+			return
+		}
+		changes[field] = value
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if rejectDuplicateCustomer(w, tx, changes, customerID) {
+		return
+	}
+
+	for _, field := range customerFields {
+		value, ok := changes[field]
+		if !ok {
+			continue
+		}
+		_, err := tx.Exec(fmt.Sprintf(`UPDATE customers SET %s = ? WHERE id = ?`, field), value, customerID)
+		if err == nil && field == "phone" {
+			_, err = tx.Exec(`UPDATE customers SET phone_digits = ? WHERE id = ?`, phoneDigits(value.(string)), customerID)
+		}
+		if err != nil {
+			if problem := customerUniqueProblem(err); problem != "" {
+				http.Error(w, problem, http.StatusConflict)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	changed := make([]string, 0, len(changes))
+	for field := range changes {
+		changed = append(changed, field)
+	}
+	sort.Strings(changed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": customerID, "changed": changed})
+}
+
+// Soft delete; refused while the customer has open jobs
+func deleteCustomer(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var customerID int64
+	err := db.QueryRow(`SELECT id FROM customers WHERE id = ? AND deleted_at IS NULL`, vars["id"]).Scan(&customerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id FROM jobs WHERE customer_id = ? AND status IN ('pending', 'assigned', 'in_progress') ORDER BY id`, customerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var jobIDs []int64
+	for rows.Next() {
+		var jobID int64
+		if err := rows.Scan(&jobID); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jobIDs = append(jobIDs, jobID)
+	}
+	rows.Close()
+	if len(jobIDs) > 0 {
+		writeActiveJobsConflict(w, "Customer has open jobs", jobIDs)
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE customers SET deleted_at = ? WHERE id = ?`, simNow().Format(sqliteTimeLayout), customerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func createCustomerContact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var contact map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var customerID int64
+	err := db.QueryRow(`SELECT id FROM customers WHERE id = ? AND deleted_at IS NULL`, vars["id"]).Scan(&customerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	id, problem, err := insertCustomerContact(tx, customerID, contact)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int64{"id": id})
+}
+
+func deleteCustomerContact(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	result, err := db.Exec(`DELETE FROM customer_contacts WHERE id = ? AND customer_id = ?`, vars["contactId"], vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Contact not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Jobs, invoices and impound records linked to a customer, newest first
+func getCustomerHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	exists, err := customerExists(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Customer not found", http.StatusNotFound)
+		return
+	}
+
+	jobs := []map[string]interface{}{}
+	rows, err := db.Query(`SELECT id, job_type, status, vehicle_description, license_plate, created_at, completed_at
+		FROM jobs WHERE customer_id = ? ORDER BY id DESC`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var id int64
+		var jobType, status, vehicleDesc, licensePlate, createdAt, completedAt sql.NullString
+		if err := rows.Scan(&id, &jobType, &status, &vehicleDesc, &licensePlate, &createdAt, &completedAt); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, map[string]interface{}{
+			"id":                  id,
+			"job_type":            jobType.String,
+			"status":              status.String,
+			"vehicle_description": vehicleDesc.String,
+			"license_plate":       licensePlate.String,
+			"created_at":          createdAt.String,
+			"completed_at":        completedAt.String,
+		})
+	}
+	rows.Close()
+
+	invoices := []map[string]interface{}{}
+	rows, err = db.Query(`SELECT id, job_id, amount, status, due_date, created_at,
+		(SELECT COALESCE(SUM(amount), 0) FROM payments WHERE invoice_id = invoices.id)
+		FROM invoices WHERE customer_id = ? ORDER BY id DESC`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var id, jobID sql.NullInt64
+		var amount, paid float64
+		var status, dueDate, createdAt sql.NullString
+		if err := rows.Scan(&id, &jobID, &amount, &status, &dueDate, &createdAt, &paid); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		invoices = append(invoices, map[string]interface{}{
+			"id":         id.Int64,
+			"job_id":     jobID.Int64,
+			"amount":     amount,
+			"paid":       roundCents(paid),
+			"status":     status.String,
+			"due_date":   formatDBDate(dueDate.String),
+			"created_at": createdAt.String,
+		})
+	}
+	rows.Close()
+
+	impounds := []map[string]interface{}{}
+	rows, err = db.Query(`SELECT id, job_id, vehicle_description, license_plate, is_currently_impounded, impounded_at, released_at
+		FROM impounded_vehicles WHERE customer_id = ? ORDER BY id DESC`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var id, jobID sql.NullInt64
+		var vehicleDesc, licensePlate, impoundedAt, releasedAt sql.NullString
+		var isCurrentlyImpounded bool
+		if err := rows.Scan(&id, &jobID, &vehicleDesc, &licensePlate, &isCurrentlyImpounded, &impoundedAt, &releasedAt); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		impounds = append(impounds, map[string]interface{}{
+			"id":                     id.Int64,
+			"job_id":                 jobID.Int64,
+			"vehicle_description":    vehicleDesc.String,
+			"license_plate":          licensePlate.String,
+			"is_currently_impounded": isCurrentlyImpounded,
+			"impounded_at":           impoundedAt.String,
+			"released_at":            releasedAt.String,
+		})
+	}
+	rows.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobs":     jobs,
+		"invoices": invoices,
+		"impounds": impounds,
+	})
+}
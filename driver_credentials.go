@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Driver credentials: commercial licence, endorsements and certifications
+// with an issuer and expiry date. Each job type lists the credential types a
+// driver needs; assignment is refused when one is missing or expired. A periodic
+// check raises an alert when a credential enters its warning period or expires.
+
+// Credential state as of a date: valid, expiring (within the type's warn_days) or expired
+func credentialStatus(expiryDate string, warnDays int, asOf time.Time) string {
+	expiry, ok := parseDBTime(expiryDate)
+	if !ok {
+		return "valid"
+	}
+	today := time.Date(asOf.Year(), asOf.Month(), asOf.Day(), 0, 0, 0, 0, time.UTC)
+	expiryDay := time.Date(expiry.Year(), expiry.Month(), expiry.Day(), 0, 0, 0, 0, time.UTC)
+	if expiryDay.Before(today) {
+		return "expired"
+	}
+	if !expiryDay.After(today.AddDate(0, 0, warnDays)) {
+		return "expiring"
+	}
+	return "valid"
+}
+
+// Credential types required for a job type that the driver lacks or has let expire
+func missingCredentials(driverID interface{}, jobType string) ([]string, error) {
+	rows, err := db.Query(`SELECT r.credential_type,
+		(SELECT MAX(c.expiry_date) FROM driver_credentials c WHERE c.driver_id = ? AND c.credential_type = r.credential_type)
+		FROM job_type_credentials r WHERE r.job_type = ? ORDER BY r.credential_type`, driverID, jobType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := simNow()
+	var missing []string
+	for rows.Next() {
+		var credentialType string
+		var expiry sql.NullString
+		if err := rows.Scan(&credentialType, &expiry); err != nil {
+			return nil, err
+		}
+		if !expiry.Valid {
+			missing = append(missing, credentialType)
+		} else if credentialStatus(expiry.String, 0, now) == "expired" {
+			missing = append(missing, credentialType+" (expired)")
+		}
+	}
+	return missing, rows.Err()
+}
+
+// Credential check worker
+func credentialExpiryWorker() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Credential expiry check started")
+
+	checkCredentialExpiry()
+	for range ticker.C {
+		checkCredentialExpiry()
+	}
+}
+
+// Raise one alert per credential each time it becomes expiring or expired.
+// Runs every minute so simulation clock jumps are picked up; flagged_status
+// keeps it to one alert per change.
+func checkCredentialExpiry() {
+	now := simNow()
+
+	rows, err := db.Query(`SELECT c.id, c.driver_id, d.name, c.credential_type, c.expiry_date, t.warn_days, c.flagged_status
+		FROM driver_credentials c JOIN drivers d ON d.id = c.driver_id JOIN credential_types t ON t.code = c.credential_type
+		WHERE d.deleted_at IS NULL`)
+	if err != nil {
+		log.Printf("Error loading driver credentials: %v", err)
+		return
+	}
+
+	type flag struct {
+		id, driverID         int64
+		driverName, credType string
+		expiry, status       string
+	}
+	var flags []flag
+	for rows.Next() {
+		var f flag
+		var expiry, flagged sql.NullString
+		var warnDays int
+		if err := rows.Scan(&f.id, &f.driverID, &f.driverName, &f.credType, &expiry, &warnDays, &flagged); err != nil {
+			log.Printf("Error scanning driver credential: %v", err)
+			continue
+		}
+		f.expiry = formatDBDate(expiry.String)
+		f.status = credentialStatus(expiry.String, warnDays, now)
+		if f.status != flagged.String {
+			flags = append(flags, f)
+		}
+	}
+	rows.Close()
+
+	for _, f := range flags {
+		message := fmt.Sprintf("%s's %s expires on %s", f.driverName, f.credType, f.expiry)
+		if f.status == "expired" {
+			message = fmt.Sprintf("%s's %s expired on %s", f.driverName, f.credType, f.expiry)
+		}
+		if err := flagCredential(f.id, f.driverID, f.status, message, now); err != nil {
+			log.Printf("Error flagging credential %d: %v", f.id, err)
+			continue
+		}
+		if f.status != "valid" {
+			log.Printf("Credential alert: %s", message)
+		}
+	}
+}
+
+// Record the credential's new status and, unless it is valid again, its
+// alert; together so a failed alert is retried on the next check
+func flagCredential(id, driverID int64, status, message string, now time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE driver_credentials SET flagged_status = ? WHERE id = ?`, status, id); err != nil {
+		return err
+	}
+	if status != "valid" {
+		_, err := tx.Exec(`INSERT INTO credential_alerts (credential_id, driver_id, level, message, created_at) VALUES (?, ?, ?, ?, ?)`,
+			id, driverID, status, message, now.Format(sqliteTimeLayout))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func getDriverCredentials(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rows, err := db.Query(`SELECT c.id, c.credential_type, t.description, c.licence_class, c.credential_number, c.issuer,
+		c.issued_date, c.expiry_date, t.warn_days,
+		(SELECT COUNT(*) FROM attachments a WHERE a.owner_type = 'credential' AND a.owner_id = c.id)
+		FROM driver_credentials c JOIN credential_types t ON t.code = c.credential_type
+		WHERE c.driver_id = ? ORDER BY c.expiry_date`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	now := simNow()
+	var credentials []map[string]interface{}
+	for rows.Next() {
+		var id, warnDays, documents sql.NullInt64
+		var credType, description, licenceClass, number, issuer, issued, expiry sql.NullString
+
+		err := rows.Scan(&id, &credType, &description, &licenceClass, &number, &issuer, &issued, &expiry, &warnDays, &documents)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		credentials = append(credentials, map[string]interface{}{
+			"id":                id.Int64,
+			"credential_type":   credType.String,
+			"description":       description.String,
+			"licence_class":     licenceClass.String,
+			"credential_number": number.String,
+			"issuer":            issuer.String,
+			"issued_date":       formatDBDate(issued.String),
+			"expiry_date":       formatDBDate(expiry.String),
+			"status":            credentialStatus(expiry.String, int(warnDays.Int64), now),
+			"documents":         documents.Int64,
+			"documents_url":     fmt.Sprintf("/credentials/%d/attachments", id.Int64),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(credentials)
+}
+
+// Validate credential fields shared by create and update
+func validateCredential(credential map[string]interface{}, requireAll bool) string {
+	if value, ok := credential["credential_type"]; ok || requireAll {
+		credType, _ := value.(string)
+		var known int
+		db.QueryRow(`SELECT COUNT(*) FROM credential_types WHERE code = ?`, credType).Scan(&known)
+		if known == 0 {
+			return "Unknown credential_type"
+		}
+	}
+	for _, field := range []string{"issued_date", "expiry_date"} {
+		value, ok := credential[field]
+		if !ok {
+			if requireAll && field == "expiry_date" {
+				return "expiry_date is required"
+			}
+			continue
+		}
+		date, _ := value.(string)
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return field + " must be YYYY-MM-DD"
+		}
+	}
+	if issued, ok := credential["issued_date"].(string); ok {
+		if expiry, ok := credential["expiry_date"].(string); ok && expiry < issued {
+			return "expiry_date must be after issued_date"
+		}
+	}
+	return ""
+}
+
+func createDriverCredential(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var credential map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := driverExists(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	if problem := validateCredential(credential, true); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO driver_credentials (driver_id, credential_type, licence_class, credential_number, issuer, issued_date, expiry_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		vars["id"], credential["credential_type"], credential["licence_class"], credential["credential_number"],
+		credential["issuer"], credential["issued_date"], credential["expiry_date"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": id})
+}
+
+// Update a credential, typically a renewal with a new expiry date
+func updateDriverCredential(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var credential map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&credential); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if problem := validateCredential(credential, false); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	// A renewed credential is checked afresh by the next expiry check
+	result, err := db.Exec(`UPDATE driver_credentials SET credential_type = COALESCE(?, credential_type),
+		licence_class = COALESCE(?, licence_class), credential_number = COALESCE(?, credential_number),
+		issuer = COALESCE(?, issuer), issued_date = COALESCE(?, issued_date), expiry_date = COALESCE(?, expiry_date),
+		flagged_status = CASE WHEN ? IS NULL THEN flagged_status ELSE NULL END WHERE id = ?`,
+		credential["credential_type"], credential["licence_class"], credential["credential_number"],
+		credential["issuer"], credential["issued_date"], credential["expiry_date"], credential["expiry_date"], vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteDriverCredential(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	tx.Exec(`DELETE FROM credential_alerts WHERE credential_id = ?`, vars["id"])
+	result, err := tx.Exec(`DELETE FROM driver_credentials WHERE id = ?`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Credential not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Credentials expiring within ?days= (default 30) or already expired. The
+// status still uses each type's warn_days, so it matches everywhere else.
+func getExpiringCredentials(w http.ResponseWriter, r *http.Request) {
+	days := 30
+	if value := r.URL.Query().Get("days"); value != "" {
+		if _, err := fmt.Sscan(value, &days); err != nil || days < 0 {
+			http.Error(w, "days must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := simNow()
+	rows, err := db.Query(`SELECT c.id, c.driver_id, d.name, c.credential_type, c.expiry_date, t.warn_days
+		FROM driver_credentials c JOIN drivers d ON d.id = c.driver_id
+		JOIN credential_types t ON t.code = c.credential_type
+		WHERE d.deleted_at IS NULL AND c.expiry_date <= ? ORDER BY c.expiry_date`,
+		now.AddDate(0, 0, days).Format("2006-01-02"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var credentials []map[string]interface{}
+	for rows.Next() {
+		var id, driverID, warnDays sql.NullInt64
+		var driverName, credType, expiry sql.NullString
+
+		if err := rows.Scan(&id, &driverID, &driverName, &credType, &expiry, &warnDays); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		credentials = append(credentials, map[string]interface{}{
+			"id":              id.Int64,
+			"driver_id":       driverID.Int64,
+			"driver_name":     driverName.String,
+			"credential_type": credType.String,
+			"expiry_date":     formatDBDate(expiry.String),
+			"status":          credentialStatus(expiry.String, int(warnDays.Int64), now),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(credentials)
+}
+
+func getCredentialAlerts(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT a.id, a.credential_id, a.driver_id, a.level, a.message, a.created_at
+		FROM credential_alerts a ORDER BY a.id DESC`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var alerts []map[string]interface{}
+	for rows.Next() {
+		var id, credentialID, driverID sql.NullInt64
+		var level, message, createdAt sql.NullString
+
+		if err := rows.Scan(&id, &credentialID, &driverID, &level, &message, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		alerts = append(alerts, map[string]interface{}{
+			"id":            id.Int64,
+			"credential_id": credentialID.Int64,
+			"driver_id":     driverID.Int64,
+			"level":         level.String,
+			"message":       message.String,
+			"created_at":    createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func getCredentialTypes(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT t.code, t.description, t.warn_days,
+		(SELECT GROUP_CONCAT(j.job_type) FROM job_type_credentials j WHERE j.credential_type = t.code)
+		FROM credential_types t ORDER BY t.code`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var types []map[string]interface{}
+	for rows.Next() {
+		var code, description, jobTypes sql.NullString
+		var warnDays sql.NullInt64
+
+		if err := rows.Scan(&code, &description, &warnDays, &jobTypes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		requiredFor := []string{}
+		if jobTypes.String != "" {
+			requiredFor = strings.Split(jobTypes.String, ",")
+		}
+		types = append(types, map[string]interface{}{
+			"code":         code.String,
+			"description":  description.String,
+			"warn_days":    warnDays.Int64,
+			"required_for": requiredFor,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types)
+}
+
+// Replace the credential types a job type requires
+func updateJobTypeCredentials(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var body struct {
+		CredentialTypes []string `json:"credential_types"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, credType := range body.CredentialTypes {
+		if seen[credType] {
+			http.Error(w, fmt.Sprintf("Credential type %s is listed more than once", credType), http.StatusBadRequest)
+			return
+		}
+		seen[credType] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Job types have no table of their own; a known one is used by a job, a
+	// credential requirement or an SLA target
+	var known bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM jobs WHERE job_type = ?)
+		OR EXISTS (SELECT 1 FROM job_type_credentials WHERE job_type = ?)
+		OR EXISTS (SELECT 1 FROM sla_targets WHERE job_type = ? AND job_type != 'default')`,
+		vars["jobType"], vars["jobType"], vars["jobType"]).Scan(&known)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !known {
+		http.Error(w, "Job type not found", http.StatusNotFound)
+		return
+	}
+
+	// Foreign keys are not enforced, so the codes are checked here
+	for _, credType := range body.CredentialTypes {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM credential_types WHERE code = ?)`, credType).Scan(&exists); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, fmt.Sprintf("Unknown credential type %s", credType), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM job_type_credentials WHERE job_type = ?`, vars["jobType"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, credType := range body.CredentialTypes {
+		_, err := tx.Exec(`INSERT INTO job_type_credentials (job_type, credential_type) VALUES (?, ?)`, vars["jobType"], credType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"job_type": vars["jobType"], "credential_types": body.CredentialTypes})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCredentialStatus(t *testing.T) {
+	asOf := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		expiry   string
+		warnDays int
+		asOf     time.Time
+		want     string
+	}{
+		{"2026-10-17", 30, asOf, "expired"},
+		{"2026-10-17 23:59:59", 0, asOf, "expired"},
+		{"2026-10-18", 0, asOf, "expiring"},
+		{"2026-10-18T23:00:00Z", 0, asOf, "expiring"},
+		{"2026-10-18", 0, time.Date(2026, 10, 18, 23, 59, 0, 0, time.UTC), "expiring"},
+		{"2026-10-19", 0, asOf, "valid"},
+		{"2026-11-17", 30, asOf, "expiring"},
+		{"2026-11-18", 30, asOf, "valid"},
+		{"2027-10-18", 30, asOf, "valid"},
+		{"", 30, asOf, "valid"},
+		{"next year", 30, asOf, "valid"},
+	}
+	for _, tt := range tests {
+		if got := credentialStatus(tt.expiry, tt.warnDays, tt.asOf); got != tt.want {
+			t.Errorf("credentialStatus(%q, %d, %s) = %s, want %s", tt.expiry, tt.warnDays, tt.asOf.Format(time.RFC3339), got, tt.want)
+		}
+	}
+}
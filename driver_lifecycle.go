@@ -0,0 +1,465 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Driver updates, deactivation and soft deletion. A driver with active jobs
+// cannot be deactivated or deleted unless the jobs are handed to another
+// driver. Deleted drivers keep their row so historical jobs still resolve.
+// Every change is written to audit_log.
+
+var phonePattern = regexp.MustCompile(`^[0-9+()\-. ]{7,20}$`)
+
+// Record one audited change
+func recordAudit(tx *sql.Tx, entityType string, entityID interface{}, action, field string, oldValue, newValue interface{}, changedBy string) error {
+	_, err := tx.Exec(`INSERT INTO audit_log (entity_type, entity_id, action, field, old_value, new_value, changed_by, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entityType, entityID, action, field, auditValue(oldValue), auditValue(newValue), changedBy, simNow().Format(sqliteTimeLayout))
+	return err
+}
+
+func auditValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return fmt.Sprint(value)
+}
+
+// Jobs the driver is working: simulated jobs in activeJobs plus any job still
+// assigned or in progress in the database
+func driverActiveJobIDs(driverID int64) ([]int64, error) {
+	seen := map[int64]bool{}
+	var jobIDs []int64
+
+	activeMutex.RLock()
+	for jobID, activeJob := range activeJobs {
+		if activeJob.DriverID == driverID && !activeJob.Completed {
+			seen[jobID] = true
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	activeMutex.RUnlock()
+
+	rows, err := db.Query(`SELECT id FROM jobs WHERE assigned_driver_id = ? AND status IN ('assigned', 'in_progress')`, driverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobID int64
+		if err := rows.Scan(&jobID); err != nil {
+			return nil, err
+		}
+		if !seen[jobID] {
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	return jobIDs, rows.Err()
+}
+
+// Check another driver can take over jobs: active, on shift, free and within hours
+func validateReassignTarget(targetID interface{}, fromID int64, jobIDs []int64) (int64, string, error) {
+	target, ok := targetID.(float64)
+	if !ok || int64(target) == fromID {
+		return 0, "reassign_to_driver_id must be another driver's id", nil
+	}
+
+	var isActive bool
+	err := db.QueryRow(`SELECT is_active FROM drivers WHERE id = ? AND deleted_at IS NULL`, int64(target)).Scan(&isActive)
+	if err != nil || !isActive {
+		return 0, "Reassignment driver is not an active driver", nil
+	}
+
+	status, _, err := driverStatus(int64(target))
+	if err != nil || status != "available" {
+		return 0, "Reassignment driver is not available", nil
+	}
+
+	if limit, err := exceededHOSLimit(int64(target)); err != nil || limit != nil {
+		return 0, "Reassignment driver has no hours-of-service time left", nil
+	}
+
+	// The same credential check as assignment, for each job type being moved
+	checked := map[string]bool{}
+	for _, jobID := range jobIDs {
+		var jobType sql.NullString
+		if err := db.QueryRow(`SELECT job_type FROM jobs WHERE id = ?`, jobID).Scan(&jobType); err != nil {
+			return 0, "", err
+		}
+		if checked[jobType.String] {
+			continue
+		}
+		checked[jobType.String] = true
+		missing, err := missingCredentials(int64(target), jobType.String)
+		if err != nil {
+			return 0, "", err
+		}
+		if len(missing) > 0 {
+			return 0, fmt.Sprintf("Reassignment driver lacks credentials required for %s jobs: %s", jobType.String, strings.Join(missing, ", ")), nil
+		}
+	}
+
+	return int64(target), "", nil
+}
+
+// Move the driver's active jobs (and their GPS simulations) to another driver
+func reassignDriverJobs(tx *sql.Tx, fromID, toID int64, jobIDs []int64, changedBy string) error {
+	for _, jobID := range jobIDs {
+		if _, err := tx.Exec(`UPDATE jobs SET assigned_driver_id = ? WHERE id = ?`, toID, jobID); err != nil {
+			return err
+		}
+		if err := recordAudit(tx, "job", jobID, "reassign", "assigned_driver_id", fromID, toID, changedBy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveActiveJobs(fromID, toID int64) {
+	activeMutex.Lock()
+	defer activeMutex.Unlock()
+	for _, activeJob := range activeJobs {
+		if activeJob.DriverID == fromID {
+			activeJob.DriverID = toID
+		}
+	}
+}
+
+// Write a 409 listing the jobs blocking a deactivation
+func writeActiveJobsConflict(w http.ResponseWriter, message string, jobIDs []int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":          message,
+		"active_job_ids": jobIDs,
+	})
+}
+
+// PUT replaces name, phone and license_number (name required); PATCH changes
+// only the fields given. Setting is_active false deactivates the driver.
+func updateDriver(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for field := range update {
+		switch field {
+		case "name", "phone", "license_number", "is_active", "changed_by", "reassign_to_driver_id":
+		default:
+			http.Error(w, fmt.Sprintf("Unknown field %s", field), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var driverID int64
+	var name, phone, license sql.NullString
+	var isActive bool
+	err := db.QueryRow(`SELECT id, name, phone, license_number, is_active FROM drivers WHERE id = ? AND deleted_at IS NULL`, vars["id"]).
+		Scan(&driverID, &name, &phone, &license, &isActive)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		if _, ok := update["name"]; !ok {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		// Fields left out of a PUT are cleared
+		for _, field := range []string{"phone", "license_number"} {
+			if _, ok := update[field]; !ok {
+				update[field] = ""
+			}
+		}
+	}
+
+	// Validate and collect the fields that actually change
+	current := map[string]interface{}{
+		"name":           name.String,
+		"phone":          phone.String,
+		"license_number": license.String,
+		"is_active":      isActive,
+	}
+	changes := map[string]interface{}{}
+	for _, field := range []string{"name", "phone", "license_number"} {
+		value, ok := update[field]
+		if !ok {
+			continue
+		}
+		text, isString := value.(string)
+		if !isString {
+			http.Error(w, field+" must be a string", http.StatusBadRequest)
+			return
+		}
+		text = strings.TrimSpace(text)
+		switch field {
+		case "name":
+			if text == "" {
+				http.Error(w, "name cannot be empty", http.StatusBadRequest)
+				return
+			}
+		case "phone":
+			if text != "" && !phonePattern.MatchString(text) {
+				http.Error(w, "phone must be 7-20 digits, spaces or + ( ) - .", http.StatusBadRequest)
+				return
+			}
+		case "license_number":
+			if text != "" {
+				var taken int
+				db.QueryRow(`SELECT COUNT(*) FROM drivers WHERE license_number = ? AND id != ? AND deleted_at IS NULL`, text, driverID).Scan(&taken)
+				if taken > 0 {
+					http.Error(w, "license_number is already used by another driver", http.StatusConflict)
+					return
+				}
+			}
+		}
+		if text != current[field] {
+			changes[field] = text
+		}
+	}
+	if value, ok := update["is_active"]; ok {
+		active, isBool := value.(bool)
+		if !isBool {
+			http.Error(w, "is_active must be a boolean", http.StatusBadRequest)
+			return
+		}
+		if active != isActive {
+			changes["is_active"] = active
+		}
+	}
+
+	changedBy, _ := update["changed_by"].(string)
+
+	// Deactivation is refused while the driver has active jobs, unless they are reassigned
+	var jobIDs []int64
+	var reassignTo int64
+	if active, ok := changes["is_active"].(bool); ok && !active {
+		if jobIDs, err = driverActiveJobIDs(driverID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(jobIDs) > 0 {
+			if _, ok := update["reassign_to_driver_id"]; !ok {
+				writeActiveJobsConflict(w, "Driver has active jobs; finish them or pass reassign_to_driver_id", jobIDs)
+				return
+			}
+			var problem string
+			if reassignTo, problem, err = validateReassignTarget(update["reassign_to_driver_id"], driverID, jobIDs); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if problem != "" {
+				http.Error(w, problem, http.StatusConflict)
+				return
+			}
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, field := range []string{"name", "phone", "license_number", "is_active"} {
+		value, ok := changes[field]
+		if !ok {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE drivers SET %s = ? WHERE id = ?`, field), value, driverID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		action := "update"
+		if field == "is_active" {
+			action = "deactivate"
+			if value == true {
+				action = "reactivate"
+			}
+		}
+		if err := recordAudit(tx, "driver", driverID, action, field, current[field], value, changedBy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if reassignTo != 0 {
+		if err := reassignDriverJobs(tx, driverID, reassignTo, jobIDs, changedBy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reassignTo != 0 {
+		moveActiveJobs(driverID, reassignTo)
+	}
+
+	changed := make([]string, 0, len(changes))
+	for field := range changes {
+		changed = append(changed, field)
+	}
+	sort.Strings(changed)
+
+	response := map[string]interface{}{"id": driverID, "changed": changed}
+	if reassignTo != 0 {
+		response["reassigned_job_ids"] = jobIDs
+		response["reassigned_to"] = reassignTo
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Soft delete: the driver is deactivated and hidden from listings, open and
+// planned shifts are closed, and jobs they worked keep pointing at them.
+// ?reassign_to_driver_id= hands over any active jobs; ?changed_by= is audited.
+func deleteDriver(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var driverID int64
+	var isActive bool
+	err := db.QueryRow(`SELECT id, is_active FROM drivers WHERE id = ? AND deleted_at IS NULL`, vars["id"]).Scan(&driverID, &isActive)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	changedBy := r.URL.Query().Get("changed_by")
+
+	jobIDs, err := driverActiveJobIDs(driverID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var reassignTo int64
+	if len(jobIDs) > 0 {
+		target := r.URL.Query().Get("reassign_to_driver_id")
+		if target == "" {
+			writeActiveJobsConflict(w, "Driver has active jobs; finish them or pass reassign_to_driver_id", jobIDs)
+			return
+		}
+		var targetID float64
+		if _, err := fmt.Sscan(target, &targetID); err != nil {
+			http.Error(w, "reassign_to_driver_id must be another driver's id", http.StatusBadRequest)
+			return
+		}
+		var problem string
+		if reassignTo, problem, err = validateReassignTarget(targetID, driverID, jobIDs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if problem != "" {
+			http.Error(w, problem, http.StatusConflict)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	now := simNow().Format(sqliteTimeLayout)
+	if _, err := tx.Exec(`UPDATE drivers SET is_active = 0, deleted_at = ? WHERE id = ?`, now, driverID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// End any break and shift in progress and drop shifts not yet started
+	_, err = tx.Exec(`UPDATE driver_breaks SET ended_at = ? WHERE ended_at IS NULL
+		AND shift_id IN (SELECT id FROM driver_shifts WHERE driver_id = ?)`, now, driverID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`UPDATE driver_shifts SET clock_out_at = ? WHERE driver_id = ? AND clock_in_at IS NOT NULL AND clock_out_at IS NULL`, now, driverID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM driver_shifts WHERE driver_id = ? AND clock_in_at IS NULL`, driverID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := recordAudit(tx, "driver", driverID, "delete", "deleted_at", nil, now, changedBy); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reassignTo != 0 {
+		if err := reassignDriverJobs(tx, driverID, reassignTo, jobIDs, changedBy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reassignTo != 0 {
+		moveActiveJobs(driverID, reassignTo)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getDriverAudit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rows, err := db.Query(`SELECT id, action, field, old_value, new_value, changed_by, created_at FROM audit_log
+		WHERE entity_type = 'driver' AND entity_id = ? ORDER BY id`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var entries []map[string]interface{}
+	for rows.Next() {
+		var id sql.NullInt64
+		var action, field, oldValue, newValue, changedBy, createdAt sql.NullString
+
+		if err := rows.Scan(&id, &action, &field, &oldValue, &newValue, &changedBy, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		entries = append(entries, map[string]interface{}{
+			"id":         id.Int64,
+			"action":     action.String,
+			"field":      field.String,
+			"old_value":  oldValue.String,
+			"new_value":  newValue.String,
+			"changed_by": changedBy.String,
+			"created_at": createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Driver performance and utilisation. Response and on-scene times come from
+// the job events the GPS simulator records (assigned, arrived, departed,
+// completed); distance from the driving log of each simulated route; revenue
+// from invoices on the driver's completed jobs; utilisation is time on jobs
+// as a share of on-duty shift time.
+
+func recordJobEvent(jobID, driverID int64, event string, lat, lng float64) {
+	_, err := db.Exec(`INSERT INTO job_events (job_id, driver_id, event, latitude, longitude, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		jobID, driverID, event, lat, lng, simNow().Format(sqliteTimeLayout))
+	if err != nil {
+		log.Printf("Error recording %s event for job %d: %v", event, jobID, err)
+	}
+}
+
+// Event times for one job by one driver
+type jobTimeline struct {
+	JobID                                  int64
+	Assigned, Arrived, Departed, Completed time.Time
+}
+
+// Job timelines for a driver with any event inside [from, to]
+func loadJobTimelines(driverID int64, from, to time.Time) ([]*jobTimeline, error) {
+	rows, err := db.Query(`SELECT job_id, event, created_at FROM job_events
+		WHERE driver_id = ? AND job_id IN (SELECT job_id FROM job_events WHERE driver_id = ? AND created_at >= ? AND created_at < ?)
+		ORDER BY job_id, created_at`,
+		driverID, driverID, from.Format(sqliteTimeLayout), to.Format(sqliteTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var timelines []*jobTimeline
+	byJob := make(map[int64]*jobTimeline)
+	for rows.Next() {
+		var jobID int64
+		var event, createdAt string
+		if err := rows.Scan(&jobID, &event, &createdAt); err != nil {
+			return nil, err
+		}
+		at, ok := parseDBTime(createdAt)
+		if !ok {
+			continue
+		}
+		timeline, exists := byJob[jobID]
+		if !exists {
+			timeline = &jobTimeline{JobID: jobID}
+			byJob[jobID] = timeline
+			timelines = append(timelines, timeline)
+		}
+		// A reassigned job keeps the latest assignment
+		switch event {
+		case "assigned":
+			timeline.Assigned = at
+		case "arrived":
+			timeline.Arrived = at
+		case "departed":
+			timeline.Departed = at
+		case "completed":
+			timeline.Completed = at
+		}
+	}
+	return timelines, rows.Err()
+}
+
+func getDriverReport(w http.ResponseWriter, r *http.Request) {
+	now := simNow().Truncate(time.Second)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from, to := today.AddDate(0, 0, -29), today
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "to must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	rangeEnd := to.AddDate(0, 0, 1)
+	if rangeEnd.After(now) {
+		rangeEnd = now
+	}
+	fromStr, endStr := from.Format(sqliteTimeLayout), to.AddDate(0, 0, 1).Format(sqliteTimeLayout)
+
+	rows, err := db.Query(`SELECT id, name FROM drivers WHERE deleted_at IS NULL ORDER BY id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type driverRow struct {
+		id   int64
+		name string
+	}
+	var drivers []driverRow
+	for rows.Next() {
+		var d driverRow
+		if err := rows.Scan(&d.id, &d.name); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		drivers = append(drivers, d)
+	}
+	rows.Close()
+
+	report := []map[string]interface{}{}
+	var totalJobs int
+	var totalKm, totalRevenue float64
+	for _, d := range drivers {
+		var jobsCompleted int
+		var revenue float64
+		err := db.QueryRow(`SELECT COUNT(*),
+			COALESCE((SELECT SUM(i.amount) FROM invoices i JOIN jobs j ON j.id = i.job_id
+				WHERE j.assigned_driver_id = ? AND j.status = 'completed' AND j.completed_at >= ? AND j.completed_at < ?), 0)
+			FROM jobs WHERE assigned_driver_id = ? AND status = 'completed' AND completed_at >= ? AND completed_at < ?`,
+			d.id, fromStr, endStr, d.id, fromStr, endStr).Scan(&jobsCompleted, &revenue)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var km float64
+		err = db.QueryRow(`SELECT COALESCE(SUM(distance_km), 0) FROM driver_driving_log
+			WHERE driver_id = ? AND started_at >= ? AND started_at < ?`, d.id, fromStr, endStr).Scan(&km)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		intervals, err := loadDutyIntervals(d.id, from, rangeEnd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		onDutyHours := hoursWithin(intervals, "on_duty", from, rangeEnd)
+
+		timelines, err := loadJobTimelines(d.id, from, rangeEnd)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Averages over jobs with both events; busy time runs from assignment to
+		// completion (or now for jobs still in progress) while the driver was on duty
+		var responseTotal, onSceneTotal, busyHours float64
+		var responseCount, onSceneCount int
+		for _, job := range timelines {
+			if !job.Assigned.IsZero() && job.Arrived.After(job.Assigned) {
+				responseTotal += job.Arrived.Sub(job.Assigned).Minutes()
+				responseCount++
+			}
+			if !job.Arrived.IsZero() && job.Departed.After(job.Arrived) {
+				onSceneTotal += job.Departed.Sub(job.Arrived).Minutes()
+				onSceneCount++
+			}
+			if job.Assigned.IsZero() {
+				continue
+			}
+			start, end := job.Assigned, job.Completed
+			if end.IsZero() || end.After(rangeEnd) {
+				end = rangeEnd
+			}
+			if start.Before(from) {
+				start = from
+			}
+			busyHours += hoursWithin(intervals, "on_duty", start, end)
+		}
+
+		entry := map[string]interface{}{
+			"driver_id":            d.id,
+			"driver_name":          d.name,
+			"jobs_completed":       jobsCompleted,
+			"avg_response_minutes": nil,
+			"avg_on_scene_minutes": nil,
+			"km_driven":            math.Round(km*100) / 100,
+			"revenue":              roundCents(revenue),
+			"on_duty_hours":        roundHours(onDutyHours),
+			"job_hours":            roundHours(busyHours),
+			"utilisation_percent":  0.0,
+		}
+		if responseCount > 0 {
+			entry["avg_response_minutes"] = math.Round(responseTotal/float64(responseCount)*10) / 10
+		}
+		if onSceneCount > 0 {
+			entry["avg_on_scene_minutes"] = math.Round(onSceneTotal/float64(onSceneCount)*10) / 10
+		}
+		if onDutyHours > 0 {
+			entry["utilisation_percent"] = math.Round(busyHours/onDutyHours*1000) / 10
+		}
+		report = append(report, entry)
+
+		totalJobs += jobsCompleted
+		totalKm += km
+		totalRevenue += revenue
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":    from.Format("2006-01-02"),
+		"to":      to.Format("2006-01-02"),
+		"drivers": report,
+		"totals": map[string]interface{}{
+			"jobs_completed": totalJobs,
+			"km_driven":      math.Round(totalKm*100) / 100,
+			"revenue":        roundCents(totalRevenue),
+		},
+	})
+}
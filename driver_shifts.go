@@ -0,0 +1,416 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Driver shifts. Dispatch plans shifts ahead of time; drivers clock in and
+// out of them and take breaks. A driver's status is derived from the open
+// shift, any open break and whether they have an active job:
+// off_duty, available, on_job or on_break.
+
+// Drivers may clock in this long before a planned shift starts
+const shiftEarlyClockIn = 30 * time.Minute
+
+type driverShift struct {
+	ID             int64
+	ScheduledStart string
+	ScheduledEnd   string
+	ClockInAt      string
+	ClockOutAt     string
+	OnBreak        bool
+}
+
+// The shift the driver is currently clocked into, if any
+func openDriverShift(driverID interface{}) (*driverShift, error) {
+	var shift driverShift
+	var scheduledStart, scheduledEnd, clockInAt sql.NullString
+	var openBreaks int
+	err := db.QueryRow(`SELECT id, scheduled_start, scheduled_end, clock_in_at,
+		(SELECT COUNT(*) FROM driver_breaks b WHERE b.shift_id = driver_shifts.id AND b.ended_at IS NULL)
+		FROM driver_shifts WHERE driver_id = ? AND clock_in_at IS NOT NULL AND clock_out_at IS NULL
+		ORDER BY clock_in_at DESC LIMIT 1`, driverID).
+		Scan(&shift.ID, &scheduledStart, &scheduledEnd, &clockInAt, &openBreaks)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	shift.ScheduledStart, shift.ScheduledEnd, shift.ClockInAt = scheduledStart.String, scheduledEnd.String, clockInAt.String
+	shift.OnBreak = openBreaks > 0
+	return &shift, nil
+}
+
+// Number of assigned or in-progress jobs for the driver
+func activeJobCount(driverID interface{}) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM jobs WHERE assigned_driver_id = ? AND status IN ('assigned', 'in_progress')`, driverID).Scan(&count)
+	return count, err
+}
+
+// Derive off_duty, available, on_job or on_break for a driver
+func driverStatus(driverID interface{}) (string, *driverShift, error) {
+	shift, err := openDriverShift(driverID)
+	if err != nil || shift == nil {
+		return "off_duty", nil, err
+	}
+
+	if shift.OnBreak {
+		return "on_break", shift, nil
+	}
+
+	jobs, err := activeJobCount(driverID)
+	if err != nil {
+		return "", nil, err
+	}
+	if jobs > 0 {
+		return "on_job", shift, nil
+	}
+	return "available", shift, nil
+}
+
+func parseShiftTime(value interface{}) (time.Time, bool) {
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+func driverExists(driverID string) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM drivers WHERE id = ?`, driverID).Scan(&count)
+	return count > 0, err
+}
+
+func getShifts(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT s.id, s.driver_id, d.name, s.scheduled_start, s.scheduled_end, s.clock_in_at, s.clock_out_at, s.notes,
+		(SELECT COUNT(*) FROM driver_breaks b WHERE b.shift_id = s.id),
+		(SELECT COALESCE(SUM(strftime('%s', COALESCE(b.ended_at, ?)) - strftime('%s', b.started_at)), 0)
+			FROM driver_breaks b WHERE b.shift_id = s.id)
+		FROM driver_shifts s JOIN drivers d ON d.id = s.driver_id WHERE 1 = 1`
+	args := []interface{}{simNow().Format(sqliteTimeLayout)}
+
+	if driverID := mux.Vars(r)["id"]; driverID != "" {
+		query += ` AND s.driver_id = ?`
+		args = append(args, driverID)
+	} else if driverID := r.URL.Query().Get("driver_id"); driverID != "" {
+		query += ` AND s.driver_id = ?`
+		args = append(args, driverID)
+	}
+	if from := r.URL.Query().Get("from"); from != "" {
+		query += ` AND date(s.scheduled_end) >= date(?)`
+		args = append(args, from)
+	}
+	if to := r.URL.Query().Get("to"); to != "" {
+		query += ` AND date(s.scheduled_start) <= date(?)`
+		args = append(args, to)
+	}
+
+	rows, err := db.Query(query+` ORDER BY s.scheduled_start`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var shifts []map[string]interface{}
+	for rows.Next() {
+		var id, driverID, breaks, breakSeconds sql.NullInt64
+		var driverName, scheduledStart, scheduledEnd, clockInAt, clockOutAt, notes sql.NullString
+
+		err := rows.Scan(&id, &driverID, &driverName, &scheduledStart, &scheduledEnd, &clockInAt, &clockOutAt, &notes, &breaks, &breakSeconds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		status := "scheduled"
+		if clockOutAt.Valid {
+			status = "completed"
+		} else if clockInAt.Valid {
+			status = "in_progress"
+		}
+
+		shifts = append(shifts, map[string]interface{}{
+			"id":              id.Int64,
+			"driver_id":       driverID.Int64,
+			"driver_name":     driverName.String,
+			"scheduled_start": scheduledStart.String,
+			"scheduled_end":   scheduledEnd.String,
+			"clock_in_at":     clockInAt.String,
+			"clock_out_at":    clockOutAt.String,
+			"status":          status,
+			"breaks":          breaks.Int64,
+			"break_minutes":   breakSeconds.Int64 / 60,
+			"notes":           notes.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shifts)
+}
+
+// Plan a shift for a driver. Shifts for the same driver may not overlap.
+func createShift(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var shift map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&shift); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start, startOK := parseShiftTime(shift["scheduled_start"])
+	end, endOK := parseShiftTime(shift["scheduled_end"])
+	if !startOK || !endOK {
+		http.Error(w, "scheduled_start and scheduled_end must be RFC3339 timestamps", http.StatusBadRequest)
+		return
+	}
+	if !end.After(start) {
+		http.Error(w, "scheduled_end must be after scheduled_start", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := driverExists(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	var overlapping int
+	db.QueryRow(`SELECT COUNT(*) FROM driver_shifts WHERE driver_id = ? AND clock_out_at IS NULL
+		AND scheduled_start < ? AND scheduled_end > ?`,
+		vars["id"], end.Format(sqliteTimeLayout), start.Format(sqliteTimeLayout)).Scan(&overlapping)
+	if overlapping > 0 {
+		http.Error(w, "Shift overlaps another shift for this driver", http.StatusConflict)
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO driver_shifts (driver_id, scheduled_start, scheduled_end, notes) VALUES (?, ?, ?, ?)`,
+		vars["id"], start.Format(sqliteTimeLayout), end.Format(sqliteTimeLayout), shift["notes"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": id})
+}
+
+// Cancel a planned shift that has not started
+func deleteShift(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var clockInAt sql.NullString
+	err := db.QueryRow(`SELECT clock_in_at FROM driver_shifts WHERE id = ?`, vars["id"]).Scan(&clockInAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Shift not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if clockInAt.Valid {
+		http.Error(w, "Shift has already started", http.StatusConflict)
+		return
+	}
+
+	if _, err := db.Exec(`DELETE FROM driver_shifts WHERE id = ?`, vars["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Clock into the planned shift covering now
+func clockIn(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var isActive bool
+	err := db.QueryRow(`SELECT is_active FROM drivers WHERE id = ?`, vars["id"]).Scan(&isActive)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !isActive {
+		http.Error(w, "Driver is not active", http.StatusBadRequest)
+		return
+	}
+
+	if shift, err := openDriverShift(vars["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if shift != nil {
+		http.Error(w, "Driver is already clocked in", http.StatusConflict)
+		return
+	}
+
+	now := simNow()
+	var shiftID int64
+	err = db.QueryRow(`SELECT id FROM driver_shifts WHERE driver_id = ? AND clock_in_at IS NULL
+		AND scheduled_start <= ? AND scheduled_end > ? ORDER BY scheduled_start LIMIT 1`,
+		vars["id"], now.Add(shiftEarlyClockIn).Format(sqliteTimeLayout), now.Format(sqliteTimeLayout)).Scan(&shiftID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Driver has no scheduled shift starting now", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE driver_shifts SET clock_in_at = ? WHERE id = ?`, now.Format(sqliteTimeLayout), shiftID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"shift_id": shiftID, "status": "available"})
+}
+
+// Clock out of the open shift. Drivers with an active job must finish it first.
+func clockOut(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	shift, err := openDriverShift(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if shift == nil {
+		http.Error(w, "Driver is not clocked in", http.StatusConflict)
+		return
+	}
+
+	if jobs, err := activeJobCount(vars["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if jobs > 0 {
+		http.Error(w, "Driver has an active job", http.StatusConflict)
+		return
+	}
+
+	now := simNow().Format(sqliteTimeLayout)
+	db.Exec(`UPDATE driver_breaks SET ended_at = ? WHERE shift_id = ? AND ended_at IS NULL`, now, shift.ID)
+	_, err = db.Exec(`UPDATE driver_shifts SET clock_out_at = ? WHERE id = ?`, now, shift.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"shift_id": shift.ID, "status": "off_duty"})
+}
+
+func startBreak(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	status, shift, err := driverStatus(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch status {
+	case "off_duty":
+		http.Error(w, "Driver is not clocked in", http.StatusConflict)
+		return
+	case "on_break":
+		http.Error(w, "Driver is already on a break", http.StatusConflict)
+		return
+	case "on_job":
+		http.Error(w, "Driver has an active job", http.StatusConflict)
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO driver_breaks (shift_id, started_at) VALUES (?, ?)`, shift.ID, simNow().Format(sqliteTimeLayout))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"break_id": id, "status": "on_break"})
+}
+
+func endBreak(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	shift, err := openDriverShift(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if shift == nil || !shift.OnBreak {
+		http.Error(w, "Driver is not on a break", http.StatusConflict)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE driver_breaks SET ended_at = ? WHERE shift_id = ? AND ended_at IS NULL`,
+		simNow().Format(sqliteTimeLayout), shift.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status, _, _ := driverStatus(vars["id"])
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+func getDriverStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	exists, err := driverExists(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	status, shift, err := driverStatus(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	driverID, _ := strconv.ParseInt(vars["id"], 10, 64)
+	response := map[string]interface{}{"driver_id": driverID, "status": status}
+	if shift != nil {
+		response["shift"] = map[string]interface{}{
+			"id":              shift.ID,
+			"scheduled_start": shift.ScheduledStart,
+			"scheduled_end":   shift.ScheduledEnd,
+			"clock_in_at":     shift.ClockInAt,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fuel and emissions. Each vehicle type has a fuel economy profile for
+// driving empty (to the job) and towing (back from it). Every simulated leg
+// burns fuel from the truck's tank at the current price for its fuel type;
+// a truck coming back below a quarter tank is refuelled at the yard.
+
+const fuelRefillThreshold = 0.25 // share of the tank left before the yard refuels a returning truck
+
+type fuelProfile struct {
+	VehicleType     string  `json:"vehicle_type"`
+	FuelType        string  `json:"fuel_type"`
+	EmptyLPer100Km  float64 `json:"empty_l_per_100km"`
+	TowingLPer100Km float64 `json:"towing_l_per_100km"`
+	TankCapacityL   float64 `json:"tank_capacity_l"`
+	CO2KgPerL       float64 `json:"co2_kg_per_l"`
+	PricePerLitre   float64 `json:"price_per_litre"`
+}
+
+func roundLitres(litres float64) float64 {
+	return math.Round(litres*100) / 100
+}
+
+// A vehicle's fuel profile, current price and tank level (a full tank if never recorded)
+func vehicleFuelState(vehicleID int64) (*fuelProfile, float64, error) {
+	var profile fuelProfile
+	var level sql.NullFloat64
+	err := db.QueryRow(`SELECT p.vehicle_type, p.fuel_type, p.empty_l_per_100km, p.towing_l_per_100km, p.tank_capacity_l, p.co2_kg_per_l,
+		COALESCE(f.price_per_litre, 0), v.fuel_level_l
+		FROM fleet_vehicles v JOIN fuel_profiles p ON p.vehicle_type = v.vehicle_type
+		LEFT JOIN fuel_prices f ON f.fuel_type = p.fuel_type
+		WHERE v.id = ?`, vehicleID).
+		Scan(&profile.VehicleType, &profile.FuelType, &profile.EmptyLPer100Km, &profile.TowingLPer100Km, &profile.TankCapacityL,
+			&profile.CO2KgPerL, &profile.PricePerLitre, &level)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !level.Valid {
+		return &profile, profile.TankCapacityL, nil
+	}
+	return &profile, level.Float64, nil
+}
+
+// Burn fuel for a finished leg: empty on the way to the job, towing on the way back
+func recordFuelBurn(activeJob *ActiveJob, leg string, distance float64) {
+	profile, _, err := vehicleFuelState(activeJob.VehicleID)
+	if err == sql.ErrNoRows {
+		return // no profile for this vehicle type
+	} else if err != nil {
+		log.Printf("Error loading fuel profile for vehicle %d: %v", activeJob.VehicleID, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error logging fuel for job %d: %v", activeJob.JobID, err)
+		return
+	}
+	defer tx.Rollback()
+
+	level, err := lockFuelLevel(tx, activeJob.VehicleID, profile.TankCapacityL)
+	if err != nil {
+		log.Printf("Error loading fuel level for vehicle %d: %v", activeJob.VehicleID, err)
+		return
+	}
+
+	towing := leg == "return"
+	rate := profile.EmptyLPer100Km
+	if towing {
+		rate = profile.TowingLPer100Km
+	}
+	// A truck cannot burn more than is left in the tank
+	litres := roundLitres(math.Min(distance*rate/100, level))
+	level = roundLitres(level - litres)
+	now := simNow().Format(sqliteTimeLayout)
+
+	_, err = tx.Exec(`INSERT INTO fuel_log (vehicle_id, job_id, leg, towing, distance_km, litres, cost, co2_kg, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		activeJob.VehicleID, activeJob.JobID, leg, towing, distance, litres,
+		roundCents(litres*profile.PricePerLitre), roundLitres(litres*profile.CO2KgPerL), now)
+	if err != nil {
+		log.Printf("Error logging fuel for job %d: %v", activeJob.JobID, err)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE fleet_vehicles SET fuel_level_l = ? WHERE id = ?`, level, activeJob.VehicleID); err != nil {
+		log.Printf("Error updating fuel level for vehicle %d: %v", activeJob.VehicleID, err)
+		return
+	}
+
+	// Back at the yard with a low tank: fill up
+	refill := 0.0
+	if towing && level < profile.TankCapacityL*fuelRefillThreshold {
+		refill = roundLitres(profile.TankCapacityL - level)
+		if err := insertRefuel(tx, activeJob.VehicleID, refill, profile.PricePerLitre, "Yard", true); err != nil {
+			log.Printf("Error refuelling vehicle %d: %v", activeJob.VehicleID, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error logging fuel for job %d: %v", activeJob.JobID, err)
+		return
+	}
+	if refill > 0 {
+		log.Printf("Vehicle %d refuelled with %.2f L at the yard", activeJob.VehicleID, refill)
+	}
+}
+
+// The tank level inside a fuel transaction, storing a full tank when none was
+// ever recorded. That first write takes the database write lock, so other
+// fuel changes wait for this transaction instead of working from a stale level.
+func lockFuelLevel(tx *sql.Tx, vehicleID int64, tankCapacity float64) (float64, error) {
+	if _, err := tx.Exec(`UPDATE fleet_vehicles SET fuel_level_l = COALESCE(fuel_level_l, ?) WHERE id = ?`, tankCapacity, vehicleID); err != nil {
+		return 0, err
+	}
+	var level float64
+	err := tx.QueryRow(`SELECT fuel_level_l FROM fleet_vehicles WHERE id = ?`, vehicleID).Scan(&level)
+	return level, err
+}
+
+func insertRefuel(tx *sql.Tx, vehicleID int64, litres, pricePerLitre float64, location string, automatic bool) error {
+	_, err := tx.Exec(`INSERT INTO fuel_refuels (vehicle_id, litres, price_per_litre, cost, location, automatic, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		vehicleID, litres, pricePerLitre, roundCents(litres*pricePerLitre), location, automatic, simNow().Format(sqliteTimeLayout))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE fleet_vehicles SET fuel_level_l = COALESCE(fuel_level_l, 0) + ? WHERE id = ?`, litres, vehicleID)
+	return err
+}
+
+func getFuelProfiles(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT p.vehicle_type, p.fuel_type, p.empty_l_per_100km, p.towing_l_per_100km, p.tank_capacity_l, p.co2_kg_per_l,
+		COALESCE(f.price_per_litre, 0)
+		FROM fuel_profiles p LEFT JOIN fuel_prices f ON f.fuel_type = p.fuel_type ORDER BY p.vehicle_type`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	profiles := []fuelProfile{}
+	for rows.Next() {
+		var p fuelProfile
+		if err := rows.Scan(&p.VehicleType, &p.FuelType, &p.EmptyLPer100Km, &p.TowingLPer100Km, &p.TankCapacityL, &p.CO2KgPerL, &p.PricePerLitre); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		profiles = append(profiles, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+}
+
+// Create or change the fuel economy profile for a vehicle type
+func updateFuelProfile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var profile map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	db.QueryRow(`SELECT COUNT(*) FROM fuel_profiles WHERE vehicle_type = ?`, vars["vehicleType"]).Scan(&exists)
+
+	values := map[string]interface{}{}
+	for _, field := range []string{"empty_l_per_100km", "towing_l_per_100km", "tank_capacity_l", "co2_kg_per_l"} {
+		value, ok := profile[field]
+		if !ok {
+			if exists == 0 {
+				http.Error(w, field+" is required", http.StatusBadRequest)
+				return
+			}
+			continue
+		}
+		number, isNumber := value.(float64)
+		if !isNumber || number <= 0 {
+			http.Error(w, field+" must be a positive number", http.StatusBadRequest)
+			return
+		}
+		values[field] = number
+	}
+	if value, ok := profile["fuel_type"]; ok {
+		fuelType, _ := value.(string)
+		var known int
+		db.QueryRow(`SELECT COUNT(*) FROM fuel_prices WHERE fuel_type = ?`, fuelType).Scan(&known)
+		if known == 0 {
+			http.Error(w, "Unknown fuel_type", http.StatusBadRequest)
+			return
+		}
+		values["fuel_type"] = fuelType
+	} else if exists == 0 {
+		values["fuel_type"] = "diesel"
+	}
+
+	var err error
+	if exists == 0 {
+		_, err = db.Exec(`INSERT INTO fuel_profiles (vehicle_type, fuel_type, empty_l_per_100km, towing_l_per_100km, tank_capacity_l, co2_kg_per_l)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			vars["vehicleType"], values["fuel_type"], values["empty_l_per_100km"], values["towing_l_per_100km"],
+			values["tank_capacity_l"], values["co2_kg_per_l"])
+	} else {
+		_, err = db.Exec(`UPDATE fuel_profiles SET fuel_type = COALESCE(?, fuel_type),
+			empty_l_per_100km = COALESCE(?, empty_l_per_100km), towing_l_per_100km = COALESCE(?, towing_l_per_100km),
+			tank_capacity_l = COALESCE(?, tank_capacity_l), co2_kg_per_l = COALESCE(?, co2_kg_per_l) WHERE vehicle_type = ?`,
+			values["fuel_type"], values["empty_l_per_100km"], values["towing_l_per_100km"],
+			values["tank_capacity_l"], values["co2_kg_per_l"], vars["vehicleType"])
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func getFuelPrices(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT fuel_type, price_per_litre FROM fuel_prices ORDER BY fuel_type`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var prices []map[string]interface{}
+	for rows.Next() {
+		var fuelType string
+		var price float64
+		if err := rows.Scan(&fuelType, &price); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		prices = append(prices, map[string]interface{}{"fuel_type": fuelType, "price_per_litre": price})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prices)
+}
+
+func updateFuelPrice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var body struct {
+		PricePerLitre float64 `json:"price_per_litre"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.PricePerLitre <= 0 {
+		http.Error(w, "price_per_litre must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO fuel_prices (fuel_type, price_per_litre) VALUES (?, ?)
+		ON CONFLICT(fuel_type) DO UPDATE SET price_per_litre = excluded.price_per_litre`, vars["fuelType"], body.PricePerLitre)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Tank level, fuel burned per leg and refuels for one vehicle
+func getVehicleFuel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	vehicleID, err := parseVehicleID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	profile, level, err := vehicleFuelState(vehicleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No fuel profile for this vehicle type", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	legs, totals, err := loadFuelLog(`vehicle_id = ?`, vehicleID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, litres, price_per_litre, cost, location, automatic, created_at
+		FROM fuel_refuels WHERE vehicle_id = ? ORDER BY id DESC`, vehicleID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	refuels := []map[string]interface{}{}
+	for rows.Next() {
+		var id int64
+		var litres, price, cost float64
+		var location, createdAt sql.NullString
+		var automatic bool
+		if err := rows.Scan(&id, &litres, &price, &cost, &location, &automatic, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		refuels = append(refuels, map[string]interface{}{
+			"id":              id,
+			"litres":          litres,
+			"price_per_litre": price,
+			"cost":            cost,
+			"location":        location.String,
+			"automatic":       automatic,
+			"created_at":      createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"vehicle_id":     vehicleID,
+		"profile":        profile,
+		"fuel_level_l":   roundLitres(level),
+		"fuel_level_pct": math.Round(level/profile.TankCapacityL*1000) / 10,
+		"totals":         totals,
+		"legs":           legs,
+		"refuels":        refuels,
+	})
+}
+
+// Fuel burned and emissions for one job
+func getJobFuel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var jobID int64
+	err := db.QueryRow(`SELECT id FROM jobs WHERE id = ?`, vars["id"]).Scan(&jobID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	legs, totals, err := loadFuelLog(`job_id = ?`, jobID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id": jobID,
+		"totals": totals,
+		"legs":   legs,
+	})
+}
+
+// Fuel log rows matching a condition on fuel_log, with their totals
+func loadFuelLog(where string, args ...interface{}) ([]map[string]interface{}, map[string]float64, error) {
+	rows, err := db.Query(`SELECT id, vehicle_id, job_id, leg, towing, distance_km, litres, cost, co2_kg, created_at
+		FROM fuel_log WHERE `+where+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	legs := []map[string]interface{}{}
+	totals := map[string]float64{"distance_km": 0, "litres": 0, "cost": 0, "co2_kg": 0}
+	for rows.Next() {
+		var id, vehicleID int64
+		var jobID sql.NullInt64
+		var leg, createdAt sql.NullString
+		var towing bool
+		var distance, litres, cost, co2 float64
+		if err := rows.Scan(&id, &vehicleID, &jobID, &leg, &towing, &distance, &litres, &cost, &co2, &createdAt); err != nil {
+			return nil, nil, err
+		}
+		legs = append(legs, map[string]interface{}{
+			"id":          id,
+			"vehicle_id":  vehicleID,
+			"job_id":      jobID.Int64,
+			"leg":         leg.String,
+			"towing":      towing,
+			"distance_km": distance,
+			"litres":      litres,
+			"cost":        cost,
+			"co2_kg":      co2,
+			"created_at":  createdAt.String,
+		})
+		totals["distance_km"] += distance
+		totals["litres"] += litres
+		totals["cost"] += cost
+		totals["co2_kg"] += co2
+	}
+	for key, value := range totals {
+		totals[key] = roundLitres(value)
+	}
+	return legs, totals, rows.Err()
+}
+
+// Manual refuel: {"litres": 120} or a fill-up when litres is left out
+func refuelVehicle(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var refuel map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&refuel); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vehicleID, err := parseVehicleID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	profile, _, err := vehicleFuelState(vehicleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No fuel profile for this vehicle type", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Free space is worked out and filled in one transaction so concurrent
+	// refuels cannot overfill the tank
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	level, err := lockFuelLevel(tx, vehicleID, profile.TankCapacityL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	space := roundLitres(profile.TankCapacityL - level)
+	litres := space
+	if value, ok := refuel["litres"]; ok {
+		amount, isNumber := value.(float64)
+		if !isNumber || amount <= 0 {
+			http.Error(w, "litres must be a positive number", http.StatusBadRequest)
+			return
+		}
+		if amount > space {
+			http.Error(w, fmt.Sprintf("litres exceeds the %.2f L of free tank capacity", space), http.StatusBadRequest)
+			return
+		}
+		litres = amount
+	}
+	if litres <= 0 {
+		http.Error(w, "Tank is already full", http.StatusConflict)
+		return
+	}
+
+	price := profile.PricePerLitre
+	if value, ok := refuel["price_per_litre"]; ok {
+		amount, isNumber := value.(float64)
+		if !isNumber || amount <= 0 {
+			http.Error(w, "price_per_litre must be a positive number", http.StatusBadRequest)
+			return
+		}
+		price = amount
+	}
+	location, _ := refuel["location"].(string)
+
+	if err := insertRefuel(tx, vehicleID, litres, price, location, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"vehicle_id":   vehicleID,
+		"litres":       litres,
+		"cost":         roundCents(litres * price),
+		"fuel_level_l": roundLitres(level + litres),
+	})
+}
+
+// Fuel and CO2 per vehicle for ?from=&to= (default the last 30 days)
+func getSustainabilityReport(w http.ResponseWriter, r *http.Request) {
+	now := simNow()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from, to := today.AddDate(0, 0, -29), today
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "to must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`SELECT v.id, v.license_plate, v.vehicle_type,
+		COALESCE(SUM(f.distance_km), 0), COALESCE(SUM(f.litres), 0), COALESCE(SUM(f.cost), 0), COALESCE(SUM(f.co2_kg), 0),
+		COUNT(DISTINCT f.job_id)
+		FROM fleet_vehicles v LEFT JOIN fuel_log f ON f.vehicle_id = v.id AND f.created_at >= ? AND f.created_at < ?
+		GROUP BY v.id ORDER BY v.id`,
+		from.Format(sqliteTimeLayout), to.AddDate(0, 0, 1).Format(sqliteTimeLayout))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	vehicles := []map[string]interface{}{}
+	var totalKm, totalLitres, totalCost, totalCO2 float64
+	var totalJobs int
+	for rows.Next() {
+		var id int64
+		var plate, vehicleType sql.NullString
+		var km, litres, cost, co2 float64
+		var jobs int
+		if err := rows.Scan(&id, &plate, &vehicleType, &km, &litres, &cost, &co2, &jobs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		vehicle := map[string]interface{}{
+			"vehicle_id":     id,
+			"license_plate":  plate.String,
+			"vehicle_type":   vehicleType.String,
+			"distance_km":    roundLitres(km),
+			"litres":         roundLitres(litres),
+			"fuel_cost":      roundCents(cost),
+			"co2_kg":         roundLitres(co2),
+			"jobs":           jobs,
+			"l_per_100km":    nil,
+			"co2_kg_per_job": nil,
+		}
+		if km > 0 {
+			vehicle["l_per_100km"] = roundLitres(litres / km * 100)
+		}
+		if jobs > 0 {
+			vehicle["co2_kg_per_job"] = roundLitres(co2 / float64(jobs))
+		}
+		vehicles = append(vehicles, vehicle)
+
+		totalKm += km
+		totalLitres += litres
+		totalCost += cost
+		totalCO2 += co2
+		totalJobs += jobs
+	}
+
+	totals := map[string]interface{}{
+		"distance_km":    roundLitres(totalKm),
+		"litres":         roundLitres(totalLitres),
+		"fuel_cost":      roundCents(totalCost),
+		"co2_kg":         roundLitres(totalCO2),
+		"jobs":           totalJobs,
+		"co2_kg_per_job": nil,
+	}
+	if totalJobs > 0 {
+		totals["co2_kg_per_job"] = roundLitres(totalCO2 / float64(totalJobs))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"vehicles": vehicles,
+		"totals":   totals,
+	})
+}
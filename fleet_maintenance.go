@@ -0,0 +1,477 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fleet maintenance. Each vehicle has service schedules with an interval in
+// km, days or both, counted from the last maintenance record of that type
+// (or from when the vehicle was acquired). The odometer grows with every
+// simulated leg. A truck with an overdue service is taken out of service
+// once it is off its current job and put back when the service is recorded.
+
+const (
+	maintenanceOverduePrefix = "Service overdue: "
+	maintenanceDueSoonKm     = 500.0
+	maintenanceDueSoonDays   = 14
+)
+
+type serviceDue struct {
+	ScheduleID      int64    `json:"schedule_id"`
+	ServiceType     string   `json:"service_type"`
+	IntervalKm      *float64 `json:"interval_km"`
+	IntervalDays    *int64   `json:"interval_days"`
+	LastServiceDate string   `json:"last_service_date"`
+	LastOdometerKm  float64  `json:"last_service_odometer_km"`
+	DueOdometerKm   *float64 `json:"due_odometer_km"`
+	DueDate         string   `json:"due_date,omitempty"`
+	Status          string   `json:"status"`
+}
+
+// Add a finished leg's distance to the truck's odometer and burn its fuel
+func recordVehicleLeg(activeJob *ActiveJob, leg string, steps []GPSCoordinate) {
+	if activeJob.VehicleID == 0 {
+		return
+	}
+	distance := math.Round(routeDistance(steps)*100) / 100
+	_, err := db.Exec(`UPDATE fleet_vehicles SET odometer_km = COALESCE(odometer_km, 0) + ? WHERE id = ?`, distance, activeJob.VehicleID)
+	if err != nil {
+		log.Printf("Error updating odometer for vehicle %d: %v", activeJob.VehicleID, err)
+	}
+	recordFuelBurn(activeJob, leg, distance)
+}
+
+// Active service schedules for a vehicle with when each is next due
+func loadServiceDue(vehicleID int64, asOf time.Time) ([]serviceDue, float64, error) {
+	var odometer float64
+	var acquired sql.NullString
+	err := db.QueryRow(`SELECT COALESCE(odometer_km, 0), date_acquired FROM fleet_vehicles WHERE id = ?`, vehicleID).Scan(&odometer, &acquired)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`SELECT s.id, s.service_type, s.interval_km, s.interval_days,
+		(SELECT m.service_date FROM maintenance_records m WHERE m.vehicle_id = s.vehicle_id AND m.service_type = s.service_type ORDER BY m.service_date DESC, m.id DESC LIMIT 1),
+		(SELECT m.odometer_km FROM maintenance_records m WHERE m.vehicle_id = s.vehicle_id AND m.service_type = s.service_type ORDER BY m.service_date DESC, m.id DESC LIMIT 1)
+		FROM maintenance_schedules s WHERE s.vehicle_id = ? AND s.is_active = 1 ORDER BY s.service_type`, vehicleID)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	today := time.Date(asOf.Year(), asOf.Month(), asOf.Day(), 0, 0, 0, 0, time.UTC)
+	var schedules []serviceDue
+	for rows.Next() {
+		var due serviceDue
+		var intervalKm, lastOdometer sql.NullFloat64
+		var intervalDays sql.NullInt64
+		var lastDate sql.NullString
+		if err := rows.Scan(&due.ScheduleID, &due.ServiceType, &intervalKm, &intervalDays, &lastDate, &lastOdometer); err != nil {
+			return nil, 0, err
+		}
+
+		// Never serviced: count from acquisition at zero km
+		since := lastDate.String
+		if !lastDate.Valid {
+			since = acquired.String
+		}
+		due.LastServiceDate = formatDBDate(since)
+		due.LastOdometerKm = lastOdometer.Float64
+		due.Status = "ok"
+
+		if intervalKm.Valid && intervalKm.Float64 > 0 {
+			km := intervalKm.Float64
+			dueAt := due.LastOdometerKm + km
+			due.IntervalKm, due.DueOdometerKm = &km, &dueAt
+			if odometer >= dueAt {
+				due.Status = "overdue"
+			} else if dueAt-odometer <= maintenanceDueSoonKm {
+				due.Status = "due_soon"
+			}
+		}
+		if intervalDays.Valid && intervalDays.Int64 > 0 {
+			days := intervalDays.Int64
+			due.IntervalDays = &days
+			if last, ok := parseDBTime(since); ok {
+				dueDate := last.AddDate(0, 0, int(days))
+				due.DueDate = dueDate.Format("2006-01-02")
+				if !dueDate.After(today) {
+					due.Status = "overdue"
+				} else if due.Status == "ok" && !dueDate.After(today.AddDate(0, 0, maintenanceDueSoonDays)) {
+					due.Status = "due_soon"
+				}
+			}
+		}
+		schedules = append(schedules, due)
+	}
+	return schedules, odometer, rows.Err()
+}
+
+// Take a vehicle out of service when a service is overdue (unless it is on a
+// job) and put it back once nothing is overdue. Manually set reasons are left alone.
+func refreshMaintenanceStatus(vehicleID int64) error {
+	var reason sql.NullString
+	if err := db.QueryRow(`SELECT out_of_service_reason FROM fleet_vehicles WHERE id = ?`, vehicleID).Scan(&reason); err != nil {
+		return err
+	}
+	if reason.String != "" && !strings.HasPrefix(reason.String, maintenanceOverduePrefix) {
+		return nil
+	}
+
+	schedules, _, err := loadServiceDue(vehicleID, simNow())
+	if err != nil {
+		return err
+	}
+	var overdue []string
+	for _, due := range schedules {
+		if due.Status == "overdue" {
+			overdue = append(overdue, due.ServiceType)
+		}
+	}
+
+	if len(overdue) == 0 {
+		if reason.String != "" {
+			log.Printf("Vehicle %d back in service", vehicleID)
+			_, err = db.Exec(`UPDATE fleet_vehicles SET out_of_service_reason = NULL WHERE id = ?`, vehicleID)
+		}
+		return err
+	}
+
+	newReason := maintenanceOverduePrefix + strings.Join(overdue, ", ")
+	if newReason == reason.String {
+		return nil
+	}
+	jobIDs, err := vehicleActiveJobIDs(vehicleID)
+	if err != nil || len(jobIDs) > 0 {
+		return err
+	}
+	log.Printf("Vehicle %d out of service: %s", vehicleID, newReason)
+	_, err = db.Exec(`UPDATE fleet_vehicles SET out_of_service_reason = ? WHERE id = ?`, newReason, vehicleID)
+	return err
+}
+
+// Maintenance check worker
+func maintenanceWorker() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Fleet maintenance check started")
+
+	checkMaintenanceDue()
+	for range ticker.C {
+		checkMaintenanceDue()
+	}
+}
+
+func checkMaintenanceDue() {
+	rows, err := db.Query(`SELECT id FROM fleet_vehicles WHERE is_active = 1`)
+	if err != nil {
+		log.Printf("Error loading fleet vehicles: %v", err)
+		return
+	}
+	var vehicleIDs []int64
+	for rows.Next() {
+		var id int64
+		rows.Scan(&id)
+		vehicleIDs = append(vehicleIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range vehicleIDs {
+		if err := refreshMaintenanceStatus(id); err != nil {
+			log.Printf("Error checking maintenance for vehicle %d: %v", id, err)
+		}
+	}
+}
+
+func getVehicleMaintenance(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	vehicleID, err := parseVehicleID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	schedules, odometer, err := loadServiceDue(vehicleID, simNow())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, service_type, service_date, odometer_km, cost, notes, performed_by
+		FROM maintenance_records WHERE vehicle_id = ? ORDER BY service_date DESC, id DESC`, vehicleID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		var id sql.NullInt64
+		var serviceType, serviceDate, notes, performedBy sql.NullString
+		var recordOdometer, cost sql.NullFloat64
+
+		if err := rows.Scan(&id, &serviceType, &serviceDate, &recordOdometer, &cost, &notes, &performedBy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		records = append(records, map[string]interface{}{
+			"id":           id.Int64,
+			"service_type": serviceType.String,
+			"service_date": formatDBDate(serviceDate.String),
+			"odometer_km":  recordOdometer.Float64,
+			"cost":         cost.Float64,
+			"notes":        notes.String,
+			"performed_by": performedBy.String,
+		})
+	}
+
+	var reason sql.NullString
+	db.QueryRow(`SELECT out_of_service_reason FROM fleet_vehicles WHERE id = ?`, vehicleID).Scan(&reason)
+
+	if schedules == nil {
+		schedules = []serviceDue{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"vehicle_id":            vehicleID,
+		"odometer_km":           math.Round(odometer*100) / 100,
+		"out_of_service_reason": reason.String,
+		"schedules":             schedules,
+		"records":               records,
+	})
+}
+
+// Resolve {id} to an existing vehicle, writing the error response if it is not one
+func parseVehicleID(w http.ResponseWriter, id string) (int64, error) {
+	var vehicleID int64
+	err := db.QueryRow(`SELECT id FROM fleet_vehicles WHERE id = ?`, id).Scan(&vehicleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return vehicleID, err
+}
+
+// Record a completed service. Resets the matching schedule and puts the
+// truck back in service if nothing else is overdue.
+func createMaintenanceRecord(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var record map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vehicleID, err := parseVehicleID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	serviceType, _ := record["service_type"].(string)
+	serviceType = strings.TrimSpace(serviceType)
+	if serviceType == "" {
+		http.Error(w, "service_type is required", http.StatusBadRequest)
+		return
+	}
+
+	serviceDate := simNow().Format("2006-01-02")
+	if value, ok := record["service_date"]; ok {
+		date, _ := value.(string)
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			http.Error(w, "service_date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		serviceDate = date
+	}
+
+	var odometer float64
+	db.QueryRow(`SELECT COALESCE(odometer_km, 0) FROM fleet_vehicles WHERE id = ?`, vehicleID).Scan(&odometer)
+	if value, ok := record["odometer_km"]; ok {
+		reading, isNumber := value.(float64)
+		if !isNumber || reading < 0 {
+			http.Error(w, "odometer_km must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		odometer = reading
+	}
+
+	cost := 0.0
+	if value, ok := record["cost"]; ok {
+		amount, isNumber := value.(float64)
+		if !isNumber || amount < 0 {
+			http.Error(w, "cost must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		cost = amount
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO maintenance_records (vehicle_id, service_type, service_date, odometer_km, cost, notes, performed_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		vehicleID, serviceType, serviceDate, odometer, roundCents(cost), record["notes"], record["performed_by"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A workshop reading ahead of the simulated odometer corrects it
+	if _, err := tx.Exec(`UPDATE fleet_vehicles SET odometer_km = MAX(COALESCE(odometer_km, 0), ?) WHERE id = ?`, odometer, vehicleID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := refreshMaintenanceStatus(vehicleID); err != nil {
+		log.Printf("Error checking maintenance for vehicle %d: %v", vehicleID, err)
+	}
+	var reason sql.NullString
+	db.QueryRow(`SELECT out_of_service_reason FROM fleet_vehicles WHERE id = ?`, vehicleID).Scan(&reason)
+
+	id, _ := result.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":                    id,
+		"in_service":            reason.String == "",
+		"out_of_service_reason": reason.String,
+	})
+}
+
+// Create or change a vehicle's service interval for one service type
+func updateMaintenanceSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var schedule map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&schedule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	vehicleID, err := parseVehicleID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	var intervalKm, intervalDays interface{}
+	if value, ok := schedule["interval_km"]; ok && value != nil {
+		km, isNumber := value.(float64)
+		if !isNumber || km <= 0 {
+			http.Error(w, "interval_km must be a positive number", http.StatusBadRequest)
+			return
+		}
+		intervalKm = km
+	}
+	if value, ok := schedule["interval_days"]; ok && value != nil {
+		days, isNumber := value.(float64)
+		if !isNumber || days < 1 || days != math.Trunc(days) {
+			http.Error(w, "interval_days must be a whole number of days", http.StatusBadRequest)
+			return
+		}
+		intervalDays = int(days)
+	}
+	if intervalKm == nil && intervalDays == nil {
+		http.Error(w, "interval_km or interval_days is required", http.StatusBadRequest)
+		return
+	}
+	isActive := true
+	if value, ok := schedule["is_active"].(bool); ok {
+		isActive = value
+	}
+
+	_, err = db.Exec(`INSERT INTO maintenance_schedules (vehicle_id, service_type, interval_km, interval_days, is_active) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(vehicle_id, service_type) DO UPDATE SET interval_km = excluded.interval_km,
+		interval_days = excluded.interval_days, is_active = excluded.is_active`,
+		vehicleID, vars["serviceType"], intervalKm, intervalDays, isActive)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := refreshMaintenanceStatus(vehicleID); err != nil {
+		log.Printf("Error checking maintenance for vehicle %d: %v", vehicleID, err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Services due soon or overdue across the fleet, optionally ?status=overdue
+func getMaintenanceDue(w http.ResponseWriter, r *http.Request) {
+	wanted := r.URL.Query().Get("status")
+	if wanted != "" && wanted != "overdue" && wanted != "due_soon" {
+		http.Error(w, "status must be overdue or due_soon", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, license_plate, vehicle_type, out_of_service_reason FROM fleet_vehicles WHERE is_active = 1 ORDER BY id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	type vehicleRow struct {
+		id                 int64
+		plate, vehicleType string
+		outOfServiceReason string
+	}
+	var vehicles []vehicleRow
+	for rows.Next() {
+		var v vehicleRow
+		var plate, vehicleType, reason sql.NullString
+		if err := rows.Scan(&v.id, &plate, &vehicleType, &reason); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		v.plate, v.vehicleType, v.outOfServiceReason = plate.String, vehicleType.String, reason.String
+		vehicles = append(vehicles, v)
+	}
+	rows.Close()
+
+	now := simNow()
+	due := []map[string]interface{}{}
+	for _, v := range vehicles {
+		schedules, odometer, err := loadServiceDue(v.id, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, schedule := range schedules {
+			if schedule.Status == "ok" || (wanted != "" && schedule.Status != wanted) {
+				continue
+			}
+			due = append(due, map[string]interface{}{
+				"vehicle_id":            v.id,
+				"license_plate":         v.plate,
+				"vehicle_type":          v.vehicleType,
+				"odometer_km":           math.Round(odometer*100) / 100,
+				"out_of_service_reason": v.outOfServiceReason,
+				"service":               schedule,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(due)
+}
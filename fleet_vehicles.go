@@ -0,0 +1,349 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fleet board. A vehicle is on a job while a job using it is assigned or in
+// progress, out of service while it has an out_of_service_reason, and idle
+// otherwise. Positions come from the GPS simulator: live for trucks on a
+// simulated job, else the last position recorded (the yard for idle trucks).
+
+const (
+	minVehicleYear     = 1950
+	maxVehicleCapacity = 100.0 // tons
+)
+
+// Jobs currently using a vehicle: simulated jobs plus any job still assigned
+// or in progress in the database
+func vehicleActiveJobIDs(vehicleID int64) ([]int64, error) {
+	seen := map[int64]bool{}
+	var jobIDs []int64
+
+	activeMutex.RLock()
+	for jobID, activeJob := range activeJobs {
+		if activeJob.VehicleID == vehicleID && !activeJob.Completed {
+			seen[jobID] = true
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	activeMutex.RUnlock()
+
+	rows, err := db.Query(`SELECT id FROM jobs WHERE assigned_vehicle_id = ? AND status IN ('assigned', 'in_progress') ORDER BY id`, vehicleID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobID int64
+		if err := rows.Scan(&jobID); err != nil {
+			return nil, err
+		}
+		if !seen[jobID] {
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	return jobIDs, rows.Err()
+}
+
+// Check a vehicle can take a job. Returns a problem message and HTTP status,
+// or an empty message when the vehicle is free.
+func vehicleAssignable(vehicleID int64) (string, int, error) {
+	// Catch a service that fell overdue since the last maintenance check
+	if err := refreshMaintenanceStatus(vehicleID); err != nil && err != sql.ErrNoRows {
+		return "", 0, err
+	}
+
+	var isActive bool
+	var outOfService sql.NullString
+	err := db.QueryRow(`SELECT is_active, out_of_service_reason FROM fleet_vehicles WHERE id = ?`, vehicleID).Scan(&isActive, &outOfService)
+	if err == sql.ErrNoRows {
+		return "Vehicle not found", http.StatusNotFound, nil
+	} else if err != nil {
+		return "", 0, err
+	}
+	if !isActive {
+		return "Vehicle is not active", http.StatusBadRequest, nil
+	}
+	if outOfService.String != "" {
+		return "Vehicle is out of service: " + outOfService.String, http.StatusConflict, nil
+	}
+
+	jobIDs, err := vehicleActiveJobIDs(vehicleID)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(jobIDs) > 0 {
+		return fmt.Sprintf("Vehicle is already on job %d", jobIDs[0]), http.StatusConflict, nil
+	}
+	return "", 0, nil
+}
+
+func normalizeFleetPlate(plate string) string {
+	return strings.ToUpper(strings.TrimSpace(plate))
+}
+
+func updateVehicle(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for field := range update {
+		switch field {
+		case "vehicle_type", "make", "model", "year", "license_plate", "capacity_tons", "is_active", "out_of_service_reason":
+		default:
+			http.Error(w, fmt.Sprintf("Unknown field %s", field), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var vehicleID int64
+	err := db.QueryRow(`SELECT id FROM fleet_vehicles WHERE id = ?`, vars["id"]).Scan(&vehicleID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// PUT replaces the vehicle's details, so all of them are required
+	if r.Method == http.MethodPut {
+		for _, field := range []string{"vehicle_type", "make", "model", "year", "license_plate", "capacity_tons"} {
+			if _, ok := update[field]; !ok {
+				http.Error(w, field+" is required", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	changes := map[string]interface{}{}
+	for _, field := range []string{"vehicle_type", "make", "model", "license_plate", "out_of_service_reason"} {
+		value, ok := update[field]
+		if !ok {
+			continue
+		}
+		text, isString := value.(string)
+		if !isString {
+			http.Error(w, field+" must be a string", http.StatusBadRequest)
+			return
+		}
+		text = strings.TrimSpace(text)
+		switch field {
+		case "vehicle_type":
+			if text == "" {
+				http.Error(w, "vehicle_type cannot be empty", http.StatusBadRequest)
+				return
+			}
+		case "license_plate":
+			text = normalizeFleetPlate(text)
+			if text == "" {
+				http.Error(w, "license_plate cannot be empty", http.StatusBadRequest)
+				return
+			}
+		}
+		if field == "out_of_service_reason" && text == "" {
+			changes[field] = nil
+		} else {
+			changes[field] = text
+		}
+	}
+
+	if value, ok := update["year"]; ok {
+		year, isNumber := value.(float64)
+		maxYear := simNow().Year() + 1
+		if !isNumber || year != math.Trunc(year) || int(year) < minVehicleYear || int(year) > maxYear {
+			http.Error(w, fmt.Sprintf("year must be a whole number between %d and %d", minVehicleYear, maxYear), http.StatusBadRequest)
+			return
+		}
+		changes["year"] = int(year)
+	}
+	if value, ok := update["capacity_tons"]; ok {
+		capacity, isNumber := value.(float64)
+		if !isNumber || capacity <= 0 || capacity > maxVehicleCapacity {
+			http.Error(w, fmt.Sprintf("capacity_tons must be greater than 0 and at most %.0f", maxVehicleCapacity), http.StatusBadRequest)
+			return
+		}
+		changes["capacity_tons"] = capacity
+	}
+	if value, ok := update["is_active"]; ok {
+		active, isBool := value.(bool)
+		if !isBool {
+			http.Error(w, "is_active must be a boolean", http.StatusBadRequest)
+			return
+		}
+		changes["is_active"] = active
+	}
+
+	// A truck cannot be retired or taken out of service in the middle of a job
+	takenOffRoad := changes["is_active"] == false
+	if reason, ok := changes["out_of_service_reason"]; ok && reason != nil {
+		takenOffRoad = true
+	}
+	if takenOffRoad {
+		jobIDs, err := vehicleActiveJobIDs(vehicleID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(jobIDs) > 0 {
+			writeActiveJobsConflict(w, "Vehicle is on an active job", jobIDs)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Plates are compared normalised; the unique index on the normalised plate
+	// catches a concurrent update that gets past the check
+	if plate, ok := changes["license_plate"]; ok {
+		var taken int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM fleet_vehicles WHERE UPPER(TRIM(license_plate)) = ? AND id != ?`, plate, vehicleID).Scan(&taken)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if taken > 0 {
+			http.Error(w, "license_plate is already used by another vehicle", http.StatusConflict)
+			return
+		}
+	}
+
+	for _, field := range []string{"vehicle_type", "make", "model", "year", "license_plate", "capacity_tons", "is_active", "out_of_service_reason"} {
+		value, ok := changes[field]
+		if !ok {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`UPDATE fleet_vehicles SET %s = ? WHERE id = ?`, field), value, vehicleID); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				http.Error(w, "license_plate is already used by another vehicle", http.StatusConflict)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	changed := make([]string, 0, len(changes))
+	for field := range changes {
+		changed = append(changed, field)
+	}
+	sort.Strings(changed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": vehicleID, "changed": changed})
+}
+
+// Live fleet board: every active vehicle with its status, driver and position
+func getActiveVehicles(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT v.id, v.vehicle_type, v.make, v.model, v.license_plate, v.out_of_service_reason,
+		v.last_latitude, v.last_longitude, v.last_position_at,
+		j.id, j.status, d.id, d.name
+		FROM fleet_vehicles v
+		LEFT JOIN jobs j ON j.id = (SELECT MAX(id) FROM jobs WHERE assigned_vehicle_id = v.id AND status IN ('assigned', 'in_progress'))
+		LEFT JOIN drivers d ON d.id = j.assigned_driver_id
+		WHERE v.is_active = 1 ORDER BY v.id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Snapshot the simulator so the lock is not held across the query
+	type livePosition struct {
+		jobID, driverID int64
+		lat, lng        float64
+		status          string
+	}
+	live := map[int64]livePosition{}
+	activeMutex.RLock()
+	for _, activeJob := range activeJobs {
+		if activeJob.VehicleID != 0 && !activeJob.Completed {
+			live[activeJob.VehicleID] = livePosition{activeJob.JobID, activeJob.DriverID, activeJob.CurrentLat, activeJob.CurrentLng, getJobStatus(activeJob)}
+		}
+	}
+	activeMutex.RUnlock()
+
+	wanted := r.URL.Query().Get("status")
+	vehicles := []map[string]interface{}{}
+	for rows.Next() {
+		var id int64
+		var vehicleType, vehicleMake, model, plate, outOfService, positionAt, jobStatus, driverName sql.NullString
+		var lat, lng sql.NullFloat64
+		var jobID, driverID sql.NullInt64
+
+		err := rows.Scan(&id, &vehicleType, &vehicleMake, &model, &plate, &outOfService, &lat, &lng, &positionAt,
+			&jobID, &jobStatus, &driverID, &driverName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		vehicle := map[string]interface{}{
+			"id":            id,
+			"vehicle_type":  vehicleType.String,
+			"make":          vehicleMake.String,
+			"model":         model.String,
+			"license_plate": plate.String,
+			"status":        "idle",
+			"job_id":        nil,
+			"driver":        nil,
+			"position":      nil,
+		}
+		if lat.Valid && lng.Valid {
+			vehicle["position"] = map[string]interface{}{"latitude": lat.Float64, "longitude": lng.Float64, "recorded_at": positionAt.String}
+		}
+
+		if position, ok := live[id]; ok {
+			vehicle["status"] = "on_job"
+			vehicle["job_id"] = position.jobID
+			vehicle["job_status"] = position.status
+			vehicle["position"] = map[string]interface{}{"latitude": position.lat, "longitude": position.lng, "recorded_at": simNow().Format(time.RFC3339)}
+			if !driverID.Valid || driverID.Int64 != position.driverID {
+				driverID = sql.NullInt64{Int64: position.driverID, Valid: true}
+				db.QueryRow(`SELECT name FROM drivers WHERE id = ?`, position.driverID).Scan(&driverName)
+			}
+		} else if jobID.Valid {
+			vehicle["status"] = "on_job"
+			vehicle["job_id"] = jobID.Int64
+			vehicle["job_status"] = jobStatus.String
+		} else if outOfService.String != "" {
+			vehicle["status"] = "out_of_service"
+			vehicle["out_of_service_reason"] = outOfService.String
+		}
+		if vehicle["status"] == "on_job" && driverID.Valid {
+			vehicle["driver"] = map[string]interface{}{"id": driverID.Int64, "name": driverName.String}
+		}
+
+		if wanted != "" && vehicle["status"] != wanted {
+			continue
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vehicles)
+}
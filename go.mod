@@ -2,9 +2,8 @@ module github.com/carsonkiibi/tow-mock-backend
 
 go 1.24.6
 
-require github.com/mattn/go-sqlite3 v1.14.32
-
 require (
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/mattn/go-sqlite3 v1.14.32
 )
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Hours of service. On-duty time comes from shift clock-ins less breaks;
+// driving time is logged per ActiveJob leg from the simulated route distance.
+// Each limit caps one of those over a rolling window. Drivers nearing a
+// limit get a warning over the GPS websocket; drivers over one cannot be
+// assigned.
+
+// Average speed used to turn a simulated leg's distance into driving time
+const hosAverageSpeedKmh = 50.0
+
+type dutyInterval struct {
+	Activity string    `json:"activity"`
+	JobID    int64     `json:"job_id,omitempty"`
+	Start    time.Time `json:"started_at"`
+	End      time.Time `json:"ended_at"`
+	Hours    float64   `json:"hours"`
+}
+
+type hosLimit struct {
+	Code           string  `json:"code"`
+	Description    string  `json:"description"`
+	Metric         string  `json:"metric"`
+	MaxHours       float64 `json:"max_hours"`
+	WindowHours    float64 `json:"window_hours"`
+	WarnRemaining  float64 `json:"warn_remaining_hours"`
+	UsedHours      float64 `json:"used_hours"`
+	RemainingHours float64 `json:"remaining_hours"`
+	Status         string  `json:"status"`
+}
+
+func roundHours(hours float64) float64 {
+	return math.Round(hours*100) / 100
+}
+
+// Length of a simulated route in km
+func routeDistance(steps []GPSCoordinate) float64 {
+	distance := 0.0
+	for i := 1; i < len(steps); i++ {
+		distance += calculateDistance(steps[i-1].Lat, steps[i-1].Lng, steps[i].Lat, steps[i].Lng)
+	}
+	return distance
+}
+
+// Log the driving time for a completed leg of a simulated job
+func recordDrivingLeg(activeJob *ActiveJob, leg string, steps []GPSCoordinate) {
+	distance := routeDistance(steps)
+
+	end := simNow()
+	start := end.Add(-time.Duration(distance / hosAverageSpeedKmh * float64(time.Hour)))
+	_, err := db.Exec(`INSERT INTO driver_driving_log (driver_id, job_id, leg, distance_km, started_at, ended_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		activeJob.DriverID, activeJob.JobID, leg, math.Round(distance*100)/100,
+		start.Format(sqliteTimeLayout), end.Format(sqliteTimeLayout))
+	if err != nil {
+		log.Printf("Error logging driving time for job %d: %v", activeJob.JobID, err)
+	}
+}
+
+// On-duty, break and driving intervals overlapping [from, to], clipped to it.
+// Open shifts and breaks run until to.
+func loadDutyIntervals(driverID interface{}, from, to time.Time) ([]dutyInterval, error) {
+	fromStr, toStr := from.Format(sqliteTimeLayout), to.Format(sqliteTimeLayout)
+
+	clip := func(activity string, jobID int64, startStr, endStr string) (dutyInterval, bool) {
+		start, ok := parseDBTime(startStr)
+		if !ok {
+			return dutyInterval{}, false
+		}
+		end, ok := parseDBTime(endStr)
+		if !ok || end.After(to) {
+			end = to
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if !end.After(start) {
+			return dutyInterval{}, false
+		}
+		return dutyInterval{Activity: activity, JobID: jobID, Start: start, End: end, Hours: roundHours(end.Sub(start).Hours())}, true
+	}
+
+	var intervals []dutyInterval
+
+	rows, err := db.Query(`SELECT s.id, s.clock_in_at, s.clock_out_at FROM driver_shifts s
+		WHERE s.driver_id = ? AND s.clock_in_at IS NOT NULL AND s.clock_in_at < ? AND (s.clock_out_at IS NULL OR s.clock_out_at > ?)
+		ORDER BY s.clock_in_at`, driverID, toStr, fromStr)
+	if err != nil {
+		return nil, err
+	}
+	type shiftSpan struct {
+		id            int64
+		start, finish string
+	}
+	var shifts []shiftSpan
+	for rows.Next() {
+		var s shiftSpan
+		var clockIn, clockOut sql.NullString
+		if err := rows.Scan(&s.id, &clockIn, &clockOut); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.start, s.finish = clockIn.String, clockOut.String
+		shifts = append(shifts, s)
+	}
+	rows.Close()
+
+	// Split each shift into on-duty stretches around its breaks
+	for _, shift := range shifts {
+		rows, err := db.Query(`SELECT started_at, ended_at FROM driver_breaks WHERE shift_id = ? ORDER BY started_at`, shift.id)
+		if err != nil {
+			return nil, err
+		}
+		cursor := shift.start
+		for rows.Next() {
+			var started, ended sql.NullString
+			if err := rows.Scan(&started, &ended); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if interval, ok := clip("on_duty", 0, cursor, started.String); ok {
+				intervals = append(intervals, interval)
+			}
+			if interval, ok := clip("break", 0, started.String, ended.String); ok {
+				intervals = append(intervals, interval)
+			}
+			cursor = ended.String
+			if !ended.Valid {
+				cursor = toStr
+			}
+		}
+		rows.Close()
+		if interval, ok := clip("on_duty", 0, cursor, shift.finish); ok {
+			intervals = append(intervals, interval)
+		}
+	}
+
+	rows, err = db.Query(`SELECT job_id, started_at, ended_at FROM driver_driving_log
+		WHERE driver_id = ? AND started_at < ? AND ended_at > ? ORDER BY started_at`, driverID, toStr, fromStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobID sql.NullInt64
+		var started, ended sql.NullString
+		if err := rows.Scan(&jobID, &started, &ended); err != nil {
+			return nil, err
+		}
+		if interval, ok := clip("driving", jobID.Int64, started.String, ended.String); ok {
+			intervals = append(intervals, interval)
+		}
+	}
+
+	return intervals, rows.Err()
+}
+
+// Hours of the given activity inside [from, to]
+func hoursWithin(intervals []dutyInterval, activity string, from, to time.Time) float64 {
+	total := 0.0
+	for _, interval := range intervals {
+		if interval.Activity != activity {
+			continue
+		}
+		start, end := interval.Start, interval.End
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			total += end.Sub(start).Hours()
+		}
+	}
+	return total
+}
+
+func loadHOSLimits() ([]hosLimit, error) {
+	rows, err := db.Query(`SELECT code, description, metric, max_hours, window_hours, warn_remaining_hours
+		FROM hos_limits WHERE is_active = 1 ORDER BY window_hours, metric`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var limits []hosLimit
+	for rows.Next() {
+		var limit hosLimit
+		var description sql.NullString
+		if err := rows.Scan(&limit.Code, &description, &limit.Metric, &limit.MaxHours, &limit.WindowHours, &limit.WarnRemaining); err != nil {
+			return nil, err
+		}
+		limit.Description = description.String
+		limits = append(limits, limit)
+	}
+	return limits, rows.Err()
+}
+
+// Usage against every active limit as of now
+func driverHOSStatus(driverID interface{}, now time.Time) ([]hosLimit, error) {
+	limits, err := loadHOSLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	longest := 0.0
+	for _, limit := range limits {
+		longest = math.Max(longest, limit.WindowHours)
+	}
+	intervals, err := loadDutyIntervals(driverID, now.Add(-time.Duration(longest*float64(time.Hour))), now)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range limits {
+		limit := &limits[i]
+		windowStart := now.Add(-time.Duration(limit.WindowHours * float64(time.Hour)))
+		limit.UsedHours = roundHours(hoursWithin(intervals, limit.Metric, windowStart, now))
+		limit.RemainingHours = roundHours(math.Max(0, limit.MaxHours-limit.UsedHours))
+
+		switch {
+		case limit.UsedHours >= limit.MaxHours:
+			limit.Status = "exceeded"
+		case limit.RemainingHours <= limit.WarnRemaining:
+			limit.Status = "warning"
+		default:
+			limit.Status = "ok"
+		}
+	}
+	return limits, nil
+}
+
+// First limit the driver is over, or nil
+func exceededHOSLimit(driverID interface{}) (*hosLimit, error) {
+	limits, err := driverHOSStatus(driverID, simNow())
+	if err != nil {
+		return nil, err
+	}
+	for i := range limits {
+		if limits[i].Status == "exceeded" {
+			return &limits[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// HOS monitor worker
+func hosMonitorWorker() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Hours-of-service monitor started")
+
+	for range ticker.C {
+		checkHoursOfService()
+	}
+}
+
+// Warn on-shift drivers nearing or over a limit, once per level per window
+func checkHoursOfService() {
+	rows, err := db.Query(`SELECT DISTINCT driver_id FROM driver_shifts WHERE clock_in_at IS NOT NULL AND clock_out_at IS NULL`)
+	if err != nil {
+		log.Printf("Error loading on-shift drivers: %v", err)
+		return
+	}
+	var driverIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			driverIDs = append(driverIDs, id)
+		}
+	}
+	rows.Close()
+
+	now := simNow()
+	for _, driverID := range driverIDs {
+		limits, err := driverHOSStatus(driverID, now)
+		if err != nil {
+			log.Printf("Error checking hours of service for driver %d: %v", driverID, err)
+			continue
+		}
+
+		for _, limit := range limits {
+			if limit.Status == "ok" {
+				continue
+			}
+
+			windowStart := now.Add(-time.Duration(limit.WindowHours * float64(time.Hour)))
+			var already int
+			db.QueryRow(`SELECT COUNT(*) FROM hos_warnings WHERE driver_id = ? AND limit_code = ? AND level = ? AND created_at > ?`,
+				driverID, limit.Code, limit.Status, windowStart.Format(sqliteTimeLayout)).Scan(&already)
+			if already > 0 {
+				continue
+			}
+
+			message := fmt.Sprintf("%s: %.2f of %.0f hours used, %.2f remaining", limit.Description, limit.UsedHours, limit.MaxHours, limit.RemainingHours)
+			if limit.Status == "exceeded" {
+				message = fmt.Sprintf("%s exceeded: %.2f of %.0f hours used", limit.Description, limit.UsedHours, limit.MaxHours)
+			}
+			db.Exec(`INSERT INTO hos_warnings (driver_id, limit_code, level, used_hours, message, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+				driverID, limit.Code, limit.Status, limit.UsedHours, message, now.Format(sqliteTimeLayout))
+
+			gpsData := GPSData{
+				DriverID:  driverID,
+				Timestamp: time.Now().Format(time.RFC3339),
+				Status:    "hos_" + limit.Status,
+				Message:   message,
+			}
+			activeMutex.RLock()
+			for _, activeJob := range activeJobs {
+				if activeJob.DriverID == driverID {
+					gpsData.JobID = activeJob.JobID
+					gpsData.Latitude, gpsData.Longitude = activeJob.CurrentLat, activeJob.CurrentLng
+				}
+			}
+			activeMutex.RUnlock()
+			broadcastGPSData(gpsData)
+		}
+	}
+}
+
+// Hours-of-service report: current limit usage, the duty log and daily totals
+// for ?from=YYYY-MM-DD&to=YYYY-MM-DD (default the last 7 days)
+func getDriverHOS(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	exists, err := driverExists(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	now := simNow().Truncate(time.Second)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from, to := today.AddDate(0, 0, -6), today
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "to must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	rangeEnd := to.AddDate(0, 0, 1)
+	if rangeEnd.After(now) {
+		rangeEnd = now
+	}
+	intervals, err := loadDutyIntervals(vars["id"], from, rangeEnd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var daily []map[string]interface{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		dayEnd := day.AddDate(0, 0, 1)
+		daily = append(daily, map[string]interface{}{
+			"date":          day.Format("2006-01-02"),
+			"on_duty_hours": roundHours(hoursWithin(intervals, "on_duty", day, dayEnd)),
+			"driving_hours": roundHours(hoursWithin(intervals, "driving", day, dayEnd)),
+			"break_hours":   roundHours(hoursWithin(intervals, "break", day, dayEnd)),
+		})
+	}
+
+	limits, err := driverHOSStatus(vars["id"], now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT limit_code, level, used_hours, message, created_at FROM hos_warnings
+		WHERE driver_id = ? AND created_at >= ? AND created_at < ? ORDER BY created_at`,
+		vars["id"], from.Format(sqliteTimeLayout), to.AddDate(0, 0, 1).Format(sqliteTimeLayout))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var warnings []map[string]interface{}
+	for rows.Next() {
+		var code, level, message, createdAt sql.NullString
+		var used sql.NullFloat64
+		if err := rows.Scan(&code, &level, &used, &message, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		warnings = append(warnings, map[string]interface{}{
+			"limit_code": code.String,
+			"level":      level.String,
+			"used_hours": used.Float64,
+			"message":    message.String,
+			"created_at": createdAt.String,
+		})
+	}
+
+	driverID, _ := strconv.ParseInt(vars["id"], 10, 64)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"driver_id":    driverID,
+		"as_of":        now.Format(time.RFC3339),
+		"from":         from.Format("2006-01-02"),
+		"to":           to.Format("2006-01-02"),
+		"limits":       limits,
+		"daily_totals": daily,
+		"log":          intervals,
+		"warnings":     warnings,
+	})
+}
+
+func getHOSLimits(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT code, description, metric, max_hours, window_hours, warn_remaining_hours, is_active
+		FROM hos_limits ORDER BY window_hours, metric`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var limits []map[string]interface{}
+	for rows.Next() {
+		var code, description, metric sql.NullString
+		var maxHours, windowHours, warnRemaining sql.NullFloat64
+		var isActive sql.NullBool
+
+		if err := rows.Scan(&code, &description, &metric, &maxHours, &windowHours, &warnRemaining, &isActive); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		limits = append(limits, map[string]interface{}{
+			"code":                 code.String,
+			"description":          description.String,
+			"metric":               metric.String,
+			"max_hours":            maxHours.Float64,
+			"window_hours":         windowHours.Float64,
+			"warn_remaining_hours": warnRemaining.Float64,
+			"is_active":            isActive.Bool,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(limits)
+}
+
+// Create or change a limit, e.g. a stricter on-duty cap for a jurisdiction
+func updateHOSLimit(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var limit map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&limit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if metric, ok := limit["metric"].(string); ok && metric != "on_duty" && metric != "driving" {
+		http.Error(w, "metric must be on_duty or driving", http.StatusBadRequest)
+		return
+	}
+	for _, field := range []string{"max_hours", "window_hours", "warn_remaining_hours"} {
+		if value, ok := limit[field].(float64); ok && value < 0 {
+			http.Error(w, field+" cannot be negative", http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := db.Exec(`UPDATE hos_limits SET description = COALESCE(?, description), metric = COALESCE(?, metric),
+		max_hours = COALESCE(?, max_hours), window_hours = COALESCE(?, window_hours),
+		warn_remaining_hours = COALESCE(?, warn_remaining_hours), is_active = COALESCE(?, is_active) WHERE code = ?`,
+		limit["description"], limit["metric"], limit["max_hours"], limit["window_hours"], limit["warn_remaining_hours"],
+		limit["is_active"], vars["code"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		metric, _ := limit["metric"].(string)
+		maxHours, maxOK := limit["max_hours"].(float64)
+		windowHours, windowOK := limit["window_hours"].(float64)
+		if metric == "" || !maxOK || !windowOK {
+			http.Error(w, "New limits need metric, max_hours and window_hours", http.StatusBadRequest)
+			return
+		}
+		_, err := db.Exec(`INSERT INTO hos_limits (code, description, metric, max_hours, window_hours, warn_remaining_hours)
+			VALUES (?, ?, ?, ?, ?, COALESCE(?, 1))`,
+			vars["code"], limit["description"], metric, maxHours, windowHours, limit["warn_remaining_hours"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
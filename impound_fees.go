@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Impound fee accrual. Storage is charged per started 24 hour period from
+// impounded_at, at the daily rate for the vehicle class, on top of the base
+// tow and admin fees. Releases outside business hours add an after-hours fee.
+
+var vehicleClasses = []string{"motorcycle", "standard", "light_truck", "heavy_duty"}
+
+// Business hours for releases (UTC, Monday to Friday)
+const (
+	releaseHoursOpen  = 8
+	releaseHoursClose = 18
+)
+
+type quoteLineItem struct {
+	Code        string  `json:"code"`
+	Description string  `json:"description"`
+	Quantity    int     `json:"quantity"`
+	UnitAmount  float64 `json:"unit_amount"`
+	Amount      float64 `json:"amount"`
+}
+
+type impoundQuote struct {
+	ImpoundID    int64           `json:"impound_id"`
+	AsOf         string          `json:"as_of"`
+	ImpoundedAt  string          `json:"impounded_at"`
+	ReleasedAt   string          `json:"released_at,omitempty"`
+	VehicleClass string          `json:"vehicle_class"`
+	DaysHeld     int             `json:"days_held"`
+	AfterHours   bool            `json:"after_hours"`
+	LineItems    []quoteLineItem `json:"line_items"`
+	Total        float64         `json:"total"`
+}
+
+func loadImpoundFeeSchedule() (map[string]float64, map[string]string, error) {
+	rows, err := db.Query(`SELECT fee_code, description, amount FROM impound_fee_schedule`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	amounts := map[string]float64{}
+	descriptions := map[string]string{}
+	for rows.Next() {
+		var code, description string
+		var amount float64
+		if err := rows.Scan(&code, &description, &amount); err != nil {
+			return nil, nil, err
+		}
+		amounts[code] = amount
+		descriptions[code] = description
+	}
+	return amounts, descriptions, rows.Err()
+}
+
+// Whole days held, counting any started day and at least one
+func impoundDaysHeld(impoundedAt, asOf time.Time) int {
+	days := int(math.Ceil(asOf.Sub(impoundedAt).Hours() / 24))
+	if days < 1 {
+		days = 1
+	}
+	return days
+}
+
+func isAfterHours(t time.Time) bool {
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return true
+	}
+	return t.Hour() < releaseHoursOpen || t.Hour() >= releaseHoursClose
+}
+
+// Compute the itemised amount owed for an impound as of the given time.
+// Released vehicles stop accruing storage at released_at.
+func computeImpoundQuote(impoundID interface{}, asOf time.Time) (*impoundQuote, error) {
+	var id int64
+	var impoundedAt, releasedAt, vehicleClass sql.NullString
+	err := db.QueryRow(`SELECT id, impounded_at, released_at, vehicle_class FROM impounded_vehicles WHERE id = ?`, impoundID).
+		Scan(&id, &impoundedAt, &releasedAt, &vehicleClass)
+	if err != nil {
+		return nil, err
+	}
+
+	heldFrom, ok := parseDBTime(impoundedAt.String)
+	if !ok {
+		return nil, fmt.Errorf("impound %d has no valid impounded_at", id)
+	}
+	released, _ := parseDBTime(releasedAt.String)
+	return newImpoundQuote(id, vehicleClass.String, heldFrom, released, asOf)
+}
+
+// The quote for a vehicle held from heldFrom; released is zero while it is
+// still held
+func newImpoundQuote(id int64, vehicleClass string, heldFrom, released, asOf time.Time) (*impoundQuote, error) {
+	quote := &impoundQuote{
+		ImpoundID:    id,
+		ImpoundedAt:  heldFrom.Format(time.RFC3339),
+		VehicleClass: vehicleClass,
+	}
+	if quote.VehicleClass == "" {
+		quote.VehicleClass = "standard"
+	}
+	if !released.IsZero() {
+		quote.ReleasedAt = released.Format(time.RFC3339)
+		if released.Before(asOf) {
+			asOf = released
+		}
+	}
+	quote.AsOf = asOf.Format(time.RFC3339)
+	quote.DaysHeld = impoundDaysHeld(heldFrom, asOf)
+	quote.AfterHours = isAfterHours(asOf)
+
+	amounts, descriptions, err := loadImpoundFeeSchedule()
+	if err != nil {
+		return nil, err
+	}
+
+	addItem := func(code string, quantity int) {
+		unit, ok := amounts[code]
+		if !ok || unit == 0 {
+			return
+		}
+		quote.LineItems = append(quote.LineItems, quoteLineItem{
+			Code:        code,
+			Description: descriptions[code],
+			Quantity:    quantity,
+			UnitAmount:  unit,
+			Amount:      roundCents(unit * float64(quantity)),
+		})
+	}
+
+	addItem("base_tow", 1)
+	addItem("storage_"+quote.VehicleClass, quote.DaysHeld)
+	addItem("admin", 1)
+	if quote.AfterHours {
+		addItem("after_hours_release", 1)
+	}
+
+	for _, item := range quote.LineItems {
+		quote.Total += item.Amount
+	}
+	quote.Total = roundCents(quote.Total)
+
+	return quote, nil
+}
+
+// Release quote for an impound as of now, or ?at=RFC3339
+func getImpoundQuote(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	asOf := simNow()
+	if at := r.URL.Query().Get("at"); at != "" {
+		parsed, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			http.Error(w, "at must be an RFC3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		asOf = parsed.UTC()
+	}
+
+	quote, err := computeImpoundQuote(vars["id"], asOf)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Impound record not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+func getImpoundFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT fee_code, description, amount FROM impound_fee_schedule ORDER BY fee_code`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var fees []map[string]interface{}
+	for rows.Next() {
+		var code, description sql.NullString
+		var amount sql.NullFloat64
+		if err := rows.Scan(&code, &description, &amount); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fees = append(fees, map[string]interface{}{
+			"fee_code":    code.String,
+			"description": description.String,
+			"amount":      amount.Float64,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fees)
+}
+
+// Update one fee in the schedule
+func updateImpoundFee(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	code := vars["code"]
+
+	var fee map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&fee); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	amount, ok := fee["amount"].(float64)
+	if !ok || amount < 0 {
+		http.Error(w, "amount must be zero or more", http.StatusBadRequest)
+		return
+	}
+	if !validImpoundFeeCode(code) {
+		http.Error(w, "Unknown fee code", http.StatusBadRequest)
+		return
+	}
+
+	description, _ := fee["description"].(string)
+	_, err := db.Exec(`INSERT INTO impound_fee_schedule (fee_code, description, amount) VALUES (?, ?, ?)
+		ON CONFLICT(fee_code) DO UPDATE SET amount = excluded.amount,
+		description = CASE WHEN excluded.description = '' THEN description ELSE excluded.description END`,
+		code, description, amount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"fee_code": code, "amount": amount})
+}
+
+func validImpoundFeeCode(code string) bool {
+	switch code {
+	case "base_tow", "admin", "after_hours_release":
+		return true
+	}
+	return strings.HasPrefix(code, "storage_") && validVehicleClass(strings.TrimPrefix(code, "storage_"))
+}
+
+func validVehicleClass(class string) bool {
+	for _, c := range vehicleClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestComputeImpoundQuote(t *testing.T) {
+	openTestDB(t,
+		`CREATE TABLE impound_fee_schedule (fee_code TEXT PRIMARY KEY, description TEXT, amount REAL)`,
+		`INSERT INTO impound_fee_schedule VALUES ('base_tow', 'Base tow', 150), ('admin', 'Admin', 45),
+			('storage_standard', 'Storage', 35), ('storage_heavy_duty', 'Storage', 80),
+			('storage_motorcycle', 'Storage', 0), ('after_hours_release', 'After hours', 60)`,
+		`CREATE TABLE impounded_vehicles (id INTEGER PRIMARY KEY, impounded_at DATETIME, released_at DATETIME, vehicle_class TEXT)`,
+		// Held from Wednesday 08:00; 2 was released on Thursday at 09:00
+		`INSERT INTO impounded_vehicles VALUES (1, '2026-10-14 08:00:00', NULL, 'standard'),
+			(2, '2026-10-14 08:00:00', '2026-10-15 09:00:00', 'heavy_duty'),
+			(3, '2026-10-14 08:00:00', NULL, ''),
+			(4, '2026-10-14 08:00:00', NULL, 'motorcycle')`,
+	)
+
+	at := func(value string) time.Time {
+		parsed, _ := time.Parse(sqliteTimeLayout, value)
+		return parsed
+	}
+	tests := []struct {
+		name       string
+		impoundID  int64
+		asOf       time.Time
+		wantClass  string
+		wantDays   int
+		afterHours bool
+		wantTotal  float64
+	}{
+		{"first day in business hours", 1, at("2026-10-14 10:00:00"), "standard", 1, false, 230},
+		{"exactly two days", 1, at("2026-10-16 08:00:00"), "standard", 2, false, 265},
+		{"a started day counts", 1, at("2026-10-16 08:00:01"), "standard", 3, false, 300},
+		{"evening release", 1, at("2026-10-14 19:00:00"), "standard", 1, true, 290},
+		{"weekend release", 1, at("2026-10-17 12:00:00"), "standard", 4, true, 395},
+		{"storage stops at release", 2, at("2026-10-20 19:00:00"), "heavy_duty", 2, false, 355},
+		{"no class is standard", 3, at("2026-10-14 10:00:00"), "standard", 1, false, 230},
+		{"zero fees are left out", 4, at("2026-10-15 10:00:00"), "motorcycle", 2, false, 195},
+	}
+	for _, tt := range tests {
+		quote, err := computeImpoundQuote(tt.impoundID, tt.asOf)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if quote.VehicleClass != tt.wantClass || quote.DaysHeld != tt.wantDays || quote.AfterHours != tt.afterHours || quote.Total != tt.wantTotal {
+			t.Errorf("%s: got class %s, %d days, after hours %v, total %.2f; want %s, %d days, after hours %v, total %.2f",
+				tt.name, quote.VehicleClass, quote.DaysHeld, quote.AfterHours, quote.Total,
+				tt.wantClass, tt.wantDays, tt.afterHours, tt.wantTotal)
+		}
+	}
+
+	if _, err := computeImpoundQuote(99, at("2026-10-14 10:00:00")); err != sql.ErrNoRows {
+		t.Errorf("unknown impound: got error %v, want sql.ErrNoRows", err)
+	}
+}
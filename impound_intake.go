@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+)
+
+// Impound intake. Manual intake and job completion both go through
+// intakeImpound so every record gets a real job, a stall and a fee quote.
+
+var errJobAlreadyImpounded = errors.New("job already has an impound record")
+
+type impoundIntake struct {
+	JobID              int64
+	VehicleDescription string
+	LicensePlate       string
+	OwnerName          string
+	OwnerPhone         string
+	CustomerID         int64 // matched from the owner's name and phone when 0
+	VehicleClass       string
+	ReleaseFee         interface{}
+}
+
+// Take a stall (overflowing if needed) and create the impound record.
+// Returns the impound id, the lot it ended up in and the stall name.
+func intakeImpound(intake impoundIntake, requestedLotID int64) (int64, int64, string, error) {
+	if intake.VehicleClass == "" {
+		intake.VehicleClass = "standard"
+	}
+
+	var err error
+	if intake.CustomerID == 0 {
+		if intake.CustomerID, err = findOrCreateCustomer(intake.OwnerName, intake.OwnerPhone); err != nil {
+			return 0, 0, "", err
+		}
+	}
+	var customerID interface{}
+	if intake.CustomerID != 0 {
+		customerID = intake.CustomerID
+	}
+
+	// Record the initial quote as the release fee unless one was given
+	now := simNow()
+	if intake.ReleaseFee == nil {
+		quote, err := newImpoundQuote(0, intake.VehicleClass, now, time.Time{}, now)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		intake.ReleaseFee = quote.Total
+	}
+
+	// The check, the stall and the record in one transaction so concurrent
+	// intakes cannot share a stall or impound the same job twice
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer tx.Rollback()
+
+	var existing int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM impounded_vehicles WHERE job_id = ?", intake.JobID).Scan(&existing); err != nil {
+		return 0, 0, "", err
+	}
+	if existing > 0 {
+		return 0, 0, "", errJobAlreadyImpounded
+	}
+
+	lotID, stallID, stallName, err := assignImpoundStall(tx, requestedLotID)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	var lotName string
+	if err := tx.QueryRow("SELECT name FROM impound_lots WHERE id = ?", lotID).Scan(&lotName); err != nil {
+		return 0, 0, "", err
+	}
+
+	result, err := tx.Exec(`INSERT INTO impounded_vehicles (job_id, vehicle_description, license_plate, owner_name, owner_phone,
+		impound_location, release_fee, vehicle_class, lot_id, stall_id, impounded_at, customer_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		intake.JobID, intake.VehicleDescription, intake.LicensePlate, intake.OwnerName, intake.OwnerPhone,
+		lotName, intake.ReleaseFee, intake.VehicleClass, lotID, stallID, now.Format(sqliteTimeLayout), customerID)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, "", err
+	}
+	return id, lotID, stallName, nil
+}
+
+// Create the impound record for a completed police or parking_violation tow.
+// Returns 0 when the job is not an impound tow or already has a record.
+func impoundCompletedJob(jobID int64) (int64, error) {
+	var jobType, vehicleDesc, licensePlate, ownerName, ownerPhone, vehicleClass, pickup sql.NullString
+	var impoundLotID sql.NullInt64
+	err := db.QueryRow(`SELECT job_type, vehicle_description, license_plate, owner_name, owner_phone, vehicle_class,
+		pickup_coordinates, impound_lot_id FROM jobs WHERE id = ?`, jobID).
+		Scan(&jobType, &vehicleDesc, &licensePlate, &ownerName, &ownerPhone, &vehicleClass, &pickup, &impoundLotID)
+	if err != nil {
+		return 0, err
+	}
+
+	if !isImpoundJobType(jobType.String) {
+		return 0, nil
+	}
+
+	lotID := impoundLotID.Int64
+	if !impoundLotID.Valid {
+		lat, lng := parseCoordinates(pickup.String)
+		if lotID, err = chooseImpoundLot(lat, lng); err != nil {
+			return 0, err
+		}
+	}
+
+	id, _, stallName, err := intakeImpound(impoundIntake{
+		JobID:              jobID,
+		VehicleDescription: vehicleDesc.String,
+		LicensePlate:       licensePlate.String,
+		OwnerName:          ownerName.String,
+		OwnerPhone:         ownerPhone.String,
+		VehicleClass:       vehicleClass.String,
+	}, lotID)
+	if err == errJobAlreadyImpounded {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	log.Printf("Impounded vehicle from job %d as impound %d in stall %s", jobID, id, stallName)
+	return id, nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Abandoned vehicle lifecycle. A sweep advances each held vehicle through the
+// statutory timeline (owner notice, lien, auction eligibility) by days held,
+// recording a notice at every stage. Auction-eligible vehicles can then be
+// sold or scrapped, which closes the impound and posts proceeds to its fees.
+
+// Lifecycle stage a vehicle reaches at each timeline step
+var lifecycleStageStatus = map[string]string{
+	"owner_notice":     "owner_notified",
+	"lien":             "lien_filed",
+	"auction_eligible": "auction_eligible",
+}
+
+// Impound lifecycle worker
+func impoundLifecycleWorker() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Impound lifecycle worker started")
+
+	runImpoundLifecycle()
+	for range ticker.C {
+		runImpoundLifecycle()
+	}
+}
+
+// Advance held vehicles through every timeline stage they have reached
+func runImpoundLifecycle() {
+	type timelineStage struct {
+		stage       string
+		days        int
+		description string
+	}
+	rows, err := db.Query(`SELECT stage, days_after_impound, description FROM lien_timeline WHERE is_active = 1 ORDER BY days_after_impound`)
+	if err != nil {
+		log.Printf("Error loading lien timeline: %v", err)
+		return
+	}
+	var stages []timelineStage
+	for rows.Next() {
+		var s timelineStage
+		if err := rows.Scan(&s.stage, &s.days, &s.description); err != nil {
+			log.Printf("Error scanning lien timeline stage: %v", err)
+			continue
+		}
+		stages = append(stages, s)
+	}
+	rows.Close()
+
+	type heldVehicle struct {
+		id                        int64
+		impoundedAt               string
+		licensePlate, description string
+		ownerName, ownerPhone     string
+	}
+	rows, err = db.Query(`SELECT id, impounded_at, license_plate, vehicle_description, owner_name, owner_phone
+		FROM impounded_vehicles WHERE is_currently_impounded = 1`)
+	if err != nil {
+		log.Printf("Error loading impounded vehicles for lifecycle: %v", err)
+		return
+	}
+	var vehicles []heldVehicle
+	for rows.Next() {
+		var v heldVehicle
+		var impoundedAt, plate, description, ownerName, ownerPhone sql.NullString
+		if err := rows.Scan(&v.id, &impoundedAt, &plate, &description, &ownerName, &ownerPhone); err != nil {
+			log.Printf("Error scanning impounded vehicle: %v", err)
+			continue
+		}
+		v.impoundedAt, v.licensePlate, v.description = impoundedAt.String, plate.String, description.String
+		v.ownerName, v.ownerPhone = ownerName.String, ownerPhone.String
+		vehicles = append(vehicles, v)
+	}
+	rows.Close()
+
+	now := simNow()
+	for _, v := range vehicles {
+		impoundedAt, ok := parseDBTime(v.impoundedAt)
+		if !ok {
+			continue
+		}
+		daysHeld := int(now.Sub(impoundedAt).Hours() / 24)
+
+		for _, s := range stages {
+			if daysHeld < s.days {
+				break
+			}
+
+			var exists int
+			db.QueryRow(`SELECT COUNT(*) FROM impound_notices WHERE impound_id = ? AND stage = ?`, v.id, s.stage).Scan(&exists)
+			if exists > 0 {
+				continue
+			}
+
+			message := fmt.Sprintf("%s: %s (plate %s) has been held %d days. %s", s.stage, v.description, v.licensePlate, daysHeld, s.description)
+			_, err := db.Exec(`INSERT INTO impound_notices (impound_id, stage, days_held, recipient_name, recipient_phone, message)
+				VALUES (?, ?, ?, ?, ?, ?)`, v.id, s.stage, daysHeld, v.ownerName, v.ownerPhone, message)
+			if err != nil {
+				log.Printf("Error recording %s notice for impound %d: %v", s.stage, v.id, err)
+				continue
+			}
+
+			if status, ok := lifecycleStageStatus[s.stage]; ok {
+				db.Exec(`UPDATE impounded_vehicles SET lifecycle_stage = ? WHERE id = ?`, status, v.id)
+			}
+			log.Printf("Impound %d reached %s after %d days", v.id, s.stage, daysHeld)
+		}
+	}
+}
+
+func getAuctionEligibleVehicles(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT id, job_id, vehicle_description, license_plate, owner_name, impounded_at, impound_location
+		FROM impounded_vehicles WHERE is_currently_impounded = 1 AND lifecycle_stage = 'auction_eligible'
+		AND NOT EXISTS (SELECT 1 FROM impound_holds h WHERE h.impound_id = impounded_vehicles.id AND h.lifted_at IS NULL)
+		ORDER BY impounded_at`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var vehicles []map[string]interface{}
+	for rows.Next() {
+		var id, jobID sql.NullInt64
+		var vehicleDesc, licensePlate, ownerName, impoundedAt, location sql.NullString
+
+		err := rows.Scan(&id, &jobID, &vehicleDesc, &licensePlate, &ownerName, &impoundedAt, &location)
+		if err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		vehicles = append(vehicles, map[string]interface{}{
+			"id":                  id.Int64,
+			"job_id":              jobID.Int64,
+			"vehicle_description": vehicleDesc.String,
+			"license_plate":       licensePlate.String,
+			"owner_name":          ownerName.String,
+			"impounded_at":        impoundedAt.String,
+			"impound_location":    location.String,
+		})
+	}
+	rows.Close()
+
+	// Include what is owed so the yard knows the reserve
+	now := simNow()
+	for _, vehicle := range vehicles {
+		quote, err := computeImpoundQuote(vehicle["id"], now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		vehicle["days_held"] = quote.DaysHeld
+		vehicle["fees_owed"] = quote.Total
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vehicles)
+}
+
+// Record a sale or disposal of an auction-eligible vehicle and close the impound
+func disposeImpoundedVehicle(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var disposal map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&disposal); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	disposition, _ := disposal["disposition"].(string)
+	if disposition != "sold" && disposition != "scrapped" {
+		http.Error(w, "disposition must be sold or scrapped", http.StatusBadRequest)
+		return
+	}
+	proceeds, _ := disposal["sale_price"].(float64)
+	if proceeds < 0 {
+		http.Error(w, "sale_price cannot be negative", http.StatusBadRequest)
+		return
+	}
+	disposedBy, _ := disposal["disposed_by"].(string)
+	if disposedBy == "" {
+		http.Error(w, "disposed_by is required", http.StatusBadRequest)
+		return
+	}
+
+	var id int64
+	var isCurrentlyImpounded bool
+	var stage sql.NullString
+	err := db.QueryRow(`SELECT id, is_currently_impounded, lifecycle_stage FROM impounded_vehicles WHERE id = ?`, vars["id"]).
+		Scan(&id, &isCurrentlyImpounded, &stage)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Impound record not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !isCurrentlyImpounded {
+		http.Error(w, "Vehicle is no longer impounded", http.StatusConflict)
+		return
+	}
+	if stage.String != "auction_eligible" {
+		http.Error(w, "Vehicle is not yet eligible for auction", http.StatusConflict)
+		return
+	}
+	if holds, err := activeImpoundHolds(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if holds > 0 {
+		http.Error(w, "Vehicle has an active hold", http.StatusConflict)
+		return
+	}
+
+	now := simNow()
+	quote, err := computeImpoundQuote(id, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	invoiceID, amount, paid, err := ensureImpoundInvoice(tx, id, quote)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Proceeds pay down the fees first; anything left over is surplus owed to the owner
+	balance := roundCents(amount - paid)
+	applied := proceeds
+	if applied > balance {
+		applied = balance
+	}
+	surplus := roundCents(proceeds - applied)
+
+	if applied > 0 {
+		_, err := tx.Exec(`INSERT INTO payments (invoice_id, amount, payment_method, reference_number, paid_at) VALUES (?, ?, 'auction_proceeds', ?, ?)`,
+			invoiceID, applied, fmt.Sprintf("DISP%06d", id), simNow().Format(sqliteTimeLayout))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if roundCents(balance-applied) <= 0 {
+		if _, err := tx.Exec(`UPDATE invoices SET status = 'paid' WHERE id = ?`, invoiceID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	_, err = tx.Exec(`UPDATE impounded_vehicles SET is_currently_impounded = 0, released_at = ?, lifecycle_stage = 'disposed',
+		disposition = ?, sale_price = ?, buyer_name = ?, released_by = ?, release_fee = ? WHERE id = ?`,
+		now.Format(sqliteTimeLayout), disposition, proceeds, disposal["buyer_name"], disposedBy, amount, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":            "disposed",
+		"disposition":       disposition,
+		"invoice_id":        invoiceID,
+		"fees_owed":         balance,
+		"proceeds_applied":  applied,
+		"surplus_to_owner":  surplus,
+		"remaining_balance": roundCents(balance - applied),
+	})
+}
+
+func getImpoundNotices(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT n.id, n.impound_id, n.stage, n.days_held, n.recipient_name, n.recipient_phone, n.message, n.created_at,
+		v.license_plate FROM impound_notices n JOIN impounded_vehicles v ON v.id = n.impound_id`
+	var args []interface{}
+	if stage := r.URL.Query().Get("stage"); stage != "" {
+		query += ` WHERE n.stage = ?`
+		args = append(args, stage)
+	}
+
+	rows, err := db.Query(query+` ORDER BY n.id`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var notices []map[string]interface{}
+	for rows.Next() {
+		var id, impoundID, daysHeld sql.NullInt64
+		var stage, recipientName, recipientPhone, message, createdAt, licensePlate sql.NullString
+
+		err := rows.Scan(&id, &impoundID, &stage, &daysHeld, &recipientName, &recipientPhone, &message, &createdAt, &licensePlate)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		notices = append(notices, map[string]interface{}{
+			"id":              id.Int64,
+			"impound_id":      impoundID.Int64,
+			"license_plate":   licensePlate.String,
+			"stage":           stage.String,
+			"days_held":       daysHeld.Int64,
+			"recipient_name":  recipientName.String,
+			"recipient_phone": recipientPhone.String,
+			"message":         message.String,
+			"created_at":      createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notices)
+}
+
+func getLienTimeline(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT stage, days_after_impound, description, is_active FROM lien_timeline ORDER BY days_after_impound`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var timeline []map[string]interface{}
+	for rows.Next() {
+		var stage, description sql.NullString
+		var days sql.NullInt64
+		var isActive sql.NullBool
+
+		if err := rows.Scan(&stage, &days, &description, &isActive); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		timeline = append(timeline, map[string]interface{}{
+			"stage":              stage.String,
+			"days_after_impound": days.Int64,
+			"description":        description.String,
+			"is_active":          isActive.Bool,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timeline)
+}
+
+// Change when a timeline stage applies (e.g. a jurisdiction with a 60 day lien)
+func updateLienTimelineStage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	stage := vars["stage"]
+
+	if _, ok := lifecycleStageStatus[stage]; !ok {
+		http.Error(w, "stage must be one of owner_notice, lien, auction_eligible", http.StatusBadRequest)
+		return
+	}
+
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if days, ok := update["days_after_impound"].(float64); ok && days < 0 {
+		http.Error(w, "days_after_impound cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`UPDATE lien_timeline SET days_after_impound = COALESCE(?, days_after_impound),
+		description = COALESCE(?, description), is_active = COALESCE(?, is_active) WHERE stage = ?`,
+		update["days_after_impound"], update["description"], update["is_active"], stage)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
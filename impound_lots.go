@@ -0,0 +1,373 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Impound lots. Each lot has named stalls; intake takes the first free stall
+// in the requested lot and spills over to the lot's overflow lot when full.
+// Occupancy is derived from impounded_vehicles still held in a stall.
+
+var errLotFull = errors.New("impound lot is full")
+
+// Find a free stall in the lot, following overflow lots when it is full
+func assignImpoundStall(tx *sql.Tx, lotID int64) (int64, int64, string, error) {
+	visited := map[int64]bool{}
+	for lotID != 0 && !visited[lotID] {
+		visited[lotID] = true
+
+		var stallID int64
+		var stallName string
+		err := tx.QueryRow(`SELECT s.id, s.name FROM impound_stalls s
+			JOIN impound_lots l ON l.id = s.lot_id
+			WHERE s.lot_id = ? AND s.is_active = 1 AND l.is_active = 1
+			AND NOT EXISTS (SELECT 1 FROM impounded_vehicles v WHERE v.stall_id = s.id AND v.is_currently_impounded = 1)
+			ORDER BY s.row_label, s.position LIMIT 1`, lotID).Scan(&stallID, &stallName)
+		if err == nil {
+			return lotID, stallID, stallName, nil
+		} else if err != sql.ErrNoRows {
+			return 0, 0, "", err
+		}
+
+		var overflow sql.NullInt64
+		if err := tx.QueryRow(`SELECT overflow_lot_id FROM impound_lots WHERE id = ?`, lotID).Scan(&overflow); err != nil {
+			return 0, 0, "", err
+		}
+		lotID = overflow.Int64
+	}
+	return 0, 0, "", errLotFull
+}
+
+// Towing into one of these job types ends at an impound lot
+func isImpoundJobType(jobType string) bool {
+	return jobType == "police" || jobType == "parking_violation"
+}
+
+// Pick the lot for an intake from lot_id, a legacy impound_location name,
+// or the lot the job was routed to
+func resolveImpoundLot(vehicle map[string]interface{}) (int64, error) {
+	var id int64
+	if lotID, ok := vehicle["lot_id"].(float64); ok {
+		err := db.QueryRow(`SELECT id FROM impound_lots WHERE id = ?`, int64(lotID)).Scan(&id)
+		return id, err
+	}
+
+	if location, ok := vehicle["impound_location"].(string); ok && location != "" {
+		err := db.QueryRow(`SELECT id FROM impound_lots WHERE name = ?`, location).Scan(&id)
+		return id, err
+	}
+
+	if jobID, ok := vehicle["job_id"].(float64); ok {
+		err := db.QueryRow(`SELECT impound_lot_id FROM jobs WHERE id = ? AND impound_lot_id IS NOT NULL`, int64(jobID)).Scan(&id)
+		return id, err
+	}
+
+	return 0, sql.ErrNoRows
+}
+
+// Nearest active lot with a free stall, used when a job does not name one
+func chooseImpoundLot(lat, lng float64) (int64, error) {
+	rows, err := db.Query(`SELECT l.id, l.latitude, l.longitude FROM impound_lots l WHERE l.is_active = 1
+		AND EXISTS (SELECT 1 FROM impound_stalls s WHERE s.lot_id = l.id AND s.is_active = 1
+			AND NOT EXISTS (SELECT 1 FROM impounded_vehicles v WHERE v.stall_id = s.id AND v.is_currently_impounded = 1))`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var bestID int64
+	bestDistance := -1.0
+	for rows.Next() {
+		var id int64
+		var lotLat, lotLng float64
+		if err := rows.Scan(&id, &lotLat, &lotLng); err != nil {
+			return 0, err
+		}
+		if distance := calculateDistance(lat, lng, lotLat, lotLng); bestDistance < 0 || distance < bestDistance {
+			bestID, bestDistance = id, distance
+		}
+	}
+	if bestID == 0 {
+		return 0, errLotFull
+	}
+	return bestID, rows.Err()
+}
+
+func getImpoundLots(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT l.id, l.name, l.address, l.latitude, l.longitude, l.overflow_lot_id, l.hours, l.is_active,
+		(SELECT COUNT(*) FROM impound_stalls s WHERE s.lot_id = l.id AND s.is_active = 1),
+		(SELECT COUNT(*) FROM impounded_vehicles v WHERE v.lot_id = l.id AND v.is_currently_impounded = 1)
+		FROM impound_lots l ORDER BY l.id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var lots []map[string]interface{}
+	for rows.Next() {
+		var id, overflowLotID, capacity, occupied sql.NullInt64
+		var name, address, hours sql.NullString
+		var latitude, longitude sql.NullFloat64
+		var isActive sql.NullBool
+
+		err := rows.Scan(&id, &name, &address, &latitude, &longitude, &overflowLotID, &hours, &isActive, &capacity, &occupied)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		lots = append(lots, map[string]interface{}{
+			"id":              id.Int64,
+			"name":            name.String,
+			"address":         address.String,
+			"latitude":        latitude.Float64,
+			"longitude":       longitude.Float64,
+			"overflow_lot_id": overflowLotID.Int64,
+			"hours":           hours.String,
+			"is_active":       isActive.Bool,
+			"capacity":        capacity.Int64,
+			"occupied":        occupied.Int64,
+			"available":       capacity.Int64 - occupied.Int64,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lots)
+}
+
+// Create a lot and its stalls: either explicit "stalls" names, or "rows" x "stalls_per_row"
+func createImpoundLot(w http.ResponseWriter, r *http.Request) {
+	var lot map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&lot); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, _ := lot["name"].(string)
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	latitude, latOK := lot["latitude"].(float64)
+	longitude, lngOK := lot["longitude"].(float64)
+	if !latOK || !lngOK {
+		http.Error(w, "latitude and longitude are required", http.StatusBadRequest)
+		return
+	}
+
+	type stall struct {
+		name     string
+		row      string
+		position int
+	}
+	var stalls []stall
+	if names, ok := lot["stalls"].([]interface{}); ok {
+		for i, n := range names {
+			stallName, _ := n.(string)
+			if stallName == "" {
+				http.Error(w, "stall names must be non-empty strings", http.StatusBadRequest)
+				return
+			}
+			stalls = append(stalls, stall{name: stallName, position: i + 1})
+		}
+	} else {
+		rowCount, _ := lot["rows"].(float64)
+		perRow, _ := lot["stalls_per_row"].(float64)
+		if rowCount < 1 || rowCount > 26 || perRow < 1 {
+			http.Error(w, "Provide stalls, or rows (1-26) and stalls_per_row", http.StatusBadRequest)
+			return
+		}
+		for row := 0; row < int(rowCount); row++ {
+			label := string(rune('A' + row))
+			for position := 1; position <= int(perRow); position++ {
+				stalls = append(stalls, stall{name: fmt.Sprintf("%s-%02d", label, position), row: label, position: position})
+			}
+		}
+	}
+
+	if problem, err := overflowLotProblem(lot["overflow_lot_id"], 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO impound_lots (name, address, latitude, longitude, overflow_lot_id, hours) VALUES (?, ?, ?, ?, ?, ?)`,
+		name, lot["address"], latitude, longitude, lot["overflow_lot_id"], lot["hours"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lotID, _ := result.LastInsertId()
+
+	for _, s := range stalls {
+		_, err := tx.Exec(`INSERT INTO impound_stalls (lot_id, name, row_label, position) VALUES (?, ?, ?, ?)`,
+			lotID, s.name, s.row, s.position)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invalidateGeofences()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": lotID, "capacity": len(stalls)})
+}
+
+// Foreign keys are not enforced, so overflow_lot_id is checked here: it must
+// name another lot that exists. lotID is 0 for a new lot.
+func overflowLotProblem(value interface{}, lotID int64) (string, error) {
+	if value == nil {
+		return "", nil
+	}
+	overflow, ok := value.(float64)
+	if !ok || overflow != math.Trunc(overflow) {
+		return "overflow_lot_id must be a lot id", nil
+	}
+	if int64(overflow) == lotID {
+		return "A lot cannot overflow into itself", nil
+	}
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM impound_lots WHERE id = ?`, int64(overflow)).Scan(&exists); err != nil {
+		return "", err
+	}
+	if exists == 0 {
+		return "Overflow lot not found", nil
+	}
+	return "", nil
+}
+
+// Update lot details, overflow routing or take it out of service
+func updateImpoundLot(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var lot map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&lot); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lotID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Impound lot not found", http.StatusNotFound)
+		return
+	}
+	if problem, err := overflowLotProblem(lot["overflow_lot_id"], lotID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE impound_lots SET address = COALESCE(?, address), latitude = COALESCE(?, latitude),
+		longitude = COALESCE(?, longitude), overflow_lot_id = COALESCE(?, overflow_lot_id), hours = COALESCE(?, hours),
+		is_active = COALESCE(?, is_active) WHERE id = ?`,
+		lot["address"], lot["latitude"], lot["longitude"], lot["overflow_lot_id"], lot["hours"], lot["is_active"], lotID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Impound lot not found", http.StatusNotFound)
+		return
+	}
+	invalidateGeofences()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Yard map: every stall in the lot and the vehicle currently in it
+func getImpoundLotOccupancy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var lotID int64
+	var name sql.NullString
+	err := db.QueryRow(`SELECT id, name FROM impound_lots WHERE id = ?`, vars["id"]).Scan(&lotID, &name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Impound lot not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT s.id, s.name, s.row_label, s.position, s.is_active,
+		v.id, v.vehicle_description, v.license_plate, v.impounded_at
+		FROM impound_stalls s
+		LEFT JOIN impounded_vehicles v ON v.stall_id = s.id AND v.is_currently_impounded = 1
+		WHERE s.lot_id = ? ORDER BY s.row_label, s.position`, lotID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var stalls []map[string]interface{}
+	capacity, occupied := 0, 0
+	for rows.Next() {
+		var stallID, position, impoundID sql.NullInt64
+		var stallName, rowLabel, vehicleDesc, licensePlate, impoundedAt sql.NullString
+		var isActive sql.NullBool
+
+		err := rows.Scan(&stallID, &stallName, &rowLabel, &position, &isActive,
+			&impoundID, &vehicleDesc, &licensePlate, &impoundedAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		stall := map[string]interface{}{
+			"id":        stallID.Int64,
+			"name":      stallName.String,
+			"row":       rowLabel.String,
+			"position":  position.Int64,
+			"is_active": isActive.Bool,
+			"occupied":  impoundID.Valid,
+		}
+		if isActive.Bool {
+			capacity++
+		}
+		if impoundID.Valid {
+			occupied++
+			stall["vehicle"] = map[string]interface{}{
+				"impound_id":          impoundID.Int64,
+				"vehicle_description": vehicleDesc.String,
+				"license_plate":       licensePlate.String,
+				"impounded_at":        impoundedAt.String,
+			}
+		}
+		stalls = append(stalls, stall)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lot_id":   lotID,
+		"name":     name.String,
+		"capacity": capacity,
+		"occupied": occupied,
+		"stalls":   stalls,
+	})
+}
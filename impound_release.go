@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Impound release checks. A vehicle is only released once the invoice for its
+// quoted fees is settled, no holds are active, and the person collecting it
+// has shown ID and proof of ownership.
+
+// Create or top up the invoice covering an impound's quoted fees.
+// Returns the invoice id, its amount and how much has been paid against it.
+func ensureImpoundInvoice(tx *sql.Tx, impoundID int64, quote *impoundQuote) (int64, float64, float64, error) {
+	var invoiceID, jobID, customerID sql.NullInt64
+	var ownerName, ownerPhone sql.NullString
+	err := tx.QueryRow(`SELECT invoice_id, job_id, owner_name, owner_phone, customer_id FROM impounded_vehicles WHERE id = ?`, impoundID).
+		Scan(&invoiceID, &jobID, &ownerName, &ownerPhone, &customerID)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if !invoiceID.Valid {
+		result, err := tx.Exec(`INSERT INTO invoices (job_id, amount, due_date, customer_name, customer_phone, customer_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			jobID.Int64, quote.Total, simNow().Format("2006-01-02"), ownerName.String, ownerPhone.String, customerID, simNow().Format(sqliteTimeLayout))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		for _, item := range quote.LineItems {
+			description := item.Description
+			if item.Quantity > 1 {
+				description = fmt.Sprintf("%s x %d", item.Description, item.Quantity)
+			}
+			_, err := tx.Exec(`INSERT INTO invoice_line_items (invoice_id, description, amount, item_type) VALUES (?, ?, ?, 'impound_fee')`,
+				id, description, item.Amount)
+			if err != nil {
+				return 0, 0, 0, err
+			}
+		}
+
+		if _, err := tx.Exec(`UPDATE impounded_vehicles SET invoice_id = ? WHERE id = ?`, id, impoundID); err != nil {
+			return 0, 0, 0, err
+		}
+		return id, quote.Total, 0, nil
+	}
+
+	var amount, paid float64
+	err = tx.QueryRow(`SELECT amount, (SELECT COALESCE(SUM(amount), 0) FROM payments WHERE invoice_id = invoices.id)
+		FROM invoices WHERE id = ?`, invoiceID.Int64).Scan(&amount, &paid)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// Storage kept accruing since the invoice was raised
+	var invoicedFees float64
+	err = tx.QueryRow(`SELECT COALESCE(SUM(amount), 0) FROM invoice_line_items WHERE invoice_id = ? AND item_type = 'impound_fee'`,
+		invoiceID.Int64).Scan(&invoicedFees)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if extra := roundCents(quote.Total - invoicedFees); extra > 0 {
+		_, err := tx.Exec(`INSERT INTO invoice_line_items (invoice_id, description, amount, item_type) VALUES (?, ?, ?, 'impound_fee')`,
+			invoiceID.Int64, fmt.Sprintf("Additional impound fees to %s", quote.AsOf), extra)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if _, err := tx.Exec(`UPDATE invoices SET amount = ROUND(amount + ?, 2), status = 'pending' WHERE id = ?`, extra, invoiceID.Int64); err != nil {
+			return 0, 0, 0, err
+		}
+		amount = roundCents(amount + extra)
+	}
+
+	return invoiceID.Int64, amount, paid, nil
+}
+
+// Raise (or refresh) the release invoice so the owner can pay before collecting
+func createImpoundInvoice(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var id int64
+	var isCurrentlyImpounded bool
+	err := db.QueryRow(`SELECT id, is_currently_impounded FROM impounded_vehicles WHERE id = ?`, vars["id"]).Scan(&id, &isCurrentlyImpounded)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Impound record not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !isCurrentlyImpounded {
+		http.Error(w, "Vehicle has already been released", http.StatusConflict)
+		return
+	}
+
+	quote, err := computeImpoundQuote(id, simNow())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	invoiceID, amount, paid, err := ensureImpoundInvoice(tx, id, quote)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"invoice_id":  invoiceID,
+		"amount":      amount,
+		"paid":        paid,
+		"balance_due": roundCents(amount - paid),
+		"quote":       quote,
+	})
+}
+
+// Count holds that have not been lifted
+func activeImpoundHolds(impoundID int64) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM impound_holds WHERE impound_id = ? AND lifted_at IS NULL`, impoundID).Scan(&count)
+	return count, err
+}
+
+func getImpoundHolds(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	rows, err := db.Query(`SELECT id, hold_type, agency, reference_number, reason, placed_at, lifted_at, lifted_by
+		FROM impound_holds WHERE impound_id = ? ORDER BY id`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var holds []map[string]interface{}
+	for rows.Next() {
+		var id sql.NullInt64
+		var holdType, agency, reference, reason, placedAt, liftedAt, liftedBy sql.NullString
+
+		if err := rows.Scan(&id, &holdType, &agency, &reference, &reason, &placedAt, &liftedAt, &liftedBy); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		holds = append(holds, map[string]interface{}{
+			"id":               id.Int64,
+			"hold_type":        holdType.String,
+			"agency":           agency.String,
+			"reference_number": reference.String,
+			"reason":           reason.String,
+			"placed_at":        placedAt.String,
+			"lifted_at":        liftedAt.String,
+			"lifted_by":        liftedBy.String,
+			"is_active":        !liftedAt.Valid,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holds)
+}
+
+// Place a hold (police, investigation, lien) that blocks release until lifted
+func createImpoundHold(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var hold map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&hold); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var impoundID int64
+	err := db.QueryRow(`SELECT id FROM impounded_vehicles WHERE id = ?`, vars["id"]).Scan(&impoundID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Impound record not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	holdType, _ := hold["hold_type"].(string)
+	if holdType == "" {
+		holdType = "police"
+	}
+
+	result, err := db.Exec(`INSERT INTO impound_holds (impound_id, hold_type, agency, reference_number, reason) VALUES (?, ?, ?, ?, ?)`,
+		impoundID, holdType, hold["agency"], hold["reference_number"], hold["reason"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"id": id})
+}
+
+func liftImpoundHold(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var lift map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&lift); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	liftedBy, _ := lift["lifted_by"].(string)
+	if liftedBy == "" {
+		http.Error(w, "lifted_by is required", http.StatusBadRequest)
+		return
+	}
+
+	var liftedAt sql.NullString
+	err := db.QueryRow(`SELECT lifted_at FROM impound_holds WHERE id = ? AND impound_id = ?`, vars["holdId"], vars["id"]).Scan(&liftedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Hold not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if liftedAt.Valid {
+		http.Error(w, "Hold has already been lifted", http.StatusConflict)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE impound_holds SET lifted_at = ?, lifted_by = ? WHERE id = ?`,
+		simNow().Format(sqliteTimeLayout), liftedBy, vars["holdId"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// Write a JSON error body for release conflicts the client can act on
+func writeReleaseConflict(w http.ResponseWriter, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(body)
+}
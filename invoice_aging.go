@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Invoice aging. A background sweep moves unpaid invoices past their due date
+// to overdue, then walks them through the late fee schedule stages. Each stage
+// adds its late fee as an invoice line item and opens a reminder for billing.
+
+type agingInvoice struct {
+	ID           int64
+	JobID        int64
+	Amount       float64
+	Paid         float64
+	DueDate      time.Time
+	Status       string
+	CustomerName string
+}
+
+func (inv agingInvoice) Outstanding() float64 {
+	return roundCents(inv.Amount - inv.Paid)
+}
+
+// Whole days past due as of the given time (0 or less means not yet due)
+func (inv agingInvoice) DaysOverdue(asOf time.Time) int {
+	today := time.Date(asOf.Year(), asOf.Month(), asOf.Day(), 0, 0, 0, 0, time.UTC)
+	due := time.Date(inv.DueDate.Year(), inv.DueDate.Month(), inv.DueDate.Day(), 0, 0, 0, 0, time.UTC)
+	return int(today.Sub(due).Hours() / 24)
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// Load unpaid invoices that have a usable due date
+func loadAgingInvoices() ([]agingInvoice, error) {
+	rows, err := db.Query(`SELECT i.id, i.job_id, i.amount, i.due_date, i.status, i.customer_name,
+		(SELECT COALESCE(SUM(p.amount), 0) FROM payments p WHERE p.invoice_id = i.id)
+		FROM invoices i WHERE i.status IN ('pending', 'overdue')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []agingInvoice
+	for rows.Next() {
+		var inv agingInvoice
+		var jobID sql.NullInt64
+		var dueDate, status, customerName sql.NullString
+
+		if err := rows.Scan(&inv.ID, &jobID, &inv.Amount, &dueDate, &status, &customerName, &inv.Paid); err != nil {
+			return nil, err
+		}
+
+		due, ok := parseDBTime(dueDate.String)
+		if !ok {
+			continue
+		}
+		inv.JobID = jobID.Int64
+		inv.DueDate = due
+		inv.Status = status.String
+		inv.CustomerName = customerName.String
+		invoices = append(invoices, inv)
+	}
+	return invoices, rows.Err()
+}
+
+// Invoice aging worker
+func invoiceAgingWorker() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Invoice aging worker started")
+
+	runInvoiceAging()
+	for range ticker.C {
+		runInvoiceAging()
+	}
+}
+
+type lateFeeStage struct {
+	stage          string
+	minDaysOverdue int
+	flatFee        float64
+	percent        float64
+}
+
+// Mark past-due invoices overdue and apply any late fee stages they have reached
+func runInvoiceAging() {
+	invoices, err := loadAgingInvoices()
+	if err != nil {
+		log.Printf("Error loading invoices for aging: %v", err)
+		return
+	}
+
+	rows, err := db.Query(`SELECT stage, min_days_overdue, flat_fee, percent_of_balance FROM late_fee_schedule
+		WHERE is_active = 1 ORDER BY min_days_overdue`)
+	if err != nil {
+		log.Printf("Error loading late fee schedule: %v", err)
+		return
+	}
+	var stages []lateFeeStage
+	for rows.Next() {
+		var s lateFeeStage
+		if err := rows.Scan(&s.stage, &s.minDaysOverdue, &s.flatFee, &s.percent); err != nil {
+			log.Printf("Error scanning late fee stage: %v", err)
+			continue
+		}
+		stages = append(stages, s)
+	}
+	rows.Close()
+
+	now := simNow()
+	for _, inv := range invoices {
+		daysOverdue := inv.DaysOverdue(now)
+		if daysOverdue <= 0 || inv.Outstanding() <= 0 {
+			continue
+		}
+		if err := ageInvoice(inv, stages, daysOverdue); err != nil {
+			log.Printf("Error aging invoice %d: %v", inv.ID, err)
+			continue
+		}
+		if inv.Status == "pending" {
+			log.Printf("Invoice %d is now overdue (%d days past due)", inv.ID, daysOverdue)
+		}
+	}
+}
+
+// Mark one invoice overdue and add the fee and reminder for each stage it has
+// newly reached. All or nothing, so a failed sweep never leaves a fee without
+// the reminder that stops the next sweep charging it again.
+func ageInvoice(inv agingInvoice, stages []lateFeeStage, daysOverdue int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if inv.Status == "pending" {
+		if _, err := tx.Exec(`UPDATE invoices SET status = 'overdue' WHERE id = ?`, inv.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range stages {
+		if daysOverdue < s.minDaysOverdue {
+			break
+		}
+
+		var exists int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM invoice_reminders WHERE invoice_id = ? AND stage = ?`, inv.ID, s.stage).Scan(&exists); err != nil {
+			return err
+		}
+		if exists > 0 {
+			continue
+		}
+
+		fee := roundCents(s.flatFee + inv.Outstanding()*s.percent/100)
+		if fee > 0 {
+			_, err := tx.Exec(`INSERT INTO invoice_line_items (invoice_id, description, amount, item_type, created_at) VALUES (?, ?, ?, 'late_fee', ?)`,
+				inv.ID, fmt.Sprintf("Late fee (%s)", s.stage), fee, simNow().Format(sqliteTimeLayout))
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(`UPDATE invoices SET amount = ROUND(amount + ?, 2) WHERE id = ?`, fee, inv.ID); err != nil {
+				return err
+			}
+			inv.Amount = roundCents(inv.Amount + fee)
+		}
+
+		_, err := tx.Exec(`INSERT INTO invoice_reminders (invoice_id, stage, days_overdue, amount_due, late_fee) VALUES (?, ?, ?, ?, ?)`,
+			inv.ID, s.stage, daysOverdue, inv.Outstanding(), fee)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Receivables aging report bucketed by days past due
+func getReceivablesAging(w http.ResponseWriter, r *http.Request) {
+	invoices, err := loadAgingInvoices()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := simNow()
+	buckets := map[string]float64{"current": 0, "1_30": 0, "31_60": 0, "61_90": 0, "over_90": 0}
+	var total float64
+	var rows []map[string]interface{}
+	for _, inv := range invoices {
+		outstanding := inv.Outstanding()
+		if outstanding <= 0 {
+			continue
+		}
+
+		daysOverdue := inv.DaysOverdue(now)
+		if daysOverdue < 0 {
+			daysOverdue = 0
+		}
+		bucket := agingBucket(daysOverdue)
+		buckets[bucket] = roundCents(buckets[bucket] + outstanding)
+		total += outstanding
+
+		rows = append(rows, map[string]interface{}{
+			"invoice_id":    inv.ID,
+			"job_id":        inv.JobID,
+			"customer_name": inv.CustomerName,
+			"due_date":      inv.DueDate.Format("2006-01-02"),
+			"days_overdue":  daysOverdue,
+			"bucket":        bucket,
+			"amount":        inv.Amount,
+			"paid":          inv.Paid,
+			"outstanding":   outstanding,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"as_of":             now.Format("2006-01-02"),
+		"buckets":           buckets,
+		"total_outstanding": roundCents(total),
+		"invoices":          rows,
+	})
+}
+
+func agingBucket(daysOverdue int) string {
+	switch {
+	case daysOverdue <= 0:
+		return "current"
+	case daysOverdue <= 30:
+		return "1_30"
+	case daysOverdue <= 60:
+		return "31_60"
+	case daysOverdue <= 90:
+		return "61_90"
+	default:
+		return "over_90"
+	}
+}
+
+func getInvoiceReminders(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT rm.id, rm.invoice_id, rm.stage, rm.days_overdue, rm.amount_due, rm.late_fee, rm.status, rm.notes,
+		rm.created_at, rm.actioned_at, i.customer_name, i.customer_phone
+		FROM invoice_reminders rm JOIN invoices i ON i.id = rm.invoice_id`
+	var args []interface{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		query += ` WHERE rm.status = ?`
+		args = append(args, status)
+	}
+
+	rows, err := db.Query(query+` ORDER BY rm.id`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var reminders []map[string]interface{}
+	for rows.Next() {
+		var id, invoiceID, daysOverdue sql.NullInt64
+		var amountDue, lateFee sql.NullFloat64
+		var stage, status, notes, createdAt, actionedAt, customerName, customerPhone sql.NullString
+
+		err := rows.Scan(&id, &invoiceID, &stage, &daysOverdue, &amountDue, &lateFee, &status, &notes,
+			&createdAt, &actionedAt, &customerName, &customerPhone)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		reminder := map[string]interface{}{
+			"id":             id.Int64,
+			"invoice_id":     invoiceID.Int64,
+			"stage":          stage.String,
+			"days_overdue":   daysOverdue.Int64,
+			"amount_due":     amountDue.Float64,
+			"late_fee":       lateFee.Float64,
+			"status":         status.String,
+			"notes":          notes.String,
+			"created_at":     createdAt.String,
+			"actioned_at":    actionedAt.String,
+			"customer_name":  customerName.String,
+			"customer_phone": customerPhone.String,
+		}
+		reminders = append(reminders, reminder)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reminders)
+}
+
+// Record what billing did with a reminder (sent, resolved or dismissed)
+func updateInvoiceReminder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	reminderID := vars["id"]
+
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status, _ := update["status"].(string)
+	if status != "sent" && status != "resolved" && status != "dismissed" {
+		http.Error(w, "status must be one of sent, resolved, dismissed", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`UPDATE invoice_reminders SET status = ?, notes = COALESCE(?, notes), actioned_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		status, update["notes"], reminderID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		http.Error(w, "Reminder not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+func getLateFeeSchedule(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT stage, min_days_overdue, flat_fee, percent_of_balance, is_active FROM late_fee_schedule ORDER BY min_days_overdue`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var schedule []map[string]interface{}
+	for rows.Next() {
+		var stage sql.NullString
+		var minDays sql.NullInt64
+		var flatFee, percent sql.NullFloat64
+		var isActive sql.NullBool
+
+		if err := rows.Scan(&stage, &minDays, &flatFee, &percent, &isActive); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		schedule = append(schedule, map[string]interface{}{
+			"stage":              stage.String,
+			"min_days_overdue":   minDays.Int64,
+			"flat_fee":           flatFee.Float64,
+			"percent_of_balance": percent.Float64,
+			"is_active":          isActive.Bool,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// Create or replace a late fee stage
+func updateLateFeeStage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	stage := vars["stage"]
+
+	var fee map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&fee); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	minDays, ok := fee["min_days_overdue"].(float64)
+	if !ok || minDays < 1 {
+		http.Error(w, "min_days_overdue must be at least 1", http.StatusBadRequest)
+		return
+	}
+	flatFee, _ := fee["flat_fee"].(float64)
+	percent, _ := fee["percent_of_balance"].(float64)
+	if flatFee < 0 || percent < 0 {
+		http.Error(w, "Fees cannot be negative", http.StatusBadRequest)
+		return
+	}
+	isActive := true
+	if active, ok := fee["is_active"].(bool); ok {
+		isActive = active
+	}
+
+	_, err := db.Exec(`INSERT OR REPLACE INTO late_fee_schedule (stage, min_days_overdue, flat_fee, percent_of_balance, is_active)
+		VALUES (?, ?, ?, ?, ?)`, stage, int(minDays), flatFee, percent, isActive)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"stage": stage})
+}
+
+func getInvoiceLineItems(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	invoiceID := vars["id"]
+
+	rows, err := db.Query(`SELECT id, description, amount, item_type, created_at FROM invoice_line_items WHERE invoice_id = ? ORDER BY id`, invoiceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var items []map[string]interface{}
+	for rows.Next() {
+		var id sql.NullInt64
+		var description, itemType, createdAt sql.NullString
+		var amount sql.NullFloat64
+
+		if err := rows.Scan(&id, &description, &amount, &itemType, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		items = append(items, map[string]interface{}{
+			"id":          id.Int64,
+			"description": description.String,
+			"amount":      amount.Float64,
+			"item_type":   itemType.String,
+			"created_at":  createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
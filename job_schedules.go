@@ -0,0 +1,785 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Jobs booked in advance. A job schedule holds the job's details, when it is
+// first due (scheduled_for) and an optional RRULE-style recurrence. The
+// scheduler turns each occurrence into a pending job lead_minutes before it is
+// due, by the simulation clock; the job carries scheduled_for and stays out of
+// the available queue, and its SLA clocks do not start, until then. One-off
+// jobs can also be booked ahead with scheduled_for on POST /jobs.
+
+// Most occurrences one schedule materialises in one pass, so a long clock
+// jump cannot flood the job list
+const maxScheduleCatchUp = 50
+
+// Longest lead time: a week
+const maxLeadMinutes = 7 * 24 * 60
+
+var scheduleMutex sync.Mutex
+
+// Parse an RFC3339 or SQLite timestamp as UTC
+func parseScheduleTime(value string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339, sqliteTimeLayout} {
+		if t, err := time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// The supported subset of RFC 5545 recurrence rules: FREQ=DAILY, WEEKLY or
+// MONTHLY with INTERVAL, BYDAY (weekly), BYMONTHDAY (monthly, negative counts
+// from the end of the month) and COUNT or UNTIL. Occurrences keep the time of
+// day of the first one.
+type recurrenceRule struct {
+	Freq       string
+	Interval   int
+	ByDay      []time.Weekday
+	ByMonthDay []int
+	Count      int
+	Until      time.Time
+}
+
+var rruleWeekdays = []string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+func parseRecurrence(value string) (*recurrenceRule, error) {
+	value = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "RRULE:")
+	rule := &recurrenceRule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("%q is not KEY=VALUE", part)
+		}
+		switch key {
+		case "FREQ":
+			if val != "DAILY" && val != "WEEKLY" && val != "MONTHLY" {
+				return nil, errors.New("FREQ must be DAILY, WEEKLY or MONTHLY")
+			}
+			rule.Freq = val
+		case "INTERVAL":
+			interval, err := strconv.Atoi(val)
+			if err != nil || interval < 1 || interval > 365 {
+				return nil, errors.New("INTERVAL must be between 1 and 365")
+			}
+			rule.Interval = interval
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				index := -1
+				for i, name := range rruleWeekdays {
+					if day == name {
+						index = i
+					}
+				}
+				if index < 0 {
+					return nil, fmt.Errorf("BYDAY %q must be one of %s", day, strings.Join(rruleWeekdays, ", "))
+				}
+				rule.ByDay = append(rule.ByDay, time.Weekday(index))
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(val, ",") {
+				monthDay, err := strconv.Atoi(day)
+				if err != nil || monthDay == 0 || monthDay < -31 || monthDay > 31 {
+					return nil, fmt.Errorf("BYMONTHDAY %q must be 1 to 31 or -1 to -31", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, monthDay)
+			}
+		case "COUNT":
+			count, err := strconv.Atoi(val)
+			if err != nil || count < 1 {
+				return nil, errors.New("COUNT must be at least 1")
+			}
+			rule.Count = count
+		case "UNTIL":
+			until, err := time.Parse("20060102T150405Z", val)
+			if err != nil {
+				day, dayErr := time.Parse("20060102", val)
+				if dayErr != nil {
+					return nil, errors.New("UNTIL must be YYYYMMDD or YYYYMMDDTHHMMSSZ")
+				}
+				until = day.Add(24*time.Hour - time.Second)
+			}
+			rule.Until = until
+		default:
+			return nil, fmt.Errorf("%s is not supported", key)
+		}
+	}
+
+	switch {
+	case rule.Freq == "":
+		return nil, errors.New("FREQ is required")
+	case rule.Count > 0 && !rule.Until.IsZero():
+		return nil, errors.New("COUNT and UNTIL cannot both be given")
+	case len(rule.ByDay) > 0 && rule.Freq != "WEEKLY":
+		return nil, errors.New("BYDAY needs FREQ=WEEKLY")
+	case len(rule.ByMonthDay) > 0 && rule.Freq != "MONTHLY":
+		return nil, errors.New("BYMONTHDAY needs FREQ=MONTHLY")
+	}
+	return rule, nil
+}
+
+// The rule written out in a fixed order, as stored
+func (rule *recurrenceRule) String() string {
+	parts := []string{"FREQ=" + rule.Freq}
+	if rule.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rule.Interval))
+	}
+	if len(rule.ByDay) > 0 {
+		days := make([]string, len(rule.ByDay))
+		for i, day := range rule.ByDay {
+			days[i] = rruleWeekdays[day]
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(rule.ByMonthDay) > 0 {
+		days := make([]string, len(rule.ByMonthDay))
+		for i, day := range rule.ByMonthDay {
+			days[i] = strconv.Itoa(day)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if rule.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(rule.Count))
+	}
+	if !rule.Until.IsZero() {
+		parts = append(parts, "UNTIL="+rule.Until.Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Candidate times in the nth period (day, week or month) after start, in order
+func (rule *recurrenceRule) period(start time.Time, n int) []time.Time {
+	var times []time.Time
+	switch rule.Freq {
+	case "DAILY":
+		times = append(times, start.AddDate(0, 0, n*rule.Interval))
+	case "WEEKLY":
+		// Weeks start on Monday
+		monday := start.AddDate(0, 0, 7*n*rule.Interval-(int(start.Weekday())+6)%7)
+		days := rule.ByDay
+		if len(days) == 0 {
+			days = []time.Weekday{start.Weekday()}
+		}
+		for _, day := range days {
+			times = append(times, monday.AddDate(0, 0, (int(day)+6)%7))
+		}
+	case "MONTHLY":
+		first := time.Date(start.Year(), start.Month()+time.Month(n*rule.Interval), 1,
+			start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+		lastDay := first.AddDate(0, 1, -1).Day()
+		days := rule.ByMonthDay
+		if len(days) == 0 {
+			days = []int{start.Day()}
+		}
+		for _, day := range days {
+			if day < 0 {
+				day = lastDay + 1 + day
+			}
+			// Months without the day are skipped
+			if day >= 1 && day <= lastDay {
+				times = append(times, first.AddDate(0, 0, day-1))
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	return times
+}
+
+// Up to limit occurrences after the given time and no later than until (zero
+// for no end), counting COUNT from the first occurrence at or after start
+func (rule *recurrenceRule) occurrences(start, after time.Time, limit int, until time.Time) []time.Time {
+	var found []time.Time
+	var previous time.Time
+	count := 0
+	// Ten thousand periods is decades of daily work; it also ends rules whose
+	// days never come round, like BYMONTHDAY=31 every twelve months from April
+	for n := 0; n < 10000; n++ {
+		for _, at := range rule.period(start, n) {
+			if at.Before(start) || at.Equal(previous) {
+				continue
+			}
+			previous = at
+			count++
+			if (rule.Count > 0 && count > rule.Count) || (!rule.Until.IsZero() && at.After(rule.Until)) {
+				return found
+			}
+			if !until.IsZero() && at.After(until) {
+				return found
+			}
+			if at.After(after) {
+				if found = append(found, at); len(found) == limit {
+					return found
+				}
+			}
+		}
+	}
+	return found
+}
+
+type jobSchedule struct {
+	ID                     int64      `json:"id"`
+	VehicleDescription     string     `json:"vehicle_description"`
+	PickupCoordinates      string     `json:"pickup_coordinates"`
+	DestinationCoordinates string     `json:"destination_coordinates"`
+	JobType                string     `json:"job_type"`
+	Priority               string     `json:"priority"`
+	Zone                   string     `json:"zone"`
+	Notes                  string     `json:"notes"`
+	LicensePlate           string     `json:"license_plate"`
+	OwnerName              string     `json:"owner_name"`
+	OwnerPhone             string     `json:"owner_phone"`
+	VehicleClass           string     `json:"vehicle_class"`
+	ImpoundLotID           int64      `json:"impound_lot_id,omitempty"`
+	CustomerID             int64      `json:"customer_id"`
+	PONumber               string     `json:"po_number"`
+	ScheduledFor           time.Time  `json:"scheduled_for"`
+	Recurrence             string     `json:"recurrence"`
+	LeadMinutes            int        `json:"lead_minutes"`
+	NextRunAt              *time.Time `json:"next_run_at"`
+	IsActive               bool       `json:"is_active"`
+	rule                   *recurrenceRule
+}
+
+// Up to limit occurrences after the given time and no later than until (zero
+// for no end); a schedule without a recurrence has one
+func (schedule *jobSchedule) occurrences(after time.Time, limit int, until time.Time) []time.Time {
+	if schedule.rule != nil {
+		return schedule.rule.occurrences(schedule.ScheduledFor, after, limit, until)
+	}
+	if schedule.ScheduledFor.After(after) && (until.IsZero() || !schedule.ScheduledFor.After(until)) {
+		return []time.Time{schedule.ScheduledFor}
+	}
+	return nil
+}
+
+// The next occurrence to materialise: the first one due no earlier than from
+// and after the last occurrence already turned into a job
+func (schedule *jobSchedule) nextRun(from, lastRun time.Time) (time.Time, bool) {
+	after := from.Add(-time.Second)
+	if lastRun.After(after) {
+		after = lastRun
+	}
+	next := schedule.occurrences(after, 1, time.Time{})
+	if len(next) == 0 {
+		return time.Time{}, false
+	}
+	return next[0], true
+}
+
+const jobScheduleColumns = `id, vehicle_description, pickup_coordinates, destination_coordinates, job_type, priority, zone, notes,
+	license_plate, owner_name, owner_phone, vehicle_class, impound_lot_id, customer_id, po_number, starts_at, recurrence,
+	lead_minutes, next_run_at, is_active`
+
+func loadJobSchedules(where string, args ...interface{}) ([]*jobSchedule, error) {
+	rows, err := db.Query(`SELECT `+jobScheduleColumns+` FROM job_schedules `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []*jobSchedule
+	for rows.Next() {
+		schedule := &jobSchedule{}
+		var destination, priority, zone, notes, licensePlate, ownerName, ownerPhone, vehicleClass sql.NullString
+		var poNumber, startsAt, recurrence, nextRunAt sql.NullString
+		var impoundLotID, customerID sql.NullInt64
+		err := rows.Scan(&schedule.ID, &schedule.VehicleDescription, &schedule.PickupCoordinates, &destination, &schedule.JobType,
+			&priority, &zone, &notes, &licensePlate, &ownerName, &ownerPhone, &vehicleClass, &impoundLotID, &customerID,
+			&poNumber, &startsAt, &recurrence, &schedule.LeadMinutes, &nextRunAt, &schedule.IsActive)
+		if err != nil {
+			return nil, err
+		}
+		schedule.DestinationCoordinates, schedule.Priority, schedule.Zone = destination.String, priority.String, zone.String
+		schedule.Notes, schedule.LicensePlate = notes.String, licensePlate.String
+		schedule.OwnerName, schedule.OwnerPhone, schedule.VehicleClass = ownerName.String, ownerPhone.String, vehicleClass.String
+		schedule.ImpoundLotID, schedule.CustomerID, schedule.PONumber = impoundLotID.Int64, customerID.Int64, poNumber.String
+		schedule.ScheduledFor, _ = parseDBTime(startsAt.String)
+		if next, ok := parseDBTime(nextRunAt.String); ok {
+			schedule.NextRunAt = &next
+		}
+		if recurrence.String != "" {
+			if schedule.rule, err = parseRecurrence(recurrence.String); err != nil {
+				return nil, fmt.Errorf("schedule %d: %v", schedule.ID, err)
+			}
+			schedule.Recurrence = schedule.rule.String()
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules, rows.Err()
+}
+
+func parseScheduleID(w http.ResponseWriter, id string) (*jobSchedule, bool) {
+	scheduleID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return nil, false
+	}
+	schedules, err := loadJobSchedules(`WHERE id = ?`, scheduleID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(schedules) == 0 {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return nil, false
+	}
+	return schedules[0], true
+}
+
+// Latest occurrence already turned into a job, zero if none
+func lastScheduledRun(scheduleID int64) (time.Time, error) {
+	var lastRun sql.NullString
+	if err := db.QueryRow(`SELECT MAX(scheduled_for) FROM jobs WHERE schedule_id = ?`, scheduleID).Scan(&lastRun); err != nil {
+		return time.Time{}, err
+	}
+	last, _ := parseDBTime(lastRun.String)
+	return last, nil
+}
+
+func scheduleWorker() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Job scheduler started")
+
+	materializeScheduledJobs()
+	for range ticker.C {
+		materializeScheduledJobs()
+	}
+}
+
+// Turn every occurrence within its schedule's lead time into a pending job,
+// catching up on occurrences passed while the clock jumped ahead
+func materializeScheduledJobs() {
+	scheduleMutex.Lock()
+	defer scheduleMutex.Unlock()
+
+	schedules, err := loadJobSchedules(`WHERE is_active = 1 AND next_run_at IS NOT NULL`)
+	if err != nil {
+		log.Printf("Error loading job schedules: %v", err)
+		return
+	}
+
+	now := simNow()
+	for _, schedule := range schedules {
+		lead := time.Duration(schedule.LeadMinutes) * time.Minute
+		for i := 0; i < maxScheduleCatchUp && schedule.NextRunAt != nil && !schedule.NextRunAt.Add(-lead).After(now); i++ {
+			due := *schedule.NextRunAt
+			jobID, err := materializeOccurrence(schedule)
+			if err != nil {
+				log.Printf("Error creating job for schedule %d: %v", schedule.ID, err)
+				break
+			}
+			log.Printf("Schedule %d: created %s job %d due %s", schedule.ID, schedule.JobType, jobID, due.Format(time.RFC3339))
+		}
+	}
+}
+
+// Create the job for a schedule's next occurrence and move the schedule on
+func materializeOccurrence(schedule *jobSchedule) (int64, error) {
+	due := *schedule.NextRunAt
+	var next interface{}
+	nextRun := schedule.occurrences(due, 1, time.Time{})
+	if len(nextRun) > 0 {
+		next = nextRun[0].Format(sqliteTimeLayout)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO jobs (vehicle_description, pickup_coordinates, destination_coordinates, job_type, notes,
+		impound_lot_id, license_plate, owner_name, owner_phone, vehicle_class, customer_id, po_number, zone, priority,
+		created_at, scheduled_for, schedule_id)
+		SELECT vehicle_description, pickup_coordinates, destination_coordinates, job_type, notes,
+		impound_lot_id, license_plate, owner_name, owner_phone, vehicle_class, customer_id, po_number, zone, priority, ?, ?, id
+		FROM job_schedules WHERE id = ?`,
+		simNow().Format(sqliteTimeLayout), due.Format(sqliteTimeLayout), schedule.ID)
+	if err != nil {
+		return 0, err
+	}
+	jobID, _ := result.LastInsertId()
+	if _, err := tx.Exec(`UPDATE job_schedules SET next_run_at = ? WHERE id = ?`, next, schedule.ID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	schedule.NextRunAt = nil
+	if len(nextRun) > 0 {
+		schedule.NextRunAt = &nextRun[0]
+	}
+	return jobID, nil
+}
+
+func getSchedules(w http.ResponseWriter, r *http.Request) {
+	where := `ORDER BY next_run_at IS NULL, next_run_at, id`
+	if r.URL.Query().Get("active") == "true" {
+		where = `WHERE is_active = 1 ` + where
+	}
+	schedules, err := loadJobSchedules(where)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if schedules == nil {
+		schedules = []*jobSchedule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// Book a job ahead: the job's fields as for POST /jobs plus "scheduled_for",
+// an optional "recurrence" like "FREQ=WEEKLY;BYDAY=MO,TH" and "lead_minutes"
+// (default 60) for how long before each occurrence its job is created
+func createSchedule(w http.ResponseWriter, r *http.Request) {
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, field := range []string{"vehicle_description", "pickup_coordinates", "job_type"} {
+		if value, _ := body[field].(string); strings.TrimSpace(value) == "" {
+			http.Error(w, field+" is required", http.StatusBadRequest)
+			return
+		}
+	}
+	text, _ := body["scheduled_for"].(string)
+	scheduledFor, ok := parseScheduleTime(text)
+	if !ok {
+		http.Error(w, "scheduled_for must be an RFC3339 timestamp", http.StatusBadRequest)
+		return
+	}
+	schedule := &jobSchedule{ScheduledFor: scheduledFor, LeadMinutes: 60}
+	if value, ok := body["recurrence"]; ok && value != nil {
+		text, _ := value.(string)
+		rule, err := parseRecurrence(text)
+		if err != nil {
+			http.Error(w, "recurrence: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		schedule.rule = rule
+	}
+	if value, ok := body["lead_minutes"]; ok {
+		minutes, isNumber := value.(float64)
+		if !isNumber || minutes != float64(int(minutes)) || minutes < 0 || minutes > maxLeadMinutes {
+			http.Error(w, fmt.Sprintf("lead_minutes must be a whole number from 0 to %d", maxLeadMinutes), http.StatusBadRequest)
+			return
+		}
+		schedule.LeadMinutes = int(minutes)
+	}
+
+	next, ok := schedule.nextRun(simNow(), time.Time{})
+	if !ok {
+		http.Error(w, "scheduled_for and recurrence have no occurrences left", http.StatusBadRequest)
+		return
+	}
+
+	fields, problem, status, err := newJobFromBody(body, "scheduled")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if problem != "" {
+		http.Error(w, problem, status)
+		return
+	}
+	var recurrence interface{}
+	if schedule.rule != nil {
+		recurrence = schedule.rule.String()
+	}
+
+	result, err := db.Exec(`INSERT INTO job_schedules (vehicle_description, pickup_coordinates, destination_coordinates, job_type, notes,
+		impound_lot_id, license_plate, owner_name, owner_phone, vehicle_class, customer_id, po_number, zone, priority,
+		starts_at, recurrence, lead_minutes, next_run_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		body["vehicle_description"], body["pickup_coordinates"], body["destination_coordinates"], body["job_type"], body["notes"],
+		body["impound_lot_id"], body["license_plate"], body["owner_name"], body["owner_phone"], fields.VehicleClass, fields.Customer,
+		fields.PONumber, fields.Zone, fields.Priority, scheduledFor.Format(sqliteTimeLayout), recurrence, schedule.LeadMinutes,
+		next.Format(sqliteTimeLayout))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	// An occurrence already inside the lead time gets its job straight away
+	materializeScheduledJobs()
+
+	writeSchedule(w, id, http.StatusCreated)
+}
+
+func getSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule, ok := parseScheduleID(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	writeSchedule(w, schedule.ID, http.StatusOK)
+}
+
+// A schedule with its next five occurrences and the jobs made so far
+func writeSchedule(w http.ResponseWriter, scheduleID int64, status int) {
+	schedules, err := loadJobSchedules(`WHERE id = ?`, scheduleID)
+	if err != nil || len(schedules) == 0 {
+		http.Error(w, fmt.Sprintf("loading schedule %d: %v", scheduleID, err), http.StatusInternalServerError)
+		return
+	}
+	schedule := schedules[0]
+
+	upcoming := []string{}
+	if schedule.IsActive && schedule.NextRunAt != nil {
+		for _, at := range schedule.occurrences(schedule.NextRunAt.Add(-time.Second), 5, time.Time{}) {
+			upcoming = append(upcoming, at.Format(time.RFC3339))
+		}
+	}
+
+	rows, err := db.Query(`SELECT id, scheduled_for, status, assigned_driver_id FROM jobs WHERE schedule_id = ? ORDER BY scheduled_for DESC, id DESC`, scheduleID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	jobs := []map[string]interface{}{}
+	for rows.Next() {
+		var id int64
+		var scheduledFor, jobStatus sql.NullString
+		var driverID sql.NullInt64
+		if err := rows.Scan(&id, &scheduledFor, &jobStatus, &driverID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jobs = append(jobs, map[string]interface{}{
+			"id":                 id,
+			"scheduled_for":      scheduledFor.String,
+			"status":             jobStatus.String,
+			"assigned_driver_id": driverID.Int64,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"schedule": schedule,
+		"upcoming": upcoming,
+		"jobs":     jobs,
+	})
+}
+
+// Change a schedule: scheduled_for, recurrence (null for a one-off),
+// lead_minutes, priority, notes or is_active. Occurrences missed while a
+// schedule was paused are skipped when it is resumed.
+func updateSchedule(w http.ResponseWriter, r *http.Request) {
+	schedule, ok := parseScheduleID(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	values := map[string]interface{}{}
+	rescheduled := false
+	for field, value := range update {
+		switch field {
+		case "scheduled_for":
+			text, _ := value.(string)
+			scheduledFor, ok := parseScheduleTime(text)
+			if !ok {
+				http.Error(w, "scheduled_for must be an RFC3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			schedule.ScheduledFor = scheduledFor
+			values["starts_at"] = scheduledFor.Format(sqliteTimeLayout)
+			rescheduled = true
+		case "recurrence":
+			schedule.rule, values["recurrence"] = nil, nil
+			if value != nil {
+				text, _ := value.(string)
+				rule, err := parseRecurrence(text)
+				if err != nil {
+					http.Error(w, "recurrence: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				schedule.rule, values["recurrence"] = rule, rule.String()
+			}
+			rescheduled = true
+		case "lead_minutes":
+			minutes, isNumber := value.(float64)
+			if !isNumber || minutes != float64(int(minutes)) || minutes < 0 || minutes > maxLeadMinutes {
+				http.Error(w, fmt.Sprintf("lead_minutes must be a whole number from 0 to %d", maxLeadMinutes), http.StatusBadRequest)
+				return
+			}
+			values[field] = int(minutes)
+		case "priority":
+			if priority, _ := value.(string); !validPriority(priority) {
+				http.Error(w, "priority must be one of "+strings.Join(jobPriorities, ", "), http.StatusBadRequest)
+				return
+			}
+			values[field] = value
+		case "notes":
+			if _, isText := value.(string); !isText {
+				http.Error(w, "notes must be text", http.StatusBadRequest)
+				return
+			}
+			values[field] = value
+		case "is_active":
+			active, isBool := value.(bool)
+			if !isBool {
+				http.Error(w, "is_active must be true or false", http.StatusBadRequest)
+				return
+			}
+			values[field] = active
+			rescheduled = rescheduled || (active && !schedule.IsActive)
+		default:
+			http.Error(w, field+" cannot be changed", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var nextRunAt interface{}
+	if rescheduled {
+		lastRun, err := lastScheduledRun(schedule.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		values["next_run_at"] = nil
+		if next, ok := schedule.nextRun(simNow(), lastRun); ok {
+			values["next_run_at"], nextRunAt = next.Format(sqliteTimeLayout), next.Format(time.RFC3339)
+		}
+	}
+
+	scheduleMutex.Lock()
+	changed := []string{}
+	for field, value := range values {
+		if _, err := db.Exec(`UPDATE job_schedules SET `+field+` = ? WHERE id = ?`, value, schedule.ID); err != nil {
+			scheduleMutex.Unlock()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if field == "starts_at" {
+			field = "scheduled_for"
+		}
+		if field != "next_run_at" {
+			changed = append(changed, field)
+		}
+	}
+	scheduleMutex.Unlock()
+	sort.Strings(changed)
+
+	if rescheduled {
+		materializeScheduledJobs()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": schedule.ID, "changed": changed, "next_run_at": nextRunAt})
+}
+
+// Work booked over the next ?days= (default 7, up to 90): jobs already
+// created but not yet due and the schedules' occurrences still to come, in
+// the order they are due
+func getUpcomingWork(w http.ResponseWriter, r *http.Request) {
+	days := 7
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 90 {
+			http.Error(w, "days must be between 1 and 90", http.StatusBadRequest)
+			return
+		}
+		days = parsed
+	}
+	now := simNow()
+	until := now.AddDate(0, 0, days)
+
+	rows, err := db.Query(`SELECT id, schedule_id, scheduled_for, job_type, priority, status, vehicle_description, pickup_coordinates, zone, assigned_driver_id
+		FROM jobs WHERE status IN ('pending', 'assigned') AND scheduled_for > ? AND scheduled_for <= ?`,
+		now.Format(sqliteTimeLayout), until.Format(sqliteTimeLayout))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type upcomingWork struct {
+		due  time.Time
+		work map[string]interface{}
+	}
+	var upcoming []upcomingWork
+	for rows.Next() {
+		var id int64
+		var scheduleID, driverID sql.NullInt64
+		var scheduledFor, jobType, priority, status, vehicle, pickup, zone sql.NullString
+		if err := rows.Scan(&id, &scheduleID, &scheduledFor, &jobType, &priority, &status, &vehicle, &pickup, &zone, &driverID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		due, _ := parseDBTime(scheduledFor.String)
+		upcoming = append(upcoming, upcomingWork{due, map[string]interface{}{
+			"scheduled_for":       due.Format(time.RFC3339),
+			"job_id":              id,
+			"schedule_id":         scheduleID.Int64,
+			"job_type":            jobType.String,
+			"priority":            priority.String,
+			"status":              status.String,
+			"assigned_driver_id":  driverID.Int64,
+			"vehicle_description": vehicle.String,
+			"pickup_coordinates":  pickup.String,
+			"zone":                zone.String,
+		}})
+	}
+	rows.Close()
+
+	schedules, err := loadJobSchedules(`WHERE is_active = 1 AND next_run_at IS NOT NULL`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, schedule := range schedules {
+		for _, due := range schedule.occurrences(schedule.NextRunAt.Add(-time.Second), 100, until) {
+			upcoming = append(upcoming, upcomingWork{due, map[string]interface{}{
+				"scheduled_for":       due.Format(time.RFC3339),
+				"schedule_id":         schedule.ID,
+				"job_type":            schedule.JobType,
+				"priority":            schedule.Priority,
+				"status":              "scheduled",
+				"vehicle_description": schedule.VehicleDescription,
+				"pickup_coordinates":  schedule.PickupCoordinates,
+				"zone":                schedule.Zone,
+			}})
+		}
+	}
+
+	sort.SliceStable(upcoming, func(i, j int) bool { return upcoming[i].due.Before(upcoming[j].due) })
+	work := []map[string]interface{}{}
+	for _, item := range upcoming {
+		work = append(work, item.work)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from": now.Format(time.RFC3339),
+		"to":   until.Format(time.RFC3339),
+		"work": work,
+	})
+}
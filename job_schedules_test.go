@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string // normalised rule, empty when it must be rejected
+	}{
+		{"FREQ=DAILY", "FREQ=DAILY"},
+		{"FREQ=DAILY;INTERVAL=1", "FREQ=DAILY"},
+		{"RRULE:freq=weekly;byday=mo,th;count=4", "FREQ=WEEKLY;BYDAY=MO,TH;COUNT=4"},
+		{" FREQ=MONTHLY;BYMONTHDAY=-1 ", "FREQ=MONTHLY;BYMONTHDAY=-1"},
+		{"COUNT=3;INTERVAL=2;FREQ=MONTHLY;BYMONTHDAY=1,15", "FREQ=MONTHLY;INTERVAL=2;BYMONTHDAY=1,15;COUNT=3"},
+		{"FREQ=DAILY;UNTIL=20261031", "FREQ=DAILY;UNTIL=20261031T235959Z"},
+		{"FREQ=DAILY;UNTIL=20261031T120000Z", "FREQ=DAILY;UNTIL=20261031T120000Z"},
+		{"", ""},
+		{"FREQ", ""},
+		{"INTERVAL=2", ""},
+		{"FREQ=YEARLY", ""},
+		{"FREQ=DAILY;INTERVAL=0", ""},
+		{"FREQ=DAILY;INTERVAL=366", ""},
+		{"FREQ=DAILY;COUNT=0", ""},
+		{"FREQ=DAILY;COUNT=2;UNTIL=20261031", ""},
+		{"FREQ=DAILY;UNTIL=tomorrow", ""},
+		{"FREQ=DAILY;BYDAY=MO", ""},
+		{"FREQ=WEEKLY;BYDAY=XX", ""},
+		{"FREQ=WEEKLY;BYMONTHDAY=1", ""},
+		{"FREQ=MONTHLY;BYMONTHDAY=0", ""},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", ""},
+		{"FREQ=MONTHLY;BYSETPOS=1", ""},
+	}
+	for _, tt := range tests {
+		rule, err := parseRecurrence(tt.value)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseRecurrence(%q) = %s, want an error", tt.value, rule)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRecurrence(%q): unexpected error %v", tt.value, err)
+		} else if got := rule.String(); got != tt.want {
+			t.Errorf("parseRecurrence(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRecurrenceOccurrences(t *testing.T) {
+	// Thursday 15 January 2026, 09:00
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 9, 0, 0, 0, time.UTC)
+	}
+	start := day(2026, time.January, 15)
+	before := start.Add(-time.Second)
+
+	tests := []struct {
+		name  string
+		rule  string
+		start time.Time
+		after time.Time
+		limit int
+		until time.Time
+		want  []time.Time
+	}{
+		{"daily", "FREQ=DAILY", start, before, 3, time.Time{},
+			[]time.Time{day(2026, 1, 15), day(2026, 1, 16), day(2026, 1, 17)}},
+		{"daily interval", "FREQ=DAILY;INTERVAL=3", start, before, 3, time.Time{},
+			[]time.Time{day(2026, 1, 15), day(2026, 1, 18), day(2026, 1, 21)}},
+		{"after is exclusive", "FREQ=DAILY", start, start, 2, time.Time{},
+			[]time.Time{day(2026, 1, 16), day(2026, 1, 17)}},
+		{"rule until", "FREQ=DAILY;UNTIL=20260117", start, before, 10, time.Time{},
+			[]time.Time{day(2026, 1, 15), day(2026, 1, 16), day(2026, 1, 17)}},
+		{"until argument is inclusive", "FREQ=DAILY", start, before, 10, day(2026, 1, 16),
+			[]time.Time{day(2026, 1, 15), day(2026, 1, 16)}},
+		{"weekly on the start day", "FREQ=WEEKLY;INTERVAL=2", start, before, 3, time.Time{},
+			[]time.Time{day(2026, 1, 15), day(2026, 1, 29), day(2026, 2, 12)}},
+		{"count with byday", "FREQ=WEEKLY;BYDAY=MO,TH;COUNT=5", start, before, 10, time.Time{},
+			[]time.Time{day(2026, 1, 15), day(2026, 1, 19), day(2026, 1, 22), day(2026, 1, 26), day(2026, 1, 29)}},
+		{"count with byday runs from start, not after", "FREQ=WEEKLY;BYDAY=MO,TH;COUNT=5", start, day(2026, 1, 20), 10, time.Time{},
+			[]time.Time{day(2026, 1, 22), day(2026, 1, 26), day(2026, 1, 29)}},
+		{"byday before the start day waits a week", "FREQ=WEEKLY;BYDAY=MO;COUNT=2", start, before, 10, time.Time{},
+			[]time.Time{day(2026, 1, 19), day(2026, 1, 26)}},
+		{"monthly on the start day", "FREQ=MONTHLY;COUNT=3", start, before, 10, time.Time{},
+			[]time.Time{day(2026, 1, 15), day(2026, 2, 15), day(2026, 3, 15)}},
+		{"bymonthday", "FREQ=MONTHLY;BYMONTHDAY=1,15", start, before, 3, time.Time{},
+			[]time.Time{day(2026, 1, 15), day(2026, 2, 1), day(2026, 2, 15)}},
+		{"last day of the month", "FREQ=MONTHLY;BYMONTHDAY=-1", start, before, 4, time.Time{},
+			[]time.Time{day(2026, 1, 31), day(2026, 2, 28), day(2026, 3, 31), day(2026, 4, 30)}},
+		{"last day of february in a leap year", "FREQ=MONTHLY;BYMONTHDAY=-1", day(2028, 1, 10), day(2028, 1, 9), 2, time.Time{},
+			[]time.Time{day(2028, 1, 31), day(2028, 2, 29)}},
+		{"second to last day", "FREQ=MONTHLY;BYMONTHDAY=-2", start, before, 2, time.Time{},
+			[]time.Time{day(2026, 1, 30), day(2026, 2, 27)}},
+		{"months without the day are skipped", "FREQ=MONTHLY;BYMONTHDAY=31", start, before, 3, time.Time{},
+			[]time.Time{day(2026, 1, 31), day(2026, 3, 31), day(2026, 5, 31)}},
+		{"period cap ends a rule whose day never comes", "FREQ=MONTHLY;INTERVAL=12;BYMONTHDAY=31", day(2026, 4, 10), day(2026, 4, 9), 1, time.Time{},
+			nil},
+	}
+	for _, tt := range tests {
+		rule, err := parseRecurrence(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got := rule.occurrences(tt.start, tt.after, tt.limit, tt.until)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tt.want[i]) {
+				t.Errorf("%s: occurrence %d is %v, want %v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
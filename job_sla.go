@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Job priority and service level targets. Each job type and priority has a
+// target time to assign and a target time to arrive, both counted from when
+// the job was created, or from when it is due for jobs booked ahead; targets
+// for job type "default" apply to job types without their own. A monitor
+// checks open jobs every minute and broadcasts sla_warning once a job has
+// used warn_percent of a target and sla_breached once it is over, one
+// message per job, target and level.
+
+var jobPriorities = []string{"emergency", "high", "normal", "scheduled"}
+
+// Position in the available queue; lower goes first
+func priorityRank(priority string) int {
+	for i, p := range jobPriorities {
+		if p == priority {
+			return i
+		}
+	}
+	return len(jobPriorities)
+}
+
+func validPriority(priority string) bool {
+	return priorityRank(priority) < len(jobPriorities)
+}
+
+type slaTarget struct {
+	JobType       string `json:"job_type"`
+	Priority      string `json:"priority"`
+	AssignMinutes int    `json:"assign_minutes"`
+	ArriveMinutes int    `json:"arrive_minutes"`
+	WarnPercent   int    `json:"warn_percent"`
+}
+
+type slaTargets map[string]slaTarget
+
+func loadSLATargets() (slaTargets, error) {
+	rows, err := db.Query(`SELECT job_type, priority, assign_minutes, arrive_minutes, warn_percent FROM sla_targets`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := slaTargets{}
+	for rows.Next() {
+		var target slaTarget
+		if err := rows.Scan(&target.JobType, &target.Priority, &target.AssignMinutes, &target.ArriveMinutes, &target.WarnPercent); err != nil {
+			return nil, err
+		}
+		targets[target.JobType+"/"+target.Priority] = target
+	}
+	return targets, rows.Err()
+}
+
+// The target for a job type and priority, falling back to the default job type
+func (targets slaTargets) lookup(jobType, priority string) (slaTarget, bool) {
+	if target, ok := targets[jobType+"/"+priority]; ok {
+		return target, true
+	}
+	target, ok := targets["default/"+priority]
+	return target, ok
+}
+
+// Where a job stands against one target
+type slaClock struct {
+	DueAt   time.Time
+	Met     bool // assigned or arrived in time
+	Status  string
+	Minutes float64 // minutes left, negative once breached
+}
+
+// Status of a target that started at start and is done at doneAt (zero while
+// still open): on_track, warning or breached, or met/missed once done
+func evaluateSLA(start time.Time, minutes, warnPercent int, doneAt, now time.Time) slaClock {
+	target := time.Duration(minutes) * time.Minute
+	clock := slaClock{DueAt: start.Add(target)}
+	if !doneAt.IsZero() {
+		clock.Met = !doneAt.After(clock.DueAt)
+		clock.Status = "met"
+		if !clock.Met {
+			clock.Status = "missed"
+		}
+		clock.Minutes = roundMinutes(clock.DueAt.Sub(doneAt))
+		return clock
+	}
+
+	elapsed := now.Sub(start)
+	clock.Minutes = roundMinutes(clock.DueAt.Sub(now))
+	switch {
+	case elapsed >= target:
+		clock.Status = "breached"
+	case elapsed >= target*time.Duration(warnPercent)/100:
+		clock.Status = "warning"
+	default:
+		clock.Status = "on_track"
+	}
+	return clock
+}
+
+func roundMinutes(d time.Duration) float64 {
+	return math.Round(d.Minutes()*10) / 10
+}
+
+func slaClockJSON(clock slaClock) map[string]interface{} {
+	return map[string]interface{}{
+		"due_at":       clock.DueAt.Format(time.RFC3339),
+		"status":       clock.Status,
+		"minutes_left": clock.Minutes,
+	}
+}
+
+// Open jobs with their SLA clocks, as checked by the monitor and the queue
+type openJobSLA struct {
+	JobID      int64
+	JobType    string
+	Priority   string
+	Status     string
+	CreatedAt  time.Time
+	StartAt    time.Time // when the SLA clocks start: scheduled_for, or created_at
+	AssignedAt time.Time
+	ArrivedAt  time.Time
+	Assign     *slaClock
+	Arrive     *slaClock
+}
+
+func loadOpenJobSLAs(statuses ...string) ([]*openJobSLA, error) {
+	targets, err := loadSLATargets()
+	if err != nil {
+		return nil, err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(statuses)), ", ")
+	args := make([]interface{}, len(statuses))
+	for i, status := range statuses {
+		args[i] = status
+	}
+	rows, err := db.Query(`SELECT j.id, j.job_type, j.priority, j.status, j.created_at, COALESCE(j.scheduled_for, j.created_at),
+		(SELECT MIN(created_at) FROM job_events e WHERE e.job_id = j.id AND e.event = 'assigned'),
+		(SELECT MIN(created_at) FROM job_events e WHERE e.job_id = j.id AND e.event = 'arrived')
+		FROM jobs j WHERE j.status IN (`+placeholders+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := simNow()
+	var jobs []*openJobSLA
+	for rows.Next() {
+		job := &openJobSLA{}
+		var jobType, priority, createdAt, startAt, assignedAt, arrivedAt sql.NullString
+		if err := rows.Scan(&job.JobID, &jobType, &priority, &job.Status, &createdAt, &startAt, &assignedAt, &arrivedAt); err != nil {
+			return nil, err
+		}
+		job.JobType, job.Priority = jobType.String, priority.String
+		if job.Priority == "" {
+			job.Priority = "normal"
+		}
+		job.CreatedAt, _ = parseDBTime(createdAt.String)
+		job.StartAt, _ = parseDBTime(startAt.String)
+		job.AssignedAt, _ = parseDBTime(assignedAt.String)
+		job.ArrivedAt, _ = parseDBTime(arrivedAt.String)
+
+		// Jobs assigned before events were recorded have no assignment time;
+		// only the arrival target is still open for them
+		if target, ok := targets.lookup(job.JobType, job.Priority); ok && !job.StartAt.IsZero() {
+			if job.Status == "pending" || !job.AssignedAt.IsZero() {
+				assign := evaluateSLA(job.StartAt, target.AssignMinutes, target.WarnPercent, job.AssignedAt, now)
+				job.Assign = &assign
+			}
+			arrive := evaluateSLA(job.StartAt, target.ArriveMinutes, target.WarnPercent, job.ArrivedAt, now)
+			job.Arrive = &arrive
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func slaMonitorWorker() {
+	ticker := time.NewTicker(60 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("SLA monitor started")
+
+	checkJobSLAs()
+	for range ticker.C {
+		checkJobSLAs()
+	}
+}
+
+// Raise a warning or breach alert for each open target that has reached one,
+// once per job, target and level
+func checkJobSLAs() {
+	jobs, err := loadOpenJobSLAs("pending", "assigned", "in_progress")
+	if err != nil {
+		log.Printf("Error checking SLAs: %v", err)
+		return
+	}
+
+	for _, job := range jobs {
+		for _, check := range []struct {
+			sla   string
+			clock *slaClock
+			label string
+		}{{"assign", job.Assign, "assignment"}, {"arrive", job.Arrive, "arrival"}} {
+			if check.clock == nil || (check.clock.Status != "warning" && check.clock.Status != "breached") {
+				continue
+			}
+			result, err := db.Exec(`INSERT OR IGNORE INTO sla_alerts (job_id, sla, level, due_at, created_at) VALUES (?, ?, ?, ?, ?)`,
+				job.JobID, check.sla, check.clock.Status, check.clock.DueAt.Format(sqliteTimeLayout), simNow().Format(sqliteTimeLayout))
+			if err != nil {
+				log.Printf("Error recording SLA alert for job %d: %v", job.JobID, err)
+				continue
+			}
+			if inserted, _ := result.RowsAffected(); inserted == 0 {
+				continue
+			}
+
+			message := fmt.Sprintf("%s-priority %s job %d: %s due in %.0f min", job.Priority, job.JobType, job.JobID, check.label, check.clock.Minutes)
+			if check.clock.Status == "breached" {
+				message = fmt.Sprintf("%s-priority %s job %d: %s target breached by %.0f min", job.Priority, job.JobType, job.JobID, check.label, -check.clock.Minutes)
+			}
+			gpsData := GPSData{
+				JobID:     job.JobID,
+				Timestamp: time.Now().Format(time.RFC3339),
+				Status:    "sla_" + check.clock.Status,
+				Message:   message,
+			}
+			activeMutex.RLock()
+			if activeJob, ok := activeJobs[job.JobID]; ok {
+				gpsData.DriverID = activeJob.DriverID
+				gpsData.Latitude, gpsData.Longitude = activeJob.CurrentLat, activeJob.CurrentLng
+			}
+			activeMutex.RUnlock()
+			broadcastGPSData(gpsData)
+		}
+	}
+}
+
+func getSLATargets(w http.ResponseWriter, r *http.Request) {
+	targets, err := loadSLATargets()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	list := []slaTarget{}
+	for _, target := range targets {
+		list = append(list, target)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].JobType != list[j].JobType {
+			return list[i].JobType < list[j].JobType
+		}
+		return priorityRank(list[i].Priority) < priorityRank(list[j].Priority)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Set the target for a job type (or "default") and priority:
+// {"assign_minutes": 10, "arrive_minutes": 30, "warn_percent": 80}
+func updateSLATarget(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !validPriority(vars["priority"]) {
+		http.Error(w, "priority must be one of "+strings.Join(jobPriorities, ", "), http.StatusBadRequest)
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	target := slaTarget{JobType: vars["jobType"], Priority: vars["priority"], WarnPercent: 80}
+	for field, into := range map[string]*int{"assign_minutes": &target.AssignMinutes, "arrive_minutes": &target.ArriveMinutes, "warn_percent": &target.WarnPercent} {
+		value, ok := body[field]
+		if !ok && field == "warn_percent" {
+			continue
+		}
+		number, isNumber := value.(float64)
+		if !isNumber || number != float64(int(number)) || number < 1 {
+			http.Error(w, field+" must be a whole number of at least 1", http.StatusBadRequest)
+			return
+		}
+		*into = int(number)
+	}
+	if target.WarnPercent > 99 {
+		http.Error(w, "warn_percent must be below 100", http.StatusBadRequest)
+		return
+	}
+	if target.ArriveMinutes < target.AssignMinutes {
+		http.Error(w, "arrive_minutes must not be less than assign_minutes", http.StatusBadRequest)
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO sla_targets (job_type, priority, assign_minutes, arrive_minutes, warn_percent) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(job_type, priority) DO UPDATE SET assign_minutes = excluded.assign_minutes,
+		arrive_minutes = excluded.arrive_minutes, warn_percent = excluded.warn_percent`,
+		target.JobType, target.Priority, target.AssignMinutes, target.ArriveMinutes, target.WarnPercent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(target)
+}
+
+func deleteSLATarget(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if vars["jobType"] == "default" {
+		http.Error(w, "Default targets can be changed but not removed", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`DELETE FROM sla_targets WHERE job_type = ? AND priority = ?`, vars["jobType"], vars["priority"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, "SLA target not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Alerts raised by the monitor, newest first: ?job_id=, ?sla=, ?level=
+func getSLAAlerts(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT a.id, a.job_id, j.job_type, j.priority, j.status, a.sla, a.level, a.due_at, a.created_at
+		FROM sla_alerts a JOIN jobs j ON j.id = a.job_id WHERE 1 = 1`
+	var args []interface{}
+	for _, param := range []string{"job_id", "sla", "level"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			query += ` AND a.` + param + ` = ?`
+			args = append(args, value)
+		}
+	}
+
+	rows, err := db.Query(query+` ORDER BY a.created_at DESC, a.id DESC LIMIT 200`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	alerts := []map[string]interface{}{}
+	for rows.Next() {
+		var id, jobID int64
+		var jobType, priority, status, sla, level, dueAt, createdAt sql.NullString
+		if err := rows.Scan(&id, &jobID, &jobType, &priority, &status, &sla, &level, &dueAt, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		alerts = append(alerts, map[string]interface{}{
+			"id":         id,
+			"job_id":     jobID,
+			"job_type":   jobType.String,
+			"priority":   priority.String,
+			"job_status": status.String,
+			"sla":        sla.String,
+			"level":      level.String,
+			"due_at":     dueAt.String,
+			"created_at": createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// Order the pending queue: priority first, then the soonest assignment
+// deadline, then the oldest job
+func sortJobQueue(jobs []*openJobSLA) {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		a, b := jobs[i], jobs[j]
+		if rankA, rankB := priorityRank(a.Priority), priorityRank(b.Priority); rankA != rankB {
+			return rankA < rankB
+		}
+		if a.Assign != nil && b.Assign != nil && !a.Assign.DueAt.Equal(b.Assign.DueAt) {
+			return a.Assign.DueAt.Before(b.Assign.DueAt)
+		}
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.JobID < b.JobID
+	})
+}
+
+// ?limit= for the available queue, default 5
+func queueLimit(r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("limit")
+	if value == "" {
+		return 5, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > 100 {
+		return 0, false
+	}
+	return limit, true
+}
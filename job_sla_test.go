@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvaluateSLA(t *testing.T) {
+	start := time.Date(2026, 10, 14, 10, 0, 0, 0, time.UTC)
+	at := func(minutes float64) time.Time { return start.Add(time.Duration(minutes * float64(time.Minute))) }
+	var open time.Time
+
+	// A 30 minute target warning at 80%
+	tests := []struct {
+		name        string
+		warnPercent int
+		doneAt, now time.Time
+		wantStatus  string
+		wantMet     bool
+		wantMinutes float64
+	}{
+		{"early", 80, open, at(10), "on_track", false, 20},
+		{"at the warning threshold", 80, open, at(24), "warning", false, 6},
+		{"warning with no warning period", 100, open, at(29), "on_track", false, 1},
+		{"due now", 80, open, at(30), "breached", false, 0},
+		{"overdue", 80, open, at(45), "breached", false, -15},
+		{"done early", 80, at(29), at(60), "met", true, 1},
+		{"done on the due time", 80, at(30), at(60), "met", true, 0},
+		{"done late", 80, at(31.5), at(60), "missed", false, -1.5},
+	}
+	for _, tt := range tests {
+		clock := evaluateSLA(start, 30, tt.warnPercent, tt.doneAt, tt.now)
+		if !clock.DueAt.Equal(at(30)) {
+			t.Errorf("%s: due at %s, want %s", tt.name, clock.DueAt, at(30))
+		}
+		if clock.Status != tt.wantStatus || clock.Met != tt.wantMet || clock.Minutes != tt.wantMinutes {
+			t.Errorf("%s: got %s (met %v, %.1f minutes), want %s (met %v, %.1f minutes)",
+				tt.name, clock.Status, clock.Met, clock.Minutes, tt.wantStatus, tt.wantMet, tt.wantMinutes)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
    "net/http"
    "os"
    "strconv"
+   "strings"
    "sync"
    "time"
 
@@ -34,11 +35,13 @@ type GPSData struct {
    Timestamp string  `json:"timestamp"`
    Status    string  `json:"status"`
    Message   string  `json:"message,omitempty"`
+   Geofence  *geofenceRef `json:"geofence,omitempty"`
 }
 
 type ActiveJob struct {
    JobID       int64
    DriverID    int64
+   VehicleID   int64 // 0 when no truck was assigned
    StartLat    float64
    StartLng    float64
    EndLat      float64
@@ -51,6 +54,8 @@ type ActiveJob struct {
    Steps       []GPSCoordinate
    ReturnSteps []GPSCoordinate // Exact reverse of outbound journey
    CurrentStep int
+   PickupRadiusM float64
+   Geofences   map[string]bool // Geofences the truck was inside at the last update
 }
 
 type GPSCoordinate struct {
@@ -75,7 +80,7 @@ func main() {
    }
 
    var err error
-   db, err = sql.Open("sqlite3", "./database.db")
+   db, err = sql.Open("sqlite3", "./database.db?_busy_timeout=5000")
    fmt.Println("Created new database")
    if err != nil {
    	log.Fatal(err)
@@ -88,6 +93,11 @@ func main() {
    // Seed database with mock data
    seedDatabase(db)
 
+   // Link free-text customer details to customer records
+   if err := migrateFreeTextCustomers(); err != nil {
+   	log.Printf("Error migrating customers: %v", err)
+   }
+
    // Set up routes
    r := mux.NewRouter()
    
@@ -99,6 +109,9 @@ func main() {
    r.HandleFunc("/jobs/{id}", updateJob).Methods("PUT")
    r.HandleFunc("/jobs/{id}/assign", assignJobWithValidation).Methods("PUT")
    r.HandleFunc("/jobs/{id}/complete", completeJob).Methods("PUT")
+   r.HandleFunc("/jobs/{id}/attachments", getJobAttachments).Methods("GET")
+   r.HandleFunc("/jobs/{id}/attachments", uploadJobAttachment).Methods("POST")
+   r.HandleFunc("/jobs/{id}/fuel", getJobFuel).Methods("GET")
    
    // GPS tracking websocket
    r.HandleFunc("/ws/gps", handleGPSWebSocket).Methods("GET")
@@ -106,33 +119,214 @@ func main() {
    // Drivers endpoints
    r.HandleFunc("/drivers", getDrivers).Methods("GET")
    r.HandleFunc("/drivers", createDriver).Methods("POST")
-   r.HandleFunc("/drivers/{id}", updateDriver).Methods("PUT")
+   r.HandleFunc("/drivers/{id}", updateDriver).Methods("PUT", "PATCH")
+   r.HandleFunc("/drivers/{id}", deleteDriver).Methods("DELETE")
+   r.HandleFunc("/drivers/{id}/audit", getDriverAudit).Methods("GET")
    r.HandleFunc("/drivers/active", getActiveDrivers).Methods("GET")
+   r.HandleFunc("/drivers/{id}/status", getDriverStatus).Methods("GET")
+   r.HandleFunc("/drivers/{id}/shifts", getShifts).Methods("GET")
+   r.HandleFunc("/drivers/{id}/shifts", createShift).Methods("POST")
+   r.HandleFunc("/drivers/{id}/clock-in", clockIn).Methods("POST")
+   r.HandleFunc("/drivers/{id}/clock-out", clockOut).Methods("POST")
+   r.HandleFunc("/drivers/{id}/breaks/start", startBreak).Methods("POST")
+   r.HandleFunc("/drivers/{id}/breaks/end", endBreak).Methods("POST")
+   r.HandleFunc("/drivers/{id}/hos", getDriverHOS).Methods("GET")
+   r.HandleFunc("/drivers/{id}/credentials", getDriverCredentials).Methods("GET")
+   r.HandleFunc("/drivers/{id}/credentials", createDriverCredential).Methods("POST")
+
+   // Credential endpoints
+   r.HandleFunc("/credentials/expiring", getExpiringCredentials).Methods("GET")
+   r.HandleFunc("/credentials/alerts", getCredentialAlerts).Methods("GET")
+   r.HandleFunc("/credentials/types", getCredentialTypes).Methods("GET")
+   r.HandleFunc("/credentials/requirements/{jobType}", updateJobTypeCredentials).Methods("PUT")
+   r.HandleFunc("/credentials/{id}", updateDriverCredential).Methods("PUT")
+   r.HandleFunc("/credentials/{id}", deleteDriverCredential).Methods("DELETE")
+   r.HandleFunc("/credentials/{id}/attachments", getCredentialAttachments).Methods("GET")
+   r.HandleFunc("/credentials/{id}/attachments", uploadCredentialAttachment).Methods("POST")
+
+   // Hours-of-service endpoints
+   r.HandleFunc("/hos/limits", getHOSLimits).Methods("GET")
+   r.HandleFunc("/hos/limits/{code}", updateHOSLimit).Methods("PUT")
+
+   // Shift endpoints
+   r.HandleFunc("/shifts", getShifts).Methods("GET")
+   r.HandleFunc("/shifts/{id}", deleteShift).Methods("DELETE")
    
+   // Customer endpoints
+   r.HandleFunc("/customers", getCustomers).Methods("GET")
+   r.HandleFunc("/customers", createCustomer).Methods("POST")
+   r.HandleFunc("/customers/{id}", getCustomer).Methods("GET")
+   r.HandleFunc("/customers/{id}", updateCustomer).Methods("PUT", "PATCH")
+   r.HandleFunc("/customers/{id}", deleteCustomer).Methods("DELETE")
+   r.HandleFunc("/customers/{id}/history", getCustomerHistory).Methods("GET")
+   r.HandleFunc("/customers/{id}/contacts", createCustomerContact).Methods("POST")
+   r.HandleFunc("/customers/{id}/contacts/{contactId}", deleteCustomerContact).Methods("DELETE")
+   r.HandleFunc("/customers/{id}/rates", getAccountRates).Methods("GET")
+   r.HandleFunc("/customers/{id}/rates/{jobType}", updateAccountRate).Methods("PUT")
+   r.HandleFunc("/customers/{id}/rates/{jobType}", deleteAccountRate).Methods("DELETE")
+   r.HandleFunc("/customers/{id}/statements", getAccountStatements).Methods("GET")
+   r.HandleFunc("/customers/{id}/statements", createAccountStatement).Methods("POST")
+   r.HandleFunc("/statements/{id}", getAccountStatement).Methods("GET")
+
+   // Priority SLA targets and alerts
+   r.HandleFunc("/sla-targets", getSLATargets).Methods("GET")
+   r.HandleFunc("/sla-targets/{jobType}/{priority}", updateSLATarget).Methods("PUT")
+   r.HandleFunc("/sla-targets/{jobType}/{priority}", deleteSLATarget).Methods("DELETE")
+   r.HandleFunc("/sla-alerts", getSLAAlerts).Methods("GET")
+
+   // Scheduled and recurring jobs
+   r.HandleFunc("/schedules", getSchedules).Methods("GET")
+   r.HandleFunc("/schedules", createSchedule).Methods("POST")
+   r.HandleFunc("/schedules/upcoming", getUpcomingWork).Methods("GET")
+   r.HandleFunc("/schedules/{id}", getSchedule).Methods("GET")
+   r.HandleFunc("/schedules/{id}", updateSchedule).Methods("PATCH")
+
+   // Service zones and geofencing
+   r.HandleFunc("/zones", getServiceZones).Methods("GET")
+   r.HandleFunc("/zones", createServiceZones).Methods("POST")
+   r.HandleFunc("/zones/locate", locateServiceZone).Methods("GET")
+   r.HandleFunc("/zones/{id}", getServiceZone).Methods("GET")
+   r.HandleFunc("/zones/{id}", updateServiceZone).Methods("PATCH")
+   r.HandleFunc("/zones/{id}", deleteServiceZone).Methods("DELETE")
+   r.HandleFunc("/geofence-events", getGeofenceEvents).Methods("GET")
+
+   // Police and municipal rotation lists
+   r.HandleFunc("/rotations", getRotations).Methods("GET")
+   r.HandleFunc("/rotations", createRotation).Methods("POST")
+   r.HandleFunc("/rotations/{id}", getRotation).Methods("GET")
+   r.HandleFunc("/rotations/{id}", updateRotation).Methods("PATCH")
+   r.HandleFunc("/rotations/{id}/entries", addRotationEntry).Methods("POST")
+   r.HandleFunc("/rotations/{id}/entries/{entryId}", removeRotationEntry).Methods("DELETE")
+   r.HandleFunc("/rotations/{id}/log", getRotationLog).Methods("GET")
+   r.HandleFunc("/rotations/{id}/report", getRotationReport).Methods("GET")
+
    // Fleet vehicles endpoints
    r.HandleFunc("/vehicles", getVehicles).Methods("GET")
    r.HandleFunc("/vehicles", createVehicle).Methods("POST")
-   r.HandleFunc("/vehicles/{id}", updateVehicle).Methods("PUT")
+   r.HandleFunc("/vehicles/{id}", updateVehicle).Methods("PUT", "PATCH")
    r.HandleFunc("/vehicles/active", getActiveVehicles).Methods("GET")
+   r.HandleFunc("/vehicles/{id}/maintenance", getVehicleMaintenance).Methods("GET")
+   r.HandleFunc("/vehicles/{id}/maintenance", createMaintenanceRecord).Methods("POST")
+   r.HandleFunc("/vehicles/{id}/maintenance/schedules/{serviceType}", updateMaintenanceSchedule).Methods("PUT")
+   r.HandleFunc("/vehicles/{id}/fuel", getVehicleFuel).Methods("GET")
+   r.HandleFunc("/vehicles/{id}/refuel", refuelVehicle).Methods("POST")
+   r.HandleFunc("/maintenance/due", getMaintenanceDue).Methods("GET")
+   r.HandleFunc("/vehicles/{id}/inspections", getVehicleInspections).Methods("GET")
+   r.HandleFunc("/vehicles/{id}/inspections", createVehicleInspection).Methods("POST")
+
+   // Inspection endpoints
+   r.HandleFunc("/inspections/templates", getInspectionTemplates).Methods("GET")
+   r.HandleFunc("/inspections/templates/{vehicleType}/{inspectionType}", updateInspectionTemplate).Methods("PUT")
+   r.HandleFunc("/inspections/{id}", getVehicleInspection).Methods("GET")
+   r.HandleFunc("/inspections/{id}/attachments", getInspectionAttachments).Methods("GET")
+   r.HandleFunc("/inspections/{id}/attachments", uploadInspectionAttachment).Methods("POST")
+
+   // Fuel endpoints
+   r.HandleFunc("/fuel/profiles", getFuelProfiles).Methods("GET")
+   r.HandleFunc("/fuel/profiles/{vehicleType}", updateFuelProfile).Methods("PUT")
+   r.HandleFunc("/fuel/prices", getFuelPrices).Methods("GET")
+   r.HandleFunc("/fuel/prices/{fuelType}", updateFuelPrice).Methods("PUT")
    
    // Invoices endpoints
    r.HandleFunc("/invoices", getInvoices).Methods("GET")
    r.HandleFunc("/invoices", createInvoice).Methods("POST")
+   r.HandleFunc("/invoices/reminders", getInvoiceReminders).Methods("GET")
+   r.HandleFunc("/invoices/reminders/{id}", updateInvoiceReminder).Methods("PUT")
+   r.HandleFunc("/invoices/late-fees", getLateFeeSchedule).Methods("GET")
+   r.HandleFunc("/invoices/late-fees/{stage}", updateLateFeeStage).Methods("PUT")
    r.HandleFunc("/invoices/{id}", updateInvoice).Methods("PUT")
    r.HandleFunc("/invoices/pending", getPendingInvoices).Methods("GET")
+   r.HandleFunc("/invoices/{id}/line-items", getInvoiceLineItems).Methods("GET")
    
    // Payments endpoints
    r.HandleFunc("/payments", createPayment).Methods("POST")
    r.HandleFunc("/invoices/{id}/payments", getPaymentsByInvoice).Methods("GET")
+
+   // Mock payment gateway endpoints
+   r.HandleFunc("/payments/tokens", createCardToken).Methods("POST")
+   r.HandleFunc("/payments/intents", getPaymentIntents).Methods("GET")
+   r.HandleFunc("/payments/intents", createPaymentIntent).Methods("POST")
+   r.HandleFunc("/payments/intents/{id}", getPaymentIntent).Methods("GET")
+   r.HandleFunc("/payments/intents/{id}/confirm", confirmPaymentIntent).Methods("POST")
+   r.HandleFunc("/payments/intents/{id}/authenticate", authenticatePaymentIntent).Methods("POST")
+   r.HandleFunc("/payments/webhooks", getWebhookEvents).Methods("GET")
+   r.HandleFunc("/payments/webhooks/config", updateWebhookConfig).Methods("PUT")
    
    // Impound endpoints
    r.HandleFunc("/impound", getImpoundedVehicles).Methods("GET")
    r.HandleFunc("/impound", addImpoundedVehicle).Methods("POST")
    r.HandleFunc("/impound/{id}/release", releaseVehicle).Methods("PUT")
    r.HandleFunc("/impound/current", getCurrentlyImpounded).Methods("GET")
+   r.HandleFunc("/impound/lots", getImpoundLots).Methods("GET")
+   r.HandleFunc("/impound/lots", createImpoundLot).Methods("POST")
+   r.HandleFunc("/impound/lots/{id}", updateImpoundLot).Methods("PUT")
+   r.HandleFunc("/impound/lots/{id}/occupancy", getImpoundLotOccupancy).Methods("GET")
+   r.HandleFunc("/impound/fees", getImpoundFeeSchedule).Methods("GET")
+   r.HandleFunc("/impound/fees/{code}", updateImpoundFee).Methods("PUT")
+   r.HandleFunc("/impound/{id}/quote", getImpoundQuote).Methods("GET")
+   r.HandleFunc("/impound/{id}/invoice", createImpoundInvoice).Methods("POST")
+   r.HandleFunc("/impound/{id}/holds", getImpoundHolds).Methods("GET")
+   r.HandleFunc("/impound/{id}/holds", createImpoundHold).Methods("POST")
+   r.HandleFunc("/impound/{id}/holds/{holdId}/lift", liftImpoundHold).Methods("PUT")
+   r.HandleFunc("/impound/auction-eligible", getAuctionEligibleVehicles).Methods("GET")
+   r.HandleFunc("/impound/notices", getImpoundNotices).Methods("GET")
+   r.HandleFunc("/impound/lien-timeline", getLienTimeline).Methods("GET")
+   r.HandleFunc("/impound/lien-timeline/{stage}", updateLienTimelineStage).Methods("PUT")
+   r.HandleFunc("/impound/{id}/dispose", disposeImpoundedVehicle).Methods("POST")
+   r.HandleFunc("/impound/{id}/attachments", getImpoundAttachments).Methods("GET")
+   r.HandleFunc("/impound/{id}/attachments", uploadImpoundAttachment).Methods("POST")
+
+   // Attachment endpoints
+   r.HandleFunc("/attachments/{id}", downloadAttachment).Methods("GET")
+   r.HandleFunc("/attachments/{id}", deleteAttachment).Methods("DELETE")
+   r.HandleFunc("/attachments/{id}/thumbnail", downloadAttachmentThumbnail).Methods("GET")
+
+   // Public endpoints
+   r.HandleFunc("/public/lookup", publicVehicleLookup).Methods("GET")
+
+   // Reports endpoints
+   r.HandleFunc("/reports/receivables-aging", getReceivablesAging).Methods("GET")
+   r.HandleFunc("/reports/drivers", getDriverReport).Methods("GET")
+   r.HandleFunc("/reports/sustainability", getSustainabilityReport).Methods("GET")
+
+   // Accounting export endpoints
+   r.HandleFunc("/exports/accounting", getAccountingExport).Methods("GET")
+   r.HandleFunc("/exports/account-mappings", getAccountMappings).Methods("GET")
+   r.HandleFunc("/exports/account-mappings", updateAccountMapping).Methods("PUT")
+
+   // Simulation clock endpoints
+   r.HandleFunc("/simulation/clock", getSimulationClock).Methods("GET")
+   r.HandleFunc("/simulation/clock", updateSimulationClock).Methods("PUT")
 
    // Start GPS simulation goroutine
    go gpsSimulationWorker()
+
+   // Start payment gateway settlement and webhook delivery
+   go paymentSettlementWorker()
+
+   // Start invoice aging sweep
+   go invoiceAgingWorker()
+
+   // Start abandoned vehicle lifecycle sweep
+   go impoundLifecycleWorker()
+
+   // Start hours-of-service monitor
+   go hosMonitorWorker()
+
+   // Start credential expiry check
+   go credentialExpiryWorker()
+
+   // Start fleet maintenance check
+   go maintenanceWorker()
+
+   // Start monthly account statements
+   go statementWorker()
+
+   // Start the job SLA monitor
+   go slaMonitorWorker()
+
+   // Start the job scheduler
+   go scheduleWorker()
    
    // Apply CORS middleware
    handler := enableCORS(r)
@@ -142,7 +336,172 @@ func main() {
 }
 
 func createTables() {
-   _, err := db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
+   _, err := db.Exec(`CREATE TABLE IF NOT EXISTS customers (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	customer_type TEXT NOT NULL DEFAULT 'individual',
+   	name TEXT NOT NULL,
+   	account_number TEXT,
+   	contact_name TEXT,
+   	phone TEXT,
+   	phone_digits TEXT DEFAULT '',
+   	email TEXT,
+   	address_line1 TEXT,
+   	address_line2 TEXT,
+   	city TEXT,
+   	region TEXT,
+   	postal_code TEXT,
+   	billing_terms_days INTEGER DEFAULT 0,
+   	po_required BOOLEAN DEFAULT 0,
+   	pickup_radius_m REAL,
+   	notes TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	deleted_at DATETIME
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   // One live customer per phone number and per account number
+   _, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS customers_phone ON customers (phone_digits)
+   	WHERE deleted_at IS NULL AND phone_digits != ''`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS customers_account_number ON customers (account_number)
+   	WHERE deleted_at IS NULL AND account_number IS NOT NULL AND account_number != ''`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS customer_contacts (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	customer_id INTEGER NOT NULL,
+   	name TEXT NOT NULL,
+   	role TEXT,
+   	phone TEXT,
+   	email TEXT,
+   	is_primary BOOLEAN DEFAULT 0,
+   	FOREIGN KEY (customer_id) REFERENCES customers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS sla_targets (
+   	job_type TEXT NOT NULL,
+   	priority TEXT NOT NULL,
+   	assign_minutes INTEGER NOT NULL,
+   	arrive_minutes INTEGER NOT NULL,
+   	warn_percent INTEGER DEFAULT 80,
+   	PRIMARY KEY (job_type, priority)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS sla_alerts (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	job_id INTEGER NOT NULL,
+   	sla TEXT NOT NULL,
+   	level TEXT NOT NULL,
+   	due_at DATETIME,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	UNIQUE (job_id, sla, level),
+   	FOREIGN KEY (job_id) REFERENCES jobs(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS service_zones (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	name TEXT NOT NULL UNIQUE,
+   	geometry TEXT NOT NULL,
+   	min_latitude REAL,
+   	max_latitude REAL,
+   	min_longitude REAL,
+   	max_longitude REAL,
+   	price_multiplier REAL DEFAULT 1,
+   	surcharge DECIMAL(10,2) DEFAULT 0,
+   	is_active BOOLEAN DEFAULT 1,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS geofence_events (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	job_id INTEGER NOT NULL,
+   	driver_id INTEGER NOT NULL,
+   	vehicle_id INTEGER,
+   	geofence_type TEXT NOT NULL,
+   	geofence_id INTEGER NOT NULL,
+   	geofence_name TEXT,
+   	event TEXT NOT NULL,
+   	latitude REAL,
+   	longitude REAL,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (job_id) REFERENCES jobs(id),
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS rotation_lists (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	name TEXT NOT NULL,
+   	zone TEXT NOT NULL,
+   	job_type TEXT NOT NULL DEFAULT 'police',
+   	last_position INTEGER DEFAULT 0,
+   	is_active BOOLEAN DEFAULT 1,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	UNIQUE (zone, job_type)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS rotation_entries (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	rotation_id INTEGER NOT NULL,
+   	position INTEGER NOT NULL,
+   	company TEXT,
+   	driver_id INTEGER NOT NULL,
+   	vehicle_id INTEGER,
+   	is_active BOOLEAN DEFAULT 1,
+   	FOREIGN KEY (rotation_id) REFERENCES rotation_lists(id),
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id),
+   	FOREIGN KEY (vehicle_id) REFERENCES fleet_vehicles(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS rotation_log (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	rotation_id INTEGER NOT NULL,
+   	entry_id INTEGER,
+   	job_id INTEGER,
+   	driver_id INTEGER,
+   	action TEXT NOT NULL,
+   	reason TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (rotation_id) REFERENCES rotation_lists(id),
+   	FOREIGN KEY (entry_id) REFERENCES rotation_entries(id),
+   	FOREIGN KEY (job_id) REFERENCES jobs(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS account_rates (
+   	customer_id INTEGER NOT NULL,
+   	job_type TEXT NOT NULL,
+   	flat_rate DECIMAL(10,2) NOT NULL,
+   	included_km REAL DEFAULT 0,
+   	per_km_rate DECIMAL(10,2) DEFAULT 0,
+   	PRIMARY KEY (customer_id, job_type),
+   	FOREIGN KEY (customer_id) REFERENCES customers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS account_statements (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	customer_id INTEGER NOT NULL,
+   	period_start DATE NOT NULL,
+   	period_end DATE NOT NULL,
+   	opening_balance DECIMAL(10,2),
+   	invoiced DECIMAL(10,2),
+   	paid DECIMAL(10,2),
+   	closing_balance DECIMAL(10,2),
+   	generated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	UNIQUE (customer_id, period_start),
+   	FOREIGN KEY (customer_id) REFERENCES customers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
    	id INTEGER PRIMARY KEY AUTOINCREMENT,
    	vehicle_description TEXT NOT NULL,
    	pickup_coordinates TEXT NOT NULL,
@@ -154,8 +513,62 @@ func createTables() {
    	assigned_vehicle_id INTEGER,
    	completed_at DATETIME,
    	notes TEXT,
+   	impound_lot_id INTEGER,
+   	license_plate TEXT,
+   	owner_name TEXT,
+   	owner_phone TEXT,
+   	vehicle_class TEXT DEFAULT 'standard',
+   	customer_id INTEGER,
+   	po_number TEXT,
+   	zone TEXT,
+   	priority TEXT DEFAULT 'normal',
+   	scheduled_for DATETIME,
+   	schedule_id INTEGER,
    	FOREIGN KEY (assigned_driver_id) REFERENCES drivers(id),
-   	FOREIGN KEY (assigned_vehicle_id) REFERENCES fleet_vehicles(id)
+   	FOREIGN KEY (assigned_vehicle_id) REFERENCES fleet_vehicles(id),
+   	FOREIGN KEY (impound_lot_id) REFERENCES impound_lots(id),
+   	FOREIGN KEY (customer_id) REFERENCES customers(id),
+   	FOREIGN KEY (schedule_id) REFERENCES job_schedules(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS job_schedules (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	vehicle_description TEXT NOT NULL,
+   	pickup_coordinates TEXT NOT NULL,
+   	destination_coordinates TEXT,
+   	job_type TEXT NOT NULL,
+   	notes TEXT,
+   	impound_lot_id INTEGER,
+   	license_plate TEXT,
+   	owner_name TEXT,
+   	owner_phone TEXT,
+   	vehicle_class TEXT DEFAULT 'standard',
+   	customer_id INTEGER,
+   	po_number TEXT,
+   	zone TEXT,
+   	priority TEXT DEFAULT 'scheduled',
+   	starts_at DATETIME NOT NULL,
+   	recurrence TEXT,
+   	lead_minutes INTEGER DEFAULT 60,
+   	next_run_at DATETIME,
+   	is_active BOOLEAN DEFAULT 1,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (impound_lot_id) REFERENCES impound_lots(id),
+   	FOREIGN KEY (customer_id) REFERENCES customers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS job_events (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	job_id INTEGER NOT NULL,
+   	driver_id INTEGER,
+   	event TEXT NOT NULL,
+   	latitude REAL,
+   	longitude REAL,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (job_id) REFERENCES jobs(id),
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id)
    )`)
    if err != nil { log.Fatal(err) }
 
@@ -165,10 +578,125 @@ func createTables() {
    	phone TEXT,
    	license_number TEXT,
    	date_joined DATE DEFAULT CURRENT_DATE,
+   	is_active BOOLEAN DEFAULT 1,
+   	deleted_at DATETIME
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	entity_type TEXT NOT NULL,
+   	entity_id INTEGER NOT NULL,
+   	action TEXT NOT NULL,
+   	field TEXT,
+   	old_value TEXT,
+   	new_value TEXT,
+   	changed_by TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS driver_shifts (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	driver_id INTEGER NOT NULL,
+   	scheduled_start DATETIME NOT NULL,
+   	scheduled_end DATETIME NOT NULL,
+   	clock_in_at DATETIME,
+   	clock_out_at DATETIME,
+   	notes TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS driver_breaks (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	shift_id INTEGER NOT NULL,
+   	started_at DATETIME NOT NULL,
+   	ended_at DATETIME,
+   	FOREIGN KEY (shift_id) REFERENCES driver_shifts(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS driver_driving_log (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	driver_id INTEGER NOT NULL,
+   	job_id INTEGER,
+   	leg TEXT,
+   	distance_km REAL,
+   	started_at DATETIME NOT NULL,
+   	ended_at DATETIME NOT NULL,
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id),
+   	FOREIGN KEY (job_id) REFERENCES jobs(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS hos_limits (
+   	code TEXT PRIMARY KEY,
+   	description TEXT,
+   	metric TEXT NOT NULL,
+   	max_hours REAL NOT NULL,
+   	window_hours REAL NOT NULL,
+   	warn_remaining_hours REAL DEFAULT 1,
    	is_active BOOLEAN DEFAULT 1
    )`)
    if err != nil { log.Fatal(err) }
 
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS hos_warnings (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	driver_id INTEGER NOT NULL,
+   	limit_code TEXT NOT NULL,
+   	level TEXT NOT NULL,
+   	used_hours REAL,
+   	message TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS credential_types (
+   	code TEXT PRIMARY KEY,
+   	description TEXT,
+   	warn_days INTEGER DEFAULT 30
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS driver_credentials (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	driver_id INTEGER NOT NULL,
+   	credential_type TEXT NOT NULL,
+   	licence_class TEXT,
+   	credential_number TEXT,
+   	issuer TEXT,
+   	issued_date DATE,
+   	expiry_date DATE NOT NULL,
+   	flagged_status TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id),
+   	FOREIGN KEY (credential_type) REFERENCES credential_types(code)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS job_type_credentials (
+   	job_type TEXT NOT NULL,
+   	credential_type TEXT NOT NULL,
+   	PRIMARY KEY (job_type, credential_type),
+   	FOREIGN KEY (credential_type) REFERENCES credential_types(code)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS credential_alerts (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	credential_id INTEGER NOT NULL,
+   	driver_id INTEGER NOT NULL,
+   	level TEXT NOT NULL,
+   	message TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (credential_id) REFERENCES driver_credentials(id),
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS fleet_vehicles (
    	id INTEGER PRIMARY KEY AUTOINCREMENT,
    	vehicle_type TEXT NOT NULL,
@@ -178,7 +706,127 @@ func createTables() {
    	license_plate TEXT UNIQUE,
    	capacity_tons REAL,
    	date_acquired DATE DEFAULT CURRENT_DATE,
-   	is_active BOOLEAN DEFAULT 1
+   	is_active BOOLEAN DEFAULT 1,
+   	out_of_service_reason TEXT,
+   	odometer_km REAL DEFAULT 0,
+   	fuel_level_l REAL,
+   	last_latitude REAL,
+   	last_longitude REAL,
+   	last_position_at DATETIME
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   // Plates are unique however they are cased or padded
+   _, err = db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS fleet_vehicles_plate ON fleet_vehicles (UPPER(TRIM(license_plate)))`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS maintenance_schedules (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	vehicle_id INTEGER NOT NULL,
+   	service_type TEXT NOT NULL,
+   	interval_km REAL,
+   	interval_days INTEGER,
+   	is_active BOOLEAN DEFAULT 1,
+   	UNIQUE (vehicle_id, service_type),
+   	FOREIGN KEY (vehicle_id) REFERENCES fleet_vehicles(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS maintenance_records (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	vehicle_id INTEGER NOT NULL,
+   	service_type TEXT NOT NULL,
+   	service_date DATE NOT NULL,
+   	odometer_km REAL,
+   	cost DECIMAL(10,2) DEFAULT 0,
+   	notes TEXT,
+   	performed_by TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (vehicle_id) REFERENCES fleet_vehicles(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS fuel_prices (
+   	fuel_type TEXT PRIMARY KEY,
+   	price_per_litre REAL NOT NULL
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS fuel_profiles (
+   	vehicle_type TEXT PRIMARY KEY,
+   	fuel_type TEXT NOT NULL DEFAULT 'diesel',
+   	empty_l_per_100km REAL NOT NULL,
+   	towing_l_per_100km REAL NOT NULL,
+   	tank_capacity_l REAL NOT NULL,
+   	co2_kg_per_l REAL NOT NULL,
+   	FOREIGN KEY (fuel_type) REFERENCES fuel_prices(fuel_type)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS fuel_log (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	vehicle_id INTEGER NOT NULL,
+   	job_id INTEGER,
+   	leg TEXT,
+   	towing BOOLEAN DEFAULT 0,
+   	distance_km REAL,
+   	litres REAL,
+   	cost DECIMAL(10,2),
+   	co2_kg REAL,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (vehicle_id) REFERENCES fleet_vehicles(id),
+   	FOREIGN KEY (job_id) REFERENCES jobs(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS fuel_refuels (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	vehicle_id INTEGER NOT NULL,
+   	litres REAL NOT NULL,
+   	price_per_litre REAL,
+   	cost DECIMAL(10,2),
+   	location TEXT,
+   	automatic BOOLEAN DEFAULT 0,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (vehicle_id) REFERENCES fleet_vehicles(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS inspection_templates (
+   	vehicle_type TEXT NOT NULL,
+   	inspection_type TEXT NOT NULL,
+   	item_code TEXT NOT NULL,
+   	description TEXT,
+   	is_critical BOOLEAN DEFAULT 0,
+   	sort_order INTEGER DEFAULT 0,
+   	PRIMARY KEY (vehicle_type, inspection_type, item_code)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS vehicle_inspections (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	vehicle_id INTEGER NOT NULL,
+   	driver_id INTEGER NOT NULL,
+   	shift_id INTEGER,
+   	inspection_type TEXT NOT NULL,
+   	odometer_km REAL,
+   	passed BOOLEAN NOT NULL,
+   	notes TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (vehicle_id) REFERENCES fleet_vehicles(id),
+   	FOREIGN KEY (driver_id) REFERENCES drivers(id),
+   	FOREIGN KEY (shift_id) REFERENCES driver_shifts(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS inspection_results (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	inspection_id INTEGER NOT NULL,
+   	item_code TEXT NOT NULL,
+   	status TEXT NOT NULL,
+   	is_critical BOOLEAN DEFAULT 0,
+   	notes TEXT,
+   	FOREIGN KEY (inspection_id) REFERENCES vehicle_inspections(id)
    )`)
    if err != nil { log.Fatal(err) }
 
@@ -191,7 +839,10 @@ func createTables() {
    	status TEXT DEFAULT 'pending',
    	customer_name TEXT,
    	customer_phone TEXT,
-   	FOREIGN KEY (job_id) REFERENCES jobs(id)
+   	customer_id INTEGER,
+   	po_number TEXT,
+   	FOREIGN KEY (job_id) REFERENCES jobs(id),
+   	FOREIGN KEY (customer_id) REFERENCES customers(id)
    )`)
    if err != nil { log.Fatal(err) }
 
@@ -208,7 +859,7 @@ func createTables() {
 
    _, err = db.Exec(`CREATE TABLE IF NOT EXISTS impounded_vehicles (
    	id INTEGER PRIMARY KEY AUTOINCREMENT,
-   	job_id INTEGER,
+   	job_id INTEGER NOT NULL UNIQUE,
    	vehicle_description TEXT NOT NULL,
    	license_plate TEXT,
    	owner_name TEXT,
@@ -218,91 +869,447 @@ func createTables() {
    	is_currently_impounded BOOLEAN DEFAULT 1,
    	impound_location TEXT,
    	release_fee DECIMAL(10,2),
-   	FOREIGN KEY (job_id) REFERENCES jobs(id)
+   	vehicle_class TEXT DEFAULT 'standard',
+   	invoice_id INTEGER,
+   	released_by TEXT,
+   	released_to_name TEXT,
+   	released_to_id_number TEXT,
+   	proof_of_ownership_ref TEXT,
+   	lot_id INTEGER,
+   	stall_id INTEGER,
+   	lifecycle_stage TEXT DEFAULT 'held',
+   	disposition TEXT,
+   	sale_price DECIMAL(10,2),
+   	buyer_name TEXT,
+   	customer_id INTEGER,
+   	FOREIGN KEY (job_id) REFERENCES jobs(id),
+   	FOREIGN KEY (customer_id) REFERENCES customers(id),
+   	FOREIGN KEY (invoice_id) REFERENCES invoices(id),
+   	FOREIGN KEY (lot_id) REFERENCES impound_lots(id),
+   	FOREIGN KEY (stall_id) REFERENCES impound_stalls(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   // Foreign keys are not enforced database-wide; every impound record must
+   // still come from a real job, so that one link is checked by triggers
+   for _, trigger := range []string{
+   	`CREATE TRIGGER IF NOT EXISTS impounded_vehicles_job_insert BEFORE INSERT ON impounded_vehicles
+   		WHEN NOT EXISTS (SELECT 1 FROM jobs WHERE id = NEW.job_id)
+   		BEGIN SELECT RAISE(ABORT, 'impounded_vehicles.job_id must reference a job'); END`,
+   	`CREATE TRIGGER IF NOT EXISTS impounded_vehicles_job_update BEFORE UPDATE OF job_id ON impounded_vehicles
+   		WHEN NOT EXISTS (SELECT 1 FROM jobs WHERE id = NEW.job_id)
+   		BEGIN SELECT RAISE(ABORT, 'impounded_vehicles.job_id must reference a job'); END`,
+   	`CREATE TRIGGER IF NOT EXISTS jobs_impound_delete BEFORE DELETE ON jobs
+   		WHEN EXISTS (SELECT 1 FROM impounded_vehicles WHERE job_id = OLD.id)
+   		BEGIN SELECT RAISE(ABORT, 'job has an impound record'); END`,
+   	`CREATE TRIGGER IF NOT EXISTS jobs_impound_id_update BEFORE UPDATE OF id ON jobs
+   		WHEN EXISTS (SELECT 1 FROM impounded_vehicles WHERE job_id = OLD.id)
+   		BEGIN SELECT RAISE(ABORT, 'job has an impound record'); END`,
+   } {
+   	if _, err := db.Exec(trigger); err != nil { log.Fatal(err) }
+   }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS impound_lots (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	name TEXT NOT NULL UNIQUE,
+   	address TEXT,
+   	latitude REAL NOT NULL,
+   	longitude REAL NOT NULL,
+   	overflow_lot_id INTEGER,
+   	hours TEXT,
+   	is_active BOOLEAN DEFAULT 1,
+   	FOREIGN KEY (overflow_lot_id) REFERENCES impound_lots(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS impound_stalls (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	lot_id INTEGER NOT NULL,
+   	name TEXT NOT NULL,
+   	row_label TEXT,
+   	position INTEGER,
+   	is_active BOOLEAN DEFAULT 1,
+   	UNIQUE (lot_id, name),
+   	FOREIGN KEY (lot_id) REFERENCES impound_lots(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS impound_holds (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	impound_id INTEGER NOT NULL,
+   	hold_type TEXT NOT NULL,
+   	agency TEXT,
+   	reference_number TEXT,
+   	reason TEXT,
+   	placed_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	lifted_at DATETIME,
+   	lifted_by TEXT,
+   	FOREIGN KEY (impound_id) REFERENCES impounded_vehicles(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS lien_timeline (
+   	stage TEXT PRIMARY KEY,
+   	days_after_impound INTEGER NOT NULL,
+   	description TEXT,
+   	is_active BOOLEAN DEFAULT 1
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS impound_notices (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	impound_id INTEGER NOT NULL,
+   	stage TEXT NOT NULL,
+   	days_held INTEGER NOT NULL,
+   	recipient_name TEXT,
+   	recipient_phone TEXT,
+   	message TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	UNIQUE (impound_id, stage),
+   	FOREIGN KEY (impound_id) REFERENCES impounded_vehicles(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS attachments (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	owner_type TEXT NOT NULL,
+   	owner_id INTEGER NOT NULL,
+   	category TEXT DEFAULT 'other',
+   	filename TEXT,
+   	content_type TEXT NOT NULL,
+   	size_bytes INTEGER NOT NULL,
+   	sha256 TEXT NOT NULL,
+   	storage_key TEXT NOT NULL,
+   	thumbnail_key TEXT,
+   	description TEXT,
+   	uploaded_by TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS card_tokens (
+   	token TEXT PRIMARY KEY,
+   	last4 TEXT NOT NULL,
+   	brand TEXT,
+   	behavior TEXT NOT NULL,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS payment_intents (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	invoice_id INTEGER NOT NULL,
+   	amount DECIMAL(10,2) NOT NULL,
+   	currency TEXT DEFAULT 'usd',
+   	status TEXT DEFAULT 'pending',
+   	card_token TEXT,
+   	decline_code TEXT,
+   	settle_at DATETIME,
+   	payment_id INTEGER,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (invoice_id) REFERENCES invoices(id),
+   	FOREIGN KEY (card_token) REFERENCES card_tokens(token),
+   	FOREIGN KEY (payment_id) REFERENCES payments(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS webhook_events (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	intent_id INTEGER NOT NULL,
+   	event_type TEXT NOT NULL,
+   	payload TEXT NOT NULL,
+   	attempts INTEGER DEFAULT 0,
+   	delivered_at DATETIME,
+   	last_error TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (intent_id) REFERENCES payment_intents(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS invoice_line_items (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	invoice_id INTEGER NOT NULL,
+   	description TEXT NOT NULL,
+   	amount DECIMAL(10,2) NOT NULL,
+   	item_type TEXT NOT NULL,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	FOREIGN KEY (invoice_id) REFERENCES invoices(id)
    )`)
    if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS late_fee_schedule (
+   	stage TEXT PRIMARY KEY,
+   	min_days_overdue INTEGER NOT NULL,
+   	flat_fee DECIMAL(10,2) DEFAULT 0,
+   	percent_of_balance REAL DEFAULT 0,
+   	is_active BOOLEAN DEFAULT 1
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS invoice_reminders (
+   	id INTEGER PRIMARY KEY AUTOINCREMENT,
+   	invoice_id INTEGER NOT NULL,
+   	stage TEXT NOT NULL,
+   	days_overdue INTEGER NOT NULL,
+   	amount_due DECIMAL(10,2) NOT NULL,
+   	late_fee DECIMAL(10,2) DEFAULT 0,
+   	status TEXT DEFAULT 'open',
+   	notes TEXT,
+   	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+   	actioned_at DATETIME,
+   	UNIQUE (invoice_id, stage),
+   	FOREIGN KEY (invoice_id) REFERENCES invoices(id)
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS impound_fee_schedule (
+   	fee_code TEXT PRIMARY KEY,
+   	description TEXT NOT NULL,
+   	amount DECIMAL(10,2) NOT NULL
+   )`)
+   if err != nil { log.Fatal(err) }
+
+   _, err = db.Exec(`CREATE TABLE IF NOT EXISTS account_mappings (
+   	mapping_type TEXT NOT NULL,
+   	mapping_key TEXT NOT NULL,
+   	account TEXT NOT NULL,
+   	PRIMARY KEY (mapping_type, mapping_key)
+   )`)
+   if err != nil { log.Fatal(err) }
+}
+
+// Job handlers
+func getJobs(w http.ResponseWriter, r *http.Request) {
+   rows, err := db.Query(`SELECT id, vehicle_description, pickup_coordinates, destination_coordinates, 
+   	created_at, job_type, status, assigned_driver_id, assigned_vehicle_id, completed_at, notes, impound_lot_id, 
+   	license_plate, owner_name, owner_phone, vehicle_class, customer_id, po_number, zone, priority, scheduled_for, schedule_id FROM jobs`)
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+   defer rows.Close()
+
+   var jobs []map[string]interface{}
+   for rows.Next() {
+   	var id, assignedDriverID, assignedVehicleID, impoundLotID, customerID, scheduleID sql.NullInt64
+   	var vehicleDesc, pickup, destination, jobType, status, notes sql.NullString
+   	var createdAt, completedAt sql.NullString
+   	var licensePlate, ownerName, ownerPhone, vehicleClass, poNumber, zone, priority, scheduledFor sql.NullString
+
+   	err := rows.Scan(&id, &vehicleDesc, &pickup, &destination, &createdAt, &jobType, &status, 
+   		&assignedDriverID, &assignedVehicleID, &completedAt, &notes, &impoundLotID, 
+   		&licensePlate, &ownerName, &ownerPhone, &vehicleClass, &customerID, &poNumber, &zone, &priority, &scheduledFor, &scheduleID)
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+
+   	job := map[string]interface{}{
+   		"id": id.Int64,
+   		"vehicle_description": vehicleDesc.String,
+   		"pickup_coordinates": pickup.String,
+   		"destination_coordinates": destination.String,
+   		"created_at": createdAt.String,
+   		"job_type": jobType.String,
+   		"status": status.String,
+   		"assigned_driver_id": assignedDriverID.Int64,
+   		"assigned_vehicle_id": assignedVehicleID.Int64,
+   		"completed_at": completedAt.String,
+   		"notes": notes.String,
+   		"impound_lot_id": impoundLotID.Int64,
+   		"license_plate": licensePlate.String,
+   		"owner_name": ownerName.String,
+   		"owner_phone": ownerPhone.String,
+   		"vehicle_class": vehicleClass.String,
+   		"customer_id": customerID.Int64,
+   		"po_number": poNumber.String,
+   		"zone": zone.String,
+   		"priority": priority.String,
+   		"scheduled_for": scheduledFor.String,
+   		"schedule_id": scheduleID.Int64,
+   	}
+   	jobs = append(jobs, job)
+   }
+
+   w.Header().Set("Content-Type", "application/json")
+   json.NewEncoder(w).Encode(jobs)
+}
+
+// A new job's fields from a request body: validated, with the customer, PO
+// number and zone resolved. Used for jobs booked now and for job schedules.
+type newJob struct {
+   Body         map[string]interface{}
+   Priority     string
+   VehicleClass string
+   CustomerID   int64
+   Customer     interface{}
+   PONumber     interface{}
+   Zone         interface{}
+}
+
+func newJobFromBody(job map[string]interface{}, defaultPriority string) (*newJob, string, int, error) {
+   	fields := &newJob{Body: job}
+
+   	fields.Priority, _ = job["priority"].(string)
+   	if fields.Priority == "" {
+   		fields.Priority = defaultPriority
+   	}
+   	if !validPriority(fields.Priority) {
+   		return nil, "priority must be one of " + strings.Join(jobPriorities, ", "), http.StatusBadRequest, nil
+   	}
+
+   	fields.VehicleClass, _ = job["vehicle_class"].(string)
+   	if fields.VehicleClass == "" {
+   		fields.VehicleClass = "standard"
+   	}
+   	if !validVehicleClass(fields.VehicleClass) {
+   		return nil, "vehicle_class must be one of motorcycle, standard, light_truck, heavy_duty", http.StatusBadRequest, nil
+   	}
+
+   	// The customer is given by id, or matched from the owner's name and phone
+   	customerID, problem, status, err := customerIDFromBody(job)
+   	if err != nil || problem != "" {
+   		return nil, problem, status, err
+   	}
+   	if customerID == 0 {
+   		ownerName, _ := job["owner_name"].(string)
+   		ownerPhone, _ := job["owner_phone"].(string)
+   		if customerID, err = findOrCreateCustomer(ownerName, ownerPhone); err != nil {
+   			return nil, "", 0, err
+   		}
+   	}
+   	fields.CustomerID = customerID
+   	if customerID != 0 {
+   		fields.Customer = customerID
+   	}
+
+   	// Accounts can require their PO or claim number on every job
+   	poNumber, _ := job["po_number"].(string)
+   	poNumber = strings.TrimSpace(poNumber)
+   	if customerID != 0 {
+   		billing, err := loadBillingCustomer(customerID)
+   		if err != nil {
+   			return nil, "", 0, err
+   		}
+   		if billing.PORequired && poNumber == "" {
+   			return nil, fmt.Sprintf("po_number is required for %s jobs", billing.Name), http.StatusBadRequest, nil
+   		}
+   	}
+   	if poNumber != "" {
+   		fields.PONumber = poNumber
+   	}
+
+   	// The zone picks the rotation list for police tows; without one the job
+   	// is tagged with the service zone its pickup falls in
+   	if value, _ := job["zone"].(string); strings.TrimSpace(value) != "" {
+   		fields.Zone = strings.TrimSpace(value)
+   	} else if pickup, _ := job["pickup_coordinates"].(string); pickup != "" {
+   		if lat, lng, ok := parseLatLng(pickup); ok {
+   			name, err := zoneAt(lat, lng)
+   			if err != nil {
+   				return nil, "", 0, err
+   			}
+   			if name != "" {
+   				fields.Zone = name
+   			}
+   		}
+   	}
+
+   	return fields, "", 0, nil
 }
 
-// Job handlers
-func getJobs(w http.ResponseWriter, r *http.Request) {
-   rows, err := db.Query(`SELECT id, vehicle_description, pickup_coordinates, destination_coordinates, 
-   	created_at, job_type, status, assigned_driver_id, assigned_vehicle_id, completed_at, notes FROM jobs`)
-   if err != nil {
-   	http.Error(w, err.Error(), http.StatusInternalServerError)
-   	return
-   }
-   defer rows.Close()
+func createJob(w http.ResponseWriter, r *http.Request) {
+   	var job map[string]interface{}
+   	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+   		http.Error(w, err.Error(), http.StatusBadRequest)
+   		return
+   	}
 
-   var jobs []map[string]interface{}
-   for rows.Next() {
-   	var id, assignedDriverID, assignedVehicleID sql.NullInt64
-   	var vehicleDesc, pickup, destination, jobType, status, notes sql.NullString
-   	var createdAt, completedAt sql.NullString
+   	// Jobs booked ahead stay out of the available queue until they are due;
+   	// repeating bookings are job schedules
+   	if _, ok := job["recurrence"]; ok {
+   		http.Error(w, "Recurring jobs are booked with POST /schedules", http.StatusBadRequest)
+   		return
+   	}
+   	var scheduledFor, dueAt interface{}
+   	if value, ok := job["scheduled_for"]; ok && value != nil {
+   		text, _ := value.(string)
+   		due, ok := parseScheduleTime(text)
+   		if !ok {
+   			http.Error(w, "scheduled_for must be an RFC3339 timestamp", http.StatusBadRequest)
+   			return
+   		}
+   		scheduledFor, dueAt = due.Format(sqliteTimeLayout), due.Format(time.RFC3339)
+   	}
 
-   	err := rows.Scan(&id, &vehicleDesc, &pickup, &destination, &createdAt, &jobType, &status, 
-   		&assignedDriverID, &assignedVehicleID, &completedAt, &notes)
+   	fields, problem, status, err := newJobFromBody(job, "normal")
    	if err != nil {
    		http.Error(w, err.Error(), http.StatusInternalServerError)
    		return
    	}
+   	if problem != "" {
+   		http.Error(w, problem, status)
+   		return
+   	}
 
-   	job := map[string]interface{}{
-   		"id": id.Int64,
-   		"vehicle_description": vehicleDesc.String,
-   		"pickup_coordinates": pickup.String,
-   		"destination_coordinates": destination.String,
-   		"created_at": createdAt.String,
-   		"job_type": jobType.String,
-   		"status": status.String,
-   		"assigned_driver_id": assignedDriverID.Int64,
-   		"assigned_vehicle_id": assignedVehicleID.Int64,
-   		"completed_at": completedAt.String,
-   		"notes": notes.String,
+   	result, err := db.Exec(`INSERT INTO jobs (vehicle_description, pickup_coordinates, destination_coordinates, job_type, notes, impound_lot_id, 
+   		license_plate, owner_name, owner_phone, vehicle_class, customer_id, po_number, zone, priority, created_at, scheduled_for) 
+   		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+   		job["vehicle_description"], job["pickup_coordinates"], job["destination_coordinates"], job["job_type"], job["notes"], job["impound_lot_id"],
+   		job["license_plate"], job["owner_name"], job["owner_phone"], fields.VehicleClass, fields.Customer, fields.PONumber, fields.Zone, fields.Priority,
+   		simNow().Format(sqliteTimeLayout), scheduledFor)
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
    	}
-   	jobs = append(jobs, job)
-   }
 
-   w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(jobs)
+   	id, _ := result.LastInsertId()
+   	w.Header().Set("Content-Type", "application/json")
+   	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "customer_id": fields.CustomerID, "zone": fields.Zone,
+   		"priority": fields.Priority, "scheduled_for": dueAt})
 }
 
-func createJob(w http.ResponseWriter, r *http.Request) {
-   var job map[string]interface{}
-   if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
-   	http.Error(w, err.Error(), http.StatusBadRequest)
+func completeJob(w http.ResponseWriter, r *http.Request) {
+   vars := mux.Vars(r)
+   jobID, err := strconv.ParseInt(vars["id"], 10, 64)
+   if err != nil {
+   	http.Error(w, "Invalid job ID", http.StatusBadRequest)
    	return
    }
 
-   result, err := db.Exec(`INSERT INTO jobs (vehicle_description, pickup_coordinates, destination_coordinates, job_type, notes) 
-   	VALUES (?, ?, ?, ?, ?)`,
-   	job["vehicle_description"], job["pickup_coordinates"], job["destination_coordinates"], job["job_type"], job["notes"])
+   result, err := db.Exec(`UPDATE jobs SET status = 'completed', completed_at = ? WHERE id = ?`, simNow().Format(sqliteTimeLayout), jobID)
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
+   if affected, _ := result.RowsAffected(); affected == 0 {
+   	http.Error(w, "Job not found", http.StatusNotFound)
+   	return
+   }
 
-   id, _ := result.LastInsertId()
-   w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(map[string]int64{"id": id})
-}
-
-
-func completeJob(w http.ResponseWriter, r *http.Request) {
-   vars := mux.Vars(r)
-   jobID := vars["id"]
-
-   _, err := db.Exec(`UPDATE jobs SET status = 'completed', completed_at = CURRENT_TIMESTAMP WHERE id = ?`, jobID)
+   // Police and parking violation tows go straight into the impound lot
+   impoundID, err := impoundCompletedJob(jobID)
    if err != nil {
-   	http.Error(w, err.Error(), http.StatusInternalServerError)
-   	return
+   	log.Printf("Error impounding vehicle for job %d: %v", jobID, err)
+   }
+
+   response := map[string]interface{}{"status": "completed"}
+   if impoundID != 0 {
+   	response["impound_id"] = impoundID
    }
 
-   w.WriteHeader(http.StatusOK)
+   w.Header().Set("Content-Type", "application/json")
+   json.NewEncoder(w).Encode(response)
 }
 
 // Driver handlers
 func getDrivers(w http.ResponseWriter, r *http.Request) {
-   rows, err := db.Query(`SELECT id, name, phone, license_number, date_joined, is_active FROM drivers`)
+   query := `SELECT id, name, phone, license_number, date_joined, is_active FROM drivers WHERE deleted_at IS NULL`
+   if r.URL.Query().Get("include_deleted") == "true" {
+   	query = `SELECT id, name, phone, license_number, date_joined, is_active FROM drivers`
+   }
+   rows, err := db.Query(query)
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
@@ -331,6 +1338,16 @@ func getDrivers(w http.ResponseWriter, r *http.Request) {
    	}
    	drivers = append(drivers, driver)
    }
+   rows.Close()
+
+   for _, driver := range drivers {
+   	status, _, err := driverStatus(driver["id"])
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+   	driver["status"] = status
+   }
 
    w.Header().Set("Content-Type", "application/json")
    json.NewEncoder(w).Encode(drivers)
@@ -355,21 +1372,25 @@ func createDriver(w http.ResponseWriter, r *http.Request) {
    json.NewEncoder(w).Encode(map[string]int64{"id": id})
 }
 
+// Drivers clocked into a shift, with their derived status. ?status=available
+// narrows the list to drivers who can take a job right now.
 func getActiveDrivers(w http.ResponseWriter, r *http.Request) {
-   rows, err := db.Query(`SELECT id, name, phone FROM drivers WHERE is_active = 1`)
+   rows, err := db.Query(`SELECT d.id, d.name, d.phone FROM drivers d
+   	WHERE d.is_active = 1 AND EXISTS (SELECT 1 FROM driver_shifts s
+   		WHERE s.driver_id = d.id AND s.clock_in_at IS NOT NULL AND s.clock_out_at IS NULL)`)
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
-   defer rows.Close()
 
-   var drivers []map[string]interface{}
+   var onShift []map[string]interface{}
    for rows.Next() {
    	var id sql.NullInt64
    	var name, phone sql.NullString
 
    	err := rows.Scan(&id, &name, &phone)
    	if err != nil {
+   		rows.Close()
    		http.Error(w, err.Error(), http.StatusInternalServerError)
    		return
    	}
@@ -379,6 +1400,27 @@ func getActiveDrivers(w http.ResponseWriter, r *http.Request) {
    		"name": name.String,
    		"phone": phone.String,
    	}
+   	onShift = append(onShift, driver)
+   }
+   rows.Close()
+
+   wanted := r.URL.Query().Get("status")
+   drivers := []map[string]interface{}{}
+   for _, driver := range onShift {
+   	status, shift, err := driverStatus(driver["id"])
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+   	if wanted != "" && status != wanted {
+   		continue
+   	}
+
+   	driver["status"] = status
+   	if shift != nil {
+   		driver["shift_id"] = shift.ID
+   		driver["shift_ends_at"] = shift.ScheduledEnd
+   	}
    	drivers = append(drivers, driver)
    }
 
@@ -388,7 +1430,7 @@ func getActiveDrivers(w http.ResponseWriter, r *http.Request) {
 
 // Vehicle handlers
 func getVehicles(w http.ResponseWriter, r *http.Request) {
-   rows, err := db.Query(`SELECT id, vehicle_type, make, model, year, license_plate, capacity_tons, is_active FROM fleet_vehicles`)
+   rows, err := db.Query(`SELECT id, vehicle_type, make, model, year, license_plate, capacity_tons, is_active, out_of_service_reason, odometer_km FROM fleet_vehicles`)
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
@@ -398,11 +1440,11 @@ func getVehicles(w http.ResponseWriter, r *http.Request) {
    var vehicles []map[string]interface{}
    for rows.Next() {
    	var id, year sql.NullInt64
-   	var vehicleType, make, model, licensePlate sql.NullString
-   	var capacity sql.NullFloat64
+   	var vehicleType, make, model, licensePlate, outOfService sql.NullString
+   	var capacity, odometer sql.NullFloat64
    	var isActive sql.NullBool
 
-   	err := rows.Scan(&id, &vehicleType, &make, &model, &year, &licensePlate, &capacity, &isActive)
+   	err := rows.Scan(&id, &vehicleType, &make, &model, &year, &licensePlate, &capacity, &isActive, &outOfService, &odometer)
    	if err != nil {
    		http.Error(w, err.Error(), http.StatusInternalServerError)
    		return
@@ -417,6 +1459,8 @@ func getVehicles(w http.ResponseWriter, r *http.Request) {
    		"license_plate": licensePlate.String,
    		"capacity_tons": capacity.Float64,
    		"is_active": isActive.Bool,
+   		"out_of_service_reason": outOfService.String,
+   		"odometer_km": odometer.Float64,
    	}
    	vehicles = append(vehicles, vehicle)
    }
@@ -432,152 +1476,484 @@ func createVehicle(w http.ResponseWriter, r *http.Request) {
    	return
    }
 
-   result, err := db.Exec(`INSERT INTO fleet_vehicles (vehicle_type, make, model, year, license_plate, capacity_tons) 
-   	VALUES (?, ?, ?, ?, ?, ?)`,
-   	vehicle["vehicle_type"], vehicle["make"], vehicle["model"], vehicle["year"], vehicle["license_plate"], vehicle["capacity_tons"])
+   result, err := db.Exec(`INSERT INTO fleet_vehicles (vehicle_type, make, model, year, license_plate, capacity_tons) 
+   	VALUES (?, ?, ?, ?, ?, ?)`,
+   	vehicle["vehicle_type"], vehicle["make"], vehicle["model"], vehicle["year"], vehicle["license_plate"], vehicle["capacity_tons"])
+   if err != nil && strings.Contains(err.Error(), "UNIQUE") {
+   	http.Error(w, "license_plate is already used by another vehicle", http.StatusConflict)
+   	return
+   } else if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   id, _ := result.LastInsertId()
+   w.Header().Set("Content-Type", "application/json")
+   json.NewEncoder(w).Encode(map[string]int64{"id": id})
+}
+
+// Impound handlers
+func getImpoundedVehicles(w http.ResponseWriter, r *http.Request) {
+   rows, err := db.Query(`SELECT id, job_id, vehicle_description, license_plate, owner_name, owner_phone, 
+   	impounded_at, released_at, is_currently_impounded, impound_location, release_fee, vehicle_class, customer_id FROM impounded_vehicles`)
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+   defer rows.Close()
+
+   var vehicles []map[string]interface{}
+   for rows.Next() {
+   	var id, jobID, customerID sql.NullInt64
+   	var vehicleDesc, licensePlate, ownerName, ownerPhone, impoundLocation, vehicleClass sql.NullString
+   	var impoundedAt, releasedAt sql.NullString
+   	var isCurrentlyImpounded sql.NullBool
+   	var releaseFee sql.NullFloat64
+
+   	err := rows.Scan(&id, &jobID, &vehicleDesc, &licensePlate, &ownerName, &ownerPhone, 
+   		&impoundedAt, &releasedAt, &isCurrentlyImpounded, &impoundLocation, &releaseFee, &vehicleClass, &customerID)
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+
+   	vehicle := map[string]interface{}{
+   		"id": id.Int64,
+   		"job_id": jobID.Int64,
+   		"vehicle_description": vehicleDesc.String,
+   		"license_plate": licensePlate.String,
+   		"owner_name": ownerName.String,
+   		"owner_phone": ownerPhone.String,
+   		"impounded_at": impoundedAt.String,
+   		"released_at": releasedAt.String,
+   		"is_currently_impounded": isCurrentlyImpounded.Bool,
+   		"impound_location": impoundLocation.String,
+   		"release_fee": releaseFee.Float64,
+   		"vehicle_class": vehicleClass.String,
+   		"customer_id": customerID.Int64,
+   	}
+   	vehicles = append(vehicles, vehicle)
+   }
+
+   w.Header().Set("Content-Type", "application/json")
+   json.NewEncoder(w).Encode(vehicles)
+}
+
+func getCurrentlyImpounded(w http.ResponseWriter, r *http.Request) {
+   rows, err := db.Query(`SELECT id, vehicle_description, license_plate, owner_name, impounded_at, impound_location, vehicle_class 
+   	FROM impounded_vehicles WHERE is_currently_impounded = 1`)
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   var vehicles []map[string]interface{}
+   for rows.Next() {
+   	var id sql.NullInt64
+   	var vehicleDesc, licensePlate, ownerName, impoundedAt, location, vehicleClass sql.NullString
+
+   	err := rows.Scan(&id, &vehicleDesc, &licensePlate, &ownerName, &impoundedAt, &location, &vehicleClass)
+   	if err != nil {
+   		rows.Close()
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+
+   	vehicle := map[string]interface{}{
+   		"id": id.Int64,
+   		"vehicle_description": vehicleDesc.String,
+   		"license_plate": licensePlate.String,
+   		"owner_name": ownerName.String,
+   		"impounded_at": impoundedAt.String,
+   		"impound_location": location.String,
+   		"vehicle_class": vehicleClass.String,
+   	}
+   	vehicles = append(vehicles, vehicle)
+   }
+   rows.Close()
+
+   // Add days held and fees accrued so far
+   now := simNow()
+   for _, vehicle := range vehicles {
+   	quote, err := computeImpoundQuote(vehicle["id"], now)
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+   	vehicle["days_held"] = quote.DaysHeld
+   	vehicle["current_fees"] = quote.Total
+   }
+
+   w.Header().Set("Content-Type", "application/json")
+   json.NewEncoder(w).Encode(vehicles)
+}
+
+func addImpoundedVehicle(w http.ResponseWriter, r *http.Request) {
+   var vehicle map[string]interface{}
+   if err := json.NewDecoder(r.Body).Decode(&vehicle); err != nil {
+   	http.Error(w, err.Error(), http.StatusBadRequest)
+   	return
+   }
+
+   vehicleClass, _ := vehicle["vehicle_class"].(string)
+   if vehicleClass == "" {
+   	vehicleClass = "standard"
+   }
+   if !validVehicleClass(vehicleClass) {
+   	http.Error(w, "vehicle_class must be one of motorcycle, standard, light_truck, heavy_duty", http.StatusBadRequest)
+   	return
+   }
+
+   // Every impound record must come from a real job
+   jobIDFloat, ok := vehicle["job_id"].(float64)
+   if !ok {
+   	http.Error(w, "job_id is required", http.StatusBadRequest)
+   	return
+   }
+   var jobID int64
+   err := db.QueryRow("SELECT id FROM jobs WHERE id = ?", int64(jobIDFloat)).Scan(&jobID)
+   if err == sql.ErrNoRows {
+   	http.Error(w, "Job not found", http.StatusNotFound)
+   	return
+   } else if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   // Find the lot and take a free stall, overflowing to another lot when full
+   requestedLotID, err := resolveImpoundLot(vehicle)
+   if err == sql.ErrNoRows {
+   	http.Error(w, "Impound lot not found (provide lot_id or a known impound_location)", http.StatusBadRequest)
+   	return
+   } else if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   vehicleDesc, _ := vehicle["vehicle_description"].(string)
+   licensePlate, _ := vehicle["license_plate"].(string)
+   ownerName, _ := vehicle["owner_name"].(string)
+   ownerPhone, _ := vehicle["owner_phone"].(string)
+   customerID, problem, status, err := customerIDFromBody(vehicle)
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+   if problem != "" {
+   	http.Error(w, problem, status)
+   	return
+   }
+
+   id, lotID, stallName, err := intakeImpound(impoundIntake{
+   	JobID: jobID,
+   	VehicleDescription: vehicleDesc,
+   	LicensePlate: licensePlate,
+   	OwnerName: ownerName,
+   	OwnerPhone: ownerPhone,
+   	CustomerID: customerID,
+   	VehicleClass: vehicleClass,
+   	ReleaseFee: vehicle["release_fee"],
+   }, requestedLotID)
+   if err == errLotFull {
+   	http.Error(w, "Impound lot is full and has no overflow space", http.StatusConflict)
+   	return
+   } else if err == errJobAlreadyImpounded {
+   	http.Error(w, "Job already has an impound record", http.StatusConflict)
+   	return
+   } else if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   w.Header().Set("Content-Type", "application/json")
+   json.NewEncoder(w).Encode(map[string]interface{}{
+   	"id": id,
+   	"lot_id": lotID,
+   	"stall": stallName,
+   	"overflowed": lotID != requestedLotID,
+   })
+}
+
+func releaseVehicle(w http.ResponseWriter, r *http.Request) {
+   vars := mux.Vars(r)
+   vehicleID := vars["id"]
+
+   var release map[string]interface{}
+   if err := json.NewDecoder(r.Body).Decode(&release); err != nil {
+   	http.Error(w, err.Error(), http.StatusBadRequest)
+   	return
+   }
+
+   // Record who released the vehicle and who collected it
+   for _, field := range []string{"released_by", "released_to_name", "id_document_number", "proof_of_ownership_ref"} {
+   	if value, _ := release[field].(string); value == "" {
+   		http.Error(w, field+" is required", http.StatusBadRequest)
+   		return
+   	}
+   }
+
+   // Verify impound record exists and is still held
+   var id int64
+   var isCurrentlyImpounded bool
+   err := db.QueryRow("SELECT id, is_currently_impounded FROM impounded_vehicles WHERE id = ?", vehicleID).Scan(&id, &isCurrentlyImpounded)
+   if err == sql.ErrNoRows {
+   	http.Error(w, "Impound record not found", http.StatusNotFound)
+   	return
+   } else if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   if !isCurrentlyImpounded {
+   	http.Error(w, "Vehicle has already been released", http.StatusConflict)
+   	return
+   }
+
+   // Police and other holds block release until lifted
+   holds, err := activeImpoundHolds(id)
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+   if holds > 0 {
+   	writeReleaseConflict(w, map[string]interface{}{
+   		"error": "Vehicle has an active hold",
+   		"active_holds": holds,
+   	})
+   	return
+   }
+
+   // Fees must be settled on the invoice for the current quote
+   quote, err := computeImpoundQuote(id, simNow())
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   // The invoice is kept even when release is refused, so the owner can pay it
+   tx, err := db.Begin()
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
+   defer tx.Rollback()
 
-   id, _ := result.LastInsertId()
-   w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(map[string]int64{"id": id})
-}
-
-// Impound handlers
-func getImpoundedVehicles(w http.ResponseWriter, r *http.Request) {
-   rows, err := db.Query(`SELECT id, job_id, vehicle_description, license_plate, owner_name, owner_phone, 
-   	impounded_at, released_at, is_currently_impounded, impound_location, release_fee FROM impounded_vehicles`)
+   invoiceID, amount, paid, err := ensureImpoundInvoice(tx, id, quote)
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
-   defer rows.Close()
-
-   var vehicles []map[string]interface{}
-   for rows.Next() {
-   	var id, jobID sql.NullInt64
-   	var vehicleDesc, licensePlate, ownerName, ownerPhone, impoundLocation sql.NullString
-   	var impoundedAt, releasedAt sql.NullString
-   	var isCurrentlyImpounded sql.NullBool
-   	var releaseFee sql.NullFloat64
 
-   	err := rows.Scan(&id, &jobID, &vehicleDesc, &licensePlate, &ownerName, &ownerPhone, 
-   		&impoundedAt, &releasedAt, &isCurrentlyImpounded, &impoundLocation, &releaseFee)
-   	if err != nil {
+   if balance := roundCents(amount - paid); balance > 0 {
+   	if err := tx.Commit(); err != nil {
    		http.Error(w, err.Error(), http.StatusInternalServerError)
    		return
    	}
+   	writeReleaseConflict(w, map[string]interface{}{
+   		"error": "Impound fees have not been paid",
+   		"invoice_id": invoiceID,
+   		"balance_due": balance,
+   		"quote": quote,
+   	})
+   	return
+   }
 
-   	vehicle := map[string]interface{}{
-   		"id": id.Int64,
-   		"job_id": jobID.Int64,
-   		"vehicle_description": vehicleDesc.String,
-   		"license_plate": licensePlate.String,
-   		"owner_name": ownerName.String,
-   		"owner_phone": ownerPhone.String,
-   		"impounded_at": impoundedAt.String,
-   		"released_at": releasedAt.String,
-   		"is_currently_impounded": isCurrentlyImpounded.Bool,
-   		"impound_location": impoundLocation.String,
-   		"release_fee": releaseFee.Float64,
-   	}
-   	vehicles = append(vehicles, vehicle)
+   if _, err := tx.Exec(`UPDATE invoices SET status = 'paid' WHERE id = ?`, invoiceID); err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   result, err := tx.Exec(`UPDATE impounded_vehicles SET is_currently_impounded = 0, released_at = ?, release_fee = ?, 
+   	released_by = ?, released_to_name = ?, released_to_id_number = ?, proof_of_ownership_ref = ? WHERE id = ? AND is_currently_impounded = 1`,
+   	simNow().Format(sqliteTimeLayout), amount, release["released_by"], release["released_to_name"],
+   	release["id_document_number"], release["proof_of_ownership_ref"], id)
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+   if released, _ := result.RowsAffected(); released == 0 {
+   	http.Error(w, "Vehicle has already been released", http.StatusConflict)
+   	return
+   }
+   if err := tx.Commit(); err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
    }
 
    w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(vehicles)
+   json.NewEncoder(w).Encode(map[string]interface{}{
+   	"status": "released",
+   	"invoice_id": invoiceID,
+   	"amount_paid": paid,
+   })
 }
 
-func getCurrentlyImpounded(w http.ResponseWriter, r *http.Request) {
-   rows, err := db.Query(`SELECT id, vehicle_description, license_plate, owner_name, impounded_at, impound_location 
-   	FROM impounded_vehicles WHERE is_currently_impounded = 1`)
+// Invoice handlers
+func createInvoice(w http.ResponseWriter, r *http.Request) {
+   var invoice map[string]interface{}
+   if err := json.NewDecoder(r.Body).Decode(&invoice); err != nil {
+   	http.Error(w, err.Error(), http.StatusBadRequest)
+   	return
+   }
+
+   var jobCustomerID sql.NullInt64
+   var jobType, jobPONumber, jobZone sql.NullString
+   err := db.QueryRow(`SELECT customer_id, job_type, po_number, zone FROM jobs WHERE id = ?`, invoice["job_id"]).
+   	Scan(&jobCustomerID, &jobType, &jobPONumber, &jobZone)
+   if err == sql.ErrNoRows {
+   	http.Error(w, "Job not found", http.StatusNotFound)
+   	return
+   } else if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   // Bill the customer given, else the account the job is for, else the
+   // customer named, else the job's customer
+   customerID, problem, status, err := customerIDFromBody(invoice)
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
-   defer rows.Close()
+   if problem != "" {
+   	http.Error(w, problem, status)
+   	return
+   }
+   if customerID == 0 && jobCustomerID.Valid {
+   	jobCustomer, err := loadBillingCustomer(jobCustomerID.Int64)
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+   	if jobCustomer.IsAccount {
+   		customerID = jobCustomer.ID
+   	}
+   }
+   customerName, _ := invoice["customer_name"].(string)
+   customerPhone, _ := invoice["customer_phone"].(string)
+   if customerID == 0 {
+   	if customerID, err = findOrCreateCustomer(customerName, customerPhone); err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+   }
+   if customerID == 0 {
+   	customerID = jobCustomerID.Int64
+   }
 
-   var vehicles []map[string]interface{}
-   for rows.Next() {
-   	var id sql.NullInt64
-   	var vehicleDesc, licensePlate, ownerName, impoundedAt, location sql.NullString
+   poNumber, _ := invoice["po_number"].(string)
+   poNumber = strings.TrimSpace(poNumber)
+   if poNumber == "" {
+   	poNumber = jobPONumber.String
+   }
 
-   	err := rows.Scan(&id, &vehicleDesc, &licensePlate, &ownerName, &impoundedAt, &location)
+   // Fill in the customer's details and payment terms where they were left
+   // out; accounts are always invoiced under their own name
+   dueDate := invoice["due_date"]
+   amount := invoice["amount"]
+   var customer interface{}
+   var lineItems []quoteLineItem
+   if customerID != 0 {
+   	customer = customerID
+   	billing, err := loadBillingCustomer(customerID)
    	if err != nil {
    		http.Error(w, err.Error(), http.StatusInternalServerError)
    		return
    	}
+   	if billing.IsAccount || customerName == "" {
+   		customerName = billing.Name
+   	}
+   	if billing.IsAccount || customerPhone == "" {
+   		customerPhone = billing.Phone
+   	}
+   	if dueDate == nil {
+   		dueDate = simNow().AddDate(0, 0, billing.TermsDays).Format("2006-01-02")
+   	}
+   	if billing.PORequired && poNumber == "" {
+   		http.Error(w, fmt.Sprintf("po_number is required to bill %s", billing.Name), http.StatusBadRequest)
+   		return
+   	}
 
-   	vehicle := map[string]interface{}{
-   		"id": id.Int64,
-   		"vehicle_description": vehicleDesc.String,
-   		"license_plate": licensePlate.String,
-   		"owner_name": ownerName.String,
-   		"impounded_at": impoundedAt.String,
-   		"impound_location": location.String,
+   	// Price from the account's rate card when no amount is given
+   	if amount == nil && billing.IsAccount {
+   		towedKm, err := jobTowedKm(invoice["job_id"])
+   		if err != nil {
+   			http.Error(w, err.Error(), http.StatusInternalServerError)
+   			return
+   		}
+   		if km, ok := invoice["towed_km"].(float64); ok {
+   			towedKm = km
+   		}
+   		var total float64
+   		if lineItems, total, err = priceAccountJob(customerID, jobType.String, towedKm); err != nil {
+   			http.Error(w, err.Error(), http.StatusInternalServerError)
+   			return
+   		}
+   		if lineItems != nil {
+   			// The pickup zone can add a surcharge to the rate card
+   			adjustment, err := zonePriceAdjustment(jobZone.String, total)
+   			if err != nil {
+   				http.Error(w, err.Error(), http.StatusInternalServerError)
+   				return
+   			}
+   			if adjustment != nil {
+   				lineItems = append(lineItems, *adjustment)
+   				total = roundCents(total + adjustment.Amount)
+   			}
+   			amount = total
+   		}
    	}
-   	vehicles = append(vehicles, vehicle)
    }
-
-   w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(vehicles)
-}
-
-func addImpoundedVehicle(w http.ResponseWriter, r *http.Request) {
-   var vehicle map[string]interface{}
-   if err := json.NewDecoder(r.Body).Decode(&vehicle); err != nil {
-   	http.Error(w, err.Error(), http.StatusBadRequest)
+   if amount == nil {
+   	http.Error(w, "amount is required", http.StatusBadRequest)
    	return
    }
+   var po interface{}
+   if poNumber != "" {
+   	po = poNumber
+   }
 
-   result, err := db.Exec(`INSERT INTO impounded_vehicles (job_id, vehicle_description, license_plate, owner_name, owner_phone, impound_location, release_fee) 
-   	VALUES (?, ?, ?, ?, ?, ?, ?)`,
-   	vehicle["job_id"], vehicle["vehicle_description"], vehicle["license_plate"], vehicle["owner_name"], 
-   	vehicle["owner_phone"], vehicle["impound_location"], vehicle["release_fee"])
+   tx, err := db.Begin()
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
+   defer tx.Rollback()
 
-   id, _ := result.LastInsertId()
-   w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(map[string]int64{"id": id})
-}
-
-func releaseVehicle(w http.ResponseWriter, r *http.Request) {
-   vars := mux.Vars(r)
-   vehicleID := vars["id"]
-
-   _, err := db.Exec(`UPDATE impounded_vehicles SET is_currently_impounded = 0, released_at = CURRENT_TIMESTAMP WHERE id = ?`, vehicleID)
+   result, err := tx.Exec(`INSERT INTO invoices (job_id, amount, due_date, customer_name, customer_phone, customer_id, po_number, created_at) 
+   	VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+   	invoice["job_id"], amount, dueDate, customerName, customerPhone, customer, po, simNow().Format(sqliteTimeLayout))
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
+   id, _ := result.LastInsertId()
 
-   w.WriteHeader(http.StatusOK)
-}
-
-// Invoice handlers
-func createInvoice(w http.ResponseWriter, r *http.Request) {
-   var invoice map[string]interface{}
-   if err := json.NewDecoder(r.Body).Decode(&invoice); err != nil {
-   	http.Error(w, err.Error(), http.StatusBadRequest)
-   	return
+   for _, item := range lineItems {
+   	description := item.Description
+   	if item.Quantity > 1 {
+   		description = fmt.Sprintf("%s x %d km", item.Description, item.Quantity)
+   	}
+   	_, err := tx.Exec(`INSERT INTO invoice_line_items (invoice_id, description, amount, item_type) VALUES (?, ?, ?, 'account_rate')`,
+   		id, description, item.Amount)
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
    }
 
-   result, err := db.Exec(`INSERT INTO invoices (job_id, amount, due_date, customer_name, customer_phone) 
-   	VALUES (?, ?, ?, ?, ?)`,
-   	invoice["job_id"], invoice["amount"], invoice["due_date"], invoice["customer_name"], invoice["customer_phone"])
-   if err != nil {
+   if err := tx.Commit(); err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
 
-   id, _ := result.LastInsertId()
    w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(map[string]int64{"id": id})
+   json.NewEncoder(w).Encode(map[string]interface{}{
+   	"id": id,
+   	"customer_id": customerID,
+   	"amount": amount,
+   	"po_number": poNumber,
+   })
 }
 
 func createPayment(w http.ResponseWriter, r *http.Request) {
@@ -587,13 +1963,32 @@ func createPayment(w http.ResponseWriter, r *http.Request) {
    	return
    }
 
-   result, err := db.Exec(`INSERT INTO payments (invoice_id, amount, payment_method, reference_number) 
-   	VALUES (?, ?, ?, ?)`,
-   	payment["invoice_id"], payment["amount"], payment["payment_method"], payment["reference_number"])
+   tx, err := db.Begin()
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+   defer tx.Rollback()
+
+   result, err := tx.Exec(`INSERT INTO payments (invoice_id, amount, payment_method, reference_number, paid_at) 
+   	VALUES (?, ?, ?, ?, ?)`,
+   	payment["invoice_id"], payment["amount"], payment["payment_method"], payment["reference_number"], simNow().Format(sqliteTimeLayout))
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+
+   // Fully covered invoices leave aging and reminders
+   _, err = tx.Exec(`UPDATE invoices SET status = 'paid' WHERE id = ?
+   	AND amount <= (SELECT COALESCE(SUM(amount), 0) FROM payments WHERE invoice_id = invoices.id)`, payment["invoice_id"])
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
+   if err := tx.Commit(); err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
 
    id, _ := result.LastInsertId()
    w.Header().Set("Content-Type", "application/json")
@@ -603,37 +1998,59 @@ func createPayment(w http.ResponseWriter, r *http.Request) {
 // Placeholder handlers for remaining endpoints
 func getJob(w http.ResponseWriter, r *http.Request) { /* implement individual job lookup */ }
 func updateJob(w http.ResponseWriter, r *http.Request) { /* implement job updates */ }
-func updateDriver(w http.ResponseWriter, r *http.Request) { /* implement driver updates */ }
-func updateVehicle(w http.ResponseWriter, r *http.Request) { /* implement vehicle updates */ }
 func getInvoices(w http.ResponseWriter, r *http.Request) { /* implement invoice listing */ }
 func updateInvoice(w http.ResponseWriter, r *http.Request) { /* implement invoice updates */ }
 func getPendingInvoices(w http.ResponseWriter, r *http.Request) { /* implement pending invoices */ }
 func getPaymentsByInvoice(w http.ResponseWriter, r *http.Request) { /* implement payments by invoice */ }
-func getActiveVehicles(w http.ResponseWriter, r *http.Request) { /* implement active vehicles only */ }
 
 // Get available jobs (pending/unassigned)
 func getAvailableJobs(w http.ResponseWriter, r *http.Request) {
+   limit, ok := queueLimit(r)
+   if !ok {
+   	http.Error(w, "limit must be between 1 and 100", http.StatusBadRequest)
+   	return
+   }
+
+   // Most urgent first: by priority, then by how soon the job must be assigned.
+   // Jobs booked ahead wait until they are due.
+   open, err := loadOpenJobSLAs("pending")
+   if err != nil {
+   	http.Error(w, err.Error(), http.StatusInternalServerError)
+   	return
+   }
+   now := simNow()
+   var queue []*openJobSLA
+   for _, job := range open {
+   	if !job.StartAt.After(now) {
+   		queue = append(queue, job)
+   	}
+   }
+   sortJobQueue(queue)
+   if len(queue) > limit {
+   	queue = queue[:limit]
+   }
+
    rows, err := db.Query(`SELECT id, vehicle_description, pickup_coordinates, destination_coordinates, 
-   	created_at, job_type, notes FROM jobs WHERE status = 'pending' LIMIT 5`)
+   	created_at, job_type, notes, zone, scheduled_for FROM jobs WHERE status = 'pending'`)
    if err != nil {
    	http.Error(w, err.Error(), http.StatusInternalServerError)
    	return
    }
    defer rows.Close()
 
-   var jobs []map[string]interface{}
+   pending := map[int64]map[string]interface{}{}
    for rows.Next() {
    	var id sql.NullInt64
-   	var vehicleDesc, pickup, destination, jobType, notes sql.NullString
-   	var createdAt sql.NullString
+   	var vehicleDesc, pickup, destination, jobType, notes, zone sql.NullString
+   	var createdAt, scheduledFor sql.NullString
 
-   	err := rows.Scan(&id, &vehicleDesc, &pickup, &destination, &createdAt, &jobType, &notes)
+   	err := rows.Scan(&id, &vehicleDesc, &pickup, &destination, &createdAt, &jobType, &notes, &zone, &scheduledFor)
    	if err != nil {
    		http.Error(w, err.Error(), http.StatusInternalServerError)
    		return
    	}
 
-   	job := map[string]interface{}{
+   	pending[id.Int64] = map[string]interface{}{
    		"id": id.Int64,
    		"vehicle_description": vehicleDesc.String,
    		"pickup_coordinates": pickup.String,
@@ -642,6 +2059,25 @@ func getAvailableJobs(w http.ResponseWriter, r *http.Request) {
    		"job_type": jobType.String,
    		"status": "pending",
    		"notes": notes.String,
+   		"zone": zone.String,
+   	}
+   	if scheduledFor.Valid {
+   		pending[id.Int64]["scheduled_for"] = scheduledFor.String
+   	}
+   }
+
+   var jobs []map[string]interface{}
+   for _, entry := range queue {
+   	job, ok := pending[entry.JobID]
+   	if !ok {
+   		continue
+   	}
+   	job["priority"] = entry.Priority
+   	if entry.Assign != nil {
+   		job["sla"] = map[string]interface{}{
+   			"assign": slaClockJSON(*entry.Assign),
+   			"arrive": slaClockJSON(*entry.Arrive),
+   		}
    	}
    	jobs = append(jobs, job)
    }
@@ -651,6 +2087,71 @@ func getAvailableJobs(w http.ResponseWriter, r *http.Request) {
 }
 
 // Assign job with validation
+// Check that a driver can take a job of this type now. Returns the problem
+// and the status to report it with, or "" when the driver is free to go.
+func driverAssignable(driverID interface{}, jobType string) (string, int, error) {
+   // Verify driver exists and is active
+   var isActive bool
+   err := db.QueryRow("SELECT is_active FROM drivers WHERE id = ?", driverID).Scan(&isActive)
+   if err == sql.ErrNoRows {
+   	return "Driver not found", http.StatusNotFound, nil
+   } else if err != nil {
+   	return "", 0, err
+   }
+
+   if !isActive {
+   	return "Driver is not active", http.StatusBadRequest, nil
+   }
+
+   // Driver must be clocked in, not on a break and not already on a job
+   status, _, err := driverStatus(driverID)
+   if err != nil {
+   	return "", 0, err
+   }
+   switch status {
+   case "off_duty":
+   	return "Driver is not on shift", http.StatusConflict, nil
+   case "on_break":
+   	return "Driver is on a break", http.StatusConflict, nil
+   case "on_job":
+   	return "Driver is already on an active job", http.StatusConflict, nil
+   }
+
+   // Driver must have hours-of-service time left
+   if limit, err := exceededHOSLimit(driverID); err != nil {
+   	return "", 0, err
+   } else if limit != nil {
+   	return fmt.Sprintf("Driver has exceeded the %s hours-of-service limit", limit.Code), http.StatusConflict, nil
+   }
+
+   // Driver must hold every credential the job type requires
+   missing, err := missingCredentials(driverID, jobType)
+   if err != nil {
+   	return "", 0, err
+   }
+   if len(missing) > 0 {
+   	return fmt.Sprintf("Driver lacks credentials required for %s jobs: %s", jobType, strings.Join(missing, ", ")), http.StatusConflict, nil
+   }
+   return "", 0, nil
+}
+
+// Check that a truck is in service, free and has been inspected by the driver
+func truckAssignable(vehicleID int64, driverID interface{}) (string, int, error) {
+   problem, status, err := vehicleAssignable(vehicleID)
+   if err != nil || problem != "" {
+   	return problem, status, err
+   }
+   // The driver must have walked round the truck this shift
+   inspected, err := hasPassedPreTrip(vehicleID, driverID)
+   if err != nil {
+   	return "", 0, err
+   }
+   if !inspected {
+   	return "Vehicle has no passing pre-trip inspection for this shift", http.StatusConflict, nil
+   }
+   return "", 0, nil
+}
+
 func assignJobWithValidation(w http.ResponseWriter, r *http.Request) {
    vars := mux.Vars(r)
    jobIDStr := vars["id"]
@@ -666,15 +2167,10 @@ func assignJobWithValidation(w http.ResponseWriter, r *http.Request) {
    	return
    }
 
-   driverID, ok := assignment["driver_id"]
-   if !ok {
-   	http.Error(w, "driver_id is required", http.StatusBadRequest)
-   	return
-   }
-
    // Verify job exists and is pending
-   var jobStatus string
-   err = db.QueryRow("SELECT status FROM jobs WHERE id = ?", jobID).Scan(&jobStatus)
+   var jobStatus, jobType string
+   var zone sql.NullString
+   err = db.QueryRow("SELECT status, job_type, zone FROM jobs WHERE id = ?", jobID).Scan(&jobStatus, &jobType, &zone)
    if err == sql.ErrNoRows {
    	http.Error(w, "Job not found", http.StatusNotFound)
    	return
@@ -688,35 +2184,119 @@ func assignJobWithValidation(w http.ResponseWriter, r *http.Request) {
    	return
    }
 
-   // Verify driver exists and is active
-   var isActive bool
-   err = db.QueryRow("SELECT is_active FROM drivers WHERE id = ?", driverID).Scan(&isActive)
-   if err == sql.ErrNoRows {
-   	http.Error(w, "Driver not found", http.StatusNotFound)
-   	return
-   } else if err != nil {
-   	http.Error(w, err.Error(), http.StatusInternalServerError)
-   	return
-   }
+   // Without a driver, the job goes to the next eligible truck on the zone's rotation.
+   // The walk only reads; the turn is claimed together with the assignment below,
+   // and a claim lost to another assignment walks the rotation again.
+   driverID, ok := assignment["driver_id"]
+   requestedVehicle := assignment["vehicle_id"]
+   var pick *rotationPick
+   for attempt := 0; ; attempt++ {
+   	var lastPosition int
+   	if !ok {
+   		if attempt == rotationClaimAttempts {
+   			http.Error(w, errRotationBusy.Error(), http.StatusConflict)
+   			return
+   		}
+   		pick, lastPosition, err = pickFromRotation(jobType, zone.String)
+   		if err == errNoRotation {
+   			http.Error(w, "driver_id is required", http.StatusBadRequest)
+   			return
+   		} else if err != nil {
+   			http.Error(w, err.Error(), http.StatusInternalServerError)
+   			return
+   		}
+   		if pick.Entry == nil {
+   			recordRotationTurn(pick, jobID)
+   			w.Header().Set("Content-Type", "application/json")
+   			w.WriteHeader(http.StatusConflict)
+   			json.NewEncoder(w).Encode(map[string]interface{}{
+   				"error":       "No driver on the rotation can take this job",
+   				"rotation_id": pick.RotationID,
+   				"skipped":     pick.Skipped,
+   			})
+   			return
+   		}
+   		driverID = float64(pick.Entry.DriverID)
+   		assignment["vehicle_id"] = requestedVehicle
+   		if pick.Entry.VehicleID != 0 {
+   			assignment["vehicle_id"] = float64(pick.Entry.VehicleID)
+   		}
+   	}
 
-   if !isActive {
-   	http.Error(w, "Driver is not active", http.StatusBadRequest)
-   	return
+   	if problem, status, err := driverAssignable(driverID, jobType); err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	} else if problem != "" {
+   		http.Error(w, problem, status)
+   		return
+   	}
+
+   	// Optional truck: must be in service, not already on a job and inspected by the driver
+   	var vehicleID interface{}
+   	if value := assignment["vehicle_id"]; value != nil {
+   		id, isNumber := value.(float64)
+   		if !isNumber {
+   			http.Error(w, "vehicle_id must be a number", http.StatusBadRequest)
+   			return
+   		}
+   		if problem, status, err := truckAssignable(int64(id), driverID); err != nil {
+   			http.Error(w, err.Error(), http.StatusInternalServerError)
+   			return
+   		} else if problem != "" {
+   			http.Error(w, problem, status)
+   			return
+   		}
+   		vehicleID = int64(id)
+   	}
+
+   	assigned, err := assignJob(jobID, driverID, vehicleID, pick, lastPosition)
+   	if err != nil {
+   		http.Error(w, err.Error(), http.StatusInternalServerError)
+   		return
+   	}
+   	if assigned {
+   		break
+   	}
    }
 
-   // Update job assignment
-   _, err = db.Exec(`UPDATE jobs SET assigned_driver_id = ?, status = 'assigned' WHERE id = ?`,
-   	driverID, jobID)
-   if err != nil {
-   	http.Error(w, err.Error(), http.StatusInternalServerError)
-   	return
+   response := map[string]interface{}{"status": "assigned"}
+   if pick != nil {
+   	recordRotationTurn(pick, jobID)
+   	response["driver_id"] = pick.Entry.DriverID
+   	response["vehicle_id"] = pick.Entry.VehicleID
+   	response["rotation_id"] = pick.RotationID
+   	response["skipped"] = pick.Skipped
+   } else {
+   	recordManualRotationAssignment(jobType, zone.String, jobID, driverID)
    }
 
    // Start GPS simulation for this job
    startGPSSimulation(jobID, driverID.(float64))
 
    w.Header().Set("Content-Type", "application/json")
-   json.NewEncoder(w).Encode(map[string]string{"status": "assigned"})
+   json.NewEncoder(w).Encode(response)
+}
+
+// Update the job assignment, moving the rotation on to the picked entry in the
+// same transaction. False when another assignment claimed the turn first.
+func assignJob(jobID int64, driverID, vehicleID interface{}, pick *rotationPick, lastPosition int) (bool, error) {
+   tx, err := db.Begin()
+   if err != nil {
+   	return false, err
+   }
+   defer tx.Rollback()
+
+   if pick != nil {
+   	if claimed, err := claimRotationTurn(tx, pick, lastPosition); err != nil || !claimed {
+   		return false, err
+   	}
+   }
+   _, err = tx.Exec(`UPDATE jobs SET assigned_driver_id = ?, assigned_vehicle_id = COALESCE(?, assigned_vehicle_id), status = 'assigned' WHERE id = ?`,
+   	driverID, vehicleID, jobID)
+   if err != nil {
+   	return false, err
+   }
+   return true, tx.Commit()
 }
 
 // WebSocket handler for GPS tracking
@@ -756,7 +2336,10 @@ func startGPSSimulation(jobID int64, driverIDFloat float64) {
    
    // Get job coordinates
    var pickup, destination string
-   err := db.QueryRow("SELECT pickup_coordinates, destination_coordinates FROM jobs WHERE id = ?", jobID).Scan(&pickup, &destination)
+   var jobType sql.NullString
+   var impoundLotID, vehicleID sql.NullInt64
+   err := db.QueryRow("SELECT pickup_coordinates, destination_coordinates, job_type, impound_lot_id, assigned_vehicle_id FROM jobs WHERE id = ?", jobID).
+   	Scan(&pickup, &destination, &jobType, &impoundLotID, &vehicleID)
    if err != nil {
    	log.Printf("Error getting job coordinates: %v", err)
    	return
@@ -766,10 +2349,24 @@ func startGPSSimulation(jobID int64, driverIDFloat float64) {
    startLat, startLng := parseCoordinates(pickup)
    endLat, endLng := parseCoordinates(destination)
 
+   // Impound tows end at the chosen lot (nearest one with space if none was chosen)
+   if !impoundLotID.Valid && isImpoundJobType(jobType.String) {
+   	if lotID, err := chooseImpoundLot(startLat, startLng); err == nil {
+   		impoundLotID = sql.NullInt64{Int64: lotID, Valid: true}
+   		db.Exec("UPDATE jobs SET impound_lot_id = ? WHERE id = ?", lotID, jobID)
+   	} else {
+   		log.Printf("No impound lot with space for job %d: %v", jobID, err)
+   	}
+   }
+   if impoundLotID.Valid {
+   	db.QueryRow("SELECT latitude, longitude FROM impound_lots WHERE id = ?", impoundLotID.Int64).Scan(&endLat, &endLng)
+   }
+
    // Create active job
    activeJob := &ActiveJob{
    	JobID:       jobID,
    	DriverID:    driverID,
+   	VehicleID:   vehicleID.Int64,
    	StartLat:    startLat,
    	StartLng:    startLng,
    	EndLat:      endLat,
@@ -791,18 +2388,30 @@ func startGPSSimulation(jobID int64, driverIDFloat float64) {
    	activeJob.ReturnSteps[len(activeJob.Steps)-1-i] = step
    }
 
+   // Note which geofences the truck starts in so only crossings are reported
+   activeJob.PickupRadiusM = pickupRadiusForJob(jobID)
+   if fences, err := sharedGeofences(); err != nil {
+   	log.Printf("Error loading geofences for job %d: %v", jobID, err)
+   } else {
+   	checkGeofences(activeJob, fences, false)
+   }
+
    // Add to active jobs
    activeMutex.Lock()
    activeJobs[jobID] = activeJob
    activeMutex.Unlock()
 
+   recordJobEvent(jobID, driverID, "assigned", activeJob.CurrentLat, activeJob.CurrentLng)
+
    log.Printf("Started GPS simulation for job %d with driver %d", jobID, driverID)
 }
 
 // Parse coordinates from string format
 func parseCoordinates(coords string) (float64, float64) {
-   // For simplicity, using mock coordinates
-   // In real implementation, would parse the actual coordinate string
+   if lat, lng, ok := parseLatLng(coords); ok {
+   	return lat, lng
+   }
+   // Addresses are not geocoded, so they get mock coordinates near the base
    return 49.269391 + rand.Float64()*0.1 - 0.05, -123.095063 + rand.Float64()*0.1 - 0.05
 }
 
@@ -867,6 +2476,12 @@ func gpsSimulationWorker() {
 
 // Process all active jobs
 func processActiveJobs() {
+   // Zone and impound lot geofences are read before taking the lock
+   fences, fenceErr := sharedGeofences()
+   if fenceErr != nil {
+   	log.Printf("Error loading geofences: %v", fenceErr)
+   }
+
    activeMutex.Lock()
    defer activeMutex.Unlock()
 
@@ -877,10 +2492,20 @@ func processActiveJobs() {
 
    	// Update GPS position
    	updateJobGPS(activeJob)
+   	if activeJob.VehicleID != 0 {
+   		db.Exec("UPDATE fleet_vehicles SET last_latitude = ?, last_longitude = ?, last_position_at = ? WHERE id = ?",
+   			activeJob.CurrentLat, activeJob.CurrentLng, simNow().Format(sqliteTimeLayout), activeJob.VehicleID)
+   	}
+   	if fenceErr == nil {
+   		checkGeofences(activeJob, fences, true)
+   	}
 
    	// Check if job should be completed
    	if activeJob.Direction == 1 && activeJob.CurrentStep >= len(activeJob.Steps)-1 {
    		// Driver has arrived at job location
+   		recordDrivingLeg(activeJob, "to_job", activeJob.Steps)
+   		recordVehicleLeg(activeJob, "to_job", activeJob.Steps)
+   		recordJobEvent(activeJob.JobID, activeJob.DriverID, "arrived", activeJob.CurrentLat, activeJob.CurrentLng)
    		broadcastGPSData(GPSData{
    			JobID:     activeJob.JobID,
    			DriverID:  activeJob.DriverID,
@@ -897,6 +2522,9 @@ func processActiveJobs() {
    		
    	} else if activeJob.Direction == -1 && activeJob.CurrentStep >= len(activeJob.ReturnSteps)-1 {
    		// Driver has completed the job
+   		recordDrivingLeg(activeJob, "return", activeJob.ReturnSteps)
+   		recordVehicleLeg(activeJob, "return", activeJob.ReturnSteps)
+   		recordJobEvent(activeJob.JobID, activeJob.DriverID, "completed", activeJob.CurrentLat, activeJob.CurrentLng)
    		broadcastGPSData(GPSData{
    			JobID:     activeJob.JobID,
    			DriverID:  activeJob.DriverID,
@@ -908,12 +2536,20 @@ func processActiveJobs() {
    		})
    		
    		// Mark job as completed in database
-   		db.Exec("UPDATE jobs SET status = 'completed', completed_at = CURRENT_TIMESTAMP WHERE id = ?", activeJob.JobID)
+   		db.Exec("UPDATE jobs SET status = 'completed', completed_at = ? WHERE id = ?", simNow().Format(sqliteTimeLayout), activeJob.JobID)
+   		if _, err := impoundCompletedJob(activeJob.JobID); err != nil {
+   			log.Printf("Error impounding vehicle for job %d: %v", activeJob.JobID, err)
+   		}
    		
    		activeJob.Completed = true
    		delete(activeJobs, jobID)
    		
    	} else {
+   		// First step of the return journey means the truck has left the scene
+   		if activeJob.Direction == -1 && activeJob.CurrentStep == 1 {
+   			recordJobEvent(activeJob.JobID, activeJob.DriverID, "departed", activeJob.CurrentLat, activeJob.CurrentLng)
+   		}
+
    		// Send regular GPS update during normal driving
    		broadcastGPSData(GPSData{
    			JobID:     activeJob.JobID,
@@ -995,7 +2631,7 @@ func broadcastGPSData(gpsData GPSData) {
 func enableCORS(next http.Handler) http.Handler {
    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
    	w.Header().Set("Access-Control-Allow-Origin", "*")
-   	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+   	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
    	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 
    	if r.Method == "OPTIONS" {
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// Point the package db at a fresh in-memory database set up by the given
+// statements, restoring the previous db when the test ends
+func openTestDB(t *testing.T, statements ...string) {
+	t.Helper()
+	testDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to :memory: gets its own empty database
+	testDB.SetMaxOpenConns(1)
+	for _, statement := range statements {
+		if _, err := testDB.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+}
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Mock payment gateway. Cards are tokenised, attached to a payment intent and
+// confirmed; the outcome is decided by the magic test card number so the
+// frontend can exercise every checkout failure mode without a real processor.
+
+const (
+	gatewaySettleDelay  = 10 * time.Second // processing -> succeeded
+	gatewayTimeoutDelay = 60 * time.Second // processing -> timed_out
+	webhookMaxAttempts  = 5
+)
+
+// Card behaviours keyed by magic test card number
+var testCards = map[string]string{
+	"4242424242424242": "succeed",
+	"5555555555554444": "succeed",
+	"4000000000000002": "decline",
+	"4000000000009995": "insufficient_funds",
+	"4000000000000069": "expired_card",
+	"4000000000003220": "require_3ds",
+	"4000000000000119": "timeout",
+}
+
+var (
+	webhookURL    = os.Getenv("PAYMENT_WEBHOOK_URL")
+	webhookSecret = os.Getenv("PAYMENT_WEBHOOK_SECRET")
+	webhookMutex  = sync.RWMutex{}
+	webhookClient = &http.Client{Timeout: 5 * time.Second}
+)
+
+// Tokenise a card number so the raw number never touches an intent
+func createCardToken(w http.ResponseWriter, r *http.Request) {
+	var card map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&card); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	number, _ := card["card_number"].(string)
+	number = strings.ReplaceAll(strings.ReplaceAll(number, " ", ""), "-", "")
+	if len(number) < 12 || !luhnValid(number) {
+		http.Error(w, "Invalid card number", http.StatusBadRequest)
+		return
+	}
+
+	behavior, ok := testCards[number]
+	if !ok {
+		behavior = "succeed"
+	}
+
+	token := fmt.Sprintf("tok_%d%06d", time.Now().Unix(), rand.Intn(1000000))
+	last4 := number[len(number)-4:]
+	brand := cardBrand(number)
+
+	_, err := db.Exec(`INSERT INTO card_tokens (token, last4, brand, behavior) VALUES (?, ?, ?, ?)`,
+		token, last4, brand, behavior)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": token,
+		"last4": last4,
+		"brand": brand,
+	})
+}
+
+// Create a pending payment intent against an invoice
+func createPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var intent map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&intent); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	invoiceID, ok := intent["invoice_id"]
+	if !ok {
+		http.Error(w, "invoice_id is required", http.StatusBadRequest)
+		return
+	}
+
+	// Card payments still settling count against the balance
+	var invoiceAmount, paid, settling float64
+	var status sql.NullString
+	err := db.QueryRow(`SELECT amount, status,
+		(SELECT COALESCE(SUM(amount), 0) FROM payments WHERE invoice_id = invoices.id),
+		(SELECT COALESCE(SUM(amount), 0) FROM payment_intents WHERE invoice_id = invoices.id AND status = 'processing')
+		FROM invoices WHERE id = ?`, invoiceID).Scan(&invoiceAmount, &status, &paid, &settling)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invoice not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	outstanding := roundCents(invoiceAmount - paid - settling)
+	if status.String == "paid" || outstanding <= 0 {
+		http.Error(w, "Invoice has no outstanding balance", http.StatusConflict)
+		return
+	}
+
+	// Default to the outstanding balance on the invoice
+	amount, ok := intent["amount"].(float64)
+	if !ok {
+		amount = outstanding
+	}
+	if amount <= 0 {
+		http.Error(w, "Amount must be greater than zero", http.StatusBadRequest)
+		return
+	}
+	if roundCents(amount) > outstanding {
+		http.Error(w, fmt.Sprintf("Amount is more than the outstanding balance of %.2f", outstanding), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(`INSERT INTO payment_intents (invoice_id, amount, currency, status) VALUES (?, ?, ?, 'pending')`,
+		invoiceID, amount, "usd")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	queueWebhookEvent(id, "payment_intent.created")
+
+	writePaymentIntent(w, id)
+}
+
+func getPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	writePaymentIntent(w, vars["id"])
+}
+
+func getPaymentIntents(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT id FROM payment_intents`
+	var args []interface{}
+	if invoiceID := r.URL.Query().Get("invoice_id"); invoiceID != "" {
+		query += ` WHERE invoice_id = ?`
+		args = append(args, invoiceID)
+	}
+
+	rows, err := db.Query(query+` ORDER BY id`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	var intents []map[string]interface{}
+	for _, id := range ids {
+		intent, err := loadPaymentIntent(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		intents = append(intents, intent)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(intents)
+}
+
+// Confirm an intent with a card token; the card decides what happens next
+func confirmPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	intentID := vars["id"]
+
+	var confirm map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&confirm); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token, _ := confirm["card_token"].(string)
+	if token == "" {
+		http.Error(w, "card_token is required", http.StatusBadRequest)
+		return
+	}
+
+	var id int64
+	var status string
+	err := db.QueryRow("SELECT id, status FROM payment_intents WHERE id = ?", intentID).Scan(&id, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment intent not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status != "pending" && status != "declined" && status != "timed_out" {
+		http.Error(w, "Payment intent cannot be confirmed in status "+status, http.StatusConflict)
+		return
+	}
+
+	var behavior string
+	err = db.QueryRow("SELECT behavior FROM card_tokens WHERE token = ?", token).Scan(&behavior)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown card token", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	switch behavior {
+	case "decline", "insufficient_funds", "expired_card":
+		declineCode := behavior
+		if behavior == "decline" {
+			declineCode = "card_declined"
+		}
+		_, err = db.Exec(`UPDATE payment_intents SET card_token = ?, status = 'declined', decline_code = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			token, declineCode, id)
+		queueWebhookEvent(id, "payment_intent.payment_failed")
+	case "require_3ds":
+		_, err = db.Exec(`UPDATE payment_intents SET card_token = ?, status = 'requires_action', decline_code = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			token, id)
+		queueWebhookEvent(id, "payment_intent.requires_action")
+	case "timeout":
+		_, err = db.Exec(`UPDATE payment_intents SET card_token = ?, status = 'processing', decline_code = NULL, settle_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			token, now.Add(gatewayTimeoutDelay).Format("2006-01-02 15:04:05"), id)
+		queueWebhookEvent(id, "payment_intent.processing")
+	default:
+		_, err = db.Exec(`UPDATE payment_intents SET card_token = ?, status = 'processing', decline_code = NULL, settle_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			token, now.Add(gatewaySettleDelay).Format("2006-01-02 15:04:05"), id)
+		queueWebhookEvent(id, "payment_intent.processing")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writePaymentIntent(w, id)
+}
+
+// Complete (or fail) the simulated 3DS challenge for an intent
+func authenticatePaymentIntent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	intentID := vars["id"]
+
+	var challenge map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&challenge); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var id int64
+	var status string
+	err := db.QueryRow("SELECT id, status FROM payment_intents WHERE id = ?", intentID).Scan(&id, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment intent not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if status != "requires_action" {
+		http.Error(w, "Payment intent does not require authentication", http.StatusConflict)
+		return
+	}
+
+	if outcome, _ := challenge["outcome"].(string); outcome == "fail" {
+		_, err = db.Exec(`UPDATE payment_intents SET status = 'declined', decline_code = 'authentication_failed', updated_at = CURRENT_TIMESTAMP WHERE id = ?`, id)
+		queueWebhookEvent(id, "payment_intent.payment_failed")
+	} else {
+		_, err = db.Exec(`UPDATE payment_intents SET status = 'processing', settle_at = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			time.Now().UTC().Add(gatewaySettleDelay).Format("2006-01-02 15:04:05"), id)
+		queueWebhookEvent(id, "payment_intent.processing")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writePaymentIntent(w, id)
+}
+
+func getWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT id, intent_id, event_type, payload, attempts, delivered_at, last_error, created_at
+		FROM webhook_events ORDER BY id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var events []map[string]interface{}
+	for rows.Next() {
+		var id, intentID, attempts sql.NullInt64
+		var eventType, payload, deliveredAt, lastError, createdAt sql.NullString
+
+		err := rows.Scan(&id, &intentID, &eventType, &payload, &attempts, &deliveredAt, &lastError, &createdAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		event := map[string]interface{}{
+			"id":           id.Int64,
+			"intent_id":    intentID.Int64,
+			"event_type":   eventType.String,
+			"payload":      json.RawMessage(payload.String),
+			"attempts":     attempts.Int64,
+			"delivered_at": deliveredAt.String,
+			"last_error":   lastError.String,
+			"created_at":   createdAt.String,
+		}
+		events = append(events, event)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Point webhook delivery at a URL at runtime (defaults come from the environment)
+func updateWebhookConfig(w http.ResponseWriter, r *http.Request) {
+	var config map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	webhookMutex.Lock()
+	if url, ok := config["url"].(string); ok {
+		webhookURL = url
+	}
+	if secret, ok := config["secret"].(string); ok {
+		webhookSecret = secret
+	}
+	url := webhookURL
+	webhookMutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": url})
+}
+
+func writePaymentIntent(w http.ResponseWriter, id interface{}) {
+	intent, err := loadPaymentIntent(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Payment intent not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(intent)
+}
+
+func loadPaymentIntent(id interface{}) (map[string]interface{}, error) {
+	var intentID, invoiceID, paymentID sql.NullInt64
+	var amount sql.NullFloat64
+	var currency, status, cardToken, declineCode, last4, brand, createdAt, updatedAt sql.NullString
+
+	err := db.QueryRow(`SELECT pi.id, pi.invoice_id, pi.amount, pi.currency, pi.status, pi.card_token, pi.decline_code,
+		pi.payment_id, ct.last4, ct.brand, pi.created_at, pi.updated_at
+		FROM payment_intents pi LEFT JOIN card_tokens ct ON ct.token = pi.card_token
+		WHERE pi.id = ?`, id).Scan(&intentID, &invoiceID, &amount, &currency, &status, &cardToken, &declineCode,
+		&paymentID, &last4, &brand, &createdAt, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	intent := map[string]interface{}{
+		"id":           intentID.Int64,
+		"invoice_id":   invoiceID.Int64,
+		"amount":       amount.Float64,
+		"currency":     currency.String,
+		"status":       status.String,
+		"card_token":   cardToken.String,
+		"card_last4":   last4.String,
+		"card_brand":   brand.String,
+		"decline_code": declineCode.String,
+		"payment_id":   paymentID.Int64,
+		"created_at":   createdAt.String,
+		"updated_at":   updatedAt.String,
+	}
+	if status.String == "requires_action" {
+		intent["next_action"] = map[string]string{
+			"type": "3ds_challenge",
+			"url":  fmt.Sprintf("/payments/intents/%d/authenticate", intentID.Int64),
+		}
+	}
+	return intent, nil
+}
+
+// Record a webhook event for an intent; delivery happens on the settlement worker
+func queueWebhookEvent(intentID int64, eventType string) {
+	intent, err := loadPaymentIntent(intentID)
+	if err != nil {
+		log.Printf("Error loading payment intent %d for webhook: %v", intentID, err)
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{
+		"type":       eventType,
+		"created_at": time.Now().UTC().Format(time.RFC3339),
+		"data":       intent,
+	})
+
+	_, err = db.Exec(`INSERT INTO webhook_events (intent_id, event_type, payload) VALUES (?, ?, ?)`,
+		intentID, eventType, string(payload))
+	if err != nil {
+		log.Printf("Error recording webhook event: %v", err)
+	}
+}
+
+// Payment settlement worker
+func paymentSettlementWorker() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	log.Println("Payment settlement worker started")
+
+	for range ticker.C {
+		settlePaymentIntents()
+		deliverWebhookEvents()
+	}
+}
+
+// Settle or time out intents whose processing window has elapsed
+func settlePaymentIntents() {
+	rows, err := db.Query(`SELECT pi.id, pi.invoice_id, pi.amount, ct.behavior FROM payment_intents pi
+		JOIN card_tokens ct ON ct.token = pi.card_token
+		WHERE pi.status = 'processing' AND pi.settle_at <= ?`, time.Now().UTC().Format("2006-01-02 15:04:05"))
+	if err != nil {
+		log.Printf("Error loading processing payment intents: %v", err)
+		return
+	}
+
+	type dueIntent struct {
+		id, invoiceID int64
+		amount        float64
+		behavior      string
+	}
+	var due []dueIntent
+	for rows.Next() {
+		var intent dueIntent
+		if err := rows.Scan(&intent.id, &intent.invoiceID, &intent.amount, &intent.behavior); err != nil {
+			log.Printf("Error scanning payment intent: %v", err)
+			continue
+		}
+		due = append(due, intent)
+	}
+	rows.Close()
+
+	for _, intent := range due {
+		if intent.behavior == "timeout" {
+			if _, err := db.Exec(`UPDATE payment_intents SET status = 'timed_out', decline_code = 'processing_timeout', updated_at = CURRENT_TIMESTAMP WHERE id = ?`, intent.id); err != nil {
+				log.Printf("Error timing out payment intent %d: %v", intent.id, err)
+				continue
+			}
+			queueWebhookEvent(intent.id, "payment_intent.timed_out")
+			continue
+		}
+
+		if err := settlePaymentIntent(intent.id, intent.invoiceID, intent.amount); err != nil {
+			log.Printf("Error recording payment for intent %d: %v", intent.id, err)
+			continue
+		}
+		queueWebhookEvent(intent.id, "payment_intent.succeeded")
+	}
+}
+
+// Record the payment, mark the intent succeeded and the invoice paid once
+// fully covered, all or nothing
+func settlePaymentIntent(id, invoiceID int64, amount float64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO payments (invoice_id, amount, payment_method, reference_number, paid_at) VALUES (?, ?, 'card', ?, ?)`,
+		invoiceID, amount, fmt.Sprintf("PI%06d", id), simNow().Format(sqliteTimeLayout))
+	if err != nil {
+		return err
+	}
+	paymentID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	result, err = tx.Exec(`UPDATE payment_intents SET status = 'succeeded', payment_id = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND status = 'processing'`,
+		paymentID, id)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return fmt.Errorf("intent is no longer processing")
+	}
+	if _, err := tx.Exec(`UPDATE invoices SET status = 'paid' WHERE id = ?
+		AND amount <= (SELECT COALESCE(SUM(amount), 0) FROM payments WHERE invoice_id = invoices.id)`, invoiceID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Deliver undelivered webhook events to the configured URL, signed with HMAC-SHA256
+func deliverWebhookEvents() {
+	webhookMutex.RLock()
+	url, secret := webhookURL, webhookSecret
+	webhookMutex.RUnlock()
+
+	if url == "" {
+		return
+	}
+
+	rows, err := db.Query(`SELECT id, payload FROM webhook_events WHERE delivered_at IS NULL AND attempts < ? ORDER BY id`, webhookMaxAttempts)
+	if err != nil {
+		log.Printf("Error loading webhook events: %v", err)
+		return
+	}
+
+	type pendingEvent struct {
+		id      int64
+		payload string
+	}
+	var pending []pendingEvent
+	for rows.Next() {
+		var event pendingEvent
+		if err := rows.Scan(&event.id, &event.payload); err != nil {
+			log.Printf("Error scanning webhook event: %v", err)
+			continue
+		}
+		pending = append(pending, event)
+	}
+	rows.Close()
+
+	for _, event := range pending {
+		timestamp := time.Now().Unix()
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%d.%s", timestamp, event.payload)
+		signature := hex.EncodeToString(mac.Sum(nil))
+
+		req, err := http.NewRequest("POST", url, bytes.NewBufferString(event.payload))
+		if err != nil {
+			db.Exec(`UPDATE webhook_events SET attempts = attempts + 1, last_error = ? WHERE id = ?`, err.Error(), event.id)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Mock-Signature", fmt.Sprintf("t=%d,v1=%s", timestamp, signature))
+
+		resp, err := webhookClient.Do(req)
+		if err != nil {
+			db.Exec(`UPDATE webhook_events SET attempts = attempts + 1, last_error = ? WHERE id = ?`, err.Error(), event.id)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode >= 300 {
+			db.Exec(`UPDATE webhook_events SET attempts = attempts + 1, last_error = ? WHERE id = ?`, resp.Status, event.id)
+			continue
+		}
+		db.Exec(`UPDATE webhook_events SET attempts = attempts + 1, delivered_at = CURRENT_TIMESTAMP, last_error = NULL WHERE id = ?`, event.id)
+	}
+}
+
+// Luhn checksum used by card numbers
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func cardBrand(number string) string {
+	switch {
+	case strings.HasPrefix(number, "4"):
+		return "visa"
+	case strings.HasPrefix(number, "5"):
+		return "mastercard"
+	case strings.HasPrefix(number, "34"), strings.HasPrefix(number, "37"):
+		return "amex"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"4242424242424242", true},
+		{"4111111111111111", true},
+		{"5555555555554444", true},
+		{"378282246310005", true},
+		{"79927398713", true},
+		{"4242424242424241", false},
+		{"79927398710", false},
+		{"4242 4242 4242 4242", false},
+		{"4242-4242-4242-4242", false},
+		{"424242424242424a", false},
+		{"0", true},
+		{"18", true},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Public "was my car towed?" lookup. Anyone can search by plate, so the
+// response only carries what the owner needs to come and collect the
+// vehicle: where it is, when the lot is open, what it costs and what to
+// bring. Owner names, phone numbers and job details are never returned.
+
+const (
+	publicLookupLimit  = 10 // requests per client per window
+	publicLookupWindow = time.Minute
+)
+
+type lookupWindow struct {
+	start time.Time
+	count int
+}
+
+var (
+	publicLookupClients = make(map[string]*lookupWindow)
+	publicLookupMutex   = sync.Mutex{}
+)
+
+// Fixed-window rate limit per client IP. Returns how long to wait when limited.
+func allowPublicLookup(client string) (bool, time.Duration) {
+	publicLookupMutex.Lock()
+	defer publicLookupMutex.Unlock()
+
+	now := time.Now()
+	window, exists := publicLookupClients[client]
+	if !exists || now.Sub(window.start) >= publicLookupWindow {
+		publicLookupClients[client] = &lookupWindow{start: now, count: 1}
+
+		// Drop stale clients so the map does not grow without bound
+		for key, w := range publicLookupClients {
+			if now.Sub(w.start) >= publicLookupWindow {
+				delete(publicLookupClients, key)
+			}
+		}
+		return true, 0
+	}
+
+	if window.count >= publicLookupLimit {
+		return false, publicLookupWindow - now.Sub(window.start)
+	}
+	window.count++
+	return true, 0
+}
+
+// Proxies allowed to set X-Forwarded-For, from TRUSTED_PROXIES: a comma
+// separated list of addresses or CIDR ranges
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(value string) []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			proxies = append(proxies, network)
+		}
+	}
+	return proxies
+}
+
+func isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// The connecting address, or for requests through a trusted proxy the
+// right-most X-Forwarded-For hop that is not itself a trusted proxy. Clients
+// can put anything at the left of the header, so only hops added by our own
+// proxies count.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+// Uppercase and strip spaces, dashes and other separators ("abc-123" -> "ABC123")
+func normalizePlate(plate string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(plate) {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func defaultLotHours() string {
+	return fmt.Sprintf("Mon-Fri %02d:00-%02d:00 UTC; after-hours release available for a fee", releaseHoursOpen, releaseHoursClose)
+}
+
+func publicVehicleLookup(w http.ResponseWriter, r *http.Request) {
+	if ok, retryAfter := allowPublicLookup(clientIP(r)); !ok {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())+1))
+		http.Error(w, "Too many lookups, please try again shortly", http.StatusTooManyRequests)
+		return
+	}
+
+	plate := normalizePlate(r.URL.Query().Get("plate"))
+	if len(plate) < 2 {
+		http.Error(w, "plate is required", http.StatusBadRequest)
+		return
+	}
+
+	// Only currently held vehicles; released ones are none of the public's business
+	rows, err := db.Query(`SELECT v.id, v.license_plate, v.vehicle_description, v.impounded_at,
+		l.name, l.address, l.latitude, l.longitude, l.hours
+		FROM impounded_vehicles v LEFT JOIN impound_lots l ON l.id = v.lot_id
+		WHERE v.is_currently_impounded = 1 AND v.license_plate IS NOT NULL`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	vehicles := []map[string]interface{}{}
+	var impoundIDs []int64
+	for rows.Next() {
+		var id int64
+		var licensePlate, vehicleDesc, impoundedAt, lotName, address, hours sql.NullString
+		var latitude, longitude sql.NullFloat64
+
+		err := rows.Scan(&id, &licensePlate, &vehicleDesc, &impoundedAt, &lotName, &address, &latitude, &longitude, &hours)
+		if err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if normalizePlate(licensePlate.String) != plate {
+			continue
+		}
+
+		lotHours := hours.String
+		if lotHours == "" {
+			lotHours = defaultLotHours()
+		}
+
+		vehicles = append(vehicles, map[string]interface{}{
+			"vehicle_description": vehicleDesc.String,
+			"impounded_at":        impoundedAt.String,
+			"lot": map[string]interface{}{
+				"name":      lotName.String,
+				"address":   address.String,
+				"latitude":  latitude.Float64,
+				"longitude": longitude.Float64,
+				"hours":     lotHours,
+			},
+		})
+		impoundIDs = append(impoundIDs, id)
+	}
+	rows.Close()
+
+	now := simNow()
+	for i, vehicle := range vehicles {
+		quote, err := computeImpoundQuote(impoundIDs[i], now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		vehicle["fee_quote"] = map[string]interface{}{
+			"as_of":      quote.AsOf,
+			"days_held":  quote.DaysHeld,
+			"line_items": quote.LineItems,
+			"total":      quote.Total,
+		}
+
+		documents := []string{
+			"Government-issued photo ID",
+			"Proof of ownership (vehicle registration or title)",
+			"Payment of the fees due (card, cash or bank transfer)",
+		}
+
+		// Say who has to authorise release, not why the vehicle is held
+		holdRows, err := db.Query(`SELECT DISTINCT agency FROM impound_holds WHERE impound_id = ? AND lifted_at IS NULL`, impoundIDs[i])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		onHold := false
+		for holdRows.Next() {
+			var agency sql.NullString
+			holdRows.Scan(&agency)
+			onHold = true
+			if agency.String != "" {
+				documents = append(documents, "Release authorisation from "+agency.String)
+			} else {
+				documents = append(documents, "Release authorisation from the agency that placed the hold")
+			}
+		}
+		holdRows.Close()
+
+		vehicle["release_available"] = !onHold
+		vehicle["required_documents"] = documents
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"plate":    plate,
+		"found":    len(vehicles) > 0,
+		"vehicles": vehicles,
+	})
+}
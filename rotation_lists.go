@@ -0,0 +1,712 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Police and municipal tow rotations. A rotation list covers one zone and job
+// type and holds an ordered list of trucks (driver plus optional vehicle),
+// possibly from several companies. Assigning a job without a driver gives it
+// to the next eligible entry after the last one served; entries passed over
+// are logged as skips with the reason, and manual assignments are logged so
+// the fairness report shows every job the rotation should have covered.
+
+var errNoRotation = errors.New("no rotation list for this job")
+
+var errRotationBusy = errors.New("the rotation moved on during assignment, please try again")
+
+// Attempts at claiming a turn; each retry means another assignment took the
+// turn first and the rotation is walked again
+const rotationClaimAttempts = 5
+
+type rotationEntry struct {
+	ID        int64  `json:"id"`
+	Position  int    `json:"position"`
+	Company   string `json:"company"`
+	DriverID  int64  `json:"driver_id"`
+	Driver    string `json:"driver_name"`
+	VehicleID int64  `json:"vehicle_id,omitempty"`
+	IsActive  bool   `json:"is_active"`
+}
+
+type rotationSkip struct {
+	EntryID  int64  `json:"entry_id"`
+	Position int    `json:"position"`
+	DriverID int64  `json:"driver_id"`
+	Reason   string `json:"reason"`
+}
+
+// The entry chosen for a job and the entries passed over on the way
+type rotationPick struct {
+	RotationID int64
+	Entry      *rotationEntry
+	Skipped    []rotationSkip
+}
+
+// Active rotation list for a job type in a zone
+func findRotation(jobType, zone string) (int64, int, error) {
+	var rotationID int64
+	var lastPosition int
+	err := db.QueryRow(`SELECT id, last_position FROM rotation_lists WHERE job_type = ? AND zone = ? AND is_active = 1`,
+		jobType, zone).Scan(&rotationID, &lastPosition)
+	if err == sql.ErrNoRows {
+		return 0, 0, errNoRotation
+	}
+	return rotationID, lastPosition, err
+}
+
+func loadRotationEntries(rotationID int64, activeOnly bool) ([]rotationEntry, error) {
+	query := `SELECT e.id, e.position, COALESCE(e.company, ''), e.driver_id, d.name, COALESCE(e.vehicle_id, 0), e.is_active
+		FROM rotation_entries e JOIN drivers d ON d.id = e.driver_id WHERE e.rotation_id = ?`
+	if activeOnly {
+		query += ` AND e.is_active = 1`
+	}
+	rows, err := db.Query(query+` ORDER BY e.position`, rotationID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []rotationEntry{}
+	for rows.Next() {
+		var entry rotationEntry
+		if err := rows.Scan(&entry.ID, &entry.Position, &entry.Company, &entry.DriverID, &entry.Driver, &entry.VehicleID, &entry.IsActive); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// Walk the rotation from the entry after the last one served, wrapping round,
+// and stop at the first entry whose driver and truck can take the job. Entry
+// is nil when nobody in the rotation is eligible. Returns the last_position
+// the walk started from.
+func pickFromRotation(jobType, zone string) (*rotationPick, int, error) {
+	rotationID, lastPosition, err := findRotation(jobType, zone)
+	if err != nil {
+		return nil, 0, err
+	}
+	entries, err := loadRotationEntries(rotationID, true)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := 0
+	for start < len(entries) && entries[start].Position <= lastPosition {
+		start++
+	}
+
+	pick := &rotationPick{RotationID: rotationID, Skipped: []rotationSkip{}}
+	for i := range entries {
+		entry := entries[(start+i)%len(entries)]
+		problem, _, err := driverAssignable(float64(entry.DriverID), jobType)
+		if err != nil {
+			return nil, 0, err
+		}
+		if problem == "" && entry.VehicleID != 0 {
+			if problem, _, err = truckAssignable(entry.VehicleID, float64(entry.DriverID)); err != nil {
+				return nil, 0, err
+			}
+		}
+		if problem != "" {
+			pick.Skipped = append(pick.Skipped, rotationSkip{EntryID: entry.ID, Position: entry.Position, DriverID: entry.DriverID, Reason: problem})
+			continue
+		}
+		pick.Entry = &entry
+		break
+	}
+	return pick, lastPosition, nil
+}
+
+// Move the rotation on to the picked entry inside the transaction that assigns
+// the job. The move only applies while last_position is still where the walk
+// started, so two assignments at once cannot take the same turn; false means
+// the other one got there first and the caller walks the rotation again.
+func claimRotationTurn(tx *sql.Tx, pick *rotationPick, lastPosition int) (bool, error) {
+	result, err := tx.Exec(`UPDATE rotation_lists SET last_position = ? WHERE id = ? AND last_position = ?`,
+		pick.Entry.Position, pick.RotationID, lastPosition)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed > 0, err
+}
+
+func recordRotationEvent(rotationID int64, entryID, jobID, driverID interface{}, action, reason string) {
+	_, err := db.Exec(`INSERT INTO rotation_log (rotation_id, entry_id, job_id, driver_id, action, reason, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rotationID, entryID, jobID, driverID, action, reason, simNow().Format(sqliteTimeLayout))
+	if err != nil {
+		log.Printf("Error recording rotation %s for rotation %d: %v", action, rotationID, err)
+	}
+}
+
+// Log the skips and the assignment; the rotation was moved on when the job was assigned
+func recordRotationTurn(pick *rotationPick, jobID int64) {
+	for _, skip := range pick.Skipped {
+		recordRotationEvent(pick.RotationID, skip.EntryID, jobID, skip.DriverID, "skipped", skip.Reason)
+	}
+	if pick.Entry == nil {
+		return
+	}
+	recordRotationEvent(pick.RotationID, pick.Entry.ID, jobID, pick.Entry.DriverID, "assigned", "")
+}
+
+// A dispatcher named the driver for a job the rotation covers. The rotation
+// does not move, but the job counts against the driver's entry in the report.
+func recordManualRotationAssignment(jobType, zone string, jobID int64, driverID interface{}) {
+	rotationID, _, err := findRotation(jobType, zone)
+	if err != nil {
+		if err != errNoRotation {
+			log.Printf("Error finding rotation for job %d: %v", jobID, err)
+		}
+		return
+	}
+	var entryID interface{}
+	var id int64
+	if err := db.QueryRow(`SELECT id FROM rotation_entries WHERE rotation_id = ? AND driver_id = ? AND is_active = 1 ORDER BY position LIMIT 1`,
+		rotationID, driverID).Scan(&id); err == nil {
+		entryID = id
+	}
+	recordRotationEvent(rotationID, entryID, jobID, driverID, "manual", "Driver chosen by dispatcher")
+}
+
+func parseRotationID(w http.ResponseWriter, id string) (int64, error) {
+	rotationID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid rotation ID", http.StatusBadRequest)
+		return 0, err
+	}
+	var exists int
+	err = db.QueryRow(`SELECT 1 FROM rotation_lists WHERE id = ?`, rotationID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Rotation list not found", http.StatusNotFound)
+		return 0, err
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, err
+	}
+	return rotationID, nil
+}
+
+// Check a rotation entry's driver_id and optional vehicle_id
+func rotationEntryFromBody(body map[string]interface{}) (int64, interface{}, string) {
+	driverID, ok := body["driver_id"].(float64)
+	if !ok {
+		return 0, nil, "driver_id is required"
+	}
+	exists, err := driverExists(strconv.FormatInt(int64(driverID), 10))
+	if err != nil || !exists {
+		return 0, nil, fmt.Sprintf("Driver %d not found", int64(driverID))
+	}
+
+	var vehicleID interface{}
+	if value, ok := body["vehicle_id"]; ok && value != nil {
+		id, isNumber := value.(float64)
+		if !isNumber {
+			return 0, nil, "vehicle_id must be a number"
+		}
+		var found int
+		if err := db.QueryRow(`SELECT 1 FROM fleet_vehicles WHERE id = ?`, int64(id)).Scan(&found); err != nil {
+			return 0, nil, fmt.Sprintf("Vehicle %d not found", int64(id))
+		}
+		vehicleID = int64(id)
+	}
+	return int64(driverID), vehicleID, ""
+}
+
+func getRotations(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT r.id, r.name, r.zone, r.job_type, r.last_position, r.is_active,
+		(SELECT COUNT(*) FROM rotation_entries e WHERE e.rotation_id = r.id AND e.is_active = 1)
+		FROM rotation_lists r WHERE 1 = 1`
+	var args []interface{}
+	if zone := r.URL.Query().Get("zone"); zone != "" {
+		query += ` AND r.zone = ?`
+		args = append(args, zone)
+	}
+	if jobType := r.URL.Query().Get("job_type"); jobType != "" {
+		query += ` AND r.job_type = ?`
+		args = append(args, jobType)
+	}
+
+	rows, err := db.Query(query+` ORDER BY r.zone, r.job_type`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rotations := []map[string]interface{}{}
+	for rows.Next() {
+		var id, lastPosition, entries int64
+		var name, zone, jobType string
+		var isActive bool
+		if err := rows.Scan(&id, &name, &zone, &jobType, &lastPosition, &isActive, &entries); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rotations = append(rotations, map[string]interface{}{
+			"id":            id,
+			"name":          name,
+			"zone":          zone,
+			"job_type":      jobType,
+			"last_position": lastPosition,
+			"is_active":     isActive,
+			"entries":       entries,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rotations)
+}
+
+// Create a rotation list: {"name", "zone", "job_type" (default police),
+// "entries": [{"driver_id", "vehicle_id", "company"}]} in rotation order
+func createRotation(w http.ResponseWriter, r *http.Request) {
+	var rotation map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&rotation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, _ := rotation["name"].(string)
+	zone, _ := rotation["zone"].(string)
+	name, zone = strings.TrimSpace(name), strings.TrimSpace(zone)
+	if name == "" || zone == "" {
+		http.Error(w, "name and zone are required", http.StatusBadRequest)
+		return
+	}
+	jobType := "police"
+	if value, ok := rotation["job_type"].(string); ok && value != "" {
+		jobType = value
+	}
+
+	var entries []map[string]interface{}
+	if list, ok := rotation["entries"].([]interface{}); ok {
+		for _, item := range list {
+			entry, ok := item.(map[string]interface{})
+			if !ok {
+				http.Error(w, "entries must be objects", http.StatusBadRequest)
+				return
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO rotation_lists (name, zone, job_type) VALUES (?, ?, ?)`, name, zone, jobType)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			http.Error(w, fmt.Sprintf("Zone %s already has a %s rotation", zone, jobType), http.StatusConflict)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rotationID, _ := result.LastInsertId()
+
+	for i, entry := range entries {
+		driverID, vehicleID, problem := rotationEntryFromBody(entry)
+		if problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+		company, _ := entry["company"].(string)
+		_, err := tx.Exec(`INSERT INTO rotation_entries (rotation_id, position, company, driver_id, vehicle_id) VALUES (?, ?, ?, ?, ?)`,
+			rotationID, i+1, strings.TrimSpace(company), driverID, vehicleID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int64{"id": rotationID})
+}
+
+// A rotation list with its entries and the entry that is up next
+func getRotation(w http.ResponseWriter, r *http.Request) {
+	rotationID, err := parseRotationID(w, mux.Vars(r)["id"])
+	if err != nil {
+		return
+	}
+
+	var name, zone, jobType string
+	var lastPosition int
+	var isActive bool
+	err = db.QueryRow(`SELECT name, zone, job_type, last_position, is_active FROM rotation_lists WHERE id = ?`, rotationID).
+		Scan(&name, &zone, &jobType, &lastPosition, &isActive)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := loadRotationEntries(rotationID, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Up next is the first active entry after the last one served, wrapping round
+	var next, first *rotationEntry
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.IsActive {
+			continue
+		}
+		if first == nil {
+			first = entry
+		}
+		if next == nil && entry.Position > lastPosition {
+			next = entry
+		}
+	}
+	if next == nil {
+		next = first
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":            rotationID,
+		"name":          name,
+		"zone":          zone,
+		"job_type":      jobType,
+		"last_position": lastPosition,
+		"is_active":     isActive,
+		"entries":       entries,
+		"next":          next,
+	})
+}
+
+// Rename, move or pause a rotation: {"name", "zone", "is_active"}
+func updateRotation(w http.ResponseWriter, r *http.Request) {
+	rotationID, err := parseRotationID(w, mux.Vars(r)["id"])
+	if err != nil {
+		return
+	}
+
+	var update map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	changed := []string{}
+	for _, field := range []string{"name", "zone", "is_active"} {
+		value, ok := update[field]
+		if !ok {
+			continue
+		}
+		if field == "is_active" {
+			if _, isBool := value.(bool); !isBool {
+				http.Error(w, "is_active must be true or false", http.StatusBadRequest)
+				return
+			}
+		} else {
+			text, _ := value.(string)
+			if value = strings.TrimSpace(text); value == "" {
+				http.Error(w, field+" must not be empty", http.StatusBadRequest)
+				return
+			}
+		}
+		if _, err := db.Exec(`UPDATE rotation_lists SET `+field+` = ? WHERE id = ?`, value, rotationID); err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				http.Error(w, "That zone already has a rotation for this job type", http.StatusConflict)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		changed = append(changed, field)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": rotationID, "changed": changed})
+}
+
+// Add a truck at the end of the rotation, or at "position" (later entries move down)
+func addRotationEntry(w http.ResponseWriter, r *http.Request) {
+	rotationID, err := parseRotationID(w, mux.Vars(r)["id"])
+	if err != nil {
+		return
+	}
+
+	var entry map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	driverID, vehicleID, problem := rotationEntryFromBody(entry)
+	if problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+	company, _ := entry["company"].(string)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var position int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(position), 0) + 1 FROM rotation_entries WHERE rotation_id = ?`, rotationID).Scan(&position); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if value, ok := entry["position"].(float64); ok && int(value) >= 1 && int(value) < position {
+		position = int(value)
+		if _, err := tx.Exec(`UPDATE rotation_entries SET position = position + 1 WHERE rotation_id = ? AND position >= ?`, rotationID, position); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Keep the same entry up next
+		if _, err := tx.Exec(`UPDATE rotation_lists SET last_position = last_position + 1 WHERE id = ? AND last_position >= ?`, rotationID, position); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	result, err := tx.Exec(`INSERT INTO rotation_entries (rotation_id, position, company, driver_id, vehicle_id) VALUES (?, ?, ?, ?, ?)`,
+		rotationID, position, strings.TrimSpace(company), driverID, vehicleID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id, _ := result.LastInsertId()
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "position": position})
+}
+
+// Take a truck off the rotation. The entry is kept so its history stays in the report.
+func removeRotationEntry(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	rotationID, err := parseRotationID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	result, err := db.Exec(`UPDATE rotation_entries SET is_active = 0 WHERE id = ? AND rotation_id = ? AND is_active = 1`, vars["entryId"], rotationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, "Rotation entry not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Assignments, skips and manual overrides, newest first
+func getRotationLog(w http.ResponseWriter, r *http.Request) {
+	rotationID, err := parseRotationID(w, mux.Vars(r)["id"])
+	if err != nil {
+		return
+	}
+
+	rows, err := db.Query(`SELECT l.id, l.entry_id, l.job_id, l.driver_id, d.name, l.action, l.reason, l.created_at
+		FROM rotation_log l LEFT JOIN drivers d ON d.id = l.driver_id
+		WHERE l.rotation_id = ? ORDER BY l.created_at DESC, l.id DESC LIMIT 200`, rotationID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []map[string]interface{}{}
+	for rows.Next() {
+		var id int64
+		var entryID, jobID, driverID sql.NullInt64
+		var driverName, action, reason, createdAt sql.NullString
+		if err := rows.Scan(&id, &entryID, &jobID, &driverID, &driverName, &action, &reason, &createdAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		events = append(events, map[string]interface{}{
+			"id":          id,
+			"entry_id":    entryID.Int64,
+			"job_id":      jobID.Int64,
+			"driver_id":   driverID.Int64,
+			"driver_name": driverName.String,
+			"action":      action.String,
+			"reason":      reason.String,
+			"created_at":  createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Rotation fairness over ?from=&to= (YYYY-MM-DD, default the last 30 days).
+// Each active entry's share of the jobs is compared with an equal share; a
+// truck that keeps getting skipped or passed over by manual assignments
+// shows up with a negative deviation.
+func getRotationReport(w http.ResponseWriter, r *http.Request) {
+	rotationID, err := parseRotationID(w, mux.Vars(r)["id"])
+	if err != nil {
+		return
+	}
+
+	now := simNow().Truncate(time.Second)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	from, to := today.AddDate(0, 0, -29), today
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "from must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse("2006-01-02", value); err != nil {
+			http.Error(w, "to must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+	}
+	if to.Before(from) {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := loadRotationEntries(rotationID, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	type entryStats struct {
+		assigned, manual, skipped int
+		skipReasons               map[string]int
+	}
+	stats := map[int64]*entryStats{}
+	for _, entry := range entries {
+		stats[entry.ID] = &entryStats{skipReasons: map[string]int{}}
+	}
+
+	rows, err := db.Query(`SELECT entry_id, action, COALESCE(reason, ''), COUNT(*) FROM rotation_log
+		WHERE rotation_id = ? AND entry_id IS NOT NULL AND created_at >= ? AND created_at < ?
+		GROUP BY entry_id, action, reason`,
+		rotationID, from.Format(sqliteTimeLayout), to.AddDate(0, 0, 1).Format(sqliteTimeLayout))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entryID int64
+		var action, reason string
+		var count int
+		if err := rows.Scan(&entryID, &action, &reason, &count); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s, ok := stats[entryID]
+		if !ok {
+			continue
+		}
+		switch action {
+		case "assigned":
+			s.assigned += count
+		case "manual":
+			s.manual += count
+		case "skipped":
+			s.skipped += count
+			s.skipReasons[reason] += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Jobs the rotation covered, whether it picked the driver or a dispatcher did
+	var totalJobs, activeEntries int
+	for _, entry := range entries {
+		totalJobs += stats[entry.ID].assigned + stats[entry.ID].manual
+		if entry.IsActive {
+			activeEntries++
+		}
+	}
+	expected := 0.0
+	if activeEntries > 0 {
+		expected = float64(totalJobs) / float64(activeEntries)
+	}
+
+	report := []map[string]interface{}{}
+	maxDeviation := 0.0
+	for _, entry := range entries {
+		s := stats[entry.ID]
+		jobs := s.assigned + s.manual
+		if !entry.IsActive && jobs == 0 && s.skipped == 0 {
+			continue
+		}
+		share := 0.0
+		if totalJobs > 0 {
+			share = float64(jobs) / float64(totalJobs) * 100
+		}
+		deviation := 0.0
+		if entry.IsActive {
+			deviation = float64(jobs) - expected
+			maxDeviation = math.Max(maxDeviation, math.Abs(deviation))
+		}
+		report = append(report, map[string]interface{}{
+			"entry_id":       entry.ID,
+			"position":       entry.Position,
+			"company":        entry.Company,
+			"driver_id":      entry.DriverID,
+			"driver_name":    entry.Driver,
+			"vehicle_id":     entry.VehicleID,
+			"is_active":      entry.IsActive,
+			"assigned":       s.assigned,
+			"manual":         s.manual,
+			"skipped":        s.skipped,
+			"skip_reasons":   s.skipReasons,
+			"jobs":           jobs,
+			"share_percent":  roundCents(share),
+			"expected_jobs":  roundCents(expected),
+			"deviation_jobs": roundCents(deviation),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rotation_id":        rotationID,
+		"from":               from.Format("2006-01-02"),
+		"to":                 to.Format("2006-01-02"),
+		"jobs":               totalJobs,
+		"max_deviation_jobs": roundCents(maxDeviation),
+		"entries":            report,
+	})
+}
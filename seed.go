@@ -2,9 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -30,25 +32,342 @@ func seedDatabase(db *sql.DB) {
 		}
 	}
 
+	// Seed shifts: drivers 1-4 are clocked into a shift covering now (driver 4 is
+	// on a break), driver 5 starts later today
+	now := time.Now().UTC()
+	for driverID := 1; driverID <= 5; driverID++ {
+		start := now.Add(-4 * time.Hour)
+		var clockIn interface{} = start.Format("2006-01-02 15:04:05")
+		if driverID == 5 {
+			start = now.Add(6 * time.Hour)
+			clockIn = nil
+		}
+
+		result, err := db.Exec(`INSERT INTO driver_shifts (driver_id, scheduled_start, scheduled_end, clock_in_at) VALUES (?, ?, ?, ?)`,
+			driverID, start.Format("2006-01-02 15:04:05"), start.Add(10*time.Hour).Format("2006-01-02 15:04:05"), clockIn)
+		if err != nil {
+			log.Printf("Error inserting driver shift: %v", err)
+			continue
+		}
+
+		if driverID == 4 {
+			shiftID, _ := result.LastInsertId()
+			db.Exec(`INSERT INTO driver_breaks (shift_id, started_at) VALUES (?, ?)`,
+				shiftID, now.Add(-10*time.Minute).Format("2006-01-02 15:04:05"))
+		}
+	}
+
+	// Driver 1 worked a long shift yesterday, so is close to the daily on-duty limit
+	_, err := db.Exec(`INSERT INTO driver_shifts (driver_id, scheduled_start, scheduled_end, clock_in_at, clock_out_at) VALUES (1, ?, ?, ?, ?)`,
+		now.Add(-15*time.Hour).Format("2006-01-02 15:04:05"), now.Add(-6*time.Hour).Format("2006-01-02 15:04:05"),
+		now.Add(-15*time.Hour).Format("2006-01-02 15:04:05"), now.Add(-6*time.Hour).Format("2006-01-02 15:04:05"))
+	if err != nil {
+		log.Printf("Error inserting driver shift: %v", err)
+	}
+
+	// Seed hours-of-service limits
+	hosLimits := []map[string]interface{}{
+		{"code": "driving_24h", "description": "Driving time in 24 hours", "metric": "driving", "max_hours": 11.0, "window_hours": 24.0, "warn": 1.0},
+		{"code": "on_duty_24h", "description": "On-duty time in 24 hours", "metric": "on_duty", "max_hours": 14.0, "window_hours": 24.0, "warn": 1.0},
+		{"code": "on_duty_8d", "description": "On-duty time in 8 days", "metric": "on_duty", "max_hours": 70.0, "window_hours": 192.0, "warn": 5.0},
+	}
+
+	for _, limit := range hosLimits {
+		_, err := db.Exec(`INSERT INTO hos_limits (code, description, metric, max_hours, window_hours, warn_remaining_hours) VALUES (?, ?, ?, ?, ?, ?)`,
+			limit["code"], limit["description"], limit["metric"], limit["max_hours"], limit["window_hours"], limit["warn"])
+		if err != nil {
+			log.Printf("Error inserting hours-of-service limit: %v", err)
+		}
+	}
+
+	// Seed credential types and which job types require them
+	credentialTypes := []map[string]interface{}{
+		{"code": "commercial_licence", "description": "Commercial driver's licence", "warn_days": 60},
+		{"code": "air_brake", "description": "Air brake endorsement", "warn_days": 30},
+		{"code": "heavy_recovery", "description": "Heavy recovery certification", "warn_days": 30},
+	}
+
+	for _, credType := range credentialTypes {
+		_, err := db.Exec(`INSERT INTO credential_types (code, description, warn_days) VALUES (?, ?, ?)`,
+			credType["code"], credType["description"], credType["warn_days"])
+		if err != nil {
+			log.Printf("Error inserting credential type: %v", err)
+		}
+	}
+
+	requirements := [][2]string{
+		{"police", "commercial_licence"},
+		{"breakdown", "commercial_licence"},
+		{"accident", "commercial_licence"},
+		{"accident", "heavy_recovery"},
+		{"parking_violation", "commercial_licence"},
+		{"repo", "commercial_licence"},
+	}
+
+	for _, requirement := range requirements {
+		_, err := db.Exec(`INSERT INTO job_type_credentials (job_type, credential_type) VALUES (?, ?)`, requirement[0], requirement[1])
+		if err != nil {
+			log.Printf("Error inserting credential requirement: %v", err)
+		}
+	}
+
+	// Every driver holds a commercial licence; driver 3's heavy recovery
+	// certification has lapsed and driver 2's air brake endorsement is due soon
+	issued := now.AddDate(-2, 0, 0).Format("2006-01-02")
+	credentials := []map[string]interface{}{
+		{"driver_id": 1, "type": "commercial_licence", "class": "Class 1", "number": "CL-48213", "expiry": now.AddDate(2, 0, 0)},
+		{"driver_id": 2, "type": "commercial_licence", "class": "Class 1", "number": "CL-51907", "expiry": now.AddDate(1, 6, 0)},
+		{"driver_id": 3, "type": "commercial_licence", "class": "Class 3", "number": "CL-60344", "expiry": now.AddDate(3, 0, 0)},
+		{"driver_id": 4, "type": "commercial_licence", "class": "Class 1", "number": "CL-62718", "expiry": now.AddDate(2, 3, 0)},
+		{"driver_id": 5, "type": "commercial_licence", "class": "Class 3", "number": "CL-70152", "expiry": now.AddDate(4, 0, 0)},
+		{"driver_id": 1, "type": "heavy_recovery", "number": "HR-1102", "expiry": now.AddDate(1, 0, 0)},
+		{"driver_id": 3, "type": "heavy_recovery", "number": "HR-0987", "expiry": now.AddDate(0, 0, -10)},
+		{"driver_id": 2, "type": "air_brake", "number": "AB-3391", "expiry": now.AddDate(0, 0, 20)},
+	}
+
+	for _, credential := range credentials {
+		issuer := "Provincial Licensing Office"
+		if credential["type"] == "heavy_recovery" {
+			issuer = "Towing & Recovery Association"
+		}
+		_, err := db.Exec(`INSERT INTO driver_credentials (driver_id, credential_type, licence_class, credential_number, issuer, issued_date, expiry_date)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			credential["driver_id"], credential["type"], credential["class"], credential["number"], issuer,
+			issued, credential["expiry"].(time.Time).Format("2006-01-02"))
+		if err != nil {
+			log.Printf("Error inserting driver credential: %v", err)
+		}
+	}
+
+	// Seed fuel prices and economy profiles per vehicle type (diesel: 2.68 kg CO2 per litre)
+	_, err = db.Exec(`INSERT INTO fuel_prices (fuel_type, price_per_litre) VALUES ('diesel', 1.85), ('gasoline', 1.65)`)
+	if err != nil {
+		log.Printf("Error inserting fuel prices: %v", err)
+	}
+
+	fuelProfiles := []map[string]interface{}{
+		{"vehicle_type": "Heavy Tow Truck", "empty": 38.0, "towing": 62.0, "tank": 400.0},
+		{"vehicle_type": "Medium Tow Truck", "empty": 30.0, "towing": 48.0, "tank": 300.0},
+		{"vehicle_type": "Light Tow Truck", "empty": 22.0, "towing": 34.0, "tank": 150.0},
+		{"vehicle_type": "Flatbed", "empty": 24.0, "towing": 38.0, "tank": 200.0},
+		{"vehicle_type": "Wrecker", "empty": 35.0, "towing": 55.0, "tank": 350.0},
+	}
+
+	for _, profile := range fuelProfiles {
+		_, err := db.Exec(`INSERT INTO fuel_profiles (vehicle_type, fuel_type, empty_l_per_100km, towing_l_per_100km, tank_capacity_l, co2_kg_per_l)
+			VALUES (?, 'diesel', ?, ?, ?, 2.68)`,
+			profile["vehicle_type"], profile["empty"], profile["towing"], profile["tank"])
+		if err != nil {
+			log.Printf("Error inserting fuel profile: %v", err)
+		}
+	}
+
 	// Seed fleet vehicles
 	vehicles := []map[string]interface{}{
-		{"vehicle_type": "Heavy Tow Truck", "make": "Peterbilt", "model": "379", "year": 2020, "license_plate": "TOW001", "capacity_tons": 25.0},
-		{"vehicle_type": "Medium Tow Truck", "make": "Freightliner", "model": "M2", "year": 2019, "license_plate": "TOW002", "capacity_tons": 15.0},
-		{"vehicle_type": "Light Tow Truck", "make": "Ford", "model": "F-550", "year": 2021, "license_plate": "TOW003", "capacity_tons": 8.0},
-		{"vehicle_type": "Flatbed", "make": "Chevrolet", "model": "Silverado 4500", "year": 2020, "license_plate": "TOW004", "capacity_tons": 12.0},
-		{"vehicle_type": "Wrecker", "make": "International", "model": "4300", "year": 2018, "license_plate": "TOW005", "capacity_tons": 20.0},
+		{"vehicle_type": "Heavy Tow Truck", "make": "Peterbilt", "model": "379", "year": 2020, "license_plate": "TOW001", "fuel_level_l": 310.0, "capacity_tons": 25.0, "odometer_km": 84210.0},
+		{"vehicle_type": "Medium Tow Truck", "make": "Freightliner", "model": "M2", "year": 2019, "license_plate": "TOW002", "fuel_level_l": 80.0, "capacity_tons": 15.0, "odometer_km": 61500.0},
+		{"vehicle_type": "Light Tow Truck", "make": "Ford", "model": "F-550", "year": 2021, "license_plate": "TOW003", "fuel_level_l": 120.0, "capacity_tons": 8.0, "odometer_km": 32950.0},
+		{"vehicle_type": "Flatbed", "make": "Chevrolet", "model": "Silverado 4500", "year": 2020, "license_plate": "TOW004", "fuel_level_l": 150.0, "capacity_tons": 12.0, "odometer_km": 47800.0},
+		{"vehicle_type": "Wrecker", "make": "International", "model": "4300", "year": 2018, "license_plate": "TOW005", "fuel_level_l": 260.0, "capacity_tons": 20.0, "odometer_km": 128400.0},
 	}
 
 	for _, vehicle := range vehicles {
-		_, err := db.Exec(`INSERT INTO fleet_vehicles (vehicle_type, make, model, year, license_plate, capacity_tons) 
-			VALUES (?, ?, ?, ?, ?, ?)`,
+		// Trucks start parked at the yard
+		_, err := db.Exec(`INSERT INTO fleet_vehicles (vehicle_type, make, model, year, license_plate, capacity_tons,
+			odometer_km, fuel_level_l, last_latitude, last_longitude, last_position_at) 
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 			vehicle["vehicle_type"], vehicle["make"], vehicle["model"], vehicle["year"], 
-			vehicle["license_plate"], vehicle["capacity_tons"])
+			vehicle["license_plate"], vehicle["capacity_tons"], vehicle["odometer_km"], vehicle["fuel_level_l"],
+			49.269391, -123.095063, now.Format("2006-01-02 15:04:05"))
 		if err != nil {
 			log.Printf("Error inserting vehicle: %v", err)
 		}
 	}
 
+	// Seed service schedules and past maintenance. TOW003 is a few km short of
+	// its oil change and TOW005's annual inspection has lapsed.
+	for vehicleID := 1; vehicleID <= len(vehicles); vehicleID++ {
+		schedules := []struct {
+			serviceType  string
+			intervalKm   interface{}
+			intervalDays interface{}
+		}{
+			{"oil_change", 15000.0, 180},
+			{"annual_inspection", nil, 365},
+			{"brake_inspection", 40000.0, nil},
+		}
+		for _, schedule := range schedules {
+			_, err := db.Exec(`INSERT INTO maintenance_schedules (vehicle_id, service_type, interval_km, interval_days) VALUES (?, ?, ?, ?)`,
+				vehicleID, schedule.serviceType, schedule.intervalKm, schedule.intervalDays)
+			if err != nil {
+				log.Printf("Error inserting maintenance schedule: %v", err)
+			}
+		}
+
+		odometer := vehicles[vehicleID-1]["odometer_km"].(float64)
+		oilChangeKm := odometer - float64(2000+rand.Intn(7000))
+		inspectionDaysAgo := 60 + rand.Intn(200)
+		if vehicleID == 3 {
+			oilChangeKm = odometer - 14995
+		}
+		if vehicleID == 5 {
+			inspectionDaysAgo = 380
+		}
+		records := []map[string]interface{}{
+			{"type": "oil_change", "days_ago": 30 + rand.Intn(90), "odometer": oilChangeKm, "cost": 189.50, "by": "Eastside Fleet Services"},
+			{"type": "annual_inspection", "days_ago": inspectionDaysAgo, "odometer": odometer - 12000, "cost": 320.00, "by": "Provincial Inspection Station"},
+			{"type": "brake_inspection", "days_ago": 150, "odometer": odometer - 18000, "cost": 640.00, "by": "Eastside Fleet Services"},
+		}
+		for _, record := range records {
+			_, err := db.Exec(`INSERT INTO maintenance_records (vehicle_id, service_type, service_date, odometer_km, cost, performed_by) VALUES (?, ?, ?, ?, ?, ?)`,
+				vehicleID, record["type"], now.AddDate(0, 0, -record["days_ago"].(int)).Format("2006-01-02"), record["odometer"], record["cost"], record["by"])
+			if err != nil {
+				log.Printf("Error inserting maintenance record: %v", err)
+			}
+		}
+	}
+
+	// Seed inspection checklists: every truck shares the basic walk-round and
+	// adds items for its own equipment
+	baseItems := []struct {
+		code, description string
+		critical          bool
+	}{
+		{"brakes", "Service and parking brakes hold", true},
+		{"tires", "Tires inflated, no cuts or bulges", true},
+		{"lights", "Headlights, brake lights, indicators and beacons work", true},
+		{"mirrors", "Mirrors clean and adjusted", false},
+		{"fluids", "Oil, coolant and washer fluid topped up", false},
+		{"safety_kit", "Flares, extinguisher and first aid kit on board", false},
+	}
+	equipmentDescriptions := map[string]string{
+		"boom_hydraulics": "Boom hydraulics free of leaks, controls respond",
+		"winch_cable":     "Winch cable not frayed or kinked, hook latch closes",
+		"underlift":       "Underlift arms and pins secure",
+		"wheel_lift":      "Wheel lift cradles and pins secure",
+		"tow_straps":      "Tow straps and chains free of cuts or damaged links",
+		"deck_tilt":       "Deck tilts and locks down",
+		"tie_downs":       "Tie-down straps and ratchets in good order",
+		"outriggers":      "Outriggers extend and hold",
+	}
+	equipmentItems := map[string][]string{
+		"Heavy Tow Truck":  {"boom_hydraulics", "winch_cable", "underlift"},
+		"Medium Tow Truck": {"winch_cable", "underlift"},
+		"Light Tow Truck":  {"wheel_lift", "tow_straps"},
+		"Flatbed":          {"deck_tilt", "winch_cable", "tie_downs"},
+		"Wrecker":          {"boom_hydraulics", "winch_cable", "outriggers"},
+	}
+	for _, vehicle := range vehicles {
+		vehicleType := vehicle["vehicle_type"].(string)
+		for _, inspectionType := range []string{"pre_trip", "post_trip"} {
+			order := 0
+			for _, item := range baseItems {
+				order++
+				_, err := db.Exec(`INSERT INTO inspection_templates (vehicle_type, inspection_type, item_code, description, is_critical, sort_order) VALUES (?, ?, ?, ?, ?, ?)`,
+					vehicleType, inspectionType, item.code, item.description, item.critical, order)
+				if err != nil {
+					log.Printf("Error inserting inspection item: %v", err)
+				}
+			}
+			// Lifting gear is critical: a failure can drop a vehicle
+			for _, code := range equipmentItems[vehicleType] {
+				order++
+				_, err := db.Exec(`INSERT INTO inspection_templates (vehicle_type, inspection_type, item_code, description, is_critical, sort_order) VALUES (?, ?, ?, ?, ?, ?)`,
+					vehicleType, inspectionType, code, equipmentDescriptions[code], true, order)
+				if err != nil {
+					log.Printf("Error inserting inspection item: %v", err)
+				}
+			}
+		}
+	}
+
+	// Drivers 1-4 have each passed a pre-trip inspection on the truck with
+	// their number at the start of today's shift
+	for driverID := 1; driverID <= 4; driverID++ {
+		result, err := db.Exec(`INSERT INTO vehicle_inspections (vehicle_id, driver_id, shift_id, inspection_type, odometer_km, passed, created_at)
+			SELECT ?, ?, id, 'pre_trip', ?, 1, clock_in_at FROM driver_shifts WHERE driver_id = ? AND clock_in_at IS NOT NULL AND clock_out_at IS NULL`,
+			driverID, driverID, vehicles[driverID-1]["odometer_km"], driverID)
+		if err != nil {
+			log.Printf("Error inserting vehicle inspection: %v", err)
+			continue
+		}
+		inspectionID, _ := result.LastInsertId()
+		_, err = db.Exec(`INSERT INTO inspection_results (inspection_id, item_code, status, is_critical)
+			SELECT ?, item_code, 'ok', is_critical FROM inspection_templates WHERE vehicle_type = ? AND inspection_type = 'pre_trip' ORDER BY sort_order`,
+			inspectionID, vehicles[driverID-1]["vehicle_type"])
+		if err != nil {
+			log.Printf("Error inserting inspection results: %v", err)
+		}
+	}
+
+	// Seed customer accounts; individual customers come from the free-text
+	// migration at startup
+	accounts := []struct {
+		customerType, name, accountNumber, phone, email, address, contact, contactRole string
+		termsDays                                                                      int
+		poRequired                                                                     bool
+	}{
+		{"police", "City Police Department", "ACC-CPD", "555-4100", "towdesk@citypd.example", "312 Main St", "Sgt. Dana Hill", "Tow desk supervisor", 30, false},
+		{"motor_club", "Pacific Motor Club", "ACC-PMC", "555-4200", "dispatch@pacificmotorclub.example", "1200 Broadway", "Alex Moreau", "Roadside dispatch", 30, true},
+		{"insurance", "Harbour Insurance", "ACC-HIN", "555-4300", "claims@harbourins.example", "88 Pender St", "Nina Patel", "Claims adjuster", 45, true},
+		{"property_manager", "Metro Property Management", "ACC-MPM", "555-4400", "parking@metroproperty.example", "500 Granville St", "Chris Lee", "Parking enforcement", 15, false},
+	}
+	for _, account := range accounts {
+		result, err := db.Exec(`INSERT INTO customers (customer_type, name, account_number, contact_name, phone, phone_digits, email,
+			address_line1, city, region, billing_terms_days, po_required) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 'Vancouver', 'BC', ?, ?)`,
+			account.customerType, account.name, account.accountNumber, account.contact, account.phone, phoneDigits(account.phone),
+			account.email, account.address, account.termsDays, account.poRequired)
+		if err != nil {
+			log.Printf("Error inserting customer: %v", err)
+			continue
+		}
+		customerID, _ := result.LastInsertId()
+		_, err = db.Exec(`INSERT INTO customer_contacts (customer_id, name, role, phone, email, is_primary) VALUES (?, ?, ?, ?, ?, 1)`,
+			customerID, account.contact, account.contactRole, account.phone, account.email)
+		if err != nil {
+			log.Printf("Error inserting customer contact: %v", err)
+		}
+	}
+
+	// Seed negotiated account rate cards
+	accountRates := []struct {
+		customerID                      int
+		jobType                         string
+		flatRate, includedKm, perKmRate float64
+	}{
+		{1, "police", 120, 0, 0},
+		{2, "breakdown", 95, 8, 3.25},
+		{2, "accident", 145, 8, 3.75},
+		{3, "accident", 175, 10, 4.00},
+	}
+	for _, rate := range accountRates {
+		_, err := db.Exec(`INSERT INTO account_rates (customer_id, job_type, flat_rate, included_km, per_km_rate) VALUES (?, ?, ?, ?, ?)`,
+			rate.customerID, rate.jobType, rate.flatRate, rate.includedKm, rate.perKmRate)
+		if err != nil {
+			log.Printf("Error inserting account rate: %v", err)
+		}
+	}
+
+	// Seed SLA targets in minutes: defaults per priority, tighter for police
+	slaTargets := []struct {
+		jobType, priority            string
+		assignMinutes, arriveMinutes int
+	}{
+		{"default", "emergency", 5, 20},
+		{"default", "high", 10, 30},
+		{"default", "normal", 20, 60},
+		{"default", "scheduled", 30, 90},
+		{"police", "emergency", 3, 15},
+		{"police", "high", 5, 20},
+	}
+	for _, target := range slaTargets {
+		_, err := db.Exec(`INSERT INTO sla_targets (job_type, priority, assign_minutes, arrive_minutes) VALUES (?, ?, ?, ?)`,
+			target.jobType, target.priority, target.assignMinutes, target.arriveMinutes)
+		if err != nil {
+			log.Printf("Error inserting SLA target: %v", err)
+		}
+	}
+
 	// Seed jobs
 	jobTypes := []string{"police", "breakdown", "accident", "parking_violation", "repo"}
 	statuses := []string{"pending", "assigned", "in_progress", "completed"}
@@ -78,12 +397,29 @@ func seedDatabase(db *sql.DB) {
 		"741 Aspen Blvd, Business District",
 	}
 
+	ownerNames := []string{"Kevin Park", "Priya Shah", "Tom Nguyen", "Emily Clarke", "Marcus Reid", "Sofia Rossi"}
+
 	for i := 0; i < 15; i++ {
 		// Random job data
 		vehicleDesc := vehicleDescriptions[rand.Intn(len(vehicleDescriptions))]
 		pickup := locations[rand.Intn(len(locations))]
 		destination := locations[rand.Intn(len(locations))]
 		jobType := jobTypes[rand.Intn(len(jobTypes))]
+		// The first job is a downtown police tow for the rotation list
+		if i == 0 {
+			pickup, jobType = locations[0], "police"
+		}
+		zone := strings.TrimSpace(pickup[strings.LastIndex(pickup, ",")+1:])
+
+		// The police tow is an emergency; the high-priority breakdown has
+		// been waiting long enough to breach its assignment target
+		priority, createdAt := "normal", time.Now().UTC()
+		switch i {
+		case 0:
+			priority = "emergency"
+		case 2:
+			jobType, priority, createdAt = "breakdown", "high", createdAt.Add(-25*time.Minute)
+		}
 		
 		// Ensure first 5 jobs are pending for testing
 		var status string
@@ -101,21 +437,92 @@ func seedDatabase(db *sql.DB) {
 
 		// Random completion time for completed jobs
 		var completedAt interface{}
+		var completedTime time.Time
 		if status == "completed" {
-			completedAt = time.Now().Add(-time.Duration(rand.Intn(72)) * time.Hour).Format("2006-01-02 15:04:05")
+			completedTime = time.Now().Add(-time.Duration(rand.Intn(72)) * time.Hour)
+			completedAt = completedTime.Format("2006-01-02 15:04:05")
 		}
 
 		notes := fmt.Sprintf("Job #%d - %s tow request", i+1, jobType)
+		licensePlate := fmt.Sprintf("%c%c%c%03d", 'A'+rand.Intn(26), 'A'+rand.Intn(26), 'A'+rand.Intn(26), rand.Intn(1000))
+		ownerIndex := rand.Intn(len(ownerNames))
+		owner := ownerNames[ownerIndex]
+		ownerPhone := fmt.Sprintf("555-30%02d", ownerIndex+1)
 
-		_, err := db.Exec(`INSERT INTO jobs (vehicle_description, pickup_coordinates, destination_coordinates, 
-			job_type, status, assigned_driver_id, assigned_vehicle_id, completed_at, notes) 
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-			vehicleDesc, pickup, destination, jobType, status, driverID, vehicleID, completedAt, notes)
+		// Police tows are billed to the police department
+		var customerID interface{}
+		if jobType == "police" {
+			customerID = 1
+		}
+
+		result, err := db.Exec(`INSERT INTO jobs (vehicle_description, pickup_coordinates, destination_coordinates, 
+			job_type, status, assigned_driver_id, assigned_vehicle_id, completed_at, notes, license_plate, owner_name, owner_phone, customer_id, zone, priority, created_at) 
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			vehicleDesc, pickup, destination, jobType, status, driverID, vehicleID, completedAt, notes, licensePlate, owner, ownerPhone, customerID, zone,
+			priority, createdAt.Format("2006-01-02 15:04:05"))
 		if err != nil {
 			log.Printf("Error inserting job: %v", err)
+			continue
+		}
+
+		// Completed jobs get the events the GPS simulator would have recorded
+		if status == "completed" && driverID != nil {
+			jobID, _ := result.LastInsertId()
+			arrived := completedTime.Add(-time.Duration(40+rand.Intn(30)) * time.Minute)
+			departed := arrived.Add(time.Duration(10+rand.Intn(25)) * time.Minute)
+			assigned := arrived.Add(-time.Duration(8+rand.Intn(25)) * time.Minute)
+			events := []struct {
+				event string
+				at    time.Time
+			}{{"assigned", assigned}, {"arrived", arrived}, {"departed", departed}, {"completed", completedTime}}
+			for _, e := range events {
+				_, err := db.Exec(`INSERT INTO job_events (job_id, driver_id, event, created_at) VALUES (?, ?, ?, ?)`,
+					jobID, driverID, e.event, e.at.Format("2006-01-02 15:04:05"))
+				if err != nil {
+					log.Printf("Error inserting job event: %v", err)
+				}
+			}
+		}
+	}
+
+	// Seed impound lots with a grid of stalls each
+	impoundLots := []map[string]interface{}{
+		{"name": "City Impound Lot A", "address": "1100 Industrial Ave", "latitude": 49.2705, "longitude": -123.0812, "rows": 2, "stalls_per_row": 10,
+			"hours": "Mon-Fri 08:00-18:00, Sat 09:00-13:00; after-hours release by appointment"},
+		{"name": "City Impound Lot B", "address": "455 Terminal Ave", "latitude": 49.2688, "longitude": -123.0994, "rows": 2, "stalls_per_row": 6,
+			"hours": "Mon-Fri 08:00-18:00; after-hours release by appointment"},
+		{"name": "City Impound Lot C", "address": "2890 Grandview Hwy", "latitude": 49.2582, "longitude": -123.0441, "rows": 1, "stalls_per_row": 8,
+			"hours": "Open 24 hours"},
+	}
+
+	for _, lot := range impoundLots {
+		result, err := db.Exec(`INSERT INTO impound_lots (name, address, latitude, longitude, hours) VALUES (?, ?, ?, ?, ?)`,
+			lot["name"], lot["address"], lot["latitude"], lot["longitude"], lot["hours"])
+		if err != nil {
+			log.Printf("Error inserting impound lot: %v", err)
+			continue
+		}
+		lotID, _ := result.LastInsertId()
+
+		for row := 0; row < lot["rows"].(int); row++ {
+			label := string(rune('A' + row))
+			for position := 1; position <= lot["stalls_per_row"].(int); position++ {
+				_, err := db.Exec(`INSERT INTO impound_stalls (lot_id, name, row_label, position) VALUES (?, ?, ?, ?)`,
+					lotID, fmt.Sprintf("%s-%02d", label, position), label, position)
+				if err != nil {
+					log.Printf("Error inserting impound stall: %v", err)
+				}
+			}
 		}
 	}
 
+	// Lots A and B overflow into Lot C
+	_, err = db.Exec(`UPDATE impound_lots SET overflow_lot_id = (SELECT id FROM impound_lots WHERE name = 'City Impound Lot C')
+		WHERE name IN ('City Impound Lot A', 'City Impound Lot B')`)
+	if err != nil {
+		log.Printf("Error setting overflow lots: %v", err)
+	}
+
 	// Seed impounded vehicles
 	impoundedVehicles := []map[string]interface{}{
 		{
@@ -127,6 +534,7 @@ func seedDatabase(db *sql.DB) {
 			"impound_location": "City Impound Lot A",
 			"release_fee": 250.00,
 			"is_currently_impounded": true,
+			"vehicle_class": "standard",
 		},
 		{
 			"job_id": 7,
@@ -137,6 +545,8 @@ func seedDatabase(db *sql.DB) {
 			"impound_location": "City Impound Lot B",
 			"release_fee": 180.00,
 			"is_currently_impounded": true,
+			"vehicle_class": "standard",
+			"held_days": 50,
 		},
 		{
 			"job_id": 1,
@@ -147,6 +557,7 @@ func seedDatabase(db *sql.DB) {
 			"impound_location": "City Impound Lot A",
 			"release_fee": 300.00,
 			"is_currently_impounded": false,
+			"vehicle_class": "light_truck",
 			"released_at": time.Now().Add(-time.Duration(48) * time.Hour).Format("2006-01-02 15:04:05"),
 		},
 		{
@@ -158,23 +569,46 @@ func seedDatabase(db *sql.DB) {
 			"impound_location": "City Impound Lot C",
 			"release_fee": 220.00,
 			"is_currently_impounded": true,
+			"vehicle_class": "standard",
 		},
 	}
 
 	for _, vehicle := range impoundedVehicles {
+		// Spread intake over the last two weeks so storage fees have accrued
+		impoundedAt := time.Now().UTC().Add(-time.Duration(rand.Intn(14*24)+50) * time.Hour).Format("2006-01-02 15:04:05")
+		if days, ok := vehicle["held_days"].(int); ok {
+			// Unclaimed long enough to be past the auction date
+			impoundedAt = time.Now().UTC().Add(-time.Duration(days*24) * time.Hour).Format("2006-01-02 15:04:05")
+		}
+
+		// Held vehicles take the next free stall in their lot
+		var lotID, stallID interface{}
+		db.QueryRow(`SELECT id FROM impound_lots WHERE name = ?`, vehicle["impound_location"]).Scan(&lotID)
+		if vehicle["is_currently_impounded"] == true {
+			if id, ok := lotID.(int64); ok {
+				if tx, err := db.Begin(); err == nil {
+					if _, stall, _, err := assignImpoundStall(tx, id); err == nil {
+						stallID = stall
+					}
+					tx.Rollback()
+				}
+			}
+		}
+
 		query := `INSERT INTO impounded_vehicles (job_id, vehicle_description, license_plate, owner_name, 
-			owner_phone, impound_location, release_fee, is_currently_impounded`
+			owner_phone, impound_location, release_fee, is_currently_impounded, vehicle_class, impounded_at, lot_id, stall_id`
 		values := []interface{}{
 			vehicle["job_id"], vehicle["vehicle_description"], vehicle["license_plate"],
 			vehicle["owner_name"], vehicle["owner_phone"], vehicle["impound_location"],
-			vehicle["release_fee"], vehicle["is_currently_impounded"],
+			vehicle["release_fee"], vehicle["is_currently_impounded"], vehicle["vehicle_class"], impoundedAt,
+			lotID, stallID,
 		}
 
 		if releasedAt, exists := vehicle["released_at"]; exists {
-			query += ", released_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+			query += ", released_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 			values = append(values, releasedAt)
 		} else {
-			query += ") VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+			query += ") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 		}
 
 		_, err := db.Exec(query, values...)
@@ -183,16 +617,33 @@ func seedDatabase(db *sql.DB) {
 		}
 	}
 
+	// Seed a police hold on one impounded vehicle
+	_, err = db.Exec(`INSERT INTO impound_holds (impound_id, hold_type, agency, reference_number, reason) VALUES (?, ?, ?, ?, ?)`,
+		4, "police", "City Police Department", "CPD-2025-0412", "Evidence hold pending investigation")
+	if err != nil {
+		log.Printf("Error inserting impound hold: %v", err)
+	}
+
 	// Seed invoices
 	customerNames := []string{"John Doe", "Jane Smith", "Bob Johnson", "Alice Brown", "Charlie Wilson"}
 	customerPhones := []string{"555-2001", "555-2002", "555-2003", "555-2004", "555-2005"}
 
 	for i := 1; i <= 10; i++ {
 		amount := float64(100 + rand.Intn(400)) // $100-$500
-		customerName := customerNames[rand.Intn(len(customerNames))]
-		customerPhone := customerPhones[rand.Intn(len(customerPhones))]
+		// The same people turn up with differently formatted names and phones
+		customerIndex := rand.Intn(len(customerNames))
+		customerName := customerNames[customerIndex]
+		customerPhone := customerPhones[customerIndex]
+		if i%3 == 0 {
+			customerName = strings.ToUpper(customerName)
+			customerPhone = "(" + strings.Replace(customerPhone, "-", ") ", 1)
+		}
 		status := []string{"pending", "paid", "overdue"}[rand.Intn(3)]
 		dueDate := time.Now().Add(time.Duration(rand.Intn(30)+1) * 24 * time.Hour).Format("2006-01-02")
+		if status == "overdue" {
+			// Overdue invoices fall due 1-100 days ago so aging has something to work with
+			dueDate = time.Now().Add(-time.Duration(rand.Intn(100)+1) * 24 * time.Hour).Format("2006-01-02")
+		}
 
 		result, err := db.Exec(`INSERT INTO invoices (job_id, amount, due_date, status, customer_name, customer_phone) 
 			VALUES (?, ?, ?, ?, ?, ?)`,
@@ -219,5 +670,229 @@ func seedDatabase(db *sql.DB) {
 		}
 	}
 
+	// Seed service zones: four quadrants around the base, Eastside with a
+	// surcharge for the longer run
+	baseLat, baseLng := 49.269391, -123.095063
+	serviceZones := []struct {
+		name                  string
+		latFrom, latTo        float64
+		lngFrom, lngTo        float64
+		multiplier, surcharge float64
+	}{
+		{"Downtown", baseLat, baseLat + 0.06, baseLng - 0.06, baseLng, 1, 0},
+		{"Eastside", baseLat, baseLat + 0.06, baseLng, baseLng + 0.06, 1, 15},
+		{"Westside", baseLat - 0.06, baseLat, baseLng - 0.06, baseLng, 1, 0},
+		{"Southside", baseLat - 0.06, baseLat, baseLng, baseLng + 0.06, 1.1, 0},
+	}
+	for _, zone := range serviceZones {
+		ring := [][]float64{{zone.lngFrom, zone.latFrom}, {zone.lngTo, zone.latFrom}, {zone.lngTo, zone.latTo},
+			{zone.lngFrom, zone.latTo}, {zone.lngFrom, zone.latFrom}}
+		geometry, _ := json.Marshal(map[string]interface{}{"type": "MultiPolygon", "coordinates": [][][][]float64{{ring}}})
+		_, err := db.Exec(`INSERT INTO service_zones (name, geometry, min_latitude, max_latitude, min_longitude, max_longitude,
+			price_multiplier, surcharge) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			zone.name, string(geometry), zone.latFrom, zone.latTo, zone.lngFrom, zone.lngTo, zone.multiplier, zone.surcharge)
+		if err != nil {
+			log.Printf("Error inserting service zone: %v", err)
+		}
+	}
+
+	// Seed police rotation lists. Downtown rotates across the inspected trucks;
+	// Eastside is shared with another company whose truck is on the list too
+	rotations := []struct {
+		name, zone string
+		entries    [][3]interface{}
+	}{
+		{"Downtown police rotation", "Downtown", [][3]interface{}{{"", 1, 1}, {"", 2, 2}, {"", 3, 3}, {"", 4, 4}}},
+		{"Eastside police rotation", "Eastside", [][3]interface{}{{"", 2, 2}, {"Eastside Recovery", 5, nil}, {"", 4, 4}}},
+	}
+	for _, rotation := range rotations {
+		result, err := db.Exec(`INSERT INTO rotation_lists (name, zone, job_type) VALUES (?, ?, 'police')`, rotation.name, rotation.zone)
+		if err != nil {
+			log.Printf("Error inserting rotation list: %v", err)
+			continue
+		}
+		rotationID, _ := result.LastInsertId()
+		for i, entry := range rotation.entries {
+			_, err := db.Exec(`INSERT INTO rotation_entries (rotation_id, position, company, driver_id, vehicle_id) VALUES (?, ?, ?, ?, ?)`,
+				rotationID, i+1, entry[0], entry[1], entry[2])
+			if err != nil {
+				log.Printf("Error inserting rotation entry: %v", err)
+			}
+		}
+	}
+
+	// Seed last month's motor club and insurance work so the first statements
+	// have something on them
+	lastMonth := time.Now().AddDate(0, -1, 0)
+	accountJobs := []struct {
+		customerID     int
+		jobType, owner string
+		poNumber       string
+		day            int
+		amount         float64
+		paid           bool
+	}{
+		{2, "breakdown", "Priya Shah", "PMC-77102", 4, 95.00, true},
+		{2, "accident", "Tom Becker", "PMC-77245", 12, 164.50, false},
+		{3, "accident", "Grace Kim", "HIN-CL-30918", 19, 191.00, false},
+	}
+	for i, accountJob := range accountJobs {
+		createdAt := time.Date(lastMonth.Year(), lastMonth.Month(), accountJob.day, 10, 30, 0, 0, time.Local)
+		completedAt := createdAt.Add(90 * time.Minute)
+		result, err := db.Exec(`INSERT INTO jobs (vehicle_description, pickup_coordinates, destination_coordinates, job_type, status,
+			created_at, completed_at, notes, license_plate, owner_name, owner_phone, customer_id, po_number)
+			VALUES (?, ?, ?, ?, 'completed', ?, ?, ?, ?, ?, ?, ?, ?)`,
+			vehicleDescriptions[i], "49.2827,-123.1207", "49.2488,-123.0016", accountJob.jobType,
+			createdAt.Format("2006-01-02 15:04:05"), completedAt.Format("2006-01-02 15:04:05"),
+			fmt.Sprintf("%s tow for account customer", accountJob.jobType), fmt.Sprintf("ACT%03d", i+1),
+			accountJob.owner, fmt.Sprintf("555-31%02d", i+1), accountJob.customerID, accountJob.poNumber)
+		if err != nil {
+			log.Printf("Error inserting account job: %v", err)
+			continue
+		}
+		jobID, _ := result.LastInsertId()
+
+		var name, phone string
+		var termsDays int
+		db.QueryRow(`SELECT name, phone, billing_terms_days FROM customers WHERE id = ?`, accountJob.customerID).Scan(&name, &phone, &termsDays)
+		status := "pending"
+		if accountJob.paid {
+			status = "paid"
+		}
+		result, err = db.Exec(`INSERT INTO invoices (job_id, amount, created_at, due_date, status, customer_name, customer_phone, customer_id, po_number)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			jobID, accountJob.amount, completedAt.Format("2006-01-02 15:04:05"), completedAt.AddDate(0, 0, termsDays).Format("2006-01-02"),
+			status, name, phone, accountJob.customerID, accountJob.poNumber)
+		if err != nil {
+			log.Printf("Error inserting account invoice: %v", err)
+			continue
+		}
+		if accountJob.paid {
+			invoiceID, _ := result.LastInsertId()
+			_, err := db.Exec(`INSERT INTO payments (invoice_id, amount, payment_method, reference_number, paid_at) VALUES (?, ?, 'bank_transfer', ?, ?)`,
+				invoiceID, accountJob.amount, fmt.Sprintf("EFT%06d", rand.Intn(999999)), completedAt.AddDate(0, 0, 10).Format("2006-01-02 15:04:05"))
+			if err != nil {
+				log.Printf("Error inserting account payment: %v", err)
+			}
+		}
+	}
+
+	// Seed advance bookings: Metro Property's twice-weekly lot sweep, a
+	// dealer's transfers on the 1st and 15th, and a repo booked for later today
+	tomorrow := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	nextMonth := time.Date(tomorrow.Year(), tomorrow.Month()+1, 1, 9, 0, 0, 0, time.UTC)
+	schedules := []struct {
+		jobType, vehicle, pickup, destination, owner, notes string
+		customerID                                          interface{}
+		startsAt                                            time.Time
+		recurrence                                          string
+	}{
+		{"parking_violation", "Unauthorized vehicles - Lot B", "500 Granville St, Downtown", "147 Birch Way, Industrial District", "",
+			"Private property sweep, Lot B", 4, tomorrow.Add(7 * time.Hour), "FREQ=WEEKLY;BYDAY=MO,TH"},
+		{"transfer", "Dealer stock transfer - 2 vehicles", "321 Elm St, Westside", "987 Cedar Ln, Southside", "Harbourside Motors",
+			"Dealer transfer to the Southside lot", nil, nextMonth, "FREQ=MONTHLY;BYMONTHDAY=1,15;COUNT=6"},
+	}
+	for _, booking := range schedules {
+		rule, err := parseRecurrence(booking.recurrence)
+		if err != nil {
+			log.Printf("Error parsing seed recurrence: %v", err)
+			continue
+		}
+		schedule := &jobSchedule{ScheduledFor: booking.startsAt, rule: rule}
+		next, _ := schedule.nextRun(booking.startsAt, time.Time{})
+		zone := strings.TrimSpace(booking.pickup[strings.LastIndex(booking.pickup, ",")+1:])
+		_, err = db.Exec(`INSERT INTO job_schedules (vehicle_description, pickup_coordinates, destination_coordinates, job_type, notes,
+			owner_name, customer_id, zone, starts_at, recurrence, next_run_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			booking.vehicle, booking.pickup, booking.destination, booking.jobType, booking.notes, booking.owner, booking.customerID, zone,
+			booking.startsAt.Format(sqliteTimeLayout), rule.String(), next.Format(sqliteTimeLayout))
+		if err != nil {
+			log.Printf("Error inserting job schedule: %v", err)
+		}
+	}
+	_, err = db.Exec(`INSERT INTO jobs (vehicle_description, pickup_coordinates, destination_coordinates, job_type, status, notes,
+		license_plate, zone, priority, created_at, scheduled_for) VALUES (?, ?, ?, 'repo', 'pending', ?, ?, 'Eastside', 'scheduled', ?, ?)`,
+		"2019 Nissan Rogue - Grey", "789 Pine Rd, Eastside", "147 Birch Way, Industrial District", "Repo booked with the lender for this afternoon",
+		"RPO418", time.Now().UTC().Format(sqliteTimeLayout), time.Now().UTC().Add(3*time.Hour).Format(sqliteTimeLayout))
+	if err != nil {
+		log.Printf("Error inserting scheduled job: %v", err)
+	}
+
+	// Seed late fee schedule
+	lateFeeStages := []map[string]interface{}{
+		{"stage": "overdue", "min_days_overdue": 1, "flat_fee": 25.0, "percent_of_balance": 0.0},
+		{"stage": "30_days", "min_days_overdue": 31, "flat_fee": 0.0, "percent_of_balance": 1.5},
+		{"stage": "60_days", "min_days_overdue": 61, "flat_fee": 0.0, "percent_of_balance": 1.5},
+		{"stage": "90_days", "min_days_overdue": 91, "flat_fee": 50.0, "percent_of_balance": 1.5},
+	}
+
+	for _, stage := range lateFeeStages {
+		_, err := db.Exec(`INSERT INTO late_fee_schedule (stage, min_days_overdue, flat_fee, percent_of_balance) VALUES (?, ?, ?, ?)`,
+			stage["stage"], stage["min_days_overdue"], stage["flat_fee"], stage["percent_of_balance"])
+		if err != nil {
+			log.Printf("Error inserting late fee stage: %v", err)
+		}
+	}
+
+	// Seed impound fee schedule
+	impoundFees := []map[string]interface{}{
+		{"fee_code": "base_tow", "description": "Base tow fee", "amount": 150.00},
+		{"fee_code": "admin", "description": "Administration fee", "amount": 35.00},
+		{"fee_code": "after_hours_release", "description": "After-hours release fee", "amount": 75.00},
+		{"fee_code": "storage_motorcycle", "description": "Daily storage (motorcycle)", "amount": 15.00},
+		{"fee_code": "storage_standard", "description": "Daily storage (standard vehicle)", "amount": 30.00},
+		{"fee_code": "storage_light_truck", "description": "Daily storage (light truck)", "amount": 40.00},
+		{"fee_code": "storage_heavy_duty", "description": "Daily storage (heavy duty)", "amount": 85.00},
+	}
+
+	for _, fee := range impoundFees {
+		_, err := db.Exec(`INSERT INTO impound_fee_schedule (fee_code, description, amount) VALUES (?, ?, ?)`,
+			fee["fee_code"], fee["description"], fee["amount"])
+		if err != nil {
+			log.Printf("Error inserting impound fee: %v", err)
+		}
+	}
+
+	// Seed statutory timeline for unclaimed vehicles
+	lienTimeline := []map[string]interface{}{
+		{"stage": "owner_notice", "days": 3, "description": "Registered owner notified that the vehicle is in storage and fees are accruing."},
+		{"stage": "lien", "days": 30, "description": "Storage lien filed for unpaid towing and storage charges."},
+		{"stage": "auction_eligible", "days": 45, "description": "Vehicle may be sold at auction or disposed of to recover charges."},
+	}
+
+	for _, stage := range lienTimeline {
+		_, err := db.Exec(`INSERT INTO lien_timeline (stage, days_after_impound, description) VALUES (?, ?, ?)`,
+			stage["stage"], stage["days"], stage["description"])
+		if err != nil {
+			log.Printf("Error inserting lien timeline stage: %v", err)
+		}
+	}
+
+	// Seed chart of accounts mappings for the accounting export
+	accountMappings := [][]string{
+		{"default", "accounts_receivable", "1200 Accounts Receivable"},
+		{"default", "revenue", "4000 Towing Revenue"},
+		{"default", "late_fees", "4900 Late Fee Income"},
+		{"default", "deposit", "1000 Undeposited Funds"},
+		{"job_type", "police", "4010 Police Tow Revenue"},
+		{"job_type", "breakdown", "4020 Roadside Revenue"},
+		{"job_type", "accident", "4030 Accident Recovery Revenue"},
+		{"job_type", "parking_violation", "4040 Private Property Impound Revenue"},
+		{"job_type", "repo", "4050 Repossession Revenue"},
+		{"payment_method", "cash", "1000 Undeposited Funds"},
+		{"payment_method", "check", "1000 Undeposited Funds"},
+		{"payment_method", "credit_card", "1010 Card Clearing"},
+		{"payment_method", "card", "1010 Card Clearing"},
+		{"payment_method", "bank_transfer", "1020 Operating Account"},
+		{"payment_method", "auction_proceeds", "1030 Auction Proceeds Clearing"},
+	}
+
+	for _, mapping := range accountMappings {
+		_, err := db.Exec(`INSERT INTO account_mappings (mapping_type, mapping_key, account) VALUES (?, ?, ?)`,
+			mapping[0], mapping[1], mapping[2])
+		if err != nil {
+			log.Printf("Error inserting account mapping: %v", err)
+		}
+	}
+
 	fmt.Println("Database seeding completed!")
 }
\ No newline at end of file
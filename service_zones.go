@@ -0,0 +1,809 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Service zones and geofencing. Zones are GeoJSON polygons; a job is tagged
+// with the zone its pickup falls in, and a zone can add a surcharge or
+// multiplier to rate-card prices. While a job is simulated, the truck's
+// position is checked against every zone, every impound lot and the job's
+// pickup radius, and crossing a boundary sends a geofence_enter or
+// geofence_exit message over the GPS websocket.
+
+const (
+	defaultPickupRadiusMeters = 250.0
+	impoundLotGeofenceMeters  = 150.0
+)
+
+// One polygon: an outer ring followed by any holes, each ring [lng, lat] pairs
+type zonePolygon [][][]float64
+
+type geoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+}
+
+// The geofence a message refers to
+type geofenceRef struct {
+	Type string `json:"type"` // zone, impound_lot or pickup
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type geofence struct {
+	geofenceRef
+	contains func(lat, lng float64) bool
+}
+
+type geofenceCrossing struct {
+	fence geofence
+	event string // enter or exit
+}
+
+func (g geofence) key() string {
+	return fmt.Sprintf("%s:%d", g.Type, g.ID)
+}
+
+// Parse "lat,lng" into a point; false for addresses and other free text
+func parseLatLng(value string) (float64, float64, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return 0, 0, false
+	}
+	return lat, lng, true
+}
+
+// Decode a Polygon or MultiPolygon geometry into polygons, closing open rings
+func parseZoneGeometry(geometry *geoJSONGeometry) ([]zonePolygon, error) {
+	if geometry == nil {
+		return nil, fmt.Errorf("geometry is required")
+	}
+
+	var polygons []zonePolygon
+	switch geometry.Type {
+	case "Polygon":
+		var polygon zonePolygon
+		if err := json.Unmarshal(geometry.Coordinates, &polygon); err != nil {
+			return nil, fmt.Errorf("Polygon coordinates must be rings of [lng, lat] positions")
+		}
+		polygons = []zonePolygon{polygon}
+	case "MultiPolygon":
+		if err := json.Unmarshal(geometry.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("MultiPolygon coordinates must be polygons of [lng, lat] rings")
+		}
+	default:
+		return nil, fmt.Errorf("geometry type must be Polygon or MultiPolygon")
+	}
+
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("geometry has no polygons")
+	}
+	for _, polygon := range polygons {
+		if len(polygon) == 0 {
+			return nil, fmt.Errorf("polygon has no rings")
+		}
+		for r, ring := range polygon {
+			for _, position := range ring {
+				if len(position) < 2 || position[0] < -180 || position[0] > 180 || position[1] < -90 || position[1] > 90 {
+					return nil, fmt.Errorf("positions must be [lng, lat] within range")
+				}
+			}
+			if len(ring) > 0 {
+				first, last := ring[0], ring[len(ring)-1]
+				if first[0] != last[0] || first[1] != last[1] {
+					ring = append(ring, first)
+					polygon[r] = ring
+				}
+			}
+			if len(ring) < 4 {
+				return nil, fmt.Errorf("rings need at least 3 distinct positions")
+			}
+		}
+	}
+	return polygons, nil
+}
+
+// Ray casting against one ring
+func ringContains(ring [][]float64, lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > lat) != (yj > lat) && lng < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func polygonsContain(polygons []zonePolygon, lat, lng float64) bool {
+	for _, polygon := range polygons {
+		if !ringContains(polygon[0], lat, lng) {
+			continue
+		}
+		inHole := false
+		for _, hole := range polygon[1:] {
+			if ringContains(hole, lat, lng) {
+				inHole = true
+				break
+			}
+		}
+		if !inHole {
+			return true
+		}
+	}
+	return false
+}
+
+func boundingBox(polygons []zonePolygon) (minLat, maxLat, minLng, maxLng float64) {
+	minLat, minLng = math.Inf(1), math.Inf(1)
+	maxLat, maxLng = math.Inf(-1), math.Inf(-1)
+	for _, polygon := range polygons {
+		for _, position := range polygon[0] {
+			minLng, maxLng = math.Min(minLng, position[0]), math.Max(maxLng, position[0])
+			minLat, maxLat = math.Min(minLat, position[1]), math.Max(maxLat, position[1])
+		}
+	}
+	return
+}
+
+type serviceZone struct {
+	ID       int64
+	Name     string
+	Polygons []zonePolygon
+}
+
+func loadServiceZones() ([]serviceZone, error) {
+	rows, err := db.Query(`SELECT id, name, geometry FROM service_zones WHERE is_active = 1 ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var zones []serviceZone
+	for rows.Next() {
+		var zone serviceZone
+		var geometry string
+		if err := rows.Scan(&zone.ID, &zone.Name, &geometry); err != nil {
+			return nil, err
+		}
+		var parsed geoJSONGeometry
+		if err := json.Unmarshal([]byte(geometry), &parsed); err != nil {
+			log.Printf("Skipping zone %d with unreadable geometry: %v", zone.ID, err)
+			continue
+		}
+		if zone.Polygons, err = parseZoneGeometry(&parsed); err != nil {
+			log.Printf("Skipping zone %d with invalid geometry: %v", zone.ID, err)
+			continue
+		}
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
+
+// The first active zone containing the point, or "" when it is in none
+func zoneAt(lat, lng float64) (string, error) {
+	zones, err := loadServiceZones()
+	if err != nil {
+		return "", err
+	}
+	for _, zone := range zones {
+		if polygonsContain(zone.Polygons, lat, lng) {
+			return zone.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// Zone pricing hook for rate-card invoices: a flat surcharge plus the zone's
+// multiplier applied to the priced total. Returns the extra line item, if any.
+func zonePriceAdjustment(zone string, total float64) (*quoteLineItem, error) {
+	if zone == "" {
+		return nil, nil
+	}
+	var multiplier, surcharge float64
+	err := db.QueryRow(`SELECT price_multiplier, surcharge FROM service_zones WHERE name = ? AND is_active = 1`, zone).
+		Scan(&multiplier, &surcharge)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	amount := roundCents(surcharge + total*(multiplier-1))
+	if amount == 0 {
+		return nil, nil
+	}
+	return &quoteLineItem{
+		Code:        "zone_surcharge",
+		Description: fmt.Sprintf("%s zone surcharge", zone),
+		Quantity:    1,
+		UnitAmount:  amount,
+		Amount:      amount,
+	}, nil
+}
+
+// Zone and impound lot geofences, shared by every simulated job. They are
+// loaded once and kept until a zone or lot changes, so the GPS worker does
+// not query them on every tick.
+var (
+	geofenceCache      []geofence
+	geofenceCacheValid bool
+	geofenceCacheMutex sync.Mutex
+)
+
+func sharedGeofences() ([]geofence, error) {
+	geofenceCacheMutex.Lock()
+	defer geofenceCacheMutex.Unlock()
+	if !geofenceCacheValid {
+		fences, err := loadSharedGeofences()
+		if err != nil {
+			return nil, err
+		}
+		geofenceCache, geofenceCacheValid = fences, true
+	}
+	return geofenceCache, nil
+}
+
+// Drop the cached geofences once a zone or impound lot is created, changed or deleted
+func invalidateGeofences() {
+	geofenceCacheMutex.Lock()
+	geofenceCacheValid = false
+	geofenceCacheMutex.Unlock()
+}
+
+// Every active zone and every active impound lot
+func loadSharedGeofences() ([]geofence, error) {
+	zones, err := loadServiceZones()
+	if err != nil {
+		return nil, err
+	}
+	var fences []geofence
+	for _, zone := range zones {
+		polygons := zone.Polygons
+		fences = append(fences, geofence{
+			geofenceRef: geofenceRef{Type: "zone", ID: zone.ID, Name: zone.Name},
+			contains:    func(lat, lng float64) bool { return polygonsContain(polygons, lat, lng) },
+		})
+	}
+
+	rows, err := db.Query(`SELECT id, name, latitude, longitude FROM impound_lots WHERE is_active = 1`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name string
+		var lotLat, lotLng float64
+		if err := rows.Scan(&id, &name, &lotLat, &lotLng); err != nil {
+			return nil, err
+		}
+		fences = append(fences, geofence{
+			geofenceRef: geofenceRef{Type: "impound_lot", ID: id, Name: name},
+			contains: func(lat, lng float64) bool {
+				return calculateDistance(lat, lng, lotLat, lotLng)*1000 <= impoundLotGeofenceMeters
+			},
+		})
+	}
+	return fences, rows.Err()
+}
+
+// Geofences a simulated job is checked against: the shared zone and impound
+// lot fences plus the pickup radius of the job
+func jobGeofences(shared []geofence, activeJob *ActiveJob) []geofence {
+	fences := append([]geofence{}, shared...)
+	pickupLat, pickupLng, radius := activeJob.StartLat, activeJob.StartLng, activeJob.PickupRadiusM
+	return append(fences, geofence{
+		geofenceRef: geofenceRef{Type: "pickup", ID: activeJob.JobID, Name: fmt.Sprintf("Job %d pickup", activeJob.JobID)},
+		contains: func(lat, lng float64) bool {
+			return calculateDistance(lat, lng, pickupLat, pickupLng)*1000 <= radius
+		},
+	})
+}
+
+// Pickup radius for a job: the customer's, or the default
+func pickupRadiusForJob(jobID int64) float64 {
+	var radius sql.NullFloat64
+	db.QueryRow(`SELECT c.pickup_radius_m FROM jobs j JOIN customers c ON c.id = j.customer_id WHERE j.id = ?`, jobID).Scan(&radius)
+	if radius.Valid && radius.Float64 > 0 {
+		return radius.Float64
+	}
+	return defaultPickupRadiusMeters
+}
+
+// Compare the geofences the truck is in now with where it was on the last
+// update, then record and broadcast each crossing. With announce false the
+// starting position is only noted. shared comes from sharedGeofences, loaded
+// before activeMutex is taken.
+func checkGeofences(activeJob *ActiveJob, shared []geofence, announce bool) {
+	fences := jobGeofences(shared, activeJob)
+	inside := make(map[string]bool)
+	var crossings []geofenceCrossing
+	for _, fence := range fences {
+		now := fence.contains(activeJob.CurrentLat, activeJob.CurrentLng)
+		if now {
+			inside[fence.key()] = true
+		}
+		if was := activeJob.Geofences[fence.key()]; announce && now != was {
+			event := "exit"
+			if now {
+				event = "enter"
+			}
+			crossings = append(crossings, geofenceCrossing{fence, event})
+		}
+	}
+	activeJob.Geofences = inside
+
+	for _, crossing := range crossings {
+		ref := crossing.fence.geofenceRef
+		_, err := db.Exec(`INSERT INTO geofence_events (job_id, driver_id, vehicle_id, geofence_type, geofence_id, geofence_name, event,
+			latitude, longitude, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			activeJob.JobID, activeJob.DriverID, nullableID(activeJob.VehicleID), ref.Type, ref.ID, ref.Name, crossing.event,
+			activeJob.CurrentLat, activeJob.CurrentLng, simNow().Format(sqliteTimeLayout))
+		if err != nil {
+			log.Printf("Error recording geofence event for job %d: %v", activeJob.JobID, err)
+		}
+
+		verb := "Left"
+		if crossing.event == "enter" {
+			verb = "Entered"
+		}
+		broadcastGPSData(GPSData{
+			JobID:     activeJob.JobID,
+			DriverID:  activeJob.DriverID,
+			Latitude:  activeJob.CurrentLat,
+			Longitude: activeJob.CurrentLng,
+			Timestamp: time.Now().Format(time.RFC3339),
+			Status:    "geofence_" + crossing.event,
+			Message:   fmt.Sprintf("%s %s", verb, ref.Name),
+			Geofence:  &ref,
+		})
+	}
+}
+
+func nullableID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// Check a zone's optional pricing fields
+func zonePricingValue(field string, value interface{}) (float64, string) {
+	number, isNumber := value.(float64)
+	switch {
+	case !isNumber:
+		return 0, field + " must be a number"
+	case field == "price_multiplier" && (number <= 0 || number > 5):
+		return 0, "price_multiplier must be greater than 0 and at most 5"
+	case field == "surcharge" && number < 0:
+		return 0, "surcharge must be at least 0"
+	}
+	return number, ""
+}
+
+func insertServiceZone(tx *sql.Tx, name string, geometry *geoJSONGeometry, properties map[string]interface{}) (int64, string, int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, "Every zone needs a name", http.StatusBadRequest, nil
+	}
+	polygons, err := parseZoneGeometry(geometry)
+	if err != nil {
+		return 0, fmt.Sprintf("Zone %s: %v", name, err), http.StatusBadRequest, nil
+	}
+
+	pricing := map[string]float64{"price_multiplier": 1, "surcharge": 0}
+	for field := range pricing {
+		if value, ok := properties[field]; ok && value != nil {
+			number, problem := zonePricingValue(field, value)
+			if problem != "" {
+				return 0, fmt.Sprintf("Zone %s: %s", name, problem), http.StatusBadRequest, nil
+			}
+			pricing[field] = number
+		}
+	}
+
+	stored, _ := json.Marshal(map[string]interface{}{"type": "MultiPolygon", "coordinates": polygons})
+	minLat, maxLat, minLng, maxLng := boundingBox(polygons)
+	result, err := tx.Exec(`INSERT INTO service_zones (name, geometry, min_latitude, max_latitude, min_longitude, max_longitude,
+		price_multiplier, surcharge) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		name, string(stored), minLat, maxLat, minLng, maxLng, pricing["price_multiplier"], pricing["surcharge"])
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return 0, fmt.Sprintf("A zone named %s already exists", name), http.StatusConflict, nil
+		}
+		return 0, "", 0, err
+	}
+	id, _ := result.LastInsertId()
+	return id, "", 0, nil
+}
+
+// Upload zones as a GeoJSON Feature or FeatureCollection (name, and optional
+// price_multiplier and surcharge, in properties), or as {"name", "geometry",
+// "price_multiplier", "surcharge"}
+func createServiceZones(w http.ResponseWriter, r *http.Request) {
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var bodyType string
+	json.Unmarshal(body["type"], &bodyType)
+
+	var features []geoJSONFeature
+	switch bodyType {
+	case "FeatureCollection":
+		if err := json.Unmarshal(body["features"], &features); err != nil || len(features) == 0 {
+			http.Error(w, "features must be a non-empty array of Features", http.StatusBadRequest)
+			return
+		}
+	case "Feature":
+		var feature geoJSONFeature
+		raw, _ := json.Marshal(body)
+		if err := json.Unmarshal(raw, &feature); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		features = []geoJSONFeature{feature}
+	default:
+		feature := geoJSONFeature{Properties: map[string]interface{}{}}
+		for key, value := range body {
+			if key == "geometry" {
+				if err := json.Unmarshal(value, &feature.Geometry); err != nil {
+					http.Error(w, "geometry must be a GeoJSON geometry", http.StatusBadRequest)
+					return
+				}
+				continue
+			}
+			var property interface{}
+			json.Unmarshal(value, &property)
+			feature.Properties[key] = property
+		}
+		features = []geoJSONFeature{feature}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	ids := []int64{}
+	for _, feature := range features {
+		name, _ := feature.Properties["name"].(string)
+		id, problem, status, err := insertServiceZone(tx, name, feature.Geometry, feature.Properties)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if problem != "" {
+			http.Error(w, problem, status)
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invalidateGeofences()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if bodyType == "FeatureCollection" {
+		json.NewEncoder(w).Encode(map[string][]int64{"ids": ids})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]int64{"id": ids[0]})
+}
+
+func scanServiceZone(row interface{ Scan(...interface{}) error }) (map[string]interface{}, error) {
+	var id, jobs int64
+	var name, geometry string
+	var minLat, maxLat, minLng, maxLng, multiplier, surcharge float64
+	var isActive bool
+	err := row.Scan(&id, &name, &geometry, &minLat, &maxLat, &minLng, &maxLng, &multiplier, &surcharge, &isActive, &jobs)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"id":               id,
+		"name":             name,
+		"geometry":         json.RawMessage(geometry),
+		"bbox":             []float64{minLng, minLat, maxLng, maxLat},
+		"price_multiplier": multiplier,
+		"surcharge":        surcharge,
+		"is_active":        isActive,
+		"jobs":             jobs,
+	}, nil
+}
+
+const serviceZoneColumns = `z.id, z.name, z.geometry, z.min_latitude, z.max_latitude, z.min_longitude, z.max_longitude,
+	z.price_multiplier, z.surcharge, z.is_active, (SELECT COUNT(*) FROM jobs j WHERE j.zone = z.name)`
+
+// Zones as a list, or as a GeoJSON FeatureCollection with ?format=geojson
+func getServiceZones(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(`SELECT ` + serviceZoneColumns + ` FROM service_zones z ORDER BY z.name`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	zones := []map[string]interface{}{}
+	for rows.Next() {
+		zone, err := scanServiceZone(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		zones = append(zones, zone)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Query().Get("format") != "geojson" {
+		json.NewEncoder(w).Encode(zones)
+		return
+	}
+
+	features := []map[string]interface{}{}
+	for _, zone := range zones {
+		geometry := zone["geometry"]
+		delete(zone, "geometry")
+		features = append(features, map[string]interface{}{"type": "Feature", "id": zone["id"], "properties": zone, "geometry": geometry})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"type": "FeatureCollection", "features": features})
+}
+
+func getServiceZone(w http.ResponseWriter, r *http.Request) {
+	zone, err := scanServiceZone(db.QueryRow(`SELECT `+serviceZoneColumns+` FROM service_zones z WHERE z.id = ?`, mux.Vars(r)["id"]))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Zone not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zone)
+}
+
+// Change a zone's name, geometry, pricing or is_active. Renaming a zone
+// renames it on its jobs and rotation lists too.
+func updateServiceZone(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var update map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var zoneID int64
+	var oldName string
+	err := db.QueryRow(`SELECT id, name FROM service_zones WHERE id = ?`, vars["id"]).Scan(&zoneID, &oldName)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Zone not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	changed := []string{}
+	for _, field := range []string{"name", "geometry", "price_multiplier", "surcharge", "is_active"} {
+		raw, ok := update[field]
+		if !ok {
+			continue
+		}
+		switch field {
+		case "name":
+			var name string
+			if json.Unmarshal(raw, &name) != nil || strings.TrimSpace(name) == "" {
+				http.Error(w, "name must not be empty", http.StatusBadRequest)
+				return
+			}
+			name = strings.TrimSpace(name)
+			if _, err := tx.Exec(`UPDATE service_zones SET name = ? WHERE id = ?`, name, vars["id"]); err != nil {
+				if strings.Contains(err.Error(), "UNIQUE") {
+					http.Error(w, fmt.Sprintf("A zone named %s already exists", name), http.StatusConflict)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if _, err := tx.Exec(`UPDATE jobs SET zone = ? WHERE zone = ?`, name, oldName); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if _, err := tx.Exec(`UPDATE rotation_lists SET zone = ? WHERE zone = ?`, name, oldName); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "geometry":
+			var geometry geoJSONGeometry
+			if err := json.Unmarshal(raw, &geometry); err != nil {
+				http.Error(w, "geometry must be a GeoJSON geometry", http.StatusBadRequest)
+				return
+			}
+			polygons, err := parseZoneGeometry(&geometry)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			stored, _ := json.Marshal(map[string]interface{}{"type": "MultiPolygon", "coordinates": polygons})
+			minLat, maxLat, minLng, maxLng := boundingBox(polygons)
+			_, err = tx.Exec(`UPDATE service_zones SET geometry = ?, min_latitude = ?, max_latitude = ?, min_longitude = ?, max_longitude = ?
+				WHERE id = ?`, string(stored), minLat, maxLat, minLng, maxLng, vars["id"])
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "price_multiplier", "surcharge":
+			var value interface{}
+			json.Unmarshal(raw, &value)
+			number, problem := zonePricingValue(field, value)
+			if problem != "" {
+				http.Error(w, problem, http.StatusBadRequest)
+				return
+			}
+			if _, err := tx.Exec(`UPDATE service_zones SET `+field+` = ? WHERE id = ?`, number, vars["id"]); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		case "is_active":
+			var active bool
+			if json.Unmarshal(raw, &active) != nil {
+				http.Error(w, "is_active must be true or false", http.StatusBadRequest)
+				return
+			}
+			if _, err := tx.Exec(`UPDATE service_zones SET is_active = ? WHERE id = ?`, active, vars["id"]); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		changed = append(changed, field)
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	invalidateGeofences()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": zoneID, "changed": changed})
+}
+
+// Jobs and rotation lists refer to zones by name, so a zone in use cannot be
+// deleted; deactivate it with is_active instead
+func deleteServiceZone(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	result, err := db.Exec(`DELETE FROM service_zones WHERE id = ?
+		AND NOT EXISTS (SELECT 1 FROM jobs WHERE zone = service_zones.name)
+		AND NOT EXISTS (SELECT 1 FROM rotation_lists WHERE zone = service_zones.name)`, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var jobs, rotations int
+		err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM jobs WHERE zone = z.name), (SELECT COUNT(*) FROM rotation_lists WHERE zone = z.name)
+			FROM service_zones z WHERE z.id = ?`, vars["id"]).Scan(&jobs, &rotations)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Zone not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Zone is used by %d jobs and %d rotation lists; set is_active to false instead", jobs, rotations),
+			http.StatusConflict)
+		return
+	}
+	invalidateGeofences()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Which zone a point is in: ?lat=&lng=
+func locateServiceZone(w http.ResponseWriter, r *http.Request) {
+	lat, lng, ok := parseLatLng(r.URL.Query().Get("lat") + "," + r.URL.Query().Get("lng"))
+	if !ok {
+		http.Error(w, "lat and lng must be valid coordinates", http.StatusBadRequest)
+		return
+	}
+	zone, err := zoneAt(lat, lng)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"latitude": lat, "longitude": lng, "zone": zone})
+}
+
+// Geofence crossings, newest first, filtered by ?job_id=, ?vehicle_id=,
+// ?type= (zone, impound_lot, pickup) and ?event= (enter, exit)
+func getGeofenceEvents(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT id, job_id, driver_id, vehicle_id, geofence_type, geofence_id, geofence_name, event, latitude, longitude, created_at
+		FROM geofence_events WHERE 1 = 1`
+	var args []interface{}
+	for param, column := range map[string]string{"job_id": "job_id", "vehicle_id": "vehicle_id", "type": "geofence_type", "event": "event"} {
+		if value := r.URL.Query().Get(param); value != "" {
+			query += ` AND ` + column + ` = ?`
+			args = append(args, value)
+		}
+	}
+
+	rows, err := db.Query(query+` ORDER BY created_at DESC, id DESC LIMIT 200`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []map[string]interface{}{}
+	for rows.Next() {
+		var id, jobID, driverID, geofenceID int64
+		var vehicleID sql.NullInt64
+		var geofenceType, geofenceName, event, createdAt string
+		var lat, lng float64
+		err := rows.Scan(&id, &jobID, &driverID, &vehicleID, &geofenceType, &geofenceID, &geofenceName, &event, &lat, &lng, &createdAt)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		events = append(events, map[string]interface{}{
+			"id":            id,
+			"job_id":        jobID,
+			"driver_id":     driverID,
+			"vehicle_id":    vehicleID.Int64,
+			"geofence_type": geofenceType,
+			"geofence_id":   geofenceID,
+			"geofence_name": geofenceName,
+			"event":         event,
+			"latitude":      lat,
+			"longitude":     lng,
+			"created_at":    createdAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
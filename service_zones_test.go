@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Rings are [lng, lat] positions, as in GeoJSON
+var (
+	squareRing = [][]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}
+	holeRing   = [][]float64{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}}
+	openRing   = [][]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	farRing    = [][]float64{{20, 20}, {30, 20}, {30, 30}, {20, 30}, {20, 20}}
+)
+
+func TestRingContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		ring     [][]float64
+		lat, lng float64
+		want     bool
+	}{
+		{"inside", squareRing, 5, 5, true},
+		{"outside east", squareRing, 5, 15, false},
+		{"outside north", squareRing, 15, 5, false},
+		{"outside in line with an edge", squareRing, 0, 15, false},
+		{"open ring inside", openRing, 5, 5, true},
+		{"open ring near the missing edge", openRing, 5, 0.5, true},
+		{"open ring outside", openRing, 5, -1, false},
+		{"triangle inside", [][]float64{{0, 0}, {10, 0}, {5, 10}, {0, 0}}, 2, 5, true},
+		{"triangle outside the slope", [][]float64{{0, 0}, {10, 0}, {5, 10}, {0, 0}}, 8, 1, false},
+	}
+	for _, tt := range tests {
+		if got := ringContains(tt.ring, tt.lat, tt.lng); got != tt.want {
+			t.Errorf("%s: ringContains(%v, %v) = %v, want %v", tt.name, tt.lat, tt.lng, got, tt.want)
+		}
+	}
+}
+
+func TestPolygonsContain(t *testing.T) {
+	withHole := []zonePolygon{{squareRing, holeRing}}
+	tests := []struct {
+		name     string
+		polygons []zonePolygon
+		lat, lng float64
+		want     bool
+	}{
+		{"inside", []zonePolygon{{squareRing}}, 5, 5, true},
+		{"outside", []zonePolygon{{squareRing}}, 5, 15, false},
+		{"around the hole", withHole, 2, 2, true},
+		{"in the hole", withHole, 5, 5, false},
+		{"outside with a hole", withHole, 15, 15, false},
+		{"open outer ring", []zonePolygon{{openRing}}, 5, 5, true},
+		{"open hole", []zonePolygon{{squareRing, holeRing[:4]}}, 5, 5, false},
+		{"second of several", []zonePolygon{{squareRing}, {farRing}}, 25, 25, true},
+		{"between several", []zonePolygon{{squareRing}, {farRing}}, 15, 15, false},
+		{"in one polygon's hole but inside another", []zonePolygon{{squareRing, holeRing}, {[][]float64{{3, 3}, {7, 3}, {7, 7}, {3, 7}, {3, 3}}}}, 5, 5, true},
+		{"no polygons", nil, 5, 5, false},
+	}
+	for _, tt := range tests {
+		if got := polygonsContain(tt.polygons, tt.lat, tt.lng); got != tt.want {
+			t.Errorf("%s: polygonsContain(%v, %v) = %v, want %v", tt.name, tt.lat, tt.lng, got, tt.want)
+		}
+	}
+}
+
+func TestParseZoneGeometry(t *testing.T) {
+	tests := []struct {
+		name     string
+		geometry string
+		rings    int // rings in the first polygon
+		wantErr  bool
+	}{
+		{"polygon", `{"type": "Polygon", "coordinates": [[[0,0],[10,0],[10,10],[0,10],[0,0]]]}`, 1, false},
+		{"open ring is closed", `{"type": "Polygon", "coordinates": [[[0,0],[10,0],[10,10],[0,10]]]}`, 1, false},
+		{"polygon with a hole", `{"type": "Polygon", "coordinates": [[[0,0],[10,0],[10,10],[0,10],[0,0]], [[4,4],[6,4],[6,6],[4,6]]]}`, 2, false},
+		{"multipolygon", `{"type": "MultiPolygon", "coordinates": [[[[0,0],[10,0],[10,10],[0,0]]], [[[20,20],[30,20],[30,30],[20,20]]]]}`, 1, false},
+		{"too few positions", `{"type": "Polygon", "coordinates": [[[0,0],[10,0],[0,0]]]}`, 0, true},
+		{"out of range", `{"type": "Polygon", "coordinates": [[[0,0],[190,0],[10,10],[0,0]]]}`, 0, true},
+		{"no rings", `{"type": "Polygon", "coordinates": []}`, 0, true},
+		{"point", `{"type": "Point", "coordinates": [0,0]}`, 0, true},
+	}
+	for _, tt := range tests {
+		var geometry geoJSONGeometry
+		if err := json.Unmarshal([]byte(tt.geometry), &geometry); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		polygons, err := parseZoneGeometry(&geometry)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if len(polygons[0]) != tt.rings {
+			t.Errorf("%s: got %d rings, want %d", tt.name, len(polygons[0]), tt.rings)
+		}
+		for _, polygon := range polygons {
+			for _, ring := range polygon {
+				first, last := ring[0], ring[len(ring)-1]
+				if first[0] != last[0] || first[1] != last[1] {
+					t.Errorf("%s: ring %v is not closed", tt.name, ring)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Vehicle inspections. Each vehicle type has a pre-trip and a post-trip
+// checklist; some items are critical. Drivers submit a result for every item
+// and a critical defect takes the truck out of service until a later
+// inspection passes. A driver can only be assigned a truck they have passed a
+// pre-trip inspection on during their current shift.
+
+const inspectionDefectPrefix = "Critical defect: "
+
+type inspectionItem struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Critical    bool   `json:"critical"`
+}
+
+func validInspectionType(inspectionType string) bool {
+	return inspectionType == "pre_trip" || inspectionType == "post_trip"
+}
+
+func loadInspectionTemplate(vehicleType, inspectionType string) ([]inspectionItem, error) {
+	rows, err := db.Query(`SELECT item_code, description, is_critical FROM inspection_templates
+		WHERE vehicle_type = ? AND inspection_type = ? ORDER BY sort_order, item_code`, vehicleType, inspectionType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []inspectionItem{}
+	for rows.Next() {
+		var item inspectionItem
+		var description sql.NullString
+		if err := rows.Scan(&item.Code, &description, &item.Critical); err != nil {
+			return nil, err
+		}
+		item.Description = description.String
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// Whether the driver has passed a pre-trip inspection of the vehicle during their open shift
+func hasPassedPreTrip(vehicleID int64, driverID interface{}) (bool, error) {
+	shift, err := openDriverShift(driverID)
+	if err != nil || shift == nil {
+		return false, err
+	}
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM vehicle_inspections
+		WHERE vehicle_id = ? AND driver_id = ? AND shift_id = ? AND inspection_type = 'pre_trip' AND passed = 1`,
+		vehicleID, driverID, shift.ID).Scan(&count)
+	return count > 0, err
+}
+
+func getInspectionTemplates(w http.ResponseWriter, r *http.Request) {
+	query := `SELECT vehicle_type, inspection_type, item_code, description, is_critical FROM inspection_templates`
+	var args []interface{}
+	if vehicleType := r.URL.Query().Get("vehicle_type"); vehicleType != "" {
+		query += ` WHERE vehicle_type = ?`
+		args = append(args, vehicleType)
+	}
+	query += ` ORDER BY vehicle_type, inspection_type, sort_order, item_code`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// vehicle_type -> inspection_type -> items
+	templates := map[string]map[string][]inspectionItem{}
+	for rows.Next() {
+		var vehicleType, inspectionType string
+		var item inspectionItem
+		var description sql.NullString
+		if err := rows.Scan(&vehicleType, &inspectionType, &item.Code, &description, &item.Critical); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		item.Description = description.String
+		if templates[vehicleType] == nil {
+			templates[vehicleType] = map[string][]inspectionItem{}
+		}
+		templates[vehicleType][inspectionType] = append(templates[vehicleType][inspectionType], item)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// Replace the checklist for a vehicle type and inspection type
+func updateInspectionTemplate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	if !validInspectionType(vars["inspectionType"]) {
+		http.Error(w, "inspection type must be pre_trip or post_trip", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		Items []inspectionItem `json:"items"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Items) == 0 {
+		http.Error(w, "items must not be empty", http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	for _, item := range body.Items {
+		if strings.TrimSpace(item.Code) == "" {
+			http.Error(w, "every item needs a code", http.StatusBadRequest)
+			return
+		}
+		if seen[item.Code] {
+			http.Error(w, fmt.Sprintf("Duplicate item %s", item.Code), http.StatusBadRequest)
+			return
+		}
+		seen[item.Code] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM inspection_templates WHERE vehicle_type = ? AND inspection_type = ?`,
+		vars["vehicleType"], vars["inspectionType"]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, item := range body.Items {
+		_, err := tx.Exec(`INSERT INTO inspection_templates (vehicle_type, inspection_type, item_code, description, is_critical, sort_order)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			vars["vehicleType"], vars["inspectionType"], strings.TrimSpace(item.Code), item.Description, item.Critical, i+1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body.Items)
+}
+
+// Submit an inspection: {"driver_id": 1, "inspection_type": "pre_trip",
+// "results": [{"item": "brakes", "status": "ok"}, {"item": "lights", "status": "defect", "notes": "..."}]}
+func createVehicleInspection(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var inspection struct {
+		DriverID       int64  `json:"driver_id"`
+		InspectionType string `json:"inspection_type"`
+		Notes          string `json:"notes"`
+		Results        []struct {
+			Item   string `json:"item"`
+			Status string `json:"status"`
+			Notes  string `json:"notes"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&inspection); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var vehicleID int64
+	var vehicleType string
+	var odometer sql.NullFloat64
+	var outOfService sql.NullString
+	err := db.QueryRow(`SELECT id, vehicle_type, odometer_km, out_of_service_reason FROM fleet_vehicles WHERE id = ?`, vars["id"]).
+		Scan(&vehicleID, &vehicleType, &odometer, &outOfService)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Vehicle not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !validInspectionType(inspection.InspectionType) {
+		http.Error(w, "inspection_type must be pre_trip or post_trip", http.StatusBadRequest)
+		return
+	}
+	if inspection.DriverID == 0 {
+		http.Error(w, "driver_id is required", http.StatusBadRequest)
+		return
+	}
+	exists, err := driverExists(fmt.Sprint(inspection.DriverID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Driver not found", http.StatusNotFound)
+		return
+	}
+
+	// Inspections belong to the driver's current shift
+	shift, err := openDriverShift(inspection.DriverID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if shift == nil {
+		http.Error(w, "Driver is not on shift", http.StatusConflict)
+		return
+	}
+
+	template, err := loadInspectionTemplate(vehicleType, inspection.InspectionType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(template) == 0 {
+		http.Error(w, fmt.Sprintf("No %s checklist for %s", inspection.InspectionType, vehicleType), http.StatusBadRequest)
+		return
+	}
+
+	// Every checklist item needs exactly one result
+	templateItems := map[string]inspectionItem{}
+	for _, item := range template {
+		templateItems[item.Code] = item
+	}
+	answered := map[string]bool{}
+	criticalDefects := []string{}
+	defects := 0
+	for _, result := range inspection.Results {
+		item, ok := templateItems[result.Item]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown checklist item %s", result.Item), http.StatusBadRequest)
+			return
+		}
+		if answered[result.Item] {
+			http.Error(w, fmt.Sprintf("Duplicate result for %s", result.Item), http.StatusBadRequest)
+			return
+		}
+		answered[result.Item] = true
+		switch result.Status {
+		case "ok", "na":
+		case "defect":
+			defects++
+			if item.Critical {
+				criticalDefects = append(criticalDefects, item.Code)
+			}
+		default:
+			http.Error(w, "result status must be ok, defect or na", http.StatusBadRequest)
+			return
+		}
+	}
+	var missing []string
+	for _, item := range template {
+		if !answered[item.Code] {
+			missing = append(missing, item.Code)
+		}
+	}
+	if len(missing) > 0 {
+		http.Error(w, "Missing results for "+strings.Join(missing, ", "), http.StatusBadRequest)
+		return
+	}
+
+	passed := len(criticalDefects) == 0
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO vehicle_inspections (vehicle_id, driver_id, shift_id, inspection_type, odometer_km, passed, notes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		vehicleID, inspection.DriverID, shift.ID, inspection.InspectionType, odometer.Float64, passed, inspection.Notes,
+		simNow().Format(sqliteTimeLayout))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	inspectionID, _ := result.LastInsertId()
+
+	for _, r := range inspection.Results {
+		_, err := tx.Exec(`INSERT INTO inspection_results (inspection_id, item_code, status, is_critical, notes) VALUES (?, ?, ?, ?, ?)`,
+			inspectionID, r.Item, r.Status, templateItems[r.Item].Critical, r.Notes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// A critical defect grounds the truck; a clean inspection lifts an earlier defect grounding
+	reason := outOfService.String
+	if !passed {
+		if reason == "" || strings.HasPrefix(reason, inspectionDefectPrefix) || strings.HasPrefix(reason, maintenanceOverduePrefix) {
+			reason = inspectionDefectPrefix + strings.Join(criticalDefects, ", ")
+		}
+	} else if strings.HasPrefix(reason, inspectionDefectPrefix) {
+		reason = ""
+	}
+	if reason != outOfService.String {
+		var value interface{} = reason
+		if reason == "" {
+			value = nil
+		}
+		if _, err := tx.Exec(`UPDATE fleet_vehicles SET out_of_service_reason = ? WHERE id = ?`, value, vehicleID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if reason != outOfService.String {
+		if reason != "" {
+			log.Printf("Vehicle %d out of service: %s", vehicleID, reason)
+		} else {
+			log.Printf("Vehicle %d passed inspection and is back in service", vehicleID)
+		}
+		// Overdue services still apply once the defect is cleared
+		if err := refreshMaintenanceStatus(vehicleID); err != nil {
+			log.Printf("Error checking maintenance for vehicle %d: %v", vehicleID, err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":               inspectionID,
+		"passed":           passed,
+		"defects":          defects,
+		"critical_defects": criticalDefects,
+		"out_of_service":   reason != "",
+		"photos_url":       fmt.Sprintf("/inspections/%d/attachments", inspectionID),
+	})
+}
+
+func getVehicleInspections(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	vehicleID, err := parseVehicleID(w, vars["id"])
+	if err != nil {
+		return
+	}
+
+	query := `SELECT i.id, i.driver_id, d.name, i.shift_id, i.inspection_type, i.odometer_km, i.passed, i.notes, i.created_at,
+		(SELECT COUNT(*) FROM inspection_results x WHERE x.inspection_id = i.id AND x.status = 'defect')
+		FROM vehicle_inspections i LEFT JOIN drivers d ON d.id = i.driver_id WHERE i.vehicle_id = ?`
+	args := []interface{}{vehicleID}
+	if inspectionType := r.URL.Query().Get("type"); inspectionType != "" {
+		query += ` AND i.inspection_type = ?`
+		args = append(args, inspectionType)
+	}
+	query += ` ORDER BY i.id DESC`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	inspections := []map[string]interface{}{}
+	for rows.Next() {
+		var id, driverID, shiftID sql.NullInt64
+		var driverName, inspectionType, notes, createdAt sql.NullString
+		var odometer sql.NullFloat64
+		var passed bool
+		var defects int
+		if err := rows.Scan(&id, &driverID, &driverName, &shiftID, &inspectionType, &odometer, &passed, &notes, &createdAt, &defects); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		inspections = append(inspections, map[string]interface{}{
+			"id":              id.Int64,
+			"driver_id":       driverID.Int64,
+			"driver_name":     driverName.String,
+			"shift_id":        shiftID.Int64,
+			"inspection_type": inspectionType.String,
+			"odometer_km":     odometer.Float64,
+			"passed":          passed,
+			"defects":         defects,
+			"notes":           notes.String,
+			"created_at":      createdAt.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inspections)
+}
+
+func getVehicleInspection(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var id, vehicleID, driverID, shiftID sql.NullInt64
+	var inspectionType, notes, createdAt sql.NullString
+	var odometer sql.NullFloat64
+	var passed bool
+	err := db.QueryRow(`SELECT id, vehicle_id, driver_id, shift_id, inspection_type, odometer_km, passed, notes, created_at
+		FROM vehicle_inspections WHERE id = ?`, vars["id"]).
+		Scan(&id, &vehicleID, &driverID, &shiftID, &inspectionType, &odometer, &passed, &notes, &createdAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Inspection not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(`SELECT item_code, status, is_critical, notes FROM inspection_results WHERE inspection_id = ? ORDER BY id`, id.Int64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	results := []map[string]interface{}{}
+	for rows.Next() {
+		var item, status, resultNotes sql.NullString
+		var critical bool
+		if err := rows.Scan(&item, &status, &critical, &resultNotes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, map[string]interface{}{
+			"item":     item.String,
+			"status":   status.String,
+			"critical": critical,
+			"notes":    resultNotes.String,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":              id.Int64,
+		"vehicle_id":      vehicleID.Int64,
+		"driver_id":       driverID.Int64,
+		"shift_id":        shiftID.Int64,
+		"inspection_type": inspectionType.String,
+		"odometer_km":     odometer.Float64,
+		"passed":          passed,
+		"notes":           notes.String,
+		"created_at":      createdAt.String,
+		"results":         results,
+		"photos_url":      fmt.Sprintf("/inspections/%d/attachments", id.Int64),
+	})
+}